@@ -1,3 +1,7 @@
 module github.com/kiinoda/mailrelay
 
 go 1.22.5
+
+require golang.org/x/net v0.35.0
+
+require golang.org/x/text v0.22.0 // indirect
@@ -0,0 +1,62 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// loadAuthFile reads the SMTP credentials from the auth file, refusing
+// files readable by group or others
+func (cfg *Config) loadAuthFile() error {
+	info, err := os.Stat(cfg.AuthFile)
+	if err != nil {
+		return fmt.Errorf("cannot read auth file: %w", err)
+	}
+
+	// Windows does not carry meaningful permission bits
+	if mode := info.Mode().Perm(); mode&0077 != 0 && runtime.GOOS != "windows" {
+		return fmt.Errorf("auth file %s has mode %04o, it must not be accessible by group or others", cfg.AuthFile, mode)
+	}
+
+	f, err := os.Open(cfg.AuthFile)
+	if err != nil {
+		return fmt.Errorf("cannot read auth file: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected key=value", cfg.AuthFile, lineNo)
+		}
+
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "user":
+			cfg.AuthUser = unquote(strings.TrimSpace(value))
+		case "password":
+			cfg.AuthPassword = unquote(strings.TrimSpace(value))
+		case "token":
+			cfg.OAuthToken = unquote(strings.TrimSpace(value))
+		default:
+			return fmt.Errorf("%s:%d: unknown key %q", cfg.AuthFile, lineNo, strings.TrimSpace(key))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	// A token file supplies the secret on every connection instead
+	if cfg.AuthUser == "" || (cfg.AuthPassword == "" && cfg.OAuthToken == "" && cfg.OAuthTokenFile == "") {
+		return fmt.Errorf("auth file %s must set both user and password, or user and token", cfg.AuthFile)
+	}
+	return nil
+}
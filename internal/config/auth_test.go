@@ -0,0 +1,62 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestLoadAuthFile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permission bits are not enforced on Windows")
+	}
+
+	tests := []struct {
+		name     string
+		content  string
+		mode     os.FileMode
+		wantErr  bool
+		wantUser string
+		wantPass string
+	}{
+		{"owner only", "user = relay\npassword = \"s3cret\"\n", 0600, false, "relay", "s3cret"},
+		{"owner read only", "# credentials\nuser=relay\npassword=s3cret\n", 0400, false, "relay", "s3cret"},
+		{"group readable", "user=relay\npassword=s3cret\n", 0640, true, "", ""},
+		{"world readable", "user=relay\npassword=s3cret\n", 0604, true, "", ""},
+		{"token instead of password", "user=relay\ntoken=ya29.token\n", 0600, false, "relay", ""},
+		{"missing password", "user=relay\n", 0600, true, "", ""},
+		{"unknown key", "user=relay\npassword=s3cret\nhost=smtp\n", 0600, true, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "auth")
+			if err := os.WriteFile(path, []byte(tt.content), 0600); err != nil {
+				t.Fatalf("Failed to write auth file: %v", err)
+			}
+			if err := os.Chmod(path, tt.mode); err != nil {
+				t.Fatalf("Failed to chmod auth file: %v", err)
+			}
+
+			cfg := &Config{AuthFile: path}
+			err := cfg.loadAuthFile()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadAuthFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if cfg.AuthUser != tt.wantUser || cfg.AuthPassword != tt.wantPass {
+				t.Errorf("loadAuthFile() user = %q, password = %q", cfg.AuthUser, cfg.AuthPassword)
+			}
+		})
+	}
+}
+
+func TestLoadAuthFileMissing(t *testing.T) {
+	cfg := &Config{AuthFile: filepath.Join(t.TempDir(), "missing")}
+	if err := cfg.loadAuthFile(); err == nil {
+		t.Error("loadAuthFile() should fail when the file does not exist")
+	}
+}
@@ -0,0 +1,140 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ignoredFlags are sendmail flags accepted for compatibility and silently
+// dropped, as they either describe the default behavior of mailrelay or
+// control features it does not implement
+var ignoredFlags = map[string]bool{
+	"-t":   true, // recipients are always read from the message headers
+	"-bm":  true, // deliver mail in the usual way
+	"-m":   true, // also send to me
+	"-s":   true, // save From lines
+	"-Ac":  true, // use submit.cf
+	"-Am":  true, // use sendmail.cf
+	"-om":  true, // also send to me
+	"-oo":  true, // allow old-style headers
+	"-oem": true, // mail back errors
+	"-oee": true, // mail back errors
+	"-oep": true, // print errors
+	"-oeq": true, // quiet about errors
+	"-oew": true, // write back errors
+}
+
+// ignoredFlagsWithArg are ignored sendmail flags taking an argument, either
+// attached (-B8BITMIME) or as the next argument (-B 8BITMIME)
+var ignoredFlagsWithArg = map[string]bool{
+	"-B": true, // body type
+	"-L": true, // syslog tag
+	"-N": true, // DSN notification conditions
+	"-X": true, // traffic log file
+}
+
+// filterCompatFlags removes ignored sendmail flags from the arguments,
+// leaving anything after -- untouched. Sendmail -o and -O options not
+// clashing with the defined flags are translated to mailrelay flags, or
+// dropped when mailrelay does not implement them.
+func filterCompatFlags(flags *flag.FlagSet, args []string) []string {
+	filtered := []string{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			return append(filtered, args[i:]...)
+		}
+
+		if ignoredFlags[arg] {
+			continue
+		}
+		if (strings.HasPrefix(arg, "-o") || strings.HasPrefix(arg, "-O")) && !isFlag(flags, arg) {
+			opt := arg[2:]
+			// Options may be given as the next argument, as in -O Name=value
+			if opt == "" && i+1 < len(args) {
+				i++
+				opt = args[i]
+			}
+			filtered = append(filtered, translateOption(opt)...)
+			continue
+		}
+		if len(arg) >= 2 && ignoredFlagsWithArg[arg[:2]] {
+			// Skip the argument too when it is not attached
+			if len(arg) == 2 && i+1 < len(args) {
+				i++
+			}
+			continue
+		}
+
+		filtered = append(filtered, arg)
+	}
+	return filtered
+}
+
+// translateOption returns the mailrelay arguments for a sendmail option,
+// either a long option as in Timeout.queuereturn=5d or a short one named by
+// its first letter as in T5d. Options mailrelay does not implement, and
+// values it cannot read, yield no arguments.
+func translateOption(opt string) []string {
+	name, value, long := strings.Cut(opt, "=")
+	if !long && opt != "" {
+		name, value = opt[:1], opt[1:]
+	}
+
+	switch {
+	// How long to keep trying before giving up on the message
+	case strings.EqualFold(name, "Timeout.queuereturn") || name == "T":
+		d, err := parseSendmailDuration(value)
+		if err != nil {
+			fmt.Fprintf(osStderr, "ignoring sendmail option %s: %v\n", opt, err)
+			return nil
+		}
+		return []string{"-overall-timeout", d.String()}
+
+	// Delivery mode, as in -odq, named by its first letter
+	case strings.EqualFold(name, "DeliveryMode") || name == "d":
+		modes := map[string]string{"i": DeliveryInteractive, "b": DeliveryBackground, "q": DeliveryQueue}
+		mode, ok := modes[strings.ToLower(value[:min(len(value), 1)])]
+		if !ok {
+			fmt.Fprintf(osStderr, "ignoring sendmail option %s: unsupported delivery mode\n", opt)
+			return nil
+		}
+		return []string{"-delivery-mode", mode}
+	}
+	return nil
+}
+
+// parseSendmailDuration parses a sendmail time value such as 5d or 1h30m,
+// made of numbers each followed by a unit of s, m, h, d or w
+func parseSendmailDuration(value string) (time.Duration, error) {
+	units := map[byte]time.Duration{
+		's': time.Second,
+		'm': time.Minute,
+		'h': time.Hour,
+		'd': 24 * time.Hour,
+		'w': 7 * 24 * time.Hour,
+	}
+
+	var total time.Duration
+	rest := value
+	for rest != "" {
+		end := strings.IndexFunc(rest, func(r rune) bool { return r < '0' || r > '9' })
+		if end <= 0 {
+			return 0, fmt.Errorf("invalid time value %q", value)
+		}
+		n, err := strconv.Atoi(rest[:end])
+		unit, ok := units[rest[end]]
+		if err != nil || !ok {
+			return 0, fmt.Errorf("invalid time value %q", value)
+		}
+		total += time.Duration(n) * unit
+		rest = rest[end+1:]
+	}
+	if total <= 0 {
+		return 0, fmt.Errorf("invalid time value %q", value)
+	}
+	return total, nil
+}
@@ -0,0 +1,116 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFilterCompatFlags(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		expected []string
+	}{
+		{
+			name:     "No sendmail flags",
+			args:     []string{"mailrelay", "-v", "-f", "sender@example.com"},
+			expected: []string{"mailrelay", "-v", "-f", "sender@example.com"},
+		},
+		{
+			name:     "Flags without arguments",
+			args:     []string{"mailrelay", "-oem", "-Am", "-t", "-v"},
+			expected: []string{"mailrelay", "-v"},
+		},
+		{
+			name:     "Flags with attached and separate arguments",
+			args:     []string{"mailrelay", "-B8BITMIME", "-N", "never", "-Lmailrelay", "-v"},
+			expected: []string{"mailrelay", "-v"},
+		},
+		{
+			name:     "Options mailrelay does not implement",
+			args:     []string{"mailrelay", "-O", "ErrorMode=p", "-oQ/var/spool/mqueue", "-v"},
+			expected: []string{"mailrelay", "-v"},
+		},
+		{
+			name:     "Timeout options translated",
+			args:     []string{"mailrelay", "-OTimeout.queuereturn=1d12h", "-oT90m", "-O", "timeout.QueueReturn=2w"},
+			expected: []string{"mailrelay", "-overall-timeout", "36h0m0s", "-overall-timeout", "1h30m0s", "-overall-timeout", "336h0m0s"},
+		},
+		{
+			name:     "Delivery modes translated",
+			args:     []string{"mailrelay", "-odq", "-odb", "-odi", "-oDeliveryMode=background", "-O", "DeliveryMode=queue"},
+			expected: []string{"mailrelay", "-delivery-mode", "queue", "-delivery-mode", "background", "-delivery-mode", "interactive", "-delivery-mode", "background", "-delivery-mode", "queue"},
+		},
+		{
+			name:     "Defined flags starting with o kept",
+			args:     []string{"mailrelay", "-oi", "-overall-timeout", "1m"},
+			expected: []string{"mailrelay", "-oi", "-overall-timeout", "1m"},
+		},
+		{
+			name:     "Arguments after double dash are kept",
+			args:     []string{"mailrelay", "-oem", "--", "-oem"},
+			expected: []string{"mailrelay", "--", "-oem"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flags := flag.NewFlagSet("mailrelay", flag.ContinueOnError)
+			flags.Bool("oi", false, "")
+			flags.Duration("overall-timeout", 0, "")
+			if got := filterCompatFlags(flags, tt.args); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("filterCompatFlags() = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestTranslateOptionInvalidValue(t *testing.T) {
+	var stderr bytes.Buffer
+	osStderr = &stderr
+	defer func() { osStderr = os.Stderr }()
+
+	// An unreadable value does not abort parsing
+	if got := translateOption("Timeout.queuereturn=soon"); got != nil {
+		t.Errorf("translateOption() = %v, want the option ignored", got)
+	}
+	if got := translateOption("dd"); got != nil {
+		t.Errorf("translateOption() = %v, want the deferred delivery mode ignored", got)
+	}
+	if stderr.Len() == 0 {
+		t.Error("translateOption() should warn about the ignored option")
+	}
+}
+
+func TestParseSendmailDuration(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected time.Duration
+		wantErr  bool
+	}{
+		{"90s", 90 * time.Second, false},
+		{"5d", 5 * 24 * time.Hour, false},
+		{"1h30m", 90 * time.Minute, false},
+		{"1w", 7 * 24 * time.Hour, false},
+		{"", 0, true},
+		{"5", 0, true},
+		{"5y", 0, true},
+		{"d", 0, true},
+		{"0m", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseSendmailDuration(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseSendmailDuration(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if got != tt.expected {
+			t.Errorf("parseSendmailDuration(%q) = %v, want %v", tt.value, got, tt.expected)
+		}
+	}
+}
@@ -1,10 +1,17 @@
 package config
 
 import (
+	"bytes"
+	"errors"
 	"flag"
+	"io"
 	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestParseEnvironment(t *testing.T) {
@@ -36,13 +43,32 @@ func TestParseEnvironment(t *testing.T) {
 		{
 			name: "Invalid SMTP server",
 			envVars: map[string]string{
-				MailRelayEnvVar: "invalid-server;smtp2.example.com:25",
+				MailRelayEnvVar: "invalid-server:smtp;:25;smtp2.example.com:25",
 				SenderEnvVar:    "sender@example.com",
 			},
 			expectedSMTP:    []string{"smtp2.example.com:25"},
 			expectedFrom:    "sender@example.com",
 			expectedVerbose: false,
 		},
+		{
+			name: "Portless SMTP server",
+			envVars: map[string]string{
+				MailRelayEnvVar: "smtp1.example.com;smtp2.example.com:587",
+			},
+			expectedSMTP:    []string{"smtp1.example.com:25", "smtp2.example.com:587"},
+			expectedFrom:    "",
+			expectedVerbose: false,
+		},
+		{
+			name: "Portless SMTP server with default port",
+			envVars: map[string]string{
+				MailRelayEnvVar: "smtp1.example.com",
+				PortEnvVar:      "587",
+			},
+			expectedSMTP:    []string{"smtp1.example.com:587"},
+			expectedFrom:    "",
+			expectedVerbose: false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -51,11 +77,13 @@ func TestParseEnvironment(t *testing.T) {
 			os.Unsetenv(MailRelayEnvVar)
 			os.Unsetenv(SenderEnvVar)
 			os.Unsetenv(VerboseEnvVar)
+			os.Unsetenv(PortEnvVar)
 
 			// Set environment variables for the test
 			for k, v := range tt.envVars {
 				os.Setenv(k, v)
 			}
+			defer os.Unsetenv(PortEnvVar)
 
 			// Create a new config and parse environment
 			cfg := &Config{}
@@ -79,19 +107,185 @@ func TestParseEnvironment(t *testing.T) {
 	}
 }
 
-func TestParseArguments(t *testing.T) {
-	// Save original args and flags
-	originalArgs := os.Args
+func TestParseEnvironmentInvalidServer(t *testing.T) {
+	os.Setenv(MailRelayEnvVar, "smtp1.example.com:smtp;smtp2.example.com:25")
+	defer os.Unsetenv(MailRelayEnvVar)
+
+	var stderr bytes.Buffer
+	osStderr = &stderr
+	defer func() { osStderr = os.Stderr }()
+
+	// Invalid entries are skipped with a warning by default
+	cfg := &Config{}
+	if err := cfg.parseEnvironment(); err != nil {
+		t.Fatalf("parseEnvironment() error = %v", err)
+	}
+	if !reflect.DeepEqual(cfg.SmtpAddrs, []string{"smtp2.example.com:25"}) {
+		t.Errorf("parseEnvironment() SMTP = %v", cfg.SmtpAddrs)
+	}
+	if stderr.String() != "invalid SMTP address, skipping: smtp1.example.com:smtp\n" {
+		t.Errorf("parseEnvironment() warning = %q", stderr.String())
+	}
+
+	// Strict mode makes them fatal
+	os.Setenv(StrictEnvVar, "true")
+	defer os.Unsetenv(StrictEnvVar)
+	cfg = &Config{}
+	if err := cfg.parseEnvironment(); err == nil {
+		t.Error("parseEnvironment() should fail on an invalid server in strict mode")
+	}
+}
+
+func TestParseEnvironmentExpandServers(t *testing.T) {
+	tests := []struct {
+		name     string
+		servers  string
+		expected []string
+		warning  string
+	}{
+		{
+			name:     "Defined variables",
+			servers:  "${SMTP_HOST}:${SMTP_PORT};backup.example.com",
+			expected: []string{"relay.example.com:587", "backup.example.com:25"},
+		},
+		{
+			name:     "Partially interpolated",
+			servers:  "smtp.${DOMAIN}:25;${SMTP_HOST}",
+			expected: []string{"smtp.example.com:25", "relay.example.com:25"},
+		},
+		{
+			name:     "Undefined variable",
+			servers:  "${UNDEFINED}:25;backup.example.com:25",
+			expected: []string{"backup.example.com:25"},
+			warning:  "invalid SMTP address, skipping: ${UNDEFINED}:25 (UNDEFINED not set)\n",
+		},
+	}
+
+	vars := map[string]string{
+		"SMTP_HOST": "relay.example.com",
+		"SMTP_PORT": "587",
+		"DOMAIN":    "example.com",
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stderr bytes.Buffer
+			osStderr = &stderr
+			defer func() { osStderr = os.Stderr }()
+
+			cfg := &Config{lookupEnv: func(name string) (string, bool) {
+				if name == MailRelayEnvVar {
+					return tt.servers, true
+				}
+				value, ok := vars[name]
+				return value, ok
+			}}
+			if err := cfg.parseEnvironment(); err != nil {
+				t.Fatalf("parseEnvironment() error = %v", err)
+			}
+			if !reflect.DeepEqual(cfg.SmtpAddrs, tt.expected) {
+				t.Errorf("parseEnvironment() SMTP = %v, want %v", cfg.SmtpAddrs, tt.expected)
+			}
+			if stderr.String() != tt.warning {
+				t.Errorf("parseEnvironment() warning = %q, want %q", stderr.String(), tt.warning)
+			}
+		})
+	}
+
+	// Strict mode names the unset variable
+	cfg := &Config{lookupEnv: func(name string) (string, bool) {
+		switch name {
+		case MailRelayEnvVar:
+			return "${UNDEFINED}:25", true
+		case StrictEnvVar:
+			return "true", true
+		}
+		return "", false
+	}}
+	if err := cfg.parseEnvironment(); err == nil || !strings.Contains(err.Error(), "UNDEFINED not set") {
+		t.Errorf("parseEnvironment() error = %v, want the unset variable named", err)
+	}
+}
+
+func TestNormalizeServer(t *testing.T) {
+	tests := []struct {
+		server   string
+		expected string
+		wantErr  bool
+	}{
+		{"smtp.example.com", "smtp.example.com:25", false},
+		{"smtp.example.com:587", "smtp.example.com:587", false},
+		{"[2001:db8::1]:587", "[2001:db8::1]:587", false},
+		{"[2001:db8::1]", "[2001:db8::1]:25", false},
+		{"2001:db8::1", "[2001:db8::1]:25", false},
+		{"[::1]", "[::1]:25", false},
+		{"[smtp.example.com]", "", true},
+		{"smtp.example.com:587:25", "", true},
+		{"smtp.example.com:smtp", "", true},
+		{":25", "", true},
+		{"lmtp://localhost", "lmtp://localhost:24", false},
+		{"lmtp://[::1]:2424", "lmtp://[::1]:2424", false},
+		{"lmtp://", "", true},
+		{"mx:Example.com.", "mx:example.com", false},
+		{"mx:25", "mx:25", false},
+		{"mx:", "", true},
+		{"mx:example.com:25", "", true},
+		{"smtp.müller.de", "smtp.xn--mller-kva.de:25", false},
+		{"mx:Müller.de", "mx:xn--mller-kva.de", false},
+		{"smtp.mü_ller.de", "", true},
+		{"maildir:/var/mail/capture/", "maildir:/var/mail/capture", false},
+		{"maildir:", "", true},
+		{"maildir:25", "maildir:25", false},
+		{"mbox:/var/mail//capture", "mbox:/var/mail/capture", false},
+		{"mbox:/var/mail/", "", true},
+		{"mbox:", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.server, func(t *testing.T) {
+			got, err := normalizeServer(tt.server, DefaultSMTPPort)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("normalizeServer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.expected {
+				t.Errorf("normalizeServer() = %q, want %q", got, tt.expected)
+			}
+		})
+	}
+}
 
-	// Reset flags for each test to avoid "flag redefined" errors
-	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+func TestParseEnvironmentIPv6(t *testing.T) {
+	os.Setenv(MailRelayEnvVar, "[2001:db8::1]:587;[2001:db8::2];smtp.example.com")
+	defer os.Unsetenv(MailRelayEnvVar)
 
+	cfg := &Config{}
+	if err := cfg.parseEnvironment(); err != nil {
+		t.Fatalf("parseEnvironment() error = %v", err)
+	}
+
+	expected := []string{"[2001:db8::1]:587", "[2001:db8::2]:25", "smtp.example.com:25"}
+	if !reflect.DeepEqual(cfg.SmtpAddrs, expected) {
+		t.Fatalf("parseEnvironment() SMTP = %v, want %v", cfg.SmtpAddrs, expected)
+	}
+
+	// Randomization must keep the literals intact
+	cfg.shuffleSMTPServers()
+	for _, server := range expected {
+		found := false
+		for _, got := range cfg.SmtpAddrs {
+			found = found || got == server
+		}
+		if !found {
+			t.Errorf("shuffleSMTPServers() lost %s: %v", server, cfg.SmtpAddrs)
+		}
+	}
+}
+
+func TestParseArguments(t *testing.T) {
 	tests := []struct {
-		name               string
-		args               []string
-		expectedConfig     *Config
-		expectedExitCode   int
-		expectedExitCalled bool
+		name           string
+		args           []string
+		expectedConfig *Config
+		expectedErr    error
 	}{
 		{
 			name: "Basic arguments",
@@ -109,6 +303,102 @@ func TestParseArguments(t *testing.T) {
 				BeVerbose: false,
 			},
 		},
+		{
+			name: "Sendmail -i flag",
+			args: []string{"mailrelay", "-i", "-fsender@example.com"},
+			expectedConfig: &Config{
+				FromAddr:   "sender@example.com",
+				IgnoreDots: true,
+			},
+		},
+		{
+			name: "Sendmail -oi flag",
+			args: []string{"mailrelay", "-oi", "-f", "sender@example.com", "-v"},
+			expectedConfig: &Config{
+				FromAddr:   "sender@example.com",
+				BeVerbose:  true,
+				IgnoreDots: true,
+			},
+		},
+		{
+			name: "Realistic mailx invocation",
+			args: []string{"mailrelay", "-oi", "-oem", "-odb", "-B8BITMIME", "-Am", "-t", "-f", "sender@example.com"},
+			expectedConfig: &Config{
+				FromAddr:   "sender@example.com",
+				IgnoreDots: true,
+			},
+		},
+		{
+			name: "Realistic cron invocation",
+			args: []string{"mailrelay", "-F", "CronDaemon", "-i", "-B", "8BITMIME", "-oem", "-fsender@example.com", "root"},
+			expectedConfig: &Config{
+				FromAddr:   "sender@example.com",
+				FromName:   "CronDaemon",
+				IgnoreDots: true,
+			},
+		},
+		{
+			name: "Sendmail -o and -O options",
+			args: []string{"mailrelay", "-oi", "-odb", "-oDeliveryMode=b", "-OTimeout.queuereturn=5d", "-O", "ErrorMode=m", "-f", "sender@example.com"},
+			expectedConfig: &Config{
+				FromAddr:       "sender@example.com",
+				IgnoreDots:     true,
+				OverallTimeout: 5 * 24 * time.Hour,
+			},
+		},
+		{
+			name: "Short sendmail timeout option overridden by the flag",
+			args: []string{"mailrelay", "-oT4h", "-overall-timeout", "10m"},
+			expectedConfig: &Config{
+				OverallTimeout: 10 * time.Minute,
+			},
+		},
+		{
+			name: "Quiet flag",
+			args: []string{"mailrelay", "-q", "-f", "sender@example.com"},
+			expectedConfig: &Config{
+				FromAddr: "sender@example.com",
+				Quiet:    true,
+			},
+		},
+		{
+			name: "Attached full name",
+			args: []string{"mailrelay", "-FCron Daemon", "-f", "sender@example.com"},
+			expectedConfig: &Config{
+				FromAddr: "sender@example.com",
+				FromName: "Cron Daemon",
+			},
+		},
+		{
+			name: "Flag starting with f",
+			args: []string{"mailrelay", "-flush", "-spool-dir", "/var/spool/mailrelay"},
+			expectedConfig: &Config{
+				Flush:    true,
+				SpoolDir: "/var/spool/mailrelay",
+			},
+		},
+		{
+			name: "Sender starting like a flag",
+			args: []string{"mailrelay", "-fflush@example.com"},
+			expectedConfig: &Config{
+				FromAddr: "flush@example.com",
+			},
+		},
+		{
+			name: "Confirmation flags",
+			args: []string{"mailrelay", "-confirm-threshold", "50", "-y"},
+			expectedConfig: &Config{
+				ConfirmThreshold: 50,
+				AssumeYes:        true,
+			},
+		},
+		{
+			name: "Long confirmation flag",
+			args: []string{"mailrelay", "--yes"},
+			expectedConfig: &Config{
+				AssumeYes: true,
+			},
+		},
 		{
 			name: "Help flag",
 			args: []string{"mailrelay", "-h"},
@@ -116,69 +406,94 @@ func TestParseArguments(t *testing.T) {
 				ShowHelp:  true,
 				BeVerbose: false,
 			},
-			expectedExitCode:   0,
-			expectedExitCalled: true,
+			expectedErr: flag.ErrHelp,
+		},
+		{
+			name: "Version flag",
+			args: []string{"mailrelay", "-version"},
+			expectedConfig: &Config{
+				ShowVersion: true,
+			},
+			expectedErr: ErrVersion,
+		},
+		{
+			name: "Short version flag",
+			args: []string{"mailrelay", "-V"},
+			expectedConfig: &Config{
+				ShowVersion: true,
+			},
+			expectedErr: ErrVersion,
 		},
 	}
 
-	// Save the original os.Exit and restore it after the test
+	// Help and version are returned to the caller rather than exiting
 	oldOsExit := osExit
-
-	// Create variables to track if exit was called and with what code
-	var exitCode int
-	exitCalled := false
 	osExit = func(code int) {
-		exitCalled = true
-		exitCode = code
+		t.Errorf("os.Exit(%d) called by parseArguments()", code)
 	}
-
 	defer func() { osExit = oldOsExit }()
 
+	// Discard the usage printed for help
+	osStderr = io.Discard
+	defer func() { osStderr = os.Stderr }()
+
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			// Reset exit tracking for each test case
-			exitCalled = false
-			exitCode = 0
-
-			// Reset flags for each test to avoid "flag redefined" errors
-			flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
-
-			// Set command line arguments
-			os.Args = tt.args
-
 			// Create a new config and parse arguments
 			cfg := &Config{}
-			cfg.parseArguments()
+			if err := cfg.parseArguments(tt.args[1:]); !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("parseArguments() error = %v, want %v", err, tt.expectedErr)
+			}
 
 			// Check From address
 			if cfg.FromAddr != tt.expectedConfig.FromAddr {
 				t.Errorf("parseArguments() FromAddr = %v, want %v", cfg.FromAddr, tt.expectedConfig.FromAddr)
 			}
 
+			// Check From name
+			if cfg.FromName != tt.expectedConfig.FromName {
+				t.Errorf("parseArguments() FromName = %q, want %q", cfg.FromName, tt.expectedConfig.FromName)
+			}
+
 			// Check Verbose flag
 			if cfg.BeVerbose != tt.expectedConfig.BeVerbose {
 				t.Errorf("parseArguments() BeVerbose = %v, want %v", cfg.BeVerbose, tt.expectedConfig.BeVerbose)
 			}
+			if cfg.Quiet != tt.expectedConfig.Quiet {
+				t.Errorf("parseArguments() Quiet = %v, want %v", cfg.Quiet, tt.expectedConfig.Quiet)
+			}
+
+			// Check dot handling flag
+			if cfg.IgnoreDots != tt.expectedConfig.IgnoreDots {
+				t.Errorf("parseArguments() IgnoreDots = %v, want %v", cfg.IgnoreDots, tt.expectedConfig.IgnoreDots)
+			}
+
+			// Check spool settings
+			if cfg.Flush != tt.expectedConfig.Flush || cfg.SpoolDir != tt.expectedConfig.SpoolDir {
+				t.Errorf("parseArguments() Flush = %v, SpoolDir = %q, want %v, %q", cfg.Flush, cfg.SpoolDir, tt.expectedConfig.Flush, tt.expectedConfig.SpoolDir)
+			}
+
+			// Check timeout
+			if cfg.OverallTimeout != tt.expectedConfig.OverallTimeout {
+				t.Errorf("parseArguments() OverallTimeout = %v, want %v", cfg.OverallTimeout, tt.expectedConfig.OverallTimeout)
+			}
+
+			// Check confirmation settings
+			if cfg.ConfirmThreshold != tt.expectedConfig.ConfirmThreshold || cfg.AssumeYes != tt.expectedConfig.AssumeYes {
+				t.Errorf("parseArguments() ConfirmThreshold = %d, AssumeYes = %v, want %d, %v", cfg.ConfirmThreshold, cfg.AssumeYes, tt.expectedConfig.ConfirmThreshold, tt.expectedConfig.AssumeYes)
+			}
 
 			// Check Help flag
 			if cfg.ShowHelp != tt.expectedConfig.ShowHelp {
 				t.Errorf("parseArguments() ShowHelp = %v, want %v", cfg.ShowHelp, tt.expectedConfig.ShowHelp)
 			}
 
-			// Check Return Code and if os.Exit has been called
-			if tt.name == "Help flag" {
-				if !exitCalled {
-					t.Errorf("parseArguments() os.Exit was not called")
-				}
-				if exitCode != 0 {
-					t.Errorf("parseArguments() did not exit with a 0 exit code")
-				}
+			// Check Version flag
+			if cfg.ShowVersion != tt.expectedConfig.ShowVersion {
+				t.Errorf("parseArguments() ShowVersion = %v, want %v", cfg.ShowVersion, tt.expectedConfig.ShowVersion)
 			}
 		})
 	}
-
-	// Restore original arguments
-	os.Args = originalArgs
 }
 
 func TestValidateSettings(t *testing.T) {
@@ -196,21 +511,370 @@ func TestValidateSettings(t *testing.T) {
 			expectError: false,
 		},
 		{
-			name: "Missing SMTP servers",
+			name: "Missing SMTP servers",
+			config: &Config{
+				SmtpAddrs: []string{},
+				FromAddr:  "sender@example.com",
+			},
+			expectError: true,
+		},
+		{
+			name: "Invalid archive address",
+			config: &Config{
+				SmtpAddrs: []string{"smtp.example.com:25"},
+				FromAddr:  "sender@example.com",
+				AlwaysBcc: "archive",
+			},
+			expectError: true,
+		},
+		{
+			name: "Invalid redirect address",
+			config: &Config{
+				SmtpAddrs:   []string{"smtp.example.com:25"},
+				FromAddr:    "sender@example.com",
+				RedirectAll: "not-an-email",
+			},
+			expectError: true,
+		},
+		{
+			name: "Missing sender, taken from the message",
+			config: &Config{
+				SmtpAddrs: []string{"smtp.example.com:25"},
+				FromAddr:  "",
+			},
+			expectError: false,
+		},
+		{
+			name: "Flush without sender",
+			config: &Config{
+				SmtpAddrs: []string{"smtp.example.com:25"},
+				SpoolDir:  "/var/spool/mailrelay",
+				Flush:     true,
+			},
+			expectError: false,
+		},
+		{
+			name: "Flush without spool directory",
+			config: &Config{
+				SmtpAddrs: []string{"smtp.example.com:25"},
+				FromAddr:  "sender@example.com",
+				Flush:     true,
+			},
+			expectError: true,
+		},
+		{
+			name: "Syslog with log file",
+			config: &Config{
+				SmtpAddrs: []string{"smtp.example.com:25"},
+				UseSyslog: true,
+				LogFile:   "/var/log/mailrelay.log",
+			},
+			expectError: true,
+		},
+		{
+			name: "Unsupported authentication mechanism",
+			config: &Config{
+				SmtpAddrs:      []string{"smtp.example.com:25"},
+				AuthMechanisms: []string{"plain", "NTLM"},
+			},
+			expectError: true,
+		},
+		{
+			name: "Supported authentication mechanisms",
+			config: &Config{
+				SmtpAddrs:      []string{"smtp.example.com:25"},
+				AuthMechanisms: []string{"login", "CRAM-MD5", "xoauth2"},
+			},
+			expectError: false,
+		},
+		{
+			name: "Direct delivery without servers",
+			config: &Config{
+				DirectDelivery: true,
+			},
+			expectError: false,
+		},
+		{
+			name: "Direct delivery with servers",
+			config: &Config{
+				SmtpAddrs:      []string{"smtp.example.com:25"},
+				DirectDelivery: true,
+			},
+			expectError: true,
+		},
+		{
+			name: "Checking servers in direct delivery",
+			config: &Config{
+				DirectDelivery: true,
+				Check:          true,
+			},
+			expectError: true,
+		},
+		{
+			name: "Unknown server TLS policy",
+			config: &Config{
+				SmtpAddrs: []string{"smtp.example.com:25"},
+				ServerTLS: map[string]string{"smtp.example.com:25": "maybe"},
+			},
+			expectError: true,
+		},
+		{
+			name: "Required server TLS policy in helo mode",
+			config: &Config{
+				SmtpAddrs: []string{"smtp.example.com:25"},
+				ServerTLS: map[string]string{"smtp.example.com:25": "required"},
+				SMTPMode:  "helo",
+			},
+			expectError: true,
+		},
+		{
+			name: "OAuth token file without user",
+			config: &Config{
+				SmtpAddrs:      []string{"smtp.example.com:25"},
+				OAuthTokenFile: "/run/secrets/oauth-token",
+			},
+			expectError: true,
+		},
+		{
+			name: "Negative recipients per message limit",
+			config: &Config{
+				SmtpAddrs:               []string{"smtp.example.com:25"},
+				MaxRecipientsPerMessage: -1,
+			},
+			expectError: true,
+		},
+		{
+			name: "All or nothing with partial delivery",
+			config: &Config{
+				SmtpAddrs:       []string{"smtp.example.com:25"},
+				AllOrNothing:    true,
+				PartialDelivery: true,
+			},
+			expectError: true,
+		},
+		{
+			name: "All or nothing with VERP",
+			config: &Config{
+				SmtpAddrs:    []string{"smtp.example.com:25"},
+				AllOrNothing: true,
+				EnableVERP:   true,
+			},
+			expectError: true,
+		},
+		{
+			name: "All or nothing with an LMTP server",
+			config: &Config{
+				SmtpAddrs:    []string{"lmtp://localhost:24"},
+				AllOrNothing: true,
+			},
+			expectError: true,
+		},
+		{
+			name: "All or nothing",
+			config: &Config{
+				SmtpAddrs:    []string{"smtp.example.com:25"},
+				AllOrNothing: true,
+			},
+			expectError: false,
+		},
+		{
+			name: "Invalid local address",
+			config: &Config{
+				SmtpAddrs: []string{"smtp.example.com:25"},
+				LocalAddr: "relay.example.com",
+			},
+			expectError: true,
+		},
+		{
+			name: "SMTP session with an input file",
+			config: &Config{
+				SmtpAddrs:   []string{"smtp.example.com:25"},
+				SMTPSession: true,
+				InputFile:   "message.eml",
+			},
+			expectError: true,
+		},
+		{
+			name: "Negative message size limit",
+			config: &Config{
+				SmtpAddrs:      []string{"smtp.example.com:25"},
+				MaxMessageSize: -1,
+			},
+			expectError: true,
+		},
+		{
+			name: "Invalid PROXY protocol version",
+			config: &Config{
+				SmtpAddrs:          []string{"smtp.example.com:25"},
+				SendProxyHeader:    true,
+				ProxyHeaderVersion: 3,
+			},
+			expectError: true,
+		},
+		{
+			name: "HELO mode with required TLS",
+			config: &Config{
+				SmtpAddrs:  []string{"smtp.example.com:25"},
+				SMTPMode:   SMTPModeHELO,
+				RequireTLS: true,
+			},
+			expectError: true,
+		},
+		{
+			name: "HELO mode with authentication",
+			config: &Config{
+				SmtpAddrs: []string{"smtp.example.com:25"},
+				SMTPMode:  "HELO",
+				AuthUser:  "user",
+			},
+			expectError: true,
+		},
+		{
+			name: "Invalid SMTP mode",
+			config: &Config{
+				SmtpAddrs: []string{"smtp.example.com:25"},
+				SMTPMode:  "lhlo",
+			},
+			expectError: true,
+		},
+		{
+			name: "Return-Path with VERP",
+			config: &Config{
+				SmtpAddrs:  []string{"smtp.example.com:25"},
+				FromAddr:   "sender@example.com",
+				EnableVERP: true,
+				ReturnPath: true,
+			},
+			expectError: true,
+		},
+		{
+			name: "Spool listing without servers",
+			config: &Config{
+				SpoolDir:  "/var/spool/mailrelay",
+				ListSpool: true,
+			},
+			expectError: false,
+		},
+		{
+			name: "Spool listing without spool directory",
+			config: &Config{
+				SmtpAddrs: []string{"smtp.example.com:25"},
+				ListSpool: true,
+			},
+			expectError: true,
+		},
+		{
+			name: "Malformed header name to strip",
+			config: &Config{
+				SmtpAddrs:    []string{"smtp.example.com:25"},
+				StripHeaders: []string{"Received", "X Original To"},
+			},
+			expectError: true,
+		},
+		{
+			name: "Queue delivery mode",
+			config: &Config{
+				SmtpAddrs:    []string{"smtp.example.com:25"},
+				SpoolDir:     "/var/spool/mailrelay",
+				DeliveryMode: "Queue",
+			},
+			expectError: false,
+		},
+		{
+			name: "Queue delivery mode without spool directory",
+			config: &Config{
+				SmtpAddrs:    []string{"smtp.example.com:25"},
+				DeliveryMode: DeliveryQueue,
+			},
+			expectError: true,
+		},
+		{
+			name: "Invalid delivery mode",
+			config: &Config{
+				SmtpAddrs:    []string{"smtp.example.com:25"},
+				DeliveryMode: "deferred",
+			},
+			expectError: true,
+		},
+		{
+			name: "Return-Path with sender rules",
+			config: &Config{
+				SmtpAddrs:   []string{"smtp.example.com:25"},
+				FromAddr:    "sender@example.com",
+				SenderRules: map[string]string{"gmail.com": "gmail@example.com"},
+				ReturnPath:  true,
+			},
+			expectError: true,
+		},
+		{
+			name: "Malformed sender",
+			config: &Config{
+				SmtpAddrs: []string{"smtp.example.com:25"},
+				FromAddr:  "not-an-email",
+			},
+			expectError: true,
+		},
+		{
+			name: "Sender with display name",
+			config: &Config{
+				SmtpAddrs: []string{"smtp.example.com:25"},
+				FromAddr:  "Sender Name <sender@example.com>",
+			},
+			expectError: false,
+		},
+		{
+			name: "DKIM key without selector",
+			config: &Config{
+				SmtpAddrs:   []string{"smtp.example.com:25"},
+				FromAddr:    "sender@example.com",
+				DKIMKeyPath: "/etc/mailrelay/dkim.pem",
+				DKIMDomain:  "example.com",
+			},
+			expectError: true,
+		},
+		{
+			name: "Health check without sender",
+			config: &Config{
+				SmtpAddrs: []string{"smtp.example.com:25"},
+				Check:     true,
+			},
+			expectError: false,
+		},
+		{
+			name: "Envelope without sender",
+			config: &Config{
+				SmtpAddrs:    []string{"smtp.example.com:25"},
+				EnvelopeFile: "/var/spool/mailrelay/envelope.json",
+			},
+			expectError: false,
+		},
+		{
+			name: "Input file with envelope",
 			config: &Config{
-				SmtpAddrs: []string{},
-				FromAddr:  "sender@example.com",
+				SmtpAddrs:    []string{"smtp.example.com:25"},
+				EnvelopeFile: "/var/spool/mailrelay/envelope.json",
+				InputFile:    "/tmp/message.eml",
 			},
 			expectError: true,
 		},
 		{
-			name: "Missing sender",
+			name: "Malformed extra header",
 			config: &Config{
-				SmtpAddrs: []string{"smtp.example.com:25"},
-				FromAddr:  "",
+				SmtpAddrs:    []string{"smtp.example.com:25"},
+				FromAddr:     "sender@example.com",
+				ExtraHeaders: []string{"X-Bad Header: value"},
 			},
 			expectError: true,
 		},
+		{
+			name: "Extra header",
+			config: &Config{
+				SmtpAddrs:    []string{"smtp.example.com:25"},
+				FromAddr:     "sender@example.com",
+				ExtraHeaders: []string{"X-Mailer: mailrelay"},
+			},
+			expectError: false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -224,7 +888,168 @@ func TestValidateSettings(t *testing.T) {
 	}
 }
 
-func TestRandomizeSMTPServers(t *testing.T) {
+func TestRecipientFlags(t *testing.T) {
+	args := []string{"-to", "a@example.com", "-to", "b@example.com, Carol <c@example.com>", "-cc", "d@example.com", "-bcc", "e@example.com"}
+
+	cfg := &Config{}
+	if err := cfg.parseArguments(args); err != nil {
+		t.Fatalf("parseArguments() error = %v", err)
+	}
+	cfg.SmtpAddrs = []string{"smtp.example.com:25"}
+	cfg.FromAddr = "sender@example.com"
+	if err := cfg.validateSettings(); err != nil {
+		t.Fatalf("validateSettings() error = %v", err)
+	}
+
+	expected := []string{"a@example.com", "b@example.com", "c@example.com", "d@example.com", "e@example.com"}
+	if !reflect.DeepEqual(cfg.Recipients, expected) {
+		t.Errorf("Recipients = %v, want %v", cfg.Recipients, expected)
+	}
+
+	cfg = &Config{
+		SmtpAddrs: []string{"smtp.example.com:25"},
+		FromAddr:  "sender@example.com",
+		BccAddrs:  []string{"not-an-email"},
+	}
+	if err := cfg.validateSettings(); err == nil {
+		t.Error("validateSettings() should fail on an invalid recipient")
+	}
+}
+
+func TestParseEnvironmentProxy(t *testing.T) {
+	for _, name := range []string{ProxyEnvVar, "ALL_PROXY", "all_proxy", "HTTPS_PROXY", "https_proxy", "HTTP_PROXY", "http_proxy", "NO_PROXY", "no_proxy"} {
+		if v, ok := os.LookupEnv(name); ok {
+			defer os.Setenv(name, v)
+		} else {
+			defer os.Unsetenv(name)
+		}
+		os.Unsetenv(name)
+	}
+
+	tests := []struct {
+		name     string
+		env      map[string]string
+		expected string
+	}{
+		{"No proxy", nil, ""},
+		{"HTTP proxy is ignored", map[string]string{"HTTPS_PROXY": "http://proxy:3128"}, ""},
+		{"SOCKS5 in standard variable", map[string]string{"ALL_PROXY": "socks5://proxy:1080"}, "socks5://proxy:1080"},
+		{"Own variable first", map[string]string{ProxyEnvVar: "socks5://own:1080", "ALL_PROXY": "socks5://proxy:1080"}, "socks5://own:1080"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				os.Setenv(name, value)
+				defer os.Unsetenv(name)
+			}
+			cfg := &Config{}
+			if err := cfg.parseEnvironment(); err != nil {
+				t.Fatalf("parseEnvironment() error = %v", err)
+			}
+			if cfg.SocksProxy != tt.expected {
+				t.Errorf("SocksProxy = %q, want %q", cfg.SocksProxy, tt.expected)
+			}
+		})
+	}
+
+	cfg := &Config{SmtpAddrs: []string{"smtp.example.com:25"}, FromAddr: "sender@example.com", SocksProxy: "http://proxy:3128"}
+	if err := cfg.validateSettings(); err == nil {
+		t.Error("validateSettings() should fail on a proxy that is not SOCKS5")
+	}
+}
+
+func TestParseEnvironmentRetrySchedule(t *testing.T) {
+	defer os.Unsetenv(ScheduleEnvVar)
+
+	os.Setenv(ScheduleEnvVar, "5m, 1h,1h30m")
+	cfg := &Config{}
+	if err := cfg.parseEnvironment(); err != nil {
+		t.Fatalf("parseEnvironment() error = %v", err)
+	}
+	expected := []time.Duration{5 * time.Minute, time.Hour, 90 * time.Minute}
+	if !reflect.DeepEqual(cfg.RetrySchedule, expected) {
+		t.Errorf("RetrySchedule = %v, want %v", cfg.RetrySchedule, expected)
+	}
+
+	for _, invalid := range []string{"5m,soon", "5m,0s", "-1h"} {
+		os.Setenv(ScheduleEnvVar, invalid)
+		if err := (&Config{}).parseEnvironment(); err == nil {
+			t.Errorf("parseEnvironment() should fail on retry schedule %q", invalid)
+		}
+	}
+
+	// A state directory alone follows the default schedule
+	cfg = &Config{SmtpAddrs: []string{"smtp.example.com:25"}, StateDir: t.TempDir()}
+	if err := cfg.validateSettings(); err != nil {
+		t.Fatalf("validateSettings() error = %v", err)
+	}
+	if !reflect.DeepEqual(cfg.RetrySchedule, DefaultRetrySchedule) {
+		t.Errorf("RetrySchedule = %v, want %v", cfg.RetrySchedule, DefaultRetrySchedule)
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected float64
+		wantErr  bool
+	}{
+		{"5", 5, false},
+		{"5/s", 5, false},
+		{"30/m", 0.5, false},
+		{"1800/h", 0.5, false},
+		{"0.5/s", 0.5, false},
+		{"0/s", 0, true},
+		{"-1", 0, true},
+		{"fast", 0, true},
+		{"10/d", 0, true},
+	}
+
+	for _, tt := range tests {
+		rate, err := parseRate(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseRate(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if rate != tt.expected {
+			t.Errorf("parseRate(%q) = %v, want %v", tt.value, rate, tt.expected)
+		}
+	}
+}
+
+func TestParseEnvironmentDANE(t *testing.T) {
+	defer os.Unsetenv(RequireDANEVar)
+
+	os.Setenv(RequireDANEVar, "true")
+	cfg := &Config{SmtpAddrs: []string{"smtp.example.com:25"}}
+	if err := cfg.parseEnvironment(); err != nil {
+		t.Fatalf("parseEnvironment() error = %v", err)
+	}
+	if err := cfg.validateSettings(); err != nil {
+		t.Fatalf("validateSettings() error = %v", err)
+	}
+	// Requiring DANE enables it
+	if !cfg.RequireDANE || !cfg.EnableDANE {
+		t.Errorf("RequireDANE = %v, EnableDANE = %v, want both set", cfg.RequireDANE, cfg.EnableDANE)
+	}
+}
+
+func TestValidateSettingsEnvelopeSender(t *testing.T) {
+	cfg := &Config{
+		SmtpAddrs: []string{"smtp.example.com:25"},
+		FromAddr:  "Sender Name <sender@example.com>",
+	}
+
+	if err := cfg.validateSettings(); err != nil {
+		t.Fatalf("validateSettings() error = %v", err)
+	}
+	if cfg.FromAddr != "sender@example.com" {
+		t.Errorf("validateSettings() FromAddr = %q, want the bare address", cfg.FromAddr)
+	}
+}
+
+func TestShuffleSMTPServers(t *testing.T) {
 	// Create a config with multiple SMTP servers
 	cfg := &Config{
 		SmtpAddrs: []string{
@@ -243,11 +1068,11 @@ func TestRandomizeSMTPServers(t *testing.T) {
 	// Since randomization is based on random numbers, we can't guarantee
 	// the order will change, but we can verify that the function doesn't
 	// lose any servers or add new ones
-	cfg.randomizeSMTPServers()
+	cfg.shuffleSMTPServers()
 
 	// Verify that no servers were lost during randomization
 	if len(cfg.SmtpAddrs) != len(originalOrder) {
-		t.Errorf("randomizeSMTPServers() changed the number of SMTP servers: got %d, want %d",
+		t.Errorf("shuffleSMTPServers() changed the number of SMTP servers: got %d, want %d",
 			len(cfg.SmtpAddrs), len(originalOrder))
 	}
 
@@ -262,14 +1087,392 @@ func TestRandomizeSMTPServers(t *testing.T) {
 	for _, server := range cfg.SmtpAddrs {
 		randomizedServerMap[server] = true
 		if !originalServerMap[server] {
-			t.Errorf("randomizeSMTPServers() introduced a new server: %s", server)
+			t.Errorf("shuffleSMTPServers() introduced a new server: %s", server)
 		}
 	}
 
 	// Check that no servers were lost
 	for _, server := range originalOrder {
 		if !randomizedServerMap[server] {
-			t.Errorf("randomizeSMTPServers() lost a server: %s", server)
+			t.Errorf("shuffleSMTPServers() lost a server: %s", server)
+		}
+	}
+}
+
+func TestShuffleSMTPServersNoRandomize(t *testing.T) {
+	servers := []string{"primary.example.com:25", "backup1.example.com:25", "backup2.example.com:25"}
+
+	// With shuffling the configured order would be kept only 1 in 6 times
+	for i := 0; i < 20; i++ {
+		cfg := &Config{SmtpAddrs: append([]string{}, servers...), NoRandomize: true}
+		cfg.shuffleSMTPServers()
+		if !reflect.DeepEqual(cfg.SmtpAddrs, servers) {
+			t.Fatalf("shuffleSMTPServers() = %v, want configured order %v", cfg.SmtpAddrs, servers)
+		}
+	}
+}
+
+func TestParseEnvironmentSenderRules(t *testing.T) {
+	os.Setenv(RulesEnvVar, "Gmail.com=Gmail Sender <gmail@example.com>, outlook.com=outlook@example.com")
+	defer os.Unsetenv(RulesEnvVar)
+
+	cfg := &Config{SmtpAddrs: []string{"smtp.example.com:25"}, FromAddr: "sender@example.com"}
+	if err := cfg.parseEnvironment(); err != nil {
+		t.Fatalf("parseEnvironment() error = %v", err)
+	}
+	if err := cfg.validateSettings(); err != nil {
+		t.Fatalf("validateSettings() error = %v", err)
+	}
+
+	expected := map[string]string{"gmail.com": "gmail@example.com", "outlook.com": "outlook@example.com"}
+	if !reflect.DeepEqual(cfg.SenderRules, expected) {
+		t.Errorf("SenderRules = %v, want %v", cfg.SenderRules, expected)
+	}
+
+	for _, rules := range []string{"gmail.com", "=gmail@example.com"} {
+		os.Setenv(RulesEnvVar, rules)
+		if err := (&Config{}).parseEnvironment(); err == nil {
+			t.Errorf("parseEnvironment() should fail on sender rules %q", rules)
+		}
+	}
+
+	cfg = &Config{
+		SmtpAddrs:   []string{"smtp.example.com:25"},
+		FromAddr:    "sender@example.com",
+		SenderRules: map[string]string{"gmail.com": "not-an-email"},
+	}
+	if err := cfg.validateSettings(); err == nil {
+		t.Error("validateSettings() should fail on an invalid rule sender")
+	}
+}
+
+func TestParseEnvironmentDomainMap(t *testing.T) {
+	os.Setenv(DomainMapEnvVar, "Old.example=New.EXAMPLE, *=Test <test@example.com>")
+	defer os.Unsetenv(DomainMapEnvVar)
+
+	cfg := &Config{SmtpAddrs: []string{"smtp.example.com:25"}, FromAddr: "sender@example.com"}
+	if err := cfg.parseEnvironment(); err != nil {
+		t.Fatalf("parseEnvironment() error = %v", err)
+	}
+	if err := cfg.validateSettings(); err != nil {
+		t.Fatalf("validateSettings() error = %v", err)
+	}
+
+	expected := map[string]string{"old.example": "new.example", "*": "test@example.com"}
+	if !reflect.DeepEqual(cfg.DomainMap, expected) {
+		t.Errorf("DomainMap = %v, want %v", cfg.DomainMap, expected)
+	}
+
+	for _, rules := range []string{"old.example", "=new.example", "old.example="} {
+		os.Setenv(DomainMapEnvVar, rules)
+		if err := (&Config{}).parseEnvironment(); err == nil {
+			t.Errorf("parseEnvironment() should fail on domain map %q", rules)
+		}
+	}
+
+	for _, target := range []string{"not an address@", "bad domain", "new;example"} {
+		cfg = &Config{
+			SmtpAddrs: []string{"smtp.example.com:25"},
+			FromAddr:  "sender@example.com",
+			DomainMap: map[string]string{"old.example": target},
+		}
+		if err := cfg.validateSettings(); err == nil {
+			t.Errorf("validateSettings() should fail on domain map target %q", target)
+		}
+	}
+}
+
+func TestParseEnvironmentRedirectAll(t *testing.T) {
+	os.Setenv(RedirectEnvVar, "Staging <sink@staging.example>")
+	defer os.Unsetenv(RedirectEnvVar)
+
+	cfg := &Config{SmtpAddrs: []string{"smtp.example.com:25"}, FromAddr: "sender@example.com"}
+	if err := cfg.parseEnvironment(); err != nil {
+		t.Fatalf("parseEnvironment() error = %v", err)
+	}
+	if err := cfg.validateSettings(); err != nil {
+		t.Fatalf("validateSettings() error = %v", err)
+	}
+	if cfg.RedirectAll != "sink@staging.example" {
+		t.Errorf("RedirectAll = %q, want the bare address", cfg.RedirectAll)
+	}
+}
+
+func TestParseEnvironmentBounceMailbox(t *testing.T) {
+	os.Setenv(BounceMboxVar, "/var/mail/bounces")
+	defer os.Unsetenv(BounceMboxVar)
+
+	cfg := &Config{SmtpAddrs: []string{"smtp.example.com:25"}}
+	if err := cfg.parseEnvironment(); err != nil {
+		t.Fatalf("parseEnvironment() error = %v", err)
+	}
+	if err := cfg.validateSettings(); err != nil {
+		t.Fatalf("validateSettings() error = %v", err)
+	}
+	if cfg.BounceMailbox != "/var/mail/bounces" || !cfg.BounceOnFailure {
+		t.Errorf("BounceMailbox = %q, BounceOnFailure = %v, want the mailbox enabling bounces", cfg.BounceMailbox, cfg.BounceOnFailure)
+	}
+}
+
+func TestParseEnvironmentServerWeights(t *testing.T) {
+	os.Setenv(MailRelayEnvVar, "fast.example.com;4;backup.example.com:587;other.example.com")
+	defer os.Unsetenv(MailRelayEnvVar)
+
+	cfg := &Config{}
+	if err := cfg.parseEnvironment(); err != nil {
+		t.Fatalf("parseEnvironment() error = %v", err)
+	}
+
+	expected := []string{"fast.example.com:25", "backup.example.com:587", "other.example.com:25"}
+	if !reflect.DeepEqual(cfg.SmtpAddrs, expected) {
+		t.Errorf("parseEnvironment() SMTP = %v, want %v", cfg.SmtpAddrs, expected)
+	}
+	if !reflect.DeepEqual(cfg.ServerWeights, map[string]int{"fast.example.com:25": 4}) {
+		t.Errorf("parseEnvironment() weights = %v", cfg.ServerWeights)
+	}
+	if cfg.weight("backup.example.com:587") != 1 {
+		t.Errorf("weight() = %d for a server without weight, want 1", cfg.weight("backup.example.com:587"))
+	}
+
+	// A weight must follow a server and be between 1 and MaxServerWeight
+	for _, servers := range []string{"3;smtp.example.com", "smtp.example.com;0", "smtp.example.com;1001", "smtp.example.com;9223372036854775807"} {
+		os.Setenv(MailRelayEnvVar, servers)
+		os.Setenv(StrictEnvVar, "true")
+		cfg = &Config{}
+		if err := cfg.parseEnvironment(); err == nil {
+			t.Errorf("parseEnvironment() should fail on %q in strict mode", servers)
+		}
+		os.Unsetenv(StrictEnvVar)
+	}
+}
+
+func TestPrepareFooterFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "footer.txt")
+	if err := os.WriteFile(path, []byte("ACME Corp\n"), 0644); err != nil {
+		t.Fatalf("Failed to write footer: %v", err)
+	}
+
+	cfg := &Config{SmtpAddrs: []string{"smtp.example.com:25"}, FooterFile: path}
+	if err := cfg.Prepare(); err != nil {
+		t.Fatalf("Prepare() error = %v", err)
+	}
+	if cfg.Footer != "ACME Corp\n" {
+		t.Errorf("Footer = %q", cfg.Footer)
+	}
+
+	cfg = &Config{SmtpAddrs: []string{"smtp.example.com:25"}, FooterFile: path + ".missing"}
+	if err := cfg.Prepare(); err == nil {
+		t.Error("Prepare() should fail on a missing footer file")
+	}
+}
+
+func TestPreSendTimeoutDefault(t *testing.T) {
+	cfg := &Config{SmtpAddrs: []string{"smtp.example.com:25"}, PreSendCommand: "cat"}
+	err := cfg.validateSettings()
+	if runtime.GOOS == "windows" {
+		if err == nil {
+			t.Error("validateSettings() should refuse the pre-send command on Windows")
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("validateSettings() error = %v", err)
+	}
+	if cfg.PreSendTimeout != DefaultPreSendTimeout {
+		t.Errorf("PreSendTimeout = %v, want %v", cfg.PreSendTimeout, DefaultPreSendTimeout)
+	}
+}
+
+func TestWriteChunkSize(t *testing.T) {
+	cfg := &Config{SmtpAddrs: []string{"smtp.example.com:25"}}
+	if err := cfg.validateSettings(); err != nil {
+		t.Fatalf("validateSettings() error = %v", err)
+	}
+	if cfg.WriteChunkSize != DefaultWriteChunkSize {
+		t.Errorf("WriteChunkSize = %d, want %d", cfg.WriteChunkSize, DefaultWriteChunkSize)
+	}
+
+	os.Setenv(ChunkSizeEnvVar, "4096")
+	defer os.Unsetenv(ChunkSizeEnvVar)
+	cfg = &Config{}
+	if err := cfg.parseEnvironment(); err != nil {
+		t.Fatalf("parseEnvironment() error = %v", err)
+	}
+	if cfg.WriteChunkSize != 4096 {
+		t.Errorf("WriteChunkSize = %d, want 4096", cfg.WriteChunkSize)
+	}
+
+	cfg = &Config{SmtpAddrs: []string{"smtp.example.com:25"}, WriteChunkSize: -1}
+	if err := cfg.validateSettings(); err == nil {
+		t.Error("validateSettings() should fail on a negative write chunk size")
+	}
+}
+
+func TestSubmissionFlags(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		env        string
+		port       int
+		submission bool
+		gateway    bool
+	}{
+		{name: "Neither", args: nil, port: DefaultSMTPPort},
+		{name: "Submission port", args: []string{"-U"}, port: SubmissionPort, submission: true},
+		{name: "Port flag wins", args: []string{"-U", "-port", "2525"}, port: 2525, submission: true},
+		{name: "Port setting wins", args: []string{"-U"}, env: "2525", port: 2525, submission: true},
+		{name: "Gateway", args: []string{"-G"}, port: DefaultSMTPPort, gateway: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				os.Setenv(PortEnvVar, tt.env)
+				defer os.Unsetenv(PortEnvVar)
+			}
+
+			cfg := &Config{}
+			if err := cfg.parseArguments(tt.args); err != nil {
+				t.Fatalf("parseArguments() error = %v", err)
+			}
+			if err := cfg.parseEnvironment(); err != nil {
+				t.Fatalf("parseEnvironment() error = %v", err)
+			}
+			if cfg.DefaultPort != tt.port || cfg.Submission != tt.submission || cfg.Gateway != tt.gateway {
+				t.Errorf("DefaultPort = %d, Submission = %v, Gateway = %v, want %d, %v, %v",
+					cfg.DefaultPort, cfg.Submission, cfg.Gateway, tt.port, tt.submission, tt.gateway)
+			}
+		})
+	}
+
+	cfg := &Config{SmtpAddrs: []string{"smtp.example.com:25"}, Submission: true, Gateway: true}
+	if err := cfg.validateSettings(); err == nil {
+		t.Error("validateSettings() should fail on both -U and -G")
+	}
+}
+
+func TestQuietOverridesVerbose(t *testing.T) {
+	os.Setenv(VerboseEnvVar, "true")
+	defer os.Unsetenv(VerboseEnvVar)
+
+	cfg := &Config{SmtpAddrs: []string{"smtp.example.com:25"}}
+	if err := cfg.parseArguments([]string{"-q"}); err != nil {
+		t.Fatalf("parseArguments() error = %v", err)
+	}
+	if err := cfg.parseEnvironment(); err != nil {
+		t.Fatalf("parseEnvironment() error = %v", err)
+	}
+	if err := cfg.validateSettings(); err != nil {
+		t.Fatalf("validateSettings() error = %v", err)
+	}
+	if !cfg.Quiet || cfg.BeVerbose {
+		t.Errorf("Quiet = %v, BeVerbose = %v, want quiet only", cfg.Quiet, cfg.BeVerbose)
+	}
+}
+
+func TestParseEnvironmentServerTLS(t *testing.T) {
+	os.Setenv(MailRelayEnvVar, "smtp.provider.com:587;tls=required;internal.relay:25;2;TLS=None;other.example.com")
+	defer os.Unsetenv(MailRelayEnvVar)
+
+	cfg := &Config{}
+	if err := cfg.parseEnvironment(); err != nil {
+		t.Fatalf("parseEnvironment() error = %v", err)
+	}
+
+	expected := []string{"smtp.provider.com:587", "internal.relay:25", "other.example.com:25"}
+	if !reflect.DeepEqual(cfg.SmtpAddrs, expected) {
+		t.Errorf("parseEnvironment() SMTP = %v, want %v", cfg.SmtpAddrs, expected)
+	}
+	if !reflect.DeepEqual(cfg.ServerWeights, map[string]int{"internal.relay:25": 2}) {
+		t.Errorf("parseEnvironment() weights = %v", cfg.ServerWeights)
+	}
+	cfg.RequireTLS = true
+	policies := map[string]string{
+		"smtp.provider.com:587": TLSPolicyRequired,
+		"internal.relay:25":     TLSPolicyNone,
+		"other.example.com:25":  TLSPolicyRequired,
+	}
+	for server, policy := range policies {
+		if got := cfg.TLSPolicy(server); got != policy {
+			t.Errorf("TLSPolicy(%s) = %s, want %s", server, got, policy)
+		}
+	}
+
+	// A policy must follow a server, once, and be known
+	for _, servers := range []string{"tls=none;smtp.example.com", "smtp.example.com;tls=none;tls=required", "smtp.example.com;tls=maybe"} {
+		os.Setenv(MailRelayEnvVar, servers)
+		os.Setenv(StrictEnvVar, "true")
+		cfg = &Config{}
+		if err := cfg.parseEnvironment(); err == nil {
+			t.Errorf("parseEnvironment() should fail on %q in strict mode", servers)
+		}
+		os.Unsetenv(StrictEnvVar)
+	}
+}
+
+func TestParseEnvironmentHugeServerWeights(t *testing.T) {
+	os.Setenv(MailRelayEnvVar, "a.example.com:25;9223372036854775807;b.example.com:25;9223372036854775807")
+	defer os.Unsetenv(MailRelayEnvVar)
+
+	// Out of range weights are skipped and cannot overflow the shuffle
+	cfg := &Config{}
+	if err := cfg.parseEnvironment(); err != nil {
+		t.Fatalf("parseEnvironment() error = %v", err)
+	}
+	if len(cfg.ServerWeights) != 0 {
+		t.Errorf("parseEnvironment() weights = %v, want none", cfg.ServerWeights)
+	}
+	cfg.shuffleSMTPServers()
+	if len(cfg.SmtpAddrs) != 2 {
+		t.Errorf("shuffleSMTPServers() = %v", cfg.SmtpAddrs)
+	}
+}
+
+func TestShuffleSMTPServersWeighted(t *testing.T) {
+	const iterations = 20000
+
+	// The fast relay should come first about 3 times out of 4
+	first := 0
+	for i := 0; i < iterations; i++ {
+		cfg := &Config{
+			SmtpAddrs:     []string{"backup.example.com:25", "fast.example.com:25"},
+			ServerWeights: map[string]int{"fast.example.com:25": 3},
+		}
+		cfg.shuffleSMTPServers()
+		if len(cfg.SmtpAddrs) != 2 {
+			t.Fatalf("shuffleSMTPServers() = %v, lost a server", cfg.SmtpAddrs)
+		}
+		if cfg.SmtpAddrs[0] == "fast.example.com:25" {
+			first++
+		}
+	}
+
+	expected := iterations * 3 / 4
+	if first < expected*95/100 || first > expected*105/100 {
+		t.Errorf("weighted server came first %d times, want about %d", first, expected)
+	}
+}
+
+func TestShuffleSMTPServersDistribution(t *testing.T) {
+	servers := []string{"smtp1.example.com:25", "smtp2.example.com:25", "smtp3.example.com:25"}
+	const iterations = 30000
+
+	// Count how often each ordering comes up, all 6 should be equally likely
+	counts := make(map[string]int)
+	for i := 0; i < iterations; i++ {
+		cfg := &Config{SmtpAddrs: append([]string{}, servers...)}
+		cfg.shuffleSMTPServers()
+		counts[strings.Join(cfg.SmtpAddrs, ",")]++
+	}
+
+	if len(counts) != 6 {
+		t.Fatalf("shuffleSMTPServers() produced %d orderings, want 6", len(counts))
+	}
+
+	expected := iterations / 6
+	for order, count := range counts {
+		if count < expected*85/100 || count > expected*115/100 {
+			t.Errorf("shuffleSMTPServers() ordering %s came up %d times, want about %d", order, count, expected)
 		}
 	}
 }
@@ -280,9 +1483,6 @@ func TestNew(t *testing.T) {
 	originalSender := os.Getenv(SenderEnvVar)
 	originalArgs := os.Args
 
-	// Reset flags for the test
-	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
-
 	// Restore environment and args after test
 	defer func() {
 		os.Setenv(MailRelayEnvVar, originalEnv)
@@ -320,19 +1520,18 @@ func TestNew(t *testing.T) {
 			expectError: true,
 		},
 		{
-			name: "Invalid configuration - missing sender",
+			name: "Missing sender, taken from the message later",
 			envVars: map[string]string{
 				MailRelayEnvVar: "smtp.example.com:25",
 			},
 			args:        []string{"mailrelay"},
-			expectError: true,
+			expectError: false,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			// Reset flags for each test
-			flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
 
 			// Clear environment variables
 			os.Unsetenv(MailRelayEnvVar)
@@ -363,3 +1562,100 @@ func TestNew(t *testing.T) {
 		})
 	}
 }
+
+func TestNewVersion(t *testing.T) {
+	oldArgs := os.Args
+	os.Args = []string{"mailrelay", "-V"}
+	defer func() { os.Args = oldArgs }()
+
+	exitCode := -1
+	oldOsExit := osExit
+	osExit = func(code int) { exitCode = code }
+	defer func() { osExit = oldOsExit }()
+
+	var stdout bytes.Buffer
+	osStdout = &stdout
+	defer func() { osStdout = os.Stdout }()
+
+	New()
+	if exitCode != 0 {
+		t.Errorf("New() exit code = %d, want 0", exitCode)
+	}
+	if !strings.Contains(stdout.String(), "mailrelay "+Version) {
+		t.Errorf("New() version output = %q", stdout.String())
+	}
+}
+
+func TestPrepare(t *testing.T) {
+	cfg := &Config{
+		SmtpAddrs:     []string{"relay1.example.com", "lmtp://relay2.example.com", "[2001:db8::1]"},
+		ServerWeights: map[string]int{"relay1.example.com": 3},
+		FromAddr:      "sender@example.com",
+		NoRandomize:   true,
+	}
+	if err := cfg.Prepare(); err != nil {
+		t.Fatalf("Prepare() error = %v", err)
+	}
+
+	expected := []string{"relay1.example.com:25", "lmtp://relay2.example.com:24", "[2001:db8::1]:25"}
+	if !reflect.DeepEqual(cfg.SmtpAddrs, expected) {
+		t.Errorf("SmtpAddrs = %v, want %v", cfg.SmtpAddrs, expected)
+	}
+	if w := cfg.weight("relay1.example.com:25"); w != 3 {
+		t.Errorf("weight() = %d, want the weight given before normalization", w)
+	}
+
+	cfg = &Config{SmtpAddrs: []string{"relay.example.com:http"}, FromAddr: "sender@example.com"}
+	if err := cfg.Prepare(); err == nil {
+		t.Error("Prepare() should fail on an invalid server")
+	}
+}
+
+func TestParseTwice(t *testing.T) {
+	os.Unsetenv(MailRelayEnvVar)
+	env := func(vars map[string]string) func(string) (string, bool) {
+		return func(name string) (string, bool) {
+			value, ok := vars[name]
+			return value, ok
+		}
+	}
+
+	first, err := Parse([]string{"-f", "first@example.com", "-v"}, env(map[string]string{MailRelayEnvVar: "first.example.com"}))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	second, err := Parse([]string{"-ffrom@example.com"}, env(map[string]string{MailRelayEnvVar: "second.example.com:587"}))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	if first.FromAddr != "first@example.com" || !first.BeVerbose || !reflect.DeepEqual(first.SmtpAddrs, []string{"first.example.com:25"}) {
+		t.Errorf("First Parse() = %+v", first)
+	}
+	if second.FromAddr != "from@example.com" || second.BeVerbose || !reflect.DeepEqual(second.SmtpAddrs, []string{"second.example.com:587"}) {
+		t.Errorf("Second Parse() = %+v", second)
+	}
+
+	// Unknown flags are reported instead of exiting
+	var stderr bytes.Buffer
+	osStderr = &stderr
+	defer func() { osStderr = os.Stderr }()
+	if _, err := Parse([]string{"-no-such-flag"}, env(nil)); !errors.Is(err, errUsage) {
+		t.Errorf("Parse() error = %v, want a usage error", err)
+	}
+
+	// So are help and version requests, which New exits on
+	oldOsExit := osExit
+	osExit = func(code int) {
+		t.Errorf("os.Exit(%d) called by Parse()", code)
+	}
+	defer func() { osExit = oldOsExit }()
+	for i := 0; i < 2; i++ {
+		if _, err := Parse([]string{"-version"}, env(nil)); !errors.Is(err, ErrVersion) {
+			t.Errorf("Parse() error = %v, want ErrVersion", err)
+		}
+		if _, err := Parse([]string{"-h"}, env(nil)); !errors.Is(err, flag.ErrHelp) {
+			t.Errorf("Parse() error = %v, want flag.ErrHelp", err)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// DefaultEnvFile is read from the working directory when no environment
+// file is specified
+const DefaultEnvFile = ".mailrelay.env"
+
+// untrustedVars cannot be set in the environment file, found in whatever
+// directory mailrelay runs in: they run commands, choose the configuration
+// file or name files that are written to or copied into messages
+var untrustedVars = map[string]bool{
+	ConfigEnvVar:  true,
+	PreSendEnvVar: true,
+	LogFileEnvVar: true,
+	AuditEnvVar:   true,
+	MetricsEnvVar: true,
+	SpoolEnvVar:   true,
+	StateEnvVar:   true,
+	BounceMboxVar: true,
+	FooterEnvVar:  true,
+}
+
+// loadEnvFile reads environment variables from a dotenv style file, used
+// for variables not present in the environment. The process environment
+// itself is not modified. A missing file is only an error when its path
+// was given explicitly.
+//
+// The file holds one KEY=VALUE pair per line, optionally preceded by
+// export, where every key must start with MAILRELAY_. Blank lines and
+// lines starting with # are ignored.
+func (cfg *Config) loadEnvFile() error {
+	path := cfg.EnvFile
+	explicit := path != ""
+	if !explicit {
+		path = cfg.env(EnvFileEnvVar)
+		explicit = path != ""
+	}
+	if !explicit {
+		path = DefaultEnvFile
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) && !explicit {
+			return nil
+		}
+		return fmt.Errorf("cannot read environment file: %w", err)
+	}
+	defer f.Close()
+
+	cfg.envFileValues = map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return fmt.Errorf("%s:%d: expected KEY=VALUE", path, lineNo)
+		}
+
+		// Only mailrelay settings may be set, the file is read from
+		// whatever directory mailrelay runs in and must not change PATH,
+		// LD_PRELOAD and the like
+		if !strings.HasPrefix(key, envPrefix) {
+			return fmt.Errorf("%s:%d: %s is not a %s* variable", path, lineNo, key, envPrefix)
+		}
+		if untrustedVars[key] {
+			return fmt.Errorf("%s:%d: %s cannot be set in the environment file, set it in the environment or in %s", path, lineNo, key, DefaultConfigFile)
+		}
+
+		cfg.envFileValues[key] = unquote(strings.TrimSpace(value))
+	}
+
+	return scanner.Err()
+}
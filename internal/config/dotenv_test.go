@@ -0,0 +1,162 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func writeEnvFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), DefaultEnvFile)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write environment file: %v", err)
+	}
+	return path
+}
+
+func TestLoadEnvFile(t *testing.T) {
+	path := writeEnvFile(t, `# local development
+MAILRELAY_SERVERS="localhost:1025"
+
+export MAILRELAY_FROM='dev@example.com'
+MAILRELAY_VERBOSE = yes
+`)
+
+	os.Unsetenv(MailRelayEnvVar)
+	os.Unsetenv(VerboseEnvVar)
+	os.Setenv(SenderEnvVar, "real@example.com")
+	defer func() {
+		os.Unsetenv(MailRelayEnvVar)
+		os.Unsetenv(SenderEnvVar)
+		os.Unsetenv(VerboseEnvVar)
+	}()
+
+	cfg := &Config{EnvFile: path}
+	if err := cfg.loadEnvFile(); err != nil {
+		t.Fatalf("loadEnvFile() failed: %v", err)
+	}
+
+	expected := map[string]string{
+		MailRelayEnvVar: "localhost:1025",
+		VerboseEnvVar:   "yes",
+		// The real environment is not overridden
+		SenderEnvVar: "real@example.com",
+	}
+	for name, want := range expected {
+		if got := cfg.env(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+
+	// The process environment is left alone
+	if _, set := os.LookupEnv(MailRelayEnvVar); set {
+		t.Errorf("loadEnvFile() set %s in the process environment", MailRelayEnvVar)
+	}
+}
+
+func TestLoadEnvFileErrors(t *testing.T) {
+	os.Unsetenv(EnvFileEnvVar)
+
+	cfg := &Config{EnvFile: writeEnvFile(t, "MAILRELAY_SERVERS\n")}
+	if err := cfg.loadEnvFile(); err == nil {
+		t.Error("loadEnvFile() should fail on a line without =")
+	}
+
+	// Variables outside of mailrelay are never set
+	os.Unsetenv("LD_PRELOAD")
+	cfg = &Config{EnvFile: writeEnvFile(t, "MAILRELAY_SERVERS=localhost\nLD_PRELOAD=/tmp/evil.so\n")}
+	if err := cfg.loadEnvFile(); err == nil {
+		t.Error("loadEnvFile() should fail on a variable without the MAILRELAY_ prefix")
+	}
+	os.Unsetenv(MailRelayEnvVar)
+	if _, set := os.LookupEnv("LD_PRELOAD"); set {
+		os.Unsetenv("LD_PRELOAD")
+		t.Error("loadEnvFile() set LD_PRELOAD")
+	}
+
+	cfg = &Config{EnvFile: filepath.Join(t.TempDir(), "missing.env")}
+	if err := cfg.loadEnvFile(); err == nil {
+		t.Error("loadEnvFile() should fail when an explicit file is missing")
+	}
+
+	// The default file is optional
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	cfg = &Config{}
+	if err := cfg.loadEnvFile(); err != nil {
+		t.Errorf("loadEnvFile() should ignore a missing default file, got %v", err)
+	}
+}
+
+func TestLoadEnvFileUntrusted(t *testing.T) {
+	for name := range untrustedVars {
+		t.Run(name, func(t *testing.T) {
+			cfg := &Config{EnvFile: writeEnvFile(t, "MAILRELAY_SERVERS=localhost\n"+name+"=/tmp/evil\n")}
+			if err := cfg.loadEnvFile(); err == nil {
+				t.Errorf("loadEnvFile() should refuse %s", name)
+			}
+		})
+	}
+
+	// A pre-send command dropped next to mailrelay is never run, while the
+	// same command from the environment is
+	path := writeEnvFile(t, "MAILRELAY_SERVERS=localhost\nMAILRELAY_PRE_SEND_COMMAND=touch /tmp/pwned\n")
+	env := map[string]string{EnvFileEnvVar: path}
+	lookupEnv := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+	if cfg, err := Parse(nil, lookupEnv); err == nil {
+		t.Fatalf("Parse() = %q, want the environment file refused", cfg.PreSendCommand)
+	}
+
+	// Windows refuses the command wherever it comes from
+	if runtime.GOOS == "windows" {
+		return
+	}
+	path = writeEnvFile(t, "MAILRELAY_SERVERS=localhost\n")
+	env = map[string]string{EnvFileEnvVar: path, PreSendEnvVar: "cat"}
+	cfg, err := Parse(nil, lookupEnv)
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if cfg.PreSendCommand != "cat" {
+		t.Errorf("PreSendCommand = %q, want the one from the environment", cfg.PreSendCommand)
+	}
+}
+
+func TestEnvFileLocalTargets(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		envFile string
+		env     map[string]string
+		wantErr bool
+	}{
+		{"Maildir from the environment file", "MAILRELAY_SERVERS=maildir:" + dir + "\n", nil, true},
+		{"Maildir referencing the environment file", "MAILRELAY_CAPTURE=" + dir + "\n",
+			map[string]string{MailRelayEnvVar: "relay:25;maildir:${MAILRELAY_CAPTURE}"}, true},
+		{"Mbox from the environment file", "MAILRELAY_SERVERS=mbox:" + dir + "/capture.mbox\n", nil, true},
+		{"Maildir from the environment", "MAILRELAY_VERBOSE=yes\n",
+			map[string]string{MailRelayEnvVar: "maildir:" + dir}, false},
+		{"Relay from the environment file", "MAILRELAY_SERVERS=relay:25\n", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{EnvFileEnvVar: writeEnvFile(t, tt.envFile)}
+			for name, value := range tt.env {
+				env[name] = value
+			}
+			_, err := Parse(nil, func(name string) (string, bool) {
+				value, ok := env[name]
+				return value, ok
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
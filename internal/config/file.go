@@ -0,0 +1,281 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// DefaultConfigFile is read when no configuration file is specified
+const DefaultConfigFile = "/etc/mailrelay.conf"
+
+// settings maps every environment variable that can also be set from the
+// configuration file to the command line flag overriding it
+var settings = map[string]string{
+	MailRelayEnvVar: "",
+	ProfileEnvVar:   "p",
+	SenderEnvVar:    "f",
+	FromNameEnvVar:  "F",
+	VerboseEnvVar:   "v",
+	QuietEnvVar:     "q",
+	JSONEnvVar:      "json",
+	TraceHdrEnvVar:  "trace-header",
+	AuditEnvVar:     "audit",
+	AuditHashEnvVar: "audit-hash",
+	SyslogEnvVar:    "syslog",
+	LogFileEnvVar:   "log-file",
+	SMTPModeEnvVar:  "smtp-mode",
+	GunzipEnvVar:    "z",
+	MaxRcptEnvVar:   "max-rcpt-per-message",
+	MaxRcptsEnvVar:  "max-recipients",
+	MaxSizeEnvVar:   "max-message-size",
+	DeliveryEnvVar:  "delivery-mode",
+	StripEnvVar:     "strip-headers",
+	MinTLSEnvVar:    "min-tls-version",
+	MaxTLSEnvVar:    "max-tls-version",
+	ChunkSizeEnvVar: "write-chunk-size",
+	AuthMechEnvVar:  "auth-mechanisms",
+	TokenFileEnvVar: "oauth-token-file",
+	DirectEnvVar:    "direct",
+	TrimBodyEnvVar:  "trim-body",
+	PreSendEnvVar:   "pre-send-command",
+	PreSendTOEnvVar: "pre-send-timeout",
+	FooterEnvVar:    "footer-file",
+	FooterMPEnvVar:  "footer-multipart",
+	ParallelEnvVar:  "parallel",
+	PartialEnvVar:   "partial",
+	AllOrNoneEnvVar: "all-or-nothing",
+	DKIMKeyEnvVar:   "dkim-key",
+	DKIMSelEnvVar:   "dkim-selector",
+	DKIMDomEnvVar:   "dkim-domain",
+	PortEnvVar:      "port",
+	StrictEnvVar:    "strict-servers",
+	DryRunEnvVar:    "n",
+	TimeoutEnvVar:   "overall-timeout",
+	GreetingEnvVar:  "greeting-timeout",
+	AllowEnvVar:     "allow-domains",
+	DenyEnvVar:      "deny-domains",
+	StrictDomEnvVar: "strict-domains",
+	AuthFileEnvVar:  "auth-file",
+	CertEnvVar:      "client-cert",
+	KeyEnvVar:       "client-key",
+	PinEnvVar:       "tls-fingerprint",
+	RequireTLSVar:   "require-tls",
+	DANEEnvVar:      "dane",
+	RequireDANEVar:  "dane-required",
+	ProxyEnvVar:     "proxy",
+	LocalAddrEnvVar: "local-addr",
+	ProxyHdrEnvVar:  "proxy-header",
+	ProxyVerEnvVar:  "proxy-header-version",
+	QPEnvVar:        "quoted-printable",
+	HeadersEnvVar:   "H",
+	ReplaceEnvVar:   "replace-headers",
+	ReturnEnvVar:    "return-path",
+	NoShuffleEnvVar: "no-shuffle",
+	VERPEnvVar:      "verp",
+	RateEnvVar:      "rate-limit",
+	RateRcptEnvVar:  "rate-limit-recipients",
+	ConfirmEnvVar:   "confirm-threshold",
+	NormalizeEnvVar: "normalize",
+	StripTagEnvVar:  "strip-plus-tags",
+	LowerEnvVar:     "lowercase-local",
+	MetricsEnvVar:   "metrics-file",
+	RulesEnvVar:     "",
+	DomainMapEnvVar: "",
+	RedirectEnvVar:  "redirect-all",
+	AlwaysBccEnvVar: "always-bcc",
+	SpoolEnvVar:     "spool-dir",
+	StateEnvVar:     "state-dir",
+	ScheduleEnvVar:  "retry-schedule",
+	BounceEnvVar:    "bounce",
+	BounceMboxVar:   "bounce-mailbox",
+}
+
+// parseFile reads settings from the configuration file. A missing file is
+// only an error when its path was given explicitly, or a profile was asked
+// for.
+//
+// The file holds one key=value pair per line, blank lines and lines starting
+// with # are ignored. Keys are either environment variable names or their
+// short form without the MAILRELAY_ prefix, e.g. servers or dkim-key.
+// Settings following a [name] line belong to that profile, used only when
+// selected with -p, MAILRELAY_PROFILE or a profile setting before the
+// first section.
+func (cfg *Config) parseFile() error {
+	path := cfg.ConfigFile
+	explicit := path != ""
+	if !explicit {
+		path = cfg.env(ConfigEnvVar)
+		explicit = path != ""
+	}
+	if !explicit {
+		path = DefaultConfigFile
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) && !explicit {
+			if profile := cfg.selectedProfile(); profile != "" {
+				return fmt.Errorf("profile %q needs a configuration file, %s does not exist", profile, path)
+			}
+			return nil
+		}
+		return fmt.Errorf("cannot read configuration file: %w", err)
+	}
+	defer f.Close()
+
+	cfg.fileValues = map[string]string{}
+	profiles := map[string]map[string]string{}
+	values := cfg.fileValues
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			profile := strings.TrimSpace(line[1 : len(line)-1])
+			if profile == "" {
+				return fmt.Errorf("%s:%d: expected a profile name", path, lineNo)
+			}
+			if profiles[profile] == nil {
+				profiles[profile] = map[string]string{}
+			}
+			values = profiles[profile]
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected key=value", path, lineNo)
+		}
+
+		name := settingName(key)
+		if _, known := settings[name]; !known {
+			return fmt.Errorf("%s:%d: unknown setting %q", path, lineNo, strings.TrimSpace(key))
+		}
+		if name == ProfileEnvVar && len(profiles) > 0 {
+			return fmt.Errorf("%s:%d: the profile can only be selected before the first profile", path, lineNo)
+		}
+		values[name] = unquote(strings.TrimSpace(value))
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if profile := cfg.selectedProfile(); profile != "" {
+		values, ok := profiles[profile]
+		if !ok {
+			return fmt.Errorf("profile %q not found in %s", profile, path)
+		}
+		cfg.Profile = profile
+		cfg.profileValues = values
+	}
+	return nil
+}
+
+// selectedProfile returns the name of the profile asked for, if any
+func (cfg *Config) selectedProfile() string {
+	if cfg.Profile != "" {
+		return cfg.Profile
+	}
+	if profile := cfg.env(ProfileEnvVar); profile != "" {
+		return profile
+	}
+	return cfg.fileValues[ProfileEnvVar]
+}
+
+// settingName converts a configuration file key to its environment variable name
+func settingName(key string) string {
+	name := strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(key), "-", "_"))
+	if !strings.HasPrefix(name, envPrefix) {
+		name = envPrefix + name
+	}
+	return name
+}
+
+// unquote strips a matching pair of surrounding quotes from a value
+func unquote(value string) string {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+// getenv returns the value of a setting with flags taking precedence over
+// the selected profile, then environment variables and the environment
+// file, which take precedence over the rest of the configuration file.
+// An empty value is returned when the corresponding flag was given, so the
+// flag value is kept.
+func (cfg *Config) getenv(name string) string {
+	if flagName := settings[name]; flagName != "" && cfg.setFlags[flagName] {
+		return ""
+	}
+	if value := cfg.profileValues[name]; value != "" {
+		return value
+	}
+	if value := cfg.env(name); value != "" {
+		return value
+	}
+	return cfg.fileValues[name]
+}
+
+// env returns an environment variable, as given to Parse or from the
+// process otherwise, falling back to the environment file
+func (cfg *Config) env(name string) string {
+	lookupEnv := cfg.lookupEnv
+	if lookupEnv == nil {
+		lookupEnv = os.LookupEnv
+	}
+	if value, ok := lookupEnv(name); ok {
+		return value
+	}
+	return cfg.envFileValues[name]
+}
+
+// fromEnvFile reports whether the value getenv returns for a setting comes
+// from the environment file
+func (cfg *Config) fromEnvFile(name string) bool {
+	if flagName := settings[name]; flagName != "" && cfg.setFlags[flagName] {
+		return false
+	}
+	if cfg.profileValues[name] != "" {
+		return false
+	}
+	return cfg.envFromFile(name)
+}
+
+// envFromFile reports whether env takes the variable from the environment
+// file
+func (cfg *Config) envFromFile(name string) bool {
+	lookupEnv := cfg.lookupEnv
+	if lookupEnv == nil {
+		lookupEnv = os.LookupEnv
+	}
+	if _, ok := lookupEnv(name); ok {
+		return false
+	}
+	return cfg.envFileValues[name] != ""
+}
+
+// expandsEnvFile reports whether s references a variable, as in ${NAME},
+// that expand takes from the environment file
+func (cfg *Config) expandsEnvFile(s string) bool {
+	found := false
+	os.Expand(s, func(name string) string {
+		found = found || cfg.envFromFile(name)
+		return ""
+	})
+	return found
+}
+
+// enabled reports whether a boolean setting is switched on
+func enabled(value string) bool {
+	switch strings.ToLower(value) {
+	case "", "0", "false", "no", "off":
+		return false
+	}
+	return true
+}
@@ -0,0 +1,300 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "mailrelay.conf")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	return path
+}
+
+func TestParseFile(t *testing.T) {
+	path := writeConfigFile(t, `# relays
+servers = "smtp1.example.com:25;smtp2.example.com:25"
+MAILRELAY_FROM = 'file@example.com'
+
+verbose = yes
+dkim-selector = mail
+`)
+
+	cfg := &Config{ConfigFile: path}
+	if err := cfg.parseFile(); err != nil {
+		t.Fatalf("parseFile() failed: %v", err)
+	}
+
+	expected := map[string]string{
+		MailRelayEnvVar: "smtp1.example.com:25;smtp2.example.com:25",
+		SenderEnvVar:    "file@example.com",
+		VerboseEnvVar:   "yes",
+		DKIMSelEnvVar:   "mail",
+	}
+	if !reflect.DeepEqual(cfg.fileValues, expected) {
+		t.Errorf("parseFile() values = %v, want %v", cfg.fileValues, expected)
+	}
+}
+
+func TestParseFileErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"missing separator", "servers smtp.example.com:25\n"},
+		{"unknown setting", "colour = blue\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{ConfigFile: writeConfigFile(t, tt.content)}
+			if err := cfg.parseFile(); err == nil {
+				t.Error("parseFile() should fail on a malformed file")
+			}
+		})
+	}
+}
+
+func TestParseFileMissing(t *testing.T) {
+	os.Unsetenv(ConfigEnvVar)
+	missing := filepath.Join(t.TempDir(), "missing.conf")
+
+	// An explicitly requested file must exist
+	cfg := &Config{ConfigFile: missing}
+	if err := cfg.parseFile(); err == nil {
+		t.Error("parseFile() should fail when an explicit file is missing")
+	}
+
+	os.Setenv(ConfigEnvVar, missing)
+	defer os.Unsetenv(ConfigEnvVar)
+	cfg = &Config{}
+	if err := cfg.parseFile(); err == nil {
+		t.Errorf("parseFile() should fail when %s points to a missing file", ConfigEnvVar)
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	originalArgs := os.Args
+	defer func() { os.Args = originalArgs }()
+
+	path := writeConfigFile(t, `servers = file.example.com:25
+from = file@example.com
+verbose = true
+dkim-domain = file.example.com
+`)
+
+	tests := []struct {
+		name            string
+		envVars         map[string]string
+		args            []string
+		expectedSMTP    []string
+		expectedFrom    string
+		expectedVerbose bool
+	}{
+		{
+			name:            "File only",
+			args:            []string{"mailrelay", "-config", path},
+			expectedSMTP:    []string{"file.example.com:25"},
+			expectedFrom:    "file@example.com",
+			expectedVerbose: true,
+		},
+		{
+			name: "Environment overrides file",
+			envVars: map[string]string{
+				MailRelayEnvVar: "env.example.com:25",
+				SenderEnvVar:    "env@example.com",
+			},
+			args:            []string{"mailrelay", "-config", path},
+			expectedSMTP:    []string{"env.example.com:25"},
+			expectedFrom:    "env@example.com",
+			expectedVerbose: true,
+		},
+		{
+			name: "Flags override environment and file",
+			envVars: map[string]string{
+				SenderEnvVar:  "env@example.com",
+				VerboseEnvVar: "true",
+			},
+			args:            []string{"mailrelay", "-config", path, "-f", "flag@example.com", "-v=false"},
+			expectedSMTP:    []string{"file.example.com:25"},
+			expectedFrom:    "flag@example.com",
+			expectedVerbose: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			os.Unsetenv(MailRelayEnvVar)
+			os.Unsetenv(SenderEnvVar)
+			os.Unsetenv(VerboseEnvVar)
+			for k, v := range tt.envVars {
+				os.Setenv(k, v)
+			}
+			defer func() {
+				for k := range tt.envVars {
+					os.Unsetenv(k)
+				}
+			}()
+
+			os.Args = tt.args
+
+			cfg, err := New()
+			if err != nil {
+				t.Fatalf("New() failed: %v", err)
+			}
+
+			if !reflect.DeepEqual(cfg.SmtpAddrs, tt.expectedSMTP) {
+				t.Errorf("SmtpAddrs = %v, want %v", cfg.SmtpAddrs, tt.expectedSMTP)
+			}
+			if cfg.FromAddr != tt.expectedFrom {
+				t.Errorf("FromAddr = %v, want %v", cfg.FromAddr, tt.expectedFrom)
+			}
+			if cfg.BeVerbose != tt.expectedVerbose {
+				t.Errorf("BeVerbose = %v, want %v", cfg.BeVerbose, tt.expectedVerbose)
+			}
+			if cfg.DKIMDomain != "file.example.com" {
+				t.Errorf("DKIMDomain = %v, want file.example.com", cfg.DKIMDomain)
+			}
+		})
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	authPath := filepath.Join(t.TempDir(), "auth")
+	if err := os.WriteFile(authPath, []byte("user=billing\npassword=s3cret\n"), 0600); err != nil {
+		t.Fatalf("Failed to write auth file: %v", err)
+	}
+	path := writeConfigFile(t, `servers = default.example.com:25
+from = default@example.com
+dkim-domain = example.com
+
+[billing]
+servers = billing.example.com:587
+from = billing@example.com
+auth-file = `+authPath+`
+require-tls = true
+
+[alerts]
+servers = alerts1.example.com:25;alerts2.example.com:25
+from = alerts@example.com
+no-shuffle = true
+`)
+
+	tests := []struct {
+		name        string
+		args        []string
+		env         map[string]string
+		servers     []string
+		from        string
+		user        string
+		requireTLS  bool
+		dkimDomain  string
+		wantProfile string
+	}{
+		{
+			name:       "No profile",
+			args:       []string{"-config", path},
+			servers:    []string{"default.example.com:25"},
+			from:       "default@example.com",
+			dkimDomain: "example.com",
+		},
+		{
+			name:        "Selected with -p",
+			args:        []string{"-config", path, "-p", "billing"},
+			servers:     []string{"billing.example.com:587"},
+			from:        "billing@example.com",
+			user:        "billing",
+			requireTLS:  true,
+			dkimDomain:  "example.com",
+			wantProfile: "billing",
+		},
+		{
+			name:        "Selected from the environment",
+			args:        []string{"-config", path},
+			env:         map[string]string{ProfileEnvVar: "alerts"},
+			servers:     []string{"alerts1.example.com:25", "alerts2.example.com:25"},
+			from:        "alerts@example.com",
+			dkimDomain:  "example.com",
+			wantProfile: "alerts",
+		},
+		{
+			name:        "Profile overrides the environment",
+			args:        []string{"-config", path, "-p", "alerts"},
+			env:         map[string]string{SenderEnvVar: "env@example.com", DKIMDomEnvVar: "env.example.com"},
+			servers:     []string{"alerts1.example.com:25", "alerts2.example.com:25"},
+			from:        "alerts@example.com",
+			dkimDomain:  "env.example.com",
+			wantProfile: "alerts",
+		},
+		{
+			name:        "Flags override the profile",
+			args:        []string{"-config", path, "-p", "billing", "-f", "flag@example.com"},
+			servers:     []string{"billing.example.com:587"},
+			from:        "flag@example.com",
+			user:        "billing",
+			requireTLS:  true,
+			dkimDomain:  "example.com",
+			wantProfile: "billing",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lookupEnv := func(name string) (string, bool) {
+				value, ok := tt.env[name]
+				return value, ok
+			}
+			cfg, err := Parse(tt.args, lookupEnv)
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+
+			if !reflect.DeepEqual(cfg.SmtpAddrs, tt.servers) {
+				t.Errorf("SmtpAddrs = %v, want %v", cfg.SmtpAddrs, tt.servers)
+			}
+			if cfg.FromAddr != tt.from || cfg.AuthUser != tt.user || cfg.RequireTLS != tt.requireTLS || cfg.DKIMDomain != tt.dkimDomain {
+				t.Errorf("FromAddr = %q, AuthUser = %q, RequireTLS = %v, DKIMDomain = %q, want %q, %q, %v, %q",
+					cfg.FromAddr, cfg.AuthUser, cfg.RequireTLS, cfg.DKIMDomain, tt.from, tt.user, tt.requireTLS, tt.dkimDomain)
+			}
+			if cfg.Profile != tt.wantProfile {
+				t.Errorf("Profile = %q, want %q", cfg.Profile, tt.wantProfile)
+			}
+		})
+	}
+}
+
+func TestProfileErrors(t *testing.T) {
+	noEnv := func(string) (string, bool) { return "", false }
+	tests := []struct {
+		name    string
+		content string
+		args    []string
+	}{
+		{"unknown profile", "[billing]\nservers = billing.example.com:25\n", []string{"-p", "alerts"}},
+		{"empty name", "[ ]\nservers = billing.example.com:25\n", nil},
+		{"selected within a profile", "[billing]\nprofile = alerts\n", nil},
+		{"unknown setting in a profile", "[billing]\ncolour = blue\n", []string{"-p", "billing"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"-config", writeConfigFile(t, tt.content)}, tt.args...)
+			if _, err := Parse(args, noEnv); err == nil {
+				t.Error("Parse() should fail")
+			}
+		})
+	}
+
+	// Profiles live in the configuration file
+	if _, err := os.Stat(DefaultConfigFile); os.IsNotExist(err) {
+		cfg := &Config{Profile: "billing", lookupEnv: noEnv}
+		if err := cfg.parseFile(); err == nil {
+			t.Error("parseFile() should fail on a profile without a configuration file")
+		}
+	}
+}
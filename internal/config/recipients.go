@@ -0,0 +1,43 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"net/mail"
+	"os"
+	"strings"
+)
+
+// loadRecipientsFile adds the recipients listed in RecipientsFile, one
+// address per line, to those given so far. Blank lines and lines starting
+// with # are skipped, as are addresses already listed.
+func (cfg *Config) loadRecipientsFile() error {
+	f, err := os.Open(cfg.RecipientsFile)
+	if err != nil {
+		return fmt.Errorf("cannot read recipients file: %w", err)
+	}
+	defer f.Close()
+
+	seen := map[string]bool{}
+	for _, rcpt := range cfg.Recipients {
+		seen[rcpt] = true
+	}
+
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rcpt, err := mail.ParseAddress(line)
+		if err != nil {
+			return fmt.Errorf("%s:%d: invalid recipient address %q: %w", cfg.RecipientsFile, lineNo, line, err)
+		}
+		if !seen[rcpt.Address] {
+			seen[rcpt.Address] = true
+			cfg.Recipients = append(cfg.Recipients, rcpt.Address)
+		}
+	}
+	return scanner.Err()
+}
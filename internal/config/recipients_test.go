@@ -0,0 +1,90 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadRecipientsFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		given    []string
+		expected []string
+		wantErr  string
+	}{
+		{
+			name:     "Comments and blank lines",
+			content:  "# list members\n\na@domain.tld\n  b@domain.tld  \n\n# former members\n",
+			expected: []string{"a@domain.tld", "b@domain.tld"},
+		},
+		{
+			name:     "Display names and duplicates",
+			content:  "A <a@domain.tld>\nb@domain.tld\na@domain.tld\nc@domain.tld\n",
+			given:    []string{"c@domain.tld"},
+			expected: []string{"c@domain.tld", "a@domain.tld", "b@domain.tld"},
+		},
+		{
+			name:    "Bad address",
+			content: "a@domain.tld\n# next one is broken\nnot-an-address\n",
+			wantErr: ":3: invalid recipient address \"not-an-address\"",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "recipients")
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatalf("Failed to write recipients file: %v", err)
+			}
+
+			cfg := &Config{RecipientsFile: path, Recipients: tt.given}
+			err := cfg.loadRecipientsFile()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadRecipientsFile() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadRecipientsFile() error = %v", err)
+			}
+			if !reflect.DeepEqual(cfg.Recipients, tt.expected) {
+				t.Errorf("Recipients = %v, want %v", cfg.Recipients, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRecipientsFileFlag(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recipients")
+	if err := os.WriteFile(path, []byte("a@domain.tld\nb@domain.tld\n"), 0644); err != nil {
+		t.Fatalf("Failed to write recipients file: %v", err)
+	}
+
+	args := []string{"-R", path, "-to", "b@domain.tld", "-f", "sender@domain.tld"}
+	env := func(name string) (string, bool) {
+		if name == MailRelayEnvVar {
+			return "smtp.example.com:25", true
+		}
+		return "", false
+	}
+	cfg, err := Parse(args, env)
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	// Recipients given with -to come first and are not repeated
+	expected := []string{"b@domain.tld", "a@domain.tld"}
+	if !reflect.DeepEqual(cfg.Recipients, expected) {
+		t.Errorf("Recipients = %v, want %v", cfg.Recipients, expected)
+	}
+
+	cfg = &Config{SmtpAddrs: []string{"smtp.example.com:25"}, RecipientsFile: filepath.Join(t.TempDir(), "missing")}
+	if err := cfg.Prepare(); err == nil {
+		t.Error("Prepare() should fail on a missing recipients file")
+	}
+}
@@ -0,0 +1,92 @@
+package config
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// loadClientCert loads the client certificate and its private key, which
+// must be given together and match
+func (cfg *Config) loadClientCert() error {
+	if cfg.ClientCertPath == "" || cfg.ClientKeyPath == "" {
+		return fmt.Errorf("a client certificate requires both %s and %s", CertEnvVar, KeyEnvVar)
+	}
+
+	cert, err := tls.LoadX509KeyPair(cfg.ClientCertPath, cfg.ClientKeyPath)
+	if err != nil {
+		return fmt.Errorf("cannot load client certificate %s with key %s: %w", cfg.ClientCertPath, cfg.ClientKeyPath, err)
+	}
+	cfg.ClientCert = &cert
+	return nil
+}
+
+// parseFingerprint decodes a SHA-256 fingerprint given in hex, optionally
+// separated by colons, or in base64, and returns it as lowercase hex
+func parseFingerprint(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if sum, err := hex.DecodeString(strings.ReplaceAll(s, ":", "")); err == nil && len(sum) == sha256.Size {
+		return hex.EncodeToString(sum), nil
+	}
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding} {
+		if sum, err := enc.DecodeString(s); err == nil && len(sum) == sha256.Size {
+			return hex.EncodeToString(sum), nil
+		}
+	}
+	return "", fmt.Errorf("invalid certificate fingerprint %q, expected a SHA-256 hash in hex or base64", s)
+}
+
+// tlsVersions are the TLS versions by the names they are configured with
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSVersion reads a TLS version given as 1.2 or TLS1.2
+func parseTLSVersion(s string) (uint16, error) {
+	name := strings.TrimSpace(s)
+	if len(name) > 3 && strings.EqualFold(name[:3], "tls") {
+		name = strings.TrimSpace(name[3:])
+	}
+	version, ok := tlsVersions[name]
+	if !ok {
+		return 0, fmt.Errorf("invalid TLS version %q, expected 1.0, 1.1, 1.2 or 1.3", s)
+	}
+	return version, nil
+}
+
+// formatTLSVersion returns the name of a TLS version as it is configured
+func formatTLSVersion(version uint16) string {
+	for name, v := range tlsVersions {
+		if v == version {
+			return name
+		}
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+// tlsVersionFlag is a flag.Value parsing a TLS version
+type tlsVersionFlag struct {
+	version *uint16
+}
+
+func (f tlsVersionFlag) String() string {
+	if f.version == nil || *f.version == 0 {
+		return ""
+	}
+	return formatTLSVersion(*f.version)
+}
+
+func (f tlsVersionFlag) Set(value string) error {
+	version, err := parseTLSVersion(value)
+	if err != nil {
+		return err
+	}
+	*f.version = version
+	return nil
+}
@@ -0,0 +1,169 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeKeyPair writes a self-signed certificate and its key as PEM files
+func writeKeyPair(t *testing.T, dir, name string) (certPath, keyPath string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+
+	certPath = filepath.Join(dir, name+".crt")
+	keyPath = filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+func TestLoadClientCert(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeKeyPair(t, dir, "client")
+	_, otherKeyPath := writeKeyPair(t, dir, "other")
+
+	tests := []struct {
+		name     string
+		certPath string
+		keyPath  string
+		wantErr  bool
+	}{
+		{"matching pair", certPath, keyPath, false},
+		{"mismatched key", certPath, otherKeyPath, true},
+		{"missing key path", certPath, "", true},
+		{"missing certificate path", "", keyPath, true},
+		{"missing file", filepath.Join(dir, "missing.crt"), keyPath, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{ClientCertPath: tt.certPath, ClientKeyPath: tt.keyPath}
+			err := cfg.loadClientCert()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadClientCert() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if cfg.ClientCert == nil || len(cfg.ClientCert.Certificate) != 1 {
+				t.Errorf("loadClientCert() certificate = %v", cfg.ClientCert)
+			}
+		})
+	}
+}
+
+func TestParseFingerprint(t *testing.T) {
+	const want = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+
+	tests := []struct {
+		name    string
+		input   string
+		wantErr bool
+	}{
+		{"hex", want, false},
+		{"uppercase hex with colons", "9F:86:D0:81:88:4C:7D:65:9A:2F:EA:A0:C5:5A:D0:15:A3:BF:4F:1B:2B:0B:82:2C:D1:5D:6C:15:B0:F0:0A:08", false},
+		{"base64", "n4bQgYhMfWWaL+qgxVrQFaO/TxsrC4Is0V1sFbDwCgg=", false},
+		{"unpadded base64", "n4bQgYhMfWWaL+qgxVrQFaO/TxsrC4Is0V1sFbDwCgg", false},
+		{"too short", "9f86d081884c7d65", true},
+		{"garbage", "not a fingerprint", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseFingerprint(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseFingerprint() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != want {
+				t.Errorf("parseFingerprint() = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestParseTLSVersion(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    uint16
+		wantErr bool
+	}{
+		{"1.0", tls.VersionTLS10, false},
+		{"1.2", tls.VersionTLS12, false},
+		{"TLS1.3", tls.VersionTLS13, false},
+		{" tls 1.1 ", tls.VersionTLS11, false},
+		{"1.4", 0, true},
+		{"SSL3", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := parseTLSVersion(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTLSVersion() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseTLSVersion() = %x, want %x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTLSVersionRange(t *testing.T) {
+	tests := []struct {
+		name     string
+		min, max uint16
+		wantMin  uint16
+		wantErr  bool
+	}{
+		{"Secure default", 0, 0, tls.VersionTLS12, false},
+		{"TLS 1.3 only", tls.VersionTLS13, tls.VersionTLS13, tls.VersionTLS13, false},
+		{"Legacy range", tls.VersionTLS10, tls.VersionTLS11, tls.VersionTLS10, false},
+		{"Maximum below the default minimum", 0, tls.VersionTLS11, 0, true},
+		{"Maximum below the minimum", tls.VersionTLS13, tls.VersionTLS12, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{SmtpAddrs: []string{"smtp.example.com:25"}, MinTLSVersion: tt.min, MaxTLSVersion: tt.max}
+			err := cfg.validateSettings()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateSettings() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && cfg.MinTLSVersion != tt.wantMin {
+				t.Errorf("MinTLSVersion = %x, want %x", cfg.MinTLSVersion, tt.wantMin)
+			}
+		})
+	}
+}
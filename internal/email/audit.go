@@ -0,0 +1,154 @@
+package email
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/mail"
+	"os"
+	"time"
+)
+
+// Audit results
+const (
+	AuditSent   = "sent"
+	AuditFailed = "failed"
+)
+
+// AuditRecord is a single audit log entry describing the delivery of a
+// message to one recipient
+type AuditRecord struct {
+	Timestamp string `json:"timestamp"`
+	Sender    string `json:"sender"`
+	Recipient string `json:"recipient"`
+	Server    string `json:"server"`
+	Result    string `json:"result"`
+	MessageID string `json:"message_id"`
+	Size      int    `json:"size"`
+	PrevHash  string `json:"prev_hash,omitempty"`
+	Hash      string `json:"hash,omitempty"`
+}
+
+// writeAudit appends one record per recipient to the configured audit file
+func (e *Email) writeAudit(recipients []string, server string, result *SendResult) error {
+	// Hold the lock from reading the last hash until the records are
+	// written, so that concurrent processes do not chain to the same record
+	lock, err := lockFile(e.Config.AuditFile + lockSuffix)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	f, err := os.OpenFile(e.Config.AuditFile, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	prevHash := ""
+	if e.Config.AuditHash {
+		if prevHash, err = lastAuditHash(f); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	messageID := e.messageID()
+	for _, rcpt := range recipients {
+		status := AuditSent
+		if result.Errors[rcpt] != nil {
+			status = AuditFailed
+		}
+		rec := AuditRecord{
+			Timestamp: now,
+			Sender:    e.sender(recipients),
+			Recipient: rcpt,
+			Server:    server,
+			Result:    status,
+			MessageID: messageID,
+			Size:      len(e.Body),
+		}
+		if e.Config.AuditHash {
+			rec.PrevHash = prevHash
+			rec.Hash = hashAuditRecord(rec)
+			prevHash = rec.Hash
+		}
+		line, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(append(line, '\n')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hashAuditRecord computes the SHA-256 of the record with its own hash
+// field cleared, so that it covers the previous record's hash
+func hashAuditRecord(rec AuditRecord) string {
+	rec.Hash = ""
+	data, _ := json.Marshal(rec)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// lastAuditHash returns the hash of the last record in the audit file
+func lastAuditHash(f *os.File) (string, error) {
+	last, err := lastLine(f)
+	if err != nil || last == nil {
+		return "", err
+	}
+	var rec AuditRecord
+	if err := json.Unmarshal(last, &rec); err != nil {
+		return "", err
+	}
+	return rec.Hash, nil
+}
+
+// auditChunk is the size of the blocks read backwards to find the last line
+const auditChunk = 4096
+
+// lastLine returns the last non-empty line of the file, reading backwards
+// from its end so that large audit files are not scanned whole
+func lastLine(f *os.File) ([]byte, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var buf []byte
+	for offset := info.Size(); offset > 0; {
+		n := int64(auditChunk)
+		if n > offset {
+			n = offset
+		}
+		offset -= n
+		chunk := make([]byte, n)
+		if _, err := f.ReadAt(chunk, offset); err != nil {
+			return nil, err
+		}
+		buf = append(chunk, buf...)
+
+		// The line is complete once a newline precedes it
+		trimmed := bytes.TrimRight(buf, " \t\r\n")
+		if i := bytes.LastIndexByte(trimmed, '\n'); i >= 0 {
+			return bytes.TrimSpace(trimmed[i+1:]), nil
+		}
+	}
+
+	if last := bytes.TrimSpace(buf); len(last) > 0 {
+		return last, nil
+	}
+	return nil, nil
+}
+
+// messageID returns the Message-ID header of the email, if any
+func (e *Email) messageID() string {
+	msg, err := mail.ReadMessage(bytes.NewReader(e.Body))
+	if err != nil {
+		return ""
+	}
+	return msg.Header.Get("Message-Id")
+}
@@ -0,0 +1,229 @@
+package email
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+)
+
+func readAuditRecords(t *testing.T, path string) []AuditRecord {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open audit file: %v", err)
+	}
+	defer f.Close()
+
+	var records []AuditRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("Invalid audit record %q: %v", scanner.Text(), err)
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+func TestAuditRecordPerRecipient(t *testing.T) {
+	auditFile := filepath.Join(t.TempDir(), "audit.log")
+	body := "Message-ID: <abc@example.com>\nTo: a@domain.tld\n\nhello"
+
+	cfg := &config.Config{
+		FromAddr:   testFromAddr,
+		SmtpAddrs:  []string{testSMTPAddr},
+		Recipients: []string{"a@domain.tld", "b@domain.tld", "c@domain.tld"},
+		AuditFile:  auditFile,
+	}
+
+	email := &Email{
+		Config: cfg,
+		Body:   []byte(body),
+	}
+
+	if _, err := email.sendWithDialer(context.Background(), createMockDialer(NewMockSMTPClient(), false)); err != nil {
+		t.Fatalf("sendWithDialer() failed unexpectedly: %v", err)
+	}
+
+	records := readAuditRecords(t, auditFile)
+	if len(records) != len(cfg.Recipients) {
+		t.Fatalf("Expected %d audit records, got %d", len(cfg.Recipients), len(records))
+	}
+
+	for i, rec := range records {
+		if rec.Timestamp == "" {
+			t.Errorf("Record %d has no timestamp", i)
+		}
+		if rec.Sender != testFromAddr {
+			t.Errorf("Record %d sender = %q, want %q", i, rec.Sender, testFromAddr)
+		}
+		if rec.Recipient != cfg.Recipients[i] {
+			t.Errorf("Record %d recipient = %q, want %q", i, rec.Recipient, cfg.Recipients[i])
+		}
+		if rec.Server != testSMTPAddr {
+			t.Errorf("Record %d server = %q, want %q", i, rec.Server, testSMTPAddr)
+		}
+		if rec.Result != AuditSent {
+			t.Errorf("Record %d result = %q, want %q", i, rec.Result, AuditSent)
+		}
+		if rec.MessageID != "<abc@example.com>" {
+			t.Errorf("Record %d message-id = %q", i, rec.MessageID)
+		}
+		if rec.Size != len(body) {
+			t.Errorf("Record %d size = %d, want %d", i, rec.Size, len(body))
+		}
+		if rec.Hash != "" || rec.PrevHash != "" {
+			t.Errorf("Record %d should not be hashed", i)
+		}
+	}
+}
+
+func TestAuditRecordFailure(t *testing.T) {
+	auditFile := filepath.Join(t.TempDir(), "audit.log")
+
+	cfg := &config.Config{
+		FromAddr:   testFromAddr,
+		SmtpAddrs:  []string{testSMTPAddr},
+		Recipients: []string{"a@domain.tld"},
+		AuditFile:  auditFile,
+	}
+
+	email := &Email{
+		Config: cfg,
+		Body:   []byte("test email body"),
+	}
+
+	if _, err := email.sendWithDialer(context.Background(), createMockDialer(NewMockSMTPClient(), true)); err == nil {
+		t.Fatal("sendWithDialer() should fail when dialing fails")
+	}
+
+	records := readAuditRecords(t, auditFile)
+	if len(records) != 1 || records[0].Result != AuditFailed {
+		t.Errorf("Expected a single failed audit record, got %+v", records)
+	}
+}
+
+func TestAuditHashChain(t *testing.T) {
+	auditFile := filepath.Join(t.TempDir(), "audit.log")
+
+	cfg := &config.Config{
+		FromAddr:   testFromAddr,
+		SmtpAddrs:  []string{testSMTPAddr},
+		Recipients: []string{"a@domain.tld", "b@domain.tld"},
+		AuditFile:  auditFile,
+		AuditHash:  true,
+	}
+
+	email := &Email{
+		Config: cfg,
+		Body:   []byte("test email body"),
+	}
+
+	// Send twice so the chain continues across invocations
+	for i := 0; i < 2; i++ {
+		if _, err := email.sendWithDialer(context.Background(), createMockDialer(NewMockSMTPClient(), false)); err != nil {
+			t.Fatalf("sendWithDialer() failed unexpectedly: %v", err)
+		}
+	}
+
+	records := readAuditRecords(t, auditFile)
+	if len(records) != 4 {
+		t.Fatalf("Expected 4 audit records, got %d", len(records))
+	}
+
+	prevHash := ""
+	for i, rec := range records {
+		if rec.PrevHash != prevHash {
+			t.Errorf("Record %d prev_hash = %q, want %q", i, rec.PrevHash, prevHash)
+		}
+		if rec.Hash != hashAuditRecord(rec) {
+			t.Errorf("Record %d hash does not match its contents", i)
+		}
+		prevHash = rec.Hash
+	}
+}
+
+func TestAuditHashChainConcurrent(t *testing.T) {
+	auditFile := filepath.Join(t.TempDir(), "audit.log")
+
+	const sends = 10
+	var wg sync.WaitGroup
+	for i := 0; i < sends; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			email := &Email{
+				Config: &config.Config{
+					FromAddr:   testFromAddr,
+					SmtpAddrs:  []string{testSMTPAddr},
+					Recipients: []string{"a@domain.tld", "b@domain.tld"},
+					AuditFile:  auditFile,
+					AuditHash:  true,
+				},
+				Body: []byte("test email body"),
+			}
+			if _, err := email.sendWithDialer(context.Background(), createMockDialer(NewMockSMTPClient(), false)); err != nil {
+				t.Errorf("sendWithDialer() failed unexpectedly: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	records := readAuditRecords(t, auditFile)
+	if len(records) != 2*sends {
+		t.Fatalf("Expected %d audit records, got %d", 2*sends, len(records))
+	}
+	prevHash := ""
+	for i, rec := range records {
+		if rec.PrevHash != prevHash {
+			t.Fatalf("Record %d prev_hash = %q, want %q", i, rec.PrevHash, prevHash)
+		}
+		prevHash = rec.Hash
+	}
+}
+
+func TestLastLine(t *testing.T) {
+	long := strings.Repeat("x", 3*auditChunk)
+
+	tests := []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		{"Empty file", "", ""},
+		{"Single line without newline", "first", "first"},
+		{"Trailing newline", "first\nsecond\n", "second"},
+		{"Trailing blank lines", "first\nsecond\n\n \n", "second"},
+		{"Line longer than a chunk", "first\n" + long + "\n", long},
+		{"Short line after a long one", long + "\nlast\n", "last"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.log")
+			if err := os.WriteFile(path, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			got, err := lastLine(f)
+			if err != nil {
+				t.Fatalf("lastLine() failed: %v", err)
+			}
+			if string(got) != tt.expected {
+				t.Errorf("lastLine() = %.20q, want %.20q", got, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package email
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/smtp"
+	"os"
+	"strings"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+)
+
+// errPlaintextAuth is returned when a password would be sent over a
+// connection without TLS
+var errPlaintextAuth = errors.New("refusing to send the password over a connection without TLS")
+
+// ErrTokenRejected is returned when the server refuses the OAuth2 token
+var ErrTokenRejected = errors.New("OAuth2 token rejected, it may have expired")
+
+// chooseAuth picks the first mechanism of the preference list the server
+// advertises, the first one when the server advertises none. With a token
+// configured, XOAUTH2 is preferred by default.
+func chooseAuth(c SMTPClient, cfg *config.Config, host string) (smtp.Auth, error) {
+	preferred := cfg.AuthMechanisms
+	if len(preferred) == 0 {
+		preferred = config.DefaultAuthMechanisms
+		if cfg.OAuthToken != "" || cfg.OAuthTokenFile != "" {
+			preferred = []string{config.AuthXOAUTH2}
+		}
+	}
+
+	mechanism := preferred[0]
+	if ok, params := c.Extension("AUTH"); ok {
+		advertised := map[string]bool{}
+		for _, m := range strings.Fields(params) {
+			advertised[strings.ToUpper(m)] = true
+		}
+		mechanism = ""
+		for _, m := range preferred {
+			if advertised[m] {
+				mechanism = m
+				break
+			}
+		}
+		if mechanism == "" {
+			return nil, fmt.Errorf("server offers AUTH %s, none of %s", params, strings.Join(preferred, ","))
+		}
+	}
+
+	switch mechanism {
+	case config.AuthCRAMMD5:
+		return smtp.CRAMMD5Auth(cfg.AuthUser, cfg.AuthPassword), nil
+	case config.AuthLogin:
+		return tlsOnlyAuth{&loginAuth{username: cfg.AuthUser, password: cfg.AuthPassword}}, nil
+	case config.AuthXOAUTH2:
+		token, err := oauthToken(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return tlsOnlyAuth{&xoauth2Auth{username: cfg.AuthUser, token: token}}, nil
+	default:
+		return tlsOnlyAuth{smtp.PlainAuth("", cfg.AuthUser, cfg.AuthPassword, host)}, nil
+	}
+}
+
+// tlsOnlyAuth refuses to start mechanisms sending the password in the
+// clear unless the connection uses TLS, unlike net/smtp which trusts
+// localhost
+type tlsOnlyAuth struct {
+	smtp.Auth
+}
+
+func (a tlsOnlyAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS {
+		return "", nil, errPlaintextAuth
+	}
+	return a.Auth.Start(server)
+}
+
+// loginAuth implements the LOGIN mechanism, answering the username and
+// password prompts of the server in turn
+type loginAuth struct {
+	username, password string
+	step               int
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	a.step = 0
+	return config.AuthLogin, nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	a.step++
+	switch a.step {
+	case 1:
+		return []byte(a.username), nil
+	case 2:
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected LOGIN challenge %q", fromServer)
+}
+
+// oauthToken returns the configured OAuth2 token, reading the token file
+// when set so that refreshed tokens are picked up
+func oauthToken(cfg *config.Config) (string, error) {
+	if cfg.OAuthTokenFile == "" {
+		if cfg.OAuthToken == "" {
+			return "", errors.New("XOAUTH2 needs a token, set token in the auth file or pass -oauth-token-file")
+		}
+		return cfg.OAuthToken, nil
+	}
+	data, err := os.ReadFile(cfg.OAuthTokenFile)
+	if err != nil {
+		return "", fmt.Errorf("cannot read OAuth2 token: %w", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("OAuth2 token file %s is empty", cfg.OAuthTokenFile)
+	}
+	return token, nil
+}
+
+// xoauth2Auth implements the XOAUTH2 mechanism, sending the user and bearer
+// token in the initial response
+type xoauth2Auth struct {
+	username, token string
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	return config.AuthXOAUTH2, xoauth2Response(a.username, a.token), nil
+}
+
+// Next turns the error challenge of a server refusing the token into an
+// error, which cancels the exchange
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	var status struct {
+		Status string `json:"status"`
+	}
+	if json.Unmarshal(fromServer, &status) == nil && status.Status != "" {
+		return nil, fmt.Errorf("%w (status %s)", ErrTokenRejected, status.Status)
+	}
+	return nil, fmt.Errorf("%w: %s", ErrTokenRejected, fromServer)
+}
+
+// xoauth2Response builds the XOAUTH2 initial client response, base64
+// encoded by net/smtp on the wire
+func xoauth2Response(username, token string) []byte {
+	return []byte("user=" + username + "\x01auth=Bearer " + token + "\x01\x01")
+}
@@ -0,0 +1,178 @@
+package email
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+)
+
+func TestChooseAuth(t *testing.T) {
+	tests := []struct {
+		name       string
+		advertised *string
+		preferred  []string
+		expected   string
+		wantErr    bool
+	}{
+		{"Default preference", ptr("PLAIN LOGIN CRAM-MD5"), nil, "CRAM-MD5", false},
+		{"Default preference without CRAM-MD5", ptr("LOGIN PLAIN"), nil, "PLAIN", false},
+		{"Configured preference", ptr("PLAIN LOGIN CRAM-MD5"), []string{"LOGIN", "PLAIN"}, "LOGIN", false},
+		{"Lowercase advertisement", ptr("login"), nil, "LOGIN", false},
+		{"Nothing in common", ptr("GSSAPI NTLM"), nil, "", true},
+		{"Preference not advertised", ptr("PLAIN"), []string{"CRAM-MD5"}, "", true},
+		{"No advertisement", nil, []string{"LOGIN", "PLAIN"}, "LOGIN", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockClient := NewMockSMTPClient()
+			if tt.advertised != nil {
+				mockClient.Extensions = map[string]string{"AUTH": *tt.advertised}
+			}
+			cfg := &config.Config{AuthUser: "user", AuthPassword: "secret", AuthMechanisms: tt.preferred}
+
+			auth, err := chooseAuth(mockClient, cfg, "smtp.example.com")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("chooseAuth() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			mechanism, _, err := auth.Start(&smtp.ServerInfo{Name: "smtp.example.com", TLS: true})
+			if err != nil {
+				t.Fatalf("Start() failed: %v", err)
+			}
+			if mechanism != tt.expected {
+				t.Errorf("chooseAuth() mechanism = %s, want %s", mechanism, tt.expected)
+			}
+		})
+	}
+}
+
+func TestChooseAuthWithoutTLS(t *testing.T) {
+	tests := []struct {
+		mechanism string
+		wantErr   bool
+	}{
+		{"PLAIN", true},
+		{"LOGIN", true},
+		{"CRAM-MD5", false},
+	}
+
+	for _, tt := range tests {
+		mockClient := NewMockSMTPClient()
+		mockClient.Extensions = map[string]string{"AUTH": tt.mechanism}
+		cfg := &config.Config{AuthUser: "user", AuthPassword: "secret"}
+
+		auth, err := chooseAuth(mockClient, cfg, "localhost")
+		if err != nil {
+			t.Fatalf("chooseAuth() failed: %v", err)
+		}
+		// Not even localhost gets the password in the clear
+		_, _, err = auth.Start(&smtp.ServerInfo{Name: "localhost"})
+		if tt.wantErr != errors.Is(err, errPlaintextAuth) {
+			t.Errorf("%s Start() without TLS error = %v, wantErr %v", tt.mechanism, err, tt.wantErr)
+		}
+	}
+}
+
+func TestLoginAuth(t *testing.T) {
+	auth := &loginAuth{username: "user", password: "secret"}
+	if mechanism, resp, err := auth.Start(&smtp.ServerInfo{TLS: true}); mechanism != "LOGIN" || resp != nil || err != nil {
+		t.Fatalf("Start() = %q, %q, %v", mechanism, resp, err)
+	}
+
+	for _, step := range []struct{ challenge, expected string }{
+		{"Username:", "user"},
+		{"Password:", "secret"},
+	} {
+		resp, err := auth.Next([]byte(step.challenge), true)
+		if err != nil || string(resp) != step.expected {
+			t.Errorf("Next(%q) = %q, %v, want %q", step.challenge, resp, err, step.expected)
+		}
+	}
+	if _, err := auth.Next([]byte("More:"), true); err == nil {
+		t.Error("Next() should fail on a third challenge")
+	}
+	if resp, err := auth.Next(nil, false); resp != nil || err != nil {
+		t.Errorf("Next() after success = %q, %v", resp, err)
+	}
+}
+
+func ptr(s string) *string {
+	return &s
+}
+
+func TestXOAUTH2Response(t *testing.T) {
+	// The example of the Gmail XOAUTH2 documentation
+	resp := xoauth2Response("someuser@example.com", "ya29.vF9dft4qmTc2Nvb3RlckBhdHRhdmlzdGEuY29tCg")
+	expected := "dXNlcj1zb21ldXNlckBleGFtcGxlLmNvbQFhdXRoPUJlYXJlciB5YTI5LnZGOWRmdDRxbVRjMk52YjNSbGNrQmhkSFJoZG1semRHRXVZMjl0Q2cBAQ=="
+	if got := base64.StdEncoding.EncodeToString(resp); got != expected {
+		t.Errorf("xoauth2Response() = %s, want %s", got, expected)
+	}
+}
+
+func TestXOAUTH2Auth(t *testing.T) {
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	if err := os.WriteFile(tokenFile, []byte("file-token\n"), 0600); err != nil {
+		t.Fatalf("Failed to write token: %v", err)
+	}
+	emptyFile := filepath.Join(dir, "empty")
+	if err := os.WriteFile(emptyFile, nil, 0600); err != nil {
+		t.Fatalf("Failed to write token: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		token     string
+		tokenFile string
+		expected  string
+		wantErr   bool
+	}{
+		{"Token from the auth file", "auth-token", "", "user=user\x01auth=Bearer auth-token\x01\x01", false},
+		{"Token file", "", tokenFile, "user=user\x01auth=Bearer file-token\x01\x01", false},
+		{"Empty token file", "", emptyFile, "", true},
+		{"Missing token file", "", filepath.Join(dir, "missing"), "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockClient := NewMockSMTPClient()
+			mockClient.Extensions = map[string]string{"AUTH": "PLAIN LOGIN XOAUTH2"}
+			cfg := &config.Config{AuthUser: "user", OAuthToken: tt.token, OAuthTokenFile: tt.tokenFile}
+
+			auth, err := chooseAuth(mockClient, cfg, "smtp.example.com")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("chooseAuth() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			mechanism, resp, err := auth.Start(&smtp.ServerInfo{Name: "smtp.example.com", TLS: true})
+			if err != nil || mechanism != "XOAUTH2" || string(resp) != tt.expected {
+				t.Errorf("Start() = %s, %q, %v, want XOAUTH2, %q", mechanism, resp, err, tt.expected)
+			}
+			if _, _, err := auth.Start(&smtp.ServerInfo{Name: "smtp.example.com"}); !errors.Is(err, errPlaintextAuth) {
+				t.Errorf("Start() without TLS error = %v, want the token kept off plaintext", err)
+			}
+		})
+	}
+}
+
+func TestXOAUTH2Rejected(t *testing.T) {
+	auth := &xoauth2Auth{username: "user", token: "expired"}
+	_, err := auth.Next([]byte(`{"status":"401","schemes":"bearer","scope":"https://mail.google.com/"}`), true)
+	if !errors.Is(err, ErrTokenRejected) || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Next() error = %v, want the rejected token with its status", err)
+	}
+	if resp, err := auth.Next(nil, false); resp != nil || err != nil {
+		t.Errorf("Next() after success = %q, %v", resp, err)
+	}
+}
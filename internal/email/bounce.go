@@ -0,0 +1,159 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/textproto"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// enhancedStatus matches the enhanced status code starting a server reply
+// (RFC 3463)
+var enhancedStatus = regexp.MustCompile(`^[245]\.\d{1,3}\.\d{1,3}\b`)
+
+// failedPermanently reports whether the send failed in a way retrying will
+// not fix, including messages whose retry schedule is exhausted
+func failedPermanently(err error) bool {
+	var deliveryErr *DeliveryError
+	return errors.As(err, &deliveryErr) && deliveryErr.Kind != TemporaryFailure
+}
+
+// bounce reports the failure of the send to the envelope sender, appending
+// the notification to the bounce mailbox or sending it through the
+// servers. Messages from the null sender are never bounced, so that
+// notifications cannot loop.
+func (e *Email) bounce(ctx context.Context, dialer SMTPDialer, result *SendResult, sendErr error) error {
+	if e.Config.FromAddr == "" {
+		return nil
+	}
+
+	now := time.Now()
+	dsn, err := e.deliveryStatus(result, sendErr, now)
+	if err != nil {
+		return err
+	}
+	if e.Config.BounceMailbox != "" {
+		return appendMbox(e.Config.BounceMailbox, "", dsn, now)
+	}
+
+	// The notification has its own envelope, and none of the rules of the
+	// failed message
+	cfg := *e.Config
+	cfg.FromAddr = ""
+	cfg.Recipients = []string{e.Config.FromAddr}
+	cfg.SenderRules = nil
+	cfg.EnableVERP = false
+	notice := &Email{
+		Config:  &cfg,
+		Body:    dsn,
+		limiter: e.limiter,
+	}
+	_, err = notice.sendWithDialer(ctx, dialer)
+	return err
+}
+
+// deliveryStatus composes a delivery status notification (RFC 3464) for
+// the recipients the result does not show as accepted, returning the
+// original headers along with it
+func (e *Email) deliveryStatus(result *SendResult, sendErr error, now time.Time) ([]byte, error) {
+	var random [12]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return nil, err
+	}
+	boundary := "dsn-" + hex.EncodeToString(random[:])
+	messageID, err := newMessageID("")
+	if err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	if host == "" {
+		host = "localhost"
+	}
+
+	var failed []string
+	for _, rcpt := range e.pending(result) {
+		// The archive address stays hidden from the sender
+		if rcpt != e.Config.AlwaysBcc {
+			failed = append(failed, rcpt)
+		}
+	}
+	reason := func(rcpt string) error {
+		if result != nil && result.Errors[rcpt] != nil {
+			return result.Errors[rcpt]
+		}
+		return sendErr
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: Mail Delivery System <MAILER-DAEMON@%s>\r\n", host)
+	fmt.Fprintf(&b, "To: <%s>\r\n", e.Config.FromAddr)
+	b.WriteString("Subject: Undelivered Mail Returned to Sender\r\n")
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: %s\r\n", messageID)
+	b.WriteString("Auto-Submitted: auto-replied\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/report; report-type=delivery-status; boundary=\"%s\"\r\n", boundary)
+	b.WriteString("\r\n")
+
+	fmt.Fprintf(&b, "--%s\r\n", boundary)
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString("Your message could not be delivered to the following recipients:\r\n\r\n")
+	for _, rcpt := range failed {
+		fmt.Fprintf(&b, "<%s>: %s\r\n", rcpt, oneLine(reason(rcpt).Error()))
+	}
+	b.WriteString("\r\n")
+
+	fmt.Fprintf(&b, "--%s\r\n", boundary)
+	b.WriteString("Content-Type: message/delivery-status\r\n\r\n")
+	fmt.Fprintf(&b, "Reporting-MTA: dns; %s\r\n", host)
+	fmt.Fprintf(&b, "Arrival-Date: %s\r\n", now.Format(time.RFC1123Z))
+	for _, rcpt := range failed {
+		err := reason(rcpt)
+		fmt.Fprintf(&b, "\r\nFinal-Recipient: rfc822; %s\r\n", rcpt)
+		b.WriteString("Action: failed\r\n")
+		fmt.Fprintf(&b, "Status: %s\r\n", statusCode(err))
+		var protoErr *textproto.Error
+		if errors.As(err, &protoErr) {
+			fmt.Fprintf(&b, "Diagnostic-Code: smtp; %d %s\r\n", protoErr.Code, oneLine(protoErr.Msg))
+		}
+	}
+	b.WriteString("\r\n")
+
+	fmt.Fprintf(&b, "--%s\r\n", boundary)
+	b.WriteString("Content-Type: text/rfc822-headers\r\n\r\n")
+	lines, _, _ := splitHeader(e.Body)
+	for _, line := range lines {
+		b.WriteString(strings.TrimRight(line, "\r\n") + "\r\n")
+	}
+	fmt.Fprintf(&b, "\r\n--%s--\r\n", boundary)
+	return b.Bytes(), nil
+}
+
+// statusCode returns the enhanced status code of the failure, taken from
+// the server reply when it has one
+func statusCode(err error) string {
+	var protoErr *textproto.Error
+	if !errors.As(err, &protoErr) {
+		if classify(err) == TemporaryFailure {
+			return "4.0.0"
+		}
+		return "5.0.0"
+	}
+	class := protoErr.Code / 100
+	if code := enhancedStatus.FindString(protoErr.Msg); code != "" && int(code[0]-'0') == class {
+		return code
+	}
+	return fmt.Sprintf("%d.0.0", class)
+}
+
+// oneLine joins the lines of a multiline server reply
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
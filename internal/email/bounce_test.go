@@ -0,0 +1,157 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+)
+
+func TestDeliveryStatus(t *testing.T) {
+	email := &Email{
+		Config: &config.Config{
+			FromAddr:   testFromAddr,
+			Recipients: []string{"ok@domain.tld", "bad@domain.tld", "gone@domain.tld", "archive@domain.tld"},
+			AlwaysBcc:  "archive@domain.tld",
+		},
+		Body: []byte("Subject: Report\r\nTo: ok@domain.tld\r\n\r\nSecret body\r\n"),
+	}
+	result := &SendResult{Accepted: []string{"ok@domain.tld"}}
+	result.reject("bad@domain.tld", &textproto.Error{Code: 550, Msg: "5.1.1 User unknown"})
+	sendErr := &DeliveryError{Kind: RecipientFailure, Err: &textproto.Error{Code: 554, Msg: "Transaction failed"}}
+
+	dsn, err := email.deliveryStatus(result, sendErr, time.Now())
+	if err != nil {
+		t.Fatalf("deliveryStatus() error = %v", err)
+	}
+	msg := string(dsn)
+
+	for _, want := range []string{
+		"To: <" + testFromAddr + ">\r\n",
+		"Auto-Submitted: auto-replied\r\n",
+		"Content-Type: multipart/report; report-type=delivery-status;",
+		"Content-Type: message/delivery-status\r\n",
+		"Final-Recipient: rfc822; bad@domain.tld\r\nAction: failed\r\nStatus: 5.1.1\r\nDiagnostic-Code: smtp; 550 5.1.1 User unknown\r\n",
+		"Final-Recipient: rfc822; gone@domain.tld\r\nAction: failed\r\nStatus: 5.0.0\r\nDiagnostic-Code: smtp; 554 Transaction failed\r\n",
+		"Content-Type: text/rfc822-headers\r\n\r\nSubject: Report\r\nTo: ok@domain.tld\r\n",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("deliveryStatus() lacks %q in:\n%s", want, msg)
+		}
+	}
+	for _, unwanted := range []string{"rfc822; ok@domain.tld", "archive@domain.tld", "Secret body"} {
+		if strings.Contains(msg, unwanted) {
+			t.Errorf("deliveryStatus() holds %q in:\n%s", unwanted, msg)
+		}
+	}
+}
+
+func TestStatusCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"Enhanced code", &textproto.Error{Code: 550, Msg: "5.7.1 Relaying denied"}, "5.7.1"},
+		{"No enhanced code", &textproto.Error{Code: 554, Msg: "Rejected"}, "5.0.0"},
+		{"Mismatched class", &textproto.Error{Code: 550, Msg: "4.2.2 Mailbox full"}, "5.0.0"},
+		{"Temporary reply", &textproto.Error{Code: 452, Msg: "4.2.2 Mailbox full"}, "4.2.2"},
+		{"Network error", errors.New("connection refused"), "4.0.0"},
+		{"Null MX", errNullMX, "5.0.0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := statusCode(tt.err); got != tt.want {
+				t.Errorf("statusCode() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBounceOnFailure(t *testing.T) {
+	tests := []struct {
+		name       string
+		failWith   error
+		from       string
+		wantBounce bool
+	}{
+		{"Permanent failure", &textproto.Error{Code: 550, Msg: "5.1.1 User unknown"}, testFromAddr, true},
+		{"Temporary failure", &textproto.Error{Code: 450, Msg: "4.2.0 Try again"}, testFromAddr, false},
+		{"Null sender", &textproto.Error{Code: 550, Msg: "5.1.1 User unknown"}, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mbox := filepath.Join(t.TempDir(), "bounces")
+			mockClient := NewMockSMTPClient()
+			mockClient.ShouldFailOn = "rcpt"
+			mockClient.FailWith = tt.failWith
+			email := &Email{
+				Config: &config.Config{
+					FromAddr:        tt.from,
+					SmtpAddrs:       []string{testSMTPAddr},
+					Recipients:      []string{"bad@domain.tld"},
+					BounceOnFailure: true,
+					BounceMailbox:   mbox,
+				},
+				Body: []byte("Subject: Test\n\nBody\n"),
+			}
+
+			if _, err := email.send(context.Background(), createMockDialer(mockClient, false)); err == nil {
+				t.Fatal("send() succeeded, want an error")
+			}
+
+			data, err := os.ReadFile(mbox)
+			if !tt.wantBounce {
+				if !errors.Is(err, os.ErrNotExist) {
+					t.Errorf("bounce mailbox exists, want no bounce: %s", data)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("reading bounce mailbox: %v", err)
+			}
+			if !strings.HasPrefix(string(data), "From MAILER-DAEMON ") {
+				t.Errorf("bounce mailbox does not start with a From line: %q", data)
+			}
+			if !strings.Contains(string(data), "Final-Recipient: rfc822; bad@domain.tld\nAction: failed\nStatus: 5.1.1\n") {
+				t.Errorf("bounce lacks the failed recipient:\n%s", data)
+			}
+		})
+	}
+}
+
+func TestBounceThroughServers(t *testing.T) {
+	mockClient := NewMockSMTPClient()
+	mockClient.FailOnRecipient = "bad@domain.tld"
+	mockClient.FailWith = &textproto.Error{Code: 550, Msg: "5.1.1 User unknown"}
+	email := &Email{
+		Config: &config.Config{
+			FromAddr:        testFromAddr,
+			SmtpAddrs:       []string{testSMTPAddr},
+			Recipients:      []string{"bad@domain.tld"},
+			BounceOnFailure: true,
+		},
+		Body: []byte("Subject: Test\n\nBody\n"),
+	}
+
+	if _, err := email.send(context.Background(), createMockDialer(mockClient, false)); err == nil {
+		t.Fatal("send() succeeded, want an error")
+	}
+	if mockClient.MailFrom != "" {
+		t.Errorf("bounce sent from <%s>, want the null sender", mockClient.MailFrom)
+	}
+	if got := mockClient.RcptTo[len(mockClient.RcptTo)-1]; got != testFromAddr {
+		t.Errorf("bounce sent to %s, want %s", got, testFromAddr)
+	}
+	if !strings.Contains(string(mockClient.DataWriter.Written), "Final-Recipient: rfc822; bad@domain.tld\r\n") {
+		t.Errorf("bounce lacks the failed recipient:\n%s", mockClient.DataWriter.Written)
+	}
+}
@@ -0,0 +1,28 @@
+package email
+
+import "strings"
+
+// capabilityNames are the EHLO extensions reported in verbose mode, those
+// bearing on how the message is sent
+var capabilityNames = []string{"SIZE", "PIPELINING", "8BITMIME", "SMTPUTF8", "CHUNKING", "DSN", "ENHANCEDSTATUSCODES", "STARTTLS", "AUTH"}
+
+// capabilities lists the extensions advertised by the server in its EHLO
+// reply, with their parameters such as the AUTH mechanisms. The reply is
+// read once and kept by the client.
+func capabilities(c SMTPClient) string {
+	var caps []string
+	for _, name := range capabilityNames {
+		ok, params := c.Extension(name)
+		if !ok {
+			continue
+		}
+		if params != "" {
+			name += " " + params
+		}
+		caps = append(caps, name)
+	}
+	if len(caps) == 0 {
+		return "no extensions"
+	}
+	return strings.Join(caps, ", ")
+}
@@ -0,0 +1,71 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+)
+
+func TestCapabilities(t *testing.T) {
+	tests := []struct {
+		name       string
+		extensions map[string]string
+		expected   string
+	}{
+		{"None", nil, "no extensions"},
+		{"Parameters", map[string]string{"SIZE": "35882577", "AUTH": "PLAIN LOGIN", "PIPELINING": ""}, "SIZE 35882577, PIPELINING, AUTH PLAIN LOGIN"},
+		{"Unreported", map[string]string{"STARTTLS": "", "XCLIENT": "ADDR"}, "STARTTLS"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := NewMockSMTPClient()
+			client.Extensions = tt.extensions
+			if got := capabilities(client); got != tt.expected {
+				t.Errorf("capabilities() = %q, want %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestSendLogsCapabilities(t *testing.T) {
+	mockClient := NewMockSMTPClient()
+	mockClient.Extensions = map[string]string{
+		"SIZE":       "10240000",
+		"STARTTLS":   "",
+		"AUTH":       "PLAIN CRAM-MD5",
+		"PIPELINING": "",
+	}
+
+	for _, verbose := range []bool{false, true} {
+		var buf bytes.Buffer
+		log.SetOutput(&buf)
+		defer log.SetOutput(os.Stderr)
+
+		email := &Email{
+			Config: &config.Config{
+				FromAddr:   testFromAddr,
+				SmtpAddrs:  []string{testSMTPAddr},
+				Recipients: []string{"a@domain.tld"},
+				BeVerbose:  verbose,
+			},
+			Body: []byte("test email body"),
+		}
+		if _, err := email.sendWithDialer(context.Background(), createMockDialer(mockClient, false)); err != nil {
+			t.Fatalf("sendWithDialer() failed: %v", err)
+		}
+
+		expected := testSMTPAddr + " advertises SIZE 10240000, PIPELINING, STARTTLS, AUTH PLAIN CRAM-MD5\n"
+		if logged := strings.Contains(buf.String(), expected); logged != verbose {
+			t.Errorf("Verbose = %v, log = %q, want %q logged = %v", verbose, buf.String(), expected, verbose)
+		}
+		if verbose && !strings.Contains(buf.String(), "advertises after STARTTLS") {
+			t.Errorf("Log = %q, want the capabilities after STARTTLS", buf.String())
+		}
+	}
+}
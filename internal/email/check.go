@@ -0,0 +1,62 @@
+package email
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+)
+
+// CheckResult is the outcome of the health check of a single server
+type CheckResult struct {
+	Server  string
+	Latency time.Duration
+	Err     error
+}
+
+// Check connects to every configured server, starting TLS and
+// authenticating as for a delivery, without sending any mail
+func Check(ctx context.Context, cfg *config.Config) []CheckResult {
+	return check(ctx, cfg, smtpDialer(cfg))
+}
+
+// check allows injection of a custom dialer for testing
+func check(ctx context.Context, cfg *config.Config, dialer SMTPDialer) []CheckResult {
+	var results []CheckResult
+	for _, entry := range cfg.SmtpAddrs {
+		servers, err := serversOf(ctx, entry)
+		if err != nil {
+			results = append(results, CheckResult{Server: entry, Err: err})
+			continue
+		}
+		for _, server := range servers {
+			start := time.Now()
+			err := checkServer(ctx, cfg, server, dialer)
+			results = append(results, CheckResult{Server: server, Latency: time.Since(start), Err: err})
+		}
+	}
+	return results
+}
+
+// checkServer verifies that a single server accepts a session
+func checkServer(ctx context.Context, cfg *config.Config, server string, dialer SMTPDialer) error {
+	// Local targets only need to be writable
+	if dir, ok := strings.CutPrefix(server, config.MaildirScheme); ok {
+		return makeMaildir(dir)
+	}
+	if path, ok := strings.CutPrefix(server, config.MboxScheme); ok {
+		return makeMbox(path)
+	}
+
+	c, err := connect(ctx, cfg, server, dialer)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err := c.Noop(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
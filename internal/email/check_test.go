@@ -0,0 +1,65 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+)
+
+func TestCheck(t *testing.T) {
+	reachable := NewMockSMTPClient()
+	failing := NewMockSMTPClient()
+	failing.ShouldFailOn = "noop"
+
+	dialer := func(ctx context.Context, addr string) (SMTPClient, error) {
+		switch addr {
+		case "up.example.com:25":
+			return reachable, nil
+		case "broken.example.com:25":
+			return failing, nil
+		}
+		return nil, errors.New("mock dial error")
+	}
+
+	cfg := &config.Config{
+		SmtpAddrs: []string{"up.example.com:25", "down.example.com:25", "broken.example.com:25"},
+		AuthUser:  "user",
+	}
+
+	results := check(context.Background(), cfg, dialer)
+	if len(results) != 3 {
+		t.Fatalf("check() returned %d results, want 3", len(results))
+	}
+
+	tests := []struct {
+		server  string
+		wantErr bool
+	}{
+		{"up.example.com:25", false},
+		{"down.example.com:25", true},
+		{"broken.example.com:25", true},
+	}
+	for i, tt := range tests {
+		if results[i].Server != tt.server {
+			t.Errorf("results[%d].Server = %s, want %s", i, results[i].Server, tt.server)
+		}
+		if (results[i].Err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, wantErr %v", tt.server, results[i].Err, tt.wantErr)
+		}
+	}
+
+	// A healthy server gets the full session without any mail
+	for _, method := range []string{"StartTLS", "Auth", "Noop", "Quit"} {
+		if reachable.MethodCallCount[method] != 1 {
+			t.Errorf("Expected %s to be called once, got %d", method, reachable.MethodCallCount[method])
+		}
+	}
+	if reachable.MethodCallCount["Mail"] != 0 {
+		t.Error("Mail should not be called during a health check")
+	}
+	if failing.MethodCallCount["Close"] != 1 {
+		t.Error("Connection should be closed after a failed check")
+	}
+}
@@ -0,0 +1,69 @@
+package email
+
+import (
+	"bytes"
+	"strconv"
+)
+
+// ChunkSender is implemented by clients able to send the message data in
+// BDAT chunks to servers advertising CHUNKING (RFC 3030)
+type ChunkSender interface {
+	Bdat(chunk []byte, last bool) error
+}
+
+// bdatChunkSize is the size of the BDAT chunks the message is split into
+const bdatChunkSize = 64 * 1024
+
+// Bdat sends a chunk of the message data, the last one completing the
+// message, and waits for the server to accept it
+func (r *RealSMTPClient) Bdat(chunk []byte, last bool) error {
+	cmd := "BDAT " + strconv.Itoa(len(chunk))
+	if last {
+		cmd += " LAST"
+	}
+
+	id := r.Text.Next()
+	r.Text.StartRequest(id)
+	err := r.Text.PrintfLine("%s", cmd)
+	if err == nil {
+		if _, err = r.Text.W.Write(chunk); err == nil {
+			err = r.Text.W.Flush()
+		}
+	}
+	r.Text.EndRequest(id)
+	if err != nil {
+		return err
+	}
+
+	r.Text.StartResponse(id)
+	defer r.Text.EndResponse(id)
+	_, _, err = r.Text.ReadResponse(250)
+	return err
+}
+
+// sendChunks sends the message data with BDAT commands of at most
+// bdatChunkSize bytes. Unlike DATA, the data is sent as is, so lines must
+// end in CRLF and no dot-stuffing is needed.
+func (e *Email) sendChunks(c ChunkSender, data []byte) error {
+	data = toCRLF(data)
+	for len(data) > bdatChunkSize {
+		if err := c.Bdat(data[:bdatChunkSize], false); err != nil {
+			return err
+		}
+		data = data[bdatChunkSize:]
+	}
+	return c.Bdat(data, true)
+}
+
+// toCRLF ends every line of the message with CRLF, including the last one
+// as the DATA writer of net/smtp does
+func toCRLF(body []byte) []byte {
+	lines := bytes.Split(bytes.TrimSuffix(body, []byte("\n")), []byte("\n"))
+	var b bytes.Buffer
+	b.Grow(len(body) + len(lines) + 1)
+	for _, line := range lines {
+		b.Write(bytes.TrimSuffix(line, []byte("\r")))
+		b.WriteString("\r\n")
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,167 @@
+package email
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+)
+
+func TestToCRLF(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		expected string
+	}{
+		{"LF", "Subject: a\n\nbody\n", "Subject: a\r\n\r\nbody\r\n"},
+		{"CRLF", "Subject: a\r\n\r\nbody\r\n", "Subject: a\r\n\r\nbody\r\n"},
+		{"Mixed", "Subject: a\r\n\nbody", "Subject: a\r\n\r\nbody\r\n"},
+		{"Lone dot kept", "body\n.\nmore\n", "body\r\n.\r\nmore\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(toCRLF([]byte(tt.body))); got != tt.expected {
+				t.Errorf("toCRLF() = %q, want %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestSendChunking(t *testing.T) {
+	// Lines of 98 bytes plus CRLF make chunk boundaries easy to count
+	line := strings.Repeat("x", 98) + "\n"
+	large := strings.Repeat(line, 2*bdatChunkSize/100+10)
+	exact := strings.Repeat(line, bdatChunkSize/100) + strings.Repeat("y", bdatChunkSize%100-2) + "\n"
+
+	tests := []struct {
+		name       string
+		extensions map[string]string
+		body       string
+		expected   []string // BDAT commands
+	}{
+		{"Without CHUNKING", nil, "Subject: a\n\nbody", nil},
+		{"Single chunk", map[string]string{"CHUNKING": ""}, "Subject: a\n\nbody", []string{"BDAT 20 LAST"}},
+		{"Exactly one chunk", map[string]string{"CHUNKING": ""}, exact, []string{fmt.Sprintf("BDAT %d LAST", bdatChunkSize)}},
+		{"Several chunks", map[string]string{"CHUNKING": ""}, large, []string{
+			fmt.Sprintf("BDAT %d", bdatChunkSize),
+			fmt.Sprintf("BDAT %d", bdatChunkSize),
+			fmt.Sprintf("BDAT %d LAST", len(toCRLF([]byte(large)))-2*bdatChunkSize),
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockClient := NewMockSMTPClient()
+			mockClient.Extensions = tt.extensions
+			email := &Email{
+				Config: &config.Config{
+					FromAddr:   testFromAddr,
+					SmtpAddrs:  []string{testSMTPAddr},
+					Recipients: []string{"rcpt@domain.tld"},
+				},
+				Body: []byte(tt.body),
+			}
+
+			if _, err := email.sendWithDialer(context.Background(), createMockDialer(mockClient, false)); err != nil {
+				t.Fatalf("sendWithDialer() failed: %v", err)
+			}
+
+			if tt.expected == nil {
+				if mockClient.MethodCallCount["Data"] != 1 || len(mockClient.Chunks) != 0 {
+					t.Errorf("Expected DATA, got %d DATA and chunks %d", mockClient.MethodCallCount["Data"], len(mockClient.Chunks))
+				}
+				return
+			}
+			if mockClient.MethodCallCount["Data"] != 0 {
+				t.Error("DATA should not be used with CHUNKING")
+			}
+			var commands []string
+			var sent strings.Builder
+			for _, chunk := range mockClient.Chunks {
+				cmd, data, _ := strings.Cut(chunk, "\n")
+				commands = append(commands, cmd)
+				sent.WriteString(data)
+			}
+			if strings.Join(commands, ", ") != strings.Join(tt.expected, ", ") {
+				t.Errorf("BDAT commands = %q, want %q", commands, tt.expected)
+			}
+			if sent.String() != string(toCRLF([]byte(tt.body))) {
+				t.Error("Chunks do not add up to the message")
+			}
+		})
+	}
+}
+
+func TestSendChunkingFailure(t *testing.T) {
+	mockClient := NewMockSMTPClient()
+	mockClient.Extensions = map[string]string{"CHUNKING": ""}
+	mockClient.ShouldFailOn = "bdat"
+	email := &Email{
+		Config: &config.Config{
+			FromAddr:   testFromAddr,
+			SmtpAddrs:  []string{testSMTPAddr},
+			Recipients: []string{"rcpt@domain.tld"},
+		},
+		Body: []byte("test email body"),
+	}
+
+	_, err := email.sendWithDialer(context.Background(), createMockDialer(mockClient, false))
+	if err == nil || !strings.Contains(err.Error(), "mock bdat error") {
+		t.Errorf("sendWithDialer() error = %v, want the BDAT failure", err)
+	}
+}
+
+func TestRealSMTPClientBdat(t *testing.T) {
+	client, server := net.Pipe()
+	received := make(chan string, 2)
+	go func() {
+		defer server.Close()
+		r := bufio.NewReader(server)
+		fmt.Fprint(server, "220 smtp.example.com ready\r\n")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			fields := strings.Fields(line)
+			if len(fields) < 2 || fields[0] != "BDAT" {
+				fmt.Fprint(server, "500 unexpected\r\n")
+				return
+			}
+			size, _ := strconv.Atoi(fields[1])
+			data := make([]byte, size)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return
+			}
+			received <- strings.TrimRight(line, "\r\n") + ":" + string(data)
+			fmt.Fprint(server, "250 ok\r\n")
+		}
+	}()
+
+	c, err := smtp.NewClient(client, "smtp.example.com")
+	if err != nil {
+		t.Fatalf("NewClient() failed: %v", err)
+	}
+	defer c.Close()
+
+	r := &RealSMTPClient{Client: c}
+	if err := r.Bdat([]byte("Subject: a\r\n"), false); err != nil {
+		t.Fatalf("Bdat() failed: %v", err)
+	}
+	if err := r.Bdat([]byte("\r\n.\r\n"), true); err != nil {
+		t.Fatalf("Bdat() failed: %v", err)
+	}
+	for _, want := range []string{"BDAT 12:Subject: a\r\n", "BDAT 5 LAST:\r\n.\r\n"} {
+		if got := <-received; got != want {
+			t.Errorf("Bdat() sent %q, want %q", got, want)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package email
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ErrNotConfirmed is returned by Confirm when sending was declined
+var ErrNotConfirmed = errors.New("sending declined")
+
+// ErrConfirmationRequired is returned by Confirm when sending has to be
+// confirmed and there is no terminal to ask on
+var ErrConfirmationRequired = errors.New("sending to this many recipients must be confirmed, pass -y to send without a terminal")
+
+// Prompter asks the question on the terminal and reports the answer, with
+// ok false when there is no terminal to ask on
+type Prompter func(question string) (yes, ok bool, err error)
+
+// Confirm makes sure that sending to more recipients than the confirmation
+// threshold is intended, asking with prompt unless AssumeYes is set
+func (e *Email) Confirm(prompt Prompter) error {
+	cfg := e.Config
+	n := len(cfg.Recipients)
+	if cfg.ConfirmThreshold <= 0 || n <= cfg.ConfirmThreshold || cfg.AssumeYes || cfg.DryRun {
+		return nil
+	}
+
+	yes, ok, err := prompt(fmt.Sprintf("Send this message to %d recipients?", n))
+	if err != nil {
+		return fmt.Errorf("cannot ask for confirmation: %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("%w (%d recipients, over %d)", ErrConfirmationRequired, n, cfg.ConfirmThreshold)
+	}
+	if !yes {
+		return ErrNotConfirmed
+	}
+	return nil
+}
+
+// TerminalPrompt asks on the controlling terminal, as stdin usually
+// carries the message, when stderr is a terminal too
+func TerminalPrompt(question string) (yes, ok bool, err error) {
+	if info, err := os.Stderr.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false, false, nil
+	}
+	tty, err := os.Open("/dev/tty")
+	if err != nil {
+		return false, false, nil
+	}
+	defer tty.Close()
+
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+
+	// Ending input without an answer declines
+	answer, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return false, true, err
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes", true, nil
+}
@@ -0,0 +1,67 @@
+package email
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+)
+
+func TestConfirm(t *testing.T) {
+	recipients := []string{"a@domain.tld", "b@domain.tld", "c@domain.tld"}
+
+	tests := []struct {
+		name        string
+		threshold   int
+		assumeYes   bool
+		terminal    bool
+		answer      bool
+		wantAsked   bool
+		expectedErr error
+	}{
+		{"No threshold", 0, false, false, false, false, nil},
+		{"Within the threshold", 3, false, false, false, false, nil},
+		{"Confirmed on the terminal", 2, false, true, true, true, nil},
+		{"Declined on the terminal", 2, false, true, false, true, ErrNotConfirmed},
+		{"No terminal", 2, false, false, false, true, ErrConfirmationRequired},
+		{"No terminal with -y", 2, true, false, false, false, nil},
+		{"Terminal with -y", 2, true, true, false, false, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			email := &Email{
+				Config: &config.Config{
+					Recipients:       recipients,
+					ConfirmThreshold: tt.threshold,
+					AssumeYes:        tt.assumeYes,
+				},
+			}
+
+			var asked string
+			prompt := func(question string) (bool, bool, error) {
+				asked = question
+				return tt.answer, tt.terminal, nil
+			}
+			err := email.Confirm(prompt)
+			if !errors.Is(err, tt.expectedErr) || (err == nil) != (tt.expectedErr == nil) {
+				t.Errorf("Confirm() error = %v, want %v", err, tt.expectedErr)
+			}
+			if (asked != "") != tt.wantAsked {
+				t.Errorf("Confirm() asked %q, want asked = %v", asked, tt.wantAsked)
+			}
+			if tt.wantAsked && asked != "Send this message to 3 recipients?" {
+				t.Errorf("Confirm() asked %q", asked)
+			}
+		})
+	}
+}
+
+func TestConfirmPromptError(t *testing.T) {
+	email := &Email{Config: &config.Config{Recipients: []string{"a@domain.tld", "b@domain.tld"}, ConfirmThreshold: 1}}
+	promptErr := errors.New("terminal gone")
+	err := email.Confirm(func(string) (bool, bool, error) { return false, true, promptErr })
+	if !errors.Is(err, promptErr) {
+		t.Errorf("Confirm() error = %v, want the prompt error", err)
+	}
+}
@@ -0,0 +1,345 @@
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+)
+
+// tlsaRecord is a TLSA record published for DANE (RFC 6698)
+type tlsaRecord struct {
+	Usage        uint8
+	Selector     uint8
+	MatchingType uint8
+	Data         []byte
+}
+
+// typeTLSA is the DNS type of TLSA records, unknown to dnsmessage
+const typeTLSA dnsmessage.Type = 52
+
+// Certificate usages of TLSA records, SMTP only uses the DANE ones as
+// there is no agreed set of CAs for it (RFC 7672)
+const (
+	usageDANETA = 2
+	usageDANEEE = 3
+)
+
+// Selectors and matching types of TLSA records
+const (
+	selectorCert = 0
+	selectorSPKI = 1
+
+	matchingFull   = 0
+	matchingSHA256 = 1
+	matchingSHA512 = 2
+)
+
+// errNoTLSA is returned for servers without TLSA records when DANE is
+// required
+var errNoTLSA = errors.New("server has no DNSSEC-validated TLSA records, required by the DANE policy")
+
+// lookupTLSA returns the TLSA records of the name and whether the resolver
+// validated them with DNSSEC, allowing tests to stub DNS
+var lookupTLSA = func(ctx context.Context, name string) ([]tlsaRecord, bool, error) {
+	return queryTLSA(ctx, systemNameserver(), name)
+}
+
+// daneVerifier looks up the TLSA records of the server and returns a
+// callback verifying its certificate against them, or nil when the server
+// publishes none and DANE is opportunistic
+func daneVerifier(ctx context.Context, cfg *config.Config, host, port string) (func([][]byte, [][]*x509.Certificate) error, error) {
+	var usable []tlsaRecord
+
+	// IP literals have no name to publish records under
+	if net.ParseIP(host) == nil {
+		records, secure, err := lookupTLSA(ctx, "_"+port+"._tcp."+host)
+		if err != nil {
+			return nil, fmt.Errorf("TLSA lookup failed: %w", err)
+		}
+		// Records not validated with DNSSEC may have been forged
+		if secure {
+			for _, r := range records {
+				if r.Usage == usageDANETA || r.Usage == usageDANEEE {
+					usable = append(usable, r)
+				}
+			}
+		}
+	}
+
+	if len(usable) == 0 {
+		if cfg.RequireDANE {
+			return nil, errNoTLSA
+		}
+		return nil, nil
+	}
+	return verifyTLSA(usable, host), nil
+}
+
+// verifyTLSA returns a callback accepting a server certificate matching
+// one of the records, either itself or through a trust anchor of the chain
+// presented along with it
+func verifyTLSA(records []tlsaRecord, host string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("server presented no certificate")
+		}
+		certs := make([]*x509.Certificate, 0, len(rawCerts))
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return fmt.Errorf("invalid server certificate: %w", err)
+			}
+			certs = append(certs, cert)
+		}
+
+		for _, r := range records {
+			switch r.Usage {
+			case usageDANEEE:
+				if tlsaMatches(r, certs[0]) {
+					return nil
+				}
+			case usageDANETA:
+				intermediates := x509.NewCertPool()
+				for _, cert := range certs[1:] {
+					intermediates.AddCert(cert)
+				}
+				for _, anchor := range certs[1:] {
+					if !tlsaMatches(r, anchor) {
+						continue
+					}
+					roots := x509.NewCertPool()
+					roots.AddCert(anchor)
+					opts := x509.VerifyOptions{DNSName: host, Roots: roots, Intermediates: intermediates}
+					if _, err := certs[0].Verify(opts); err == nil {
+						return nil
+					}
+				}
+			}
+		}
+		return fmt.Errorf("server certificate matches none of the %d TLSA records", len(records))
+	}
+}
+
+// tlsaMatches reports whether the certificate matches the record
+func tlsaMatches(r tlsaRecord, cert *x509.Certificate) bool {
+	var data []byte
+	switch r.Selector {
+	case selectorCert:
+		data = cert.Raw
+	case selectorSPKI:
+		data = cert.RawSubjectPublicKeyInfo
+	default:
+		return false
+	}
+
+	switch r.MatchingType {
+	case matchingFull:
+	case matchingSHA256:
+		sum := sha256.Sum256(data)
+		data = sum[:]
+	case matchingSHA512:
+		sum := sha512.Sum512(data)
+		data = sum[:]
+	default:
+		return false
+	}
+	return bytes.Equal(data, r.Data)
+}
+
+// bothVerifiers returns a callback requiring both callbacks to accept the
+// certificate, either of which may be nil
+func bothVerifiers(a, b func([][]byte, [][]*x509.Certificate) error) func([][]byte, [][]*x509.Certificate) error {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	return func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+		if err := a(rawCerts, chains); err != nil {
+			return err
+		}
+		return b(rawCerts, chains)
+	}
+}
+
+// systemNameserver returns the first nameserver of /etc/resolv.conf,
+// which must validate DNSSEC for DANE to apply
+func systemNameserver() string {
+	server := "127.0.0.1"
+	if f, err := os.Open("/etc/resolv.conf"); err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				server = fields[1]
+				break
+			}
+		}
+	}
+	return net.JoinHostPort(server, "53")
+}
+
+// queryTLSA asks the nameserver for the TLSA records of the name, over UDP
+// and over TCP when the reply is truncated
+func queryTLSA(ctx context.Context, server, name string) ([]tlsaRecord, bool, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, false, err
+	}
+	query, err := buildQuery(binary.BigEndian.Uint16(id[:]), qname)
+	if err != nil {
+		return nil, false, err
+	}
+
+	reply, err := exchange(ctx, "udp", server, query)
+	if err != nil {
+		return nil, false, err
+	}
+	var p dnsmessage.Parser
+	header, err := p.Start(reply)
+	if err == nil && header.Truncated {
+		if reply, err = exchange(ctx, "tcp", server, query); err != nil {
+			return nil, false, err
+		}
+		header, err = p.Start(reply)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if header.ID != binary.BigEndian.Uint16(id[:]) {
+		return nil, false, errors.New("DNS reply does not match the query")
+	}
+
+	switch header.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, header.AuthenticData, nil
+	default:
+		return nil, false, fmt.Errorf("DNS lookup of %s failed: %v", name, header.RCode)
+	}
+
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, false, err
+	}
+	var records []tlsaRecord
+	for {
+		h, err := p.AnswerHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			break
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if h.Type != typeTLSA {
+			if err := p.SkipAnswer(); err != nil {
+				return nil, false, err
+			}
+			continue
+		}
+		r, err := p.UnknownResource()
+		if err != nil {
+			return nil, false, err
+		}
+		if len(r.Data) < 3 {
+			return nil, false, errors.New("malformed TLSA record")
+		}
+		records = append(records, tlsaRecord{
+			Usage:        r.Data[0],
+			Selector:     r.Data[1],
+			MatchingType: r.Data[2],
+			Data:         r.Data[3:],
+		})
+	}
+	return records, header.AuthenticData, nil
+}
+
+// buildQuery builds a recursive TLSA query asking for DNSSEC validation
+func buildQuery(id uint16, name dnsmessage.Name) ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true, AuthenticData: true})
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(dnsmessage.Question{Name: name, Type: typeTLSA, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+	if err := b.StartAdditionals(); err != nil {
+		return nil, err
+	}
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(4096, dnsmessage.RCodeSuccess, true); err != nil {
+		return nil, err
+	}
+	if err := b.OPTResource(opt, dnsmessage.OPTResource{}); err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+// exchange sends the query to the server and returns its reply, with the
+// length prefix used over TCP
+func exchange(ctx context.Context, network, server string, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(5 * time.Second)
+	}
+	conn.SetDeadline(deadline)
+
+	if network == "udp" {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		reply := make([]byte, 4096)
+		n, err := conn.Read(reply)
+		if err != nil {
+			return nil, err
+		}
+		return reply[:n], nil
+	}
+
+	msg := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+	if _, err := conn.Write(append(msg, query...)); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	reply := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
@@ -0,0 +1,246 @@
+package email
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+)
+
+// stubTLSA makes lookupTLSA return the records, recording the names asked
+func stubTLSA(t *testing.T, records []tlsaRecord, secure bool, err error) *[]string {
+	t.Helper()
+	var names []string
+	orig := lookupTLSA
+	lookupTLSA = func(ctx context.Context, name string) ([]tlsaRecord, bool, error) {
+		names = append(names, name)
+		return records, secure, err
+	}
+	t.Cleanup(func() { lookupTLSA = orig })
+	return &names
+}
+
+// caSignedChain creates a leaf certificate for the host signed by a new CA,
+// returning both in DER
+func caSignedChain(t *testing.T, host string) (leaf, ca []byte) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	ca, err = x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	caCert, _ := x509.ParseCertificate(ca)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	leaf, err = x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	return leaf, ca
+}
+
+func TestVerifyTLSA(t *testing.T) {
+	cert := selfSignedCert(t, "smtp.example.com")
+	parsed, _ := x509.ParseCertificate(cert.Certificate[0])
+	spkiSHA256 := sha256.Sum256(parsed.RawSubjectPublicKeyInfo)
+	certSHA512 := sha512.Sum512(parsed.Raw)
+	other := sha256.Sum256([]byte("another key"))
+
+	tests := []struct {
+		name    string
+		records []tlsaRecord
+		wantErr bool
+	}{
+		{"DANE-EE SPKI SHA-256", []tlsaRecord{{usageDANEEE, selectorSPKI, matchingSHA256, spkiSHA256[:]}}, false},
+		{"DANE-EE full certificate", []tlsaRecord{{usageDANEEE, selectorCert, matchingFull, parsed.Raw}}, false},
+		{"DANE-EE certificate SHA-512", []tlsaRecord{{usageDANEEE, selectorCert, matchingSHA512, certSHA512[:]}}, false},
+		{"One of several records", []tlsaRecord{{usageDANEEE, selectorSPKI, matchingSHA256, other[:]}, {usageDANEEE, selectorSPKI, matchingSHA256, spkiSHA256[:]}}, false},
+		{"Mismatching record", []tlsaRecord{{usageDANEEE, selectorSPKI, matchingSHA256, other[:]}}, true},
+		{"Unknown matching type", []tlsaRecord{{usageDANEEE, selectorSPKI, 9, spkiSHA256[:]}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTLSConfig(&config.Config{}, "smtp.example.com")
+			cfg.VerifyPeerCertificate = verifyTLSA(tt.records, "smtp.example.com")
+			err := handshake(t, cert, cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("handshake error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr && !strings.Contains(err.Error(), "matches none of the") {
+				t.Errorf("handshake error = %v, want a TLSA mismatch", err)
+			}
+		})
+	}
+}
+
+func TestVerifyTLSATrustAnchor(t *testing.T) {
+	leaf, ca := caSignedChain(t, "smtp.example.com")
+	caCert, _ := x509.ParseCertificate(ca)
+	anchor := sha256.Sum256(caCert.RawSubjectPublicKeyInfo)
+	records := []tlsaRecord{{usageDANETA, selectorSPKI, matchingSHA256, anchor[:]}}
+
+	if err := verifyTLSA(records, "smtp.example.com")([][]byte{leaf, ca}, nil); err != nil {
+		t.Errorf("verifyTLSA() error = %v", err)
+	}
+	// The anchor must be presented, and the name must match
+	if err := verifyTLSA(records, "smtp.example.com")([][]byte{leaf}, nil); err == nil {
+		t.Error("verifyTLSA() should fail without the trust anchor")
+	}
+	if err := verifyTLSA(records, "other.example.com")([][]byte{leaf, ca}, nil); err == nil {
+		t.Error("verifyTLSA() should fail for another host name")
+	}
+}
+
+func TestDANEPolicy(t *testing.T) {
+	record := tlsaRecord{usageDANEEE, selectorSPKI, matchingSHA256, make([]byte, 32)}
+
+	tests := []struct {
+		name       string
+		records    []tlsaRecord
+		secure     bool
+		lookupErr  error
+		required   bool
+		wantErr    bool
+		wantVerify bool
+	}{
+		{"Records published", []tlsaRecord{record}, true, nil, false, false, true},
+		{"No records", nil, true, nil, false, false, false},
+		{"No records when required", nil, true, nil, true, true, false},
+		{"Records without DNSSEC", []tlsaRecord{record}, false, nil, false, false, false},
+		{"Records without DNSSEC when required", []tlsaRecord{record}, false, nil, true, true, false},
+		{"Only PKIX records", []tlsaRecord{{1, selectorSPKI, matchingSHA256, make([]byte, 32)}}, true, nil, false, false, false},
+		{"Lookup failure", nil, false, errors.New("SERVFAIL"), false, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			names := stubTLSA(t, tt.records, tt.secure, tt.lookupErr)
+			mockClient := NewMockSMTPClient()
+			email := &Email{
+				Config: &config.Config{
+					FromAddr:    testFromAddr,
+					SmtpAddrs:   []string{testSMTPAddr},
+					Recipients:  []string{"test@domain.tld"},
+					EnableDANE:  true,
+					RequireDANE: tt.required,
+				},
+				Body: []byte("test email body"),
+			}
+
+			_, err := email.sendWithDialer(context.Background(), createMockDialer(mockClient, false))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("sendWithDialer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(*names) != 1 || (*names)[0] != "_587._tcp.smtp.example.com" {
+				t.Errorf("TLSA lookups = %v, want _587._tcp.smtp.example.com", *names)
+			}
+			if tt.wantErr {
+				if mockClient.MethodCallCount["StartTLS"] != 0 {
+					t.Error("Server should not be used")
+				}
+				return
+			}
+			if verify := mockClient.TLSConfig.VerifyPeerCertificate != nil; verify != tt.wantVerify {
+				t.Errorf("Certificate verified = %v, want %v", verify, tt.wantVerify)
+			}
+		})
+	}
+}
+
+// serveDNS answers a single query on a local UDP port with a TLSA record
+// behind a CNAME, setting the AD bit
+func serveDNS(t *testing.T, tlsa []byte) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 4096)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var p dnsmessage.Parser
+		header, err := p.Start(buf[:n])
+		if err != nil {
+			return
+		}
+		question, err := p.Question()
+		if err != nil || question.Type != typeTLSA {
+			return
+		}
+
+		target := dnsmessage.MustNewName("tlsa.example.com.")
+		b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: header.ID, Response: true, RecursionAvailable: true, AuthenticData: true})
+		b.StartQuestions()
+		b.Question(question)
+		b.StartAnswers()
+		b.CNAMEResource(dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: 60}, dnsmessage.CNAMEResource{CNAME: target})
+		b.UnknownResource(dnsmessage.ResourceHeader{Name: target, Type: typeTLSA, Class: dnsmessage.ClassINET, TTL: 60}, dnsmessage.UnknownResource{Type: typeTLSA, Data: tlsa})
+		reply, _ := b.Finish()
+		conn.WriteTo(reply, addr)
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestQueryTLSA(t *testing.T) {
+	server := serveDNS(t, []byte{3, 1, 1, 0xde, 0xad, 0xbe, 0xef})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	records, secure, err := queryTLSA(ctx, server, "_25._tcp.smtp.example.com")
+	if err != nil {
+		t.Fatalf("queryTLSA() error = %v", err)
+	}
+	if !secure {
+		t.Error("queryTLSA() secure = false, want the AD bit of the reply")
+	}
+	if len(records) != 1 {
+		t.Fatalf("queryTLSA() returned %d records, want 1", len(records))
+	}
+	r := records[0]
+	if r.Usage != usageDANEEE || r.Selector != selectorSPKI || r.MatchingType != matchingSHA256 || string(r.Data) != "\xde\xad\xbe\xef" {
+		t.Errorf("queryTLSA() record = %+v", r)
+	}
+}
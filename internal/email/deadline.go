@@ -0,0 +1,38 @@
+package email
+
+import (
+	"net"
+	"time"
+)
+
+// dataChunkTimeout bounds the write of each chunk of message data, as the
+// 3 minutes RFC 5321 (4.5.3.2.5) suggests for a data block
+const dataChunkTimeout = 3 * time.Minute
+
+// DeadlineRefresher is implemented by clients whose connection deadline can
+// be pushed back while the message data is written
+type DeadlineRefresher interface {
+	RefreshDeadline(timeout time.Duration) error
+}
+
+// sessionDeadline keeps the connection of a client along with the deadline
+// bounding the whole session
+type sessionDeadline struct {
+	raw      net.Conn
+	deadline time.Time
+}
+
+// RefreshDeadline gives the connection timeout more time, never going past
+// the session deadline, and restores the session deadline for zero
+func (s *sessionDeadline) RefreshDeadline(timeout time.Duration) error {
+	if s.raw == nil {
+		return nil
+	}
+	deadline := s.deadline
+	if timeout > 0 {
+		if t := time.Now().Add(timeout); deadline.IsZero() || t.Before(deadline) {
+			deadline = t
+		}
+	}
+	return s.raw.SetDeadline(deadline)
+}
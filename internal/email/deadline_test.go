@@ -0,0 +1,161 @@
+package email
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+)
+
+// deadlineConn records the deadline set on the connection
+type deadlineConn struct {
+	net.Conn
+	deadline time.Time
+}
+
+func (c *deadlineConn) SetDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+func TestRefreshDeadline(t *testing.T) {
+	conn := &deadlineConn{}
+	session := sessionDeadline{raw: conn}
+
+	// Without a session deadline, the timeout alone applies
+	before := time.Now()
+	if err := session.RefreshDeadline(time.Minute); err != nil {
+		t.Fatalf("RefreshDeadline() error = %v", err)
+	}
+	if conn.deadline.Before(before.Add(time.Minute)) || conn.deadline.After(time.Now().Add(time.Minute)) {
+		t.Errorf("deadline = %v, want a minute from now", conn.deadline)
+	}
+	if session.RefreshDeadline(0); !conn.deadline.IsZero() {
+		t.Errorf("deadline = %v, want none restored", conn.deadline)
+	}
+
+	// The session deadline is never extended
+	session.deadline = time.Now().Add(time.Second)
+	session.RefreshDeadline(time.Minute)
+	if !conn.deadline.Equal(session.deadline) {
+		t.Errorf("deadline = %v, want the session deadline %v", conn.deadline, session.deadline)
+	}
+	session.deadline = time.Now().Add(time.Hour)
+	session.RefreshDeadline(time.Minute)
+	if !conn.deadline.Before(session.deadline) {
+		t.Errorf("deadline = %v, want before the session deadline %v", conn.deadline, session.deadline)
+	}
+	if session.RefreshDeadline(0); !conn.deadline.Equal(session.deadline) {
+		t.Errorf("deadline = %v, want the session deadline %v restored", conn.deadline, session.deadline)
+	}
+
+	// Clients built without a connection have nothing to refresh
+	if err := (&sessionDeadline{}).RefreshDeadline(time.Minute); err != nil {
+		t.Errorf("RefreshDeadline() without connection error = %v", err)
+	}
+}
+
+func TestSendChunkedWrites(t *testing.T) {
+	mockClient := NewMockSMTPClient()
+	body := "To: a@domain.tld\n\n0123456789\n"
+
+	email := &Email{
+		Config: &config.Config{
+			FromAddr:       testFromAddr,
+			SmtpAddrs:      []string{testSMTPAddr},
+			Recipients:     []string{"a@domain.tld"},
+			WriteChunkSize: 8,
+		},
+		Body: []byte(body),
+	}
+	if _, err := email.sendWithDialer(context.Background(), createMockDialer(mockClient, false)); err != nil {
+		t.Fatalf("sendWithDialer() failed unexpectedly: %v", err)
+	}
+
+	if string(mockClient.DataWriter.Written) != body {
+		t.Errorf("Written body = %q, want %q", mockClient.DataWriter.Written, body)
+	}
+	chunks := (len(body) + 7) / 8
+	if mockClient.DataWriter.Writes != chunks {
+		t.Errorf("Write called %d times, want %d", mockClient.DataWriter.Writes, chunks)
+	}
+
+	// Each chunk gets a fresh deadline, the session one is restored after
+	var expected []time.Duration
+	for i := 0; i < chunks; i++ {
+		expected = append(expected, dataChunkTimeout)
+	}
+	expected = append(expected, 0)
+	if !reflect.DeepEqual(mockClient.Timeouts, expected) {
+		t.Errorf("RefreshDeadline timeouts = %v, want %v", mockClient.Timeouts, expected)
+	}
+}
+
+// slowGreetingDialer returns a dialer to a server greeting after the delay,
+// then answering every command
+func slowGreetingDialer(delay time.Duration) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			time.Sleep(delay)
+			if _, err := fmt.Fprint(server, "220 smtp.example.com ready\r\n"); err != nil {
+				return
+			}
+			r := bufio.NewReader(server)
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if strings.HasPrefix(line, "QUIT") {
+					fmt.Fprint(server, "221 bye\r\n")
+					return
+				}
+				fmt.Fprint(server, "250 ok\r\n")
+			}
+		}()
+		return client, nil
+	}
+}
+
+func TestGreetingTimeout(t *testing.T) {
+	tests := []struct {
+		name     string
+		greeting time.Duration
+		delay    time.Duration
+		wantErr  string
+	}{
+		{"Greeting in time", 500 * time.Millisecond, 10 * time.Millisecond, ""},
+		{"Greeting too late", 50 * time.Millisecond, 500 * time.Millisecond, "no greeting within 50ms"},
+		{"No greeting timeout", 0, 100 * time.Millisecond, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := dialSMTP(context.Background(), testSMTPAddr, config.SMTPModeAuto, tt.greeting, slowGreetingDialer(tt.delay))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("dialSMTP() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("dialSMTP() error = %v", err)
+			}
+			defer client.Close()
+
+			// The rest of the session is not bound by the greeting timeout
+			time.Sleep(tt.greeting)
+			if err := client.Noop(); err != nil {
+				t.Errorf("Noop() after the greeting timeout error = %v", err)
+			}
+		})
+	}
+}
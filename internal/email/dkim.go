@@ -0,0 +1,171 @@
+package email
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// dkimSignedHeaders lists the headers included in the DKIM signature when
+// present in the message
+var dkimSignedHeaders = []string{
+	"From", "To", "Cc", "Subject", "Date", "Message-Id", "Reply-To",
+	"Mime-Version", "Content-Type", "Content-Transfer-Encoding",
+}
+
+// whitespaceRun matches runs of whitespace collapsed by relaxed canonicalization
+var whitespaceRun = regexp.MustCompile(`[ \t]+`)
+
+// signDKIM prepends a DKIM-Signature header to the body using the
+// configured key, selector and domain
+func (e *Email) signDKIM() error {
+	key, err := loadDKIMKey(e.Config.DKIMKeyPath)
+	if err != nil {
+		return err
+	}
+
+	eol := "\n"
+	if bytes.Contains(e.Body, []byte("\r\n")) {
+		eol = "\r\n"
+	}
+
+	header, err := dkimSignature(e.Body, key, e.Config.DKIMDomain, e.Config.DKIMSelector, time.Now())
+	if err != nil {
+		return err
+	}
+
+	e.Body = append([]byte("DKIM-Signature: "+header+eol), e.Body...)
+	return nil
+}
+
+// dkimSignature computes the value of the DKIM-Signature header for the
+// message using relaxed/relaxed canonicalization and rsa-sha256
+func dkimSignature(message []byte, key *rsa.PrivateKey, domain, selector string, now time.Time) (string, error) {
+	headers, body := splitMessage(message)
+
+	bodyHash := sha256.Sum256(canonicalBodyRelaxed(body))
+
+	// Collect the headers to sign, in order of dkimSignedHeaders
+	var names []string
+	var signed bytes.Buffer
+	for _, name := range dkimSignedHeaders {
+		for _, field := range findHeaders(headers, name) {
+			names = append(names, strings.ToLower(name))
+			signed.WriteString(canonicalHeaderRelaxed(field))
+			signed.WriteString("\r\n")
+		}
+	}
+
+	value := fmt.Sprintf("v=1; a=rsa-sha256; c=relaxed/relaxed; d=%s; s=%s; t=%d; h=%s; bh=%s; b=",
+		domain, selector, now.Unix(), strings.Join(names, ":"),
+		base64.StdEncoding.EncodeToString(bodyHash[:]))
+
+	// The signature covers its own header with an empty b= tag
+	signed.WriteString(canonicalHeaderRelaxed("DKIM-Signature: " + value))
+
+	digest := sha256.Sum256(signed.Bytes())
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return value + base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// loadDKIMKey reads a PEM encoded RSA private key in PKCS#1 or PKCS#8 form
+func loadDKIMKey(path string) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("DKIM key is not an RSA key")
+	}
+	return key, nil
+}
+
+// splitMessage splits a message into its header fields, each with folded
+// continuation lines joined by CRLF, and its body normalized to CRLF
+func splitMessage(message []byte) ([]string, []byte) {
+	normalized := strings.ReplaceAll(string(message), "\r\n", "\n")
+	head, body, _ := strings.Cut(normalized, "\n\n")
+
+	var fields []string
+	for _, line := range strings.Split(head, "\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += "\r\n" + line
+			continue
+		}
+		fields = append(fields, line)
+	}
+
+	return fields, []byte(strings.ReplaceAll(body, "\n", "\r\n"))
+}
+
+// findHeaders returns all fields with the given name, bottom-most first
+func findHeaders(fields []string, name string) []string {
+	var found []string
+	for i := len(fields) - 1; i >= 0; i-- {
+		fieldName, _, ok := strings.Cut(fields[i], ":")
+		if ok && strings.EqualFold(strings.TrimSpace(fieldName), name) {
+			found = append(found, fields[i])
+		}
+	}
+	return found
+}
+
+// canonicalHeaderRelaxed applies the relaxed header canonicalization
+// algorithm from RFC 6376 section 3.4.2
+func canonicalHeaderRelaxed(field string) string {
+	name, value, _ := strings.Cut(field, ":")
+	value = strings.NewReplacer("\r\n", "", "\n", "").Replace(value)
+	value = whitespaceRun.ReplaceAllString(value, " ")
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + strings.TrimSpace(value)
+}
+
+// canonicalBodyRelaxed applies the relaxed body canonicalization
+// algorithm from RFC 6376 section 3.4.4
+func canonicalBodyRelaxed(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(whitespaceRun.ReplaceAllString(line, " "), " ")
+	}
+
+	// Drop trailing empty lines
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
@@ -0,0 +1,162 @@
+package email
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+)
+
+// dkimTag returns the value of a tag in a DKIM-Signature header value
+func dkimTag(value, tag string) string {
+	for _, part := range strings.Split(value, ";") {
+		name, val, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if ok && name == tag {
+			return val
+		}
+	}
+	return ""
+}
+
+func writeTestDKIMKey(t *testing.T) (string, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "dkim.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+	return path, key
+}
+
+func TestCanonicalBodyRelaxed(t *testing.T) {
+	tests := []struct {
+		body     string
+		expected string
+	}{
+		{"", ""},
+		{"\r\n\r\n", ""},
+		{"Hello  \t world \r\n", "Hello world\r\n"},
+		{"line\r\n\r\n\r\n", "line\r\n"},
+		{"no newline", "no newline\r\n"},
+	}
+
+	for _, tt := range tests {
+		if got := string(canonicalBodyRelaxed([]byte(tt.body))); got != tt.expected {
+			t.Errorf("canonicalBodyRelaxed(%q) = %q, want %q", tt.body, got, tt.expected)
+		}
+	}
+}
+
+func TestCanonicalHeaderRelaxed(t *testing.T) {
+	got := canonicalHeaderRelaxed("Subject :  A  folded\r\n\t subject ")
+	if got != "subject:A folded subject" {
+		t.Errorf("canonicalHeaderRelaxed() = %q", got)
+	}
+}
+
+func TestDKIMSigning(t *testing.T) {
+	keyPath, key := writeTestDKIMKey(t)
+	body := "From: sender@example.com\nTo: rcpt@domain.tld\nSubject: Test\n\nBody  content \n\n"
+
+	cfg := &config.Config{
+		FromAddr:     testFromAddr,
+		SmtpAddrs:    []string{testSMTPAddr},
+		DKIMKeyPath:  keyPath,
+		DKIMSelector: "mail",
+		DKIMDomain:   "example.com",
+	}
+
+	email, err := New(cfg, []byte(body))
+	if err != nil {
+		t.Fatalf("New() failed: %v", err)
+	}
+
+	signed := string(email.Body)
+	if !strings.HasPrefix(signed, "DKIM-Signature: ") {
+		t.Fatalf("Expected DKIM-Signature header to be prepended, got %q", signed)
+	}
+	if !strings.HasSuffix(signed, body) {
+		t.Error("Original message should follow the signature unchanged")
+	}
+
+	value := strings.TrimPrefix(strings.SplitN(signed, "\n", 2)[0], "DKIM-Signature: ")
+	expectedTags := map[string]string{
+		"v": "1",
+		"a": "rsa-sha256",
+		"c": "relaxed/relaxed",
+		"d": "example.com",
+		"s": "mail",
+		"h": "from:to:subject",
+	}
+	for tag, want := range expectedTags {
+		if got := dkimTag(value, tag); got != want {
+			t.Errorf("DKIM tag %s = %q, want %q", tag, got, want)
+		}
+	}
+	if dkimTag(value, "t") == "" {
+		t.Error("DKIM tag t is missing")
+	}
+
+	// Body hash covers the canonicalized body
+	bodyHash := sha256.Sum256([]byte("Body content\r\n"))
+	if got := dkimTag(value, "bh"); got != base64.StdEncoding.EncodeToString(bodyHash[:]) {
+		t.Errorf("DKIM body hash = %q does not match the body", got)
+	}
+
+	// Verify the signature over the canonicalized headers
+	sig, err := base64.StdEncoding.DecodeString(dkimTag(value, "b"))
+	if err != nil {
+		t.Fatalf("Invalid signature encoding: %v", err)
+	}
+	var signedData bytes.Buffer
+	signedData.WriteString("from:sender@example.com\r\nto:rcpt@domain.tld\r\nsubject:Test\r\n")
+	signedData.WriteString(canonicalHeaderRelaxed("DKIM-Signature: " + strings.TrimSuffix(value, dkimTag(value, "b"))))
+	digest := sha256.Sum256(signedData.Bytes())
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], sig); err != nil {
+		t.Errorf("DKIM signature does not verify: %v", err)
+	}
+}
+
+func TestDKIMSigningDisabled(t *testing.T) {
+	body := "From: sender@example.com\nTo: rcpt@domain.tld\n\nBody"
+	cfg := &config.Config{
+		FromAddr:  testFromAddr,
+		SmtpAddrs: []string{testSMTPAddr},
+	}
+
+	email, err := New(cfg, []byte(body))
+	if err != nil {
+		t.Fatalf("New() failed: %v", err)
+	}
+	if string(email.Body) != body {
+		t.Errorf("Body should be unchanged without DKIM configuration, got %q", email.Body)
+	}
+}
+
+func TestDKIMSigningMissingKey(t *testing.T) {
+	cfg := &config.Config{
+		FromAddr:     testFromAddr,
+		SmtpAddrs:    []string{testSMTPAddr},
+		DKIMKeyPath:  filepath.Join(t.TempDir(), "missing.pem"),
+		DKIMSelector: "mail",
+		DKIMDomain:   "example.com",
+	}
+
+	if _, err := New(cfg, []byte("To: rcpt@domain.tld\n\nBody")); err == nil {
+		t.Error("New() should fail when the DKIM key cannot be read")
+	}
+}
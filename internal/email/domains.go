@@ -0,0 +1,65 @@
+package email
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// filterRecipients applies the allowed and denied domain lists to the
+// recipients, dropping offending ones or failing in strict mode or when
+// none are left
+func (e *Email) filterRecipients() error {
+	if len(e.Config.AllowedDomains) == 0 && len(e.Config.DeniedDomains) == 0 {
+		return nil
+	}
+
+	allowed := []string{}
+	for _, rcpt := range e.Config.Recipients {
+		if e.domainAllowed(recipientDomain(rcpt)) {
+			allowed = append(allowed, rcpt)
+			continue
+		}
+		if e.Config.StrictDomains {
+			return fmt.Errorf("recipient %s is not in an allowed domain", rcpt)
+		}
+		log.Println("dropping recipient not in an allowed domain:", rcpt)
+	}
+
+	// Refuse the email rather than connecting with nobody to send it to
+	if len(allowed) == 0 && len(e.Config.Recipients) > 0 {
+		return fmt.Errorf("no recipient left, all of %s are outside the allowed domains", strings.Join(e.Config.Recipients, ", "))
+	}
+
+	e.Config.Recipients = allowed
+	return nil
+}
+
+// domainAllowed reports whether mail may be relayed to the domain
+func (e *Email) domainAllowed(domain string) bool {
+	if matchDomain(domain, e.Config.DeniedDomains) {
+		return false
+	}
+	return len(e.Config.AllowedDomains) == 0 || matchDomain(domain, e.Config.AllowedDomains)
+}
+
+// matchDomain reports whether the domain is in the list, where entries
+// starting with a dot match any subdomain
+func matchDomain(domain string, list []string) bool {
+	for _, entry := range list {
+		entry = strings.ToLower(entry)
+		if domain == entry || (strings.HasPrefix(entry, ".") && strings.HasSuffix(domain, entry)) {
+			return true
+		}
+	}
+	return false
+}
+
+// recipientDomain returns the lowercased domain part of an address
+func recipientDomain(addr string) string {
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
+		return ""
+	}
+	return strings.ToLower(addr[at+1:])
+}
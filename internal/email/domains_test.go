@@ -0,0 +1,89 @@
+package email
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+)
+
+func TestFilterRecipients(t *testing.T) {
+	recipients := []string{"a@example.com", "b@Example.org", "c@mail.example.net", "d@other.tld"}
+
+	tests := []struct {
+		name     string
+		allowed  []string
+		denied   []string
+		strict   bool
+		wantErr  bool
+		expected []string
+	}{
+		{
+			name:     "No restrictions",
+			expected: recipients,
+		},
+		{
+			name:     "Allow only",
+			allowed:  []string{"example.com", "example.org"},
+			expected: []string{"a@example.com", "b@Example.org"},
+		},
+		{
+			name:     "Allow subdomains",
+			allowed:  []string{".example.net"},
+			expected: []string{"c@mail.example.net"},
+		},
+		{
+			name:     "Deny only",
+			denied:   []string{"other.tld"},
+			expected: []string{"a@example.com", "b@Example.org", "c@mail.example.net"},
+		},
+		{
+			name:     "Deny takes precedence over allow",
+			allowed:  []string{"example.com", "example.org"},
+			denied:   []string{"example.org"},
+			expected: []string{"a@example.com"},
+		},
+		{
+			name:    "No recipient left",
+			allowed: []string{"allowed.tld"},
+			wantErr: true,
+		},
+		{
+			name:    "Strict mode rejects the email",
+			denied:  []string{"other.tld"},
+			strict:  true,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{
+				Recipients:     append([]string{}, recipients...),
+				AllowedDomains: tt.allowed,
+				DeniedDomains:  tt.denied,
+				StrictDomains:  tt.strict,
+			}
+			email := &Email{Config: cfg}
+
+			err := email.filterRecipients()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("filterRecipients() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(cfg.Recipients, tt.expected) {
+				t.Errorf("filterRecipients() recipients = %v, want %v", cfg.Recipients, tt.expected)
+			}
+		})
+	}
+}
+
+func TestNewAllRecipientsDropped(t *testing.T) {
+	cfg := &config.Config{
+		FromAddr:      testFromAddr,
+		SmtpAddrs:     []string{testSMTPAddr},
+		DeniedDomains: []string{"domain.tld"},
+	}
+	if _, err := New(cfg, []byte("To: a@domain.tld\r\n\r\nBody\r\n")); err == nil {
+		t.Error("New() should refuse an email whose recipients are all denied")
+	}
+}
@@ -2,24 +2,36 @@ package email
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/mail"
 	"net/smtp"
+	"os"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/kiinoda/mailrelay/internal/config"
+	"github.com/kiinoda/mailrelay/internal/ratelimit"
 )
 
 // SMTPClient interface for dependency injection in tests
 type SMTPClient interface {
 	StartTLS(config *tls.Config) error
-	Mail(from string) error
+	Auth(a smtp.Auth) error
+	Extension(ext string) (bool, string)
+	Mail(from string, params ...string) error
 	Rcpt(to string) error
 	Data() (io.WriteCloser, error)
+	Reset() error
+	Noop() error
 	Quit() error
 	Close() error
 }
@@ -27,24 +39,105 @@ type SMTPClient interface {
 // RealSMTPClient wraps net/smtp.Client to implement SMTPClient interface
 type RealSMTPClient struct {
 	*smtp.Client
+	sessionDeadline
 }
 
 func (r *RealSMTPClient) Close() error {
 	return r.Client.Close()
 }
 
+// Mail issues MAIL FROM with the given ESMTP parameters, which net/smtp
+// has no way to pass
+func (r *RealSMTPClient) Mail(from string, params ...string) error {
+	if strings.ContainsAny(from, "\r\n") {
+		return errors.New("smtp: A line must not contain CR or LF")
+	}
+
+	// Greet the server first if not done yet, as net/smtp would
+	r.Client.Extension("")
+
+	cmd := "MAIL FROM:<" + from + ">"
+	if len(params) > 0 {
+		cmd += " " + strings.Join(params, " ")
+	}
+	id, err := r.Text.Cmd("%s", cmd)
+	if err != nil {
+		return err
+	}
+	r.Text.StartResponse(id)
+	defer r.Text.EndResponse(id)
+	_, _, err = r.Text.ReadResponse(250)
+	return err
+}
+
 // SMTPDialer function type for creating SMTP connections
-type SMTPDialer func(addr string) (SMTPClient, error)
+type SMTPDialer func(ctx context.Context, addr string) (SMTPClient, error)
+
+// ErrEmptyMessage is returned by New when there is no message to send
+var ErrEmptyMessage = errors.New("no message body provided")
+
+// ErrNoRecipients is returned by New when neither the command line nor the
+// message headers give a recipient, as no server would take the message
+var ErrNoRecipients = errors.New("no recipients, pass them as arguments or with -to, -cc or -bcc, or add To, Cc or Bcc headers to the message")
+
+// ErrNoSender is returned by New when neither the configuration nor the
+// From header of the message give a sender
+var ErrNoSender = errors.New("no sender, pass -f, set " + config.SenderEnvVar + " or add a From header to the message")
+
+// ErrUnsafeAddress is returned by New when a sender or recipient address
+// holds a CR, LF or NUL, which could inject SMTP commands or headers
+var ErrUnsafeAddress = errors.New("address contains CR, LF or NUL")
+
+// ErrTooManyRecipients and ErrMessageTooLarge are returned by New for
+// messages over the configured limits, before any server is contacted
+var (
+	ErrTooManyRecipients = errors.New("too many recipients")
+	ErrMessageTooLarge   = errors.New("message too large")
+)
+
+// ErrMalformedMessage is returned by New when the input does not start with
+// a header block and cannot be read as a message
+var ErrMalformedMessage = errors.New("message does not start with a header, expected lines like \"Subject: ...\"")
 
 // Email represents an email message and provides methods for reading, parsing and sending
 type Email struct {
 	Body   []byte
 	Config *config.Config
+
+	mu       sync.Mutex
+	attempts []serverAttempt
+
+	// limiter paces the transactions, shared with the other emails sent
+	// by the process
+	limiter *ratelimit.Limiter
 }
 
 // New creates a new Email instance with the provided configuration and body,
 // and parses recipients from the email
 func New(cfg *config.Config, body []byte) (*Email, error) {
+	if cfg.Decompress && len(body) > 0 {
+		var err error
+		if body, err = gunzip(body); err != nil {
+			return nil, err
+		}
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil, ErrEmptyMessage
+	}
+
+	// Some servers read a message without an empty line after the headers
+	// as all headers
+	body, err := canonicalBoundary(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse email: %w", err)
+	}
+
+	// Some producers leave garbage after the last line, drop it before
+	// signing
+	if cfg.TrimBody {
+		body = terminateBody(body, true)
+	}
+
 	email := &Email{
 		Config: cfg,
 		Body:   body,
@@ -53,9 +146,104 @@ func New(cfg *config.Config, body []byte) (*Email, error) {
 	if err := email.parseRecipients(); err != nil {
 		return nil, fmt.Errorf("failed to parse email: %w", err)
 	}
+	if len(cfg.Recipients) == 0 {
+		return nil, ErrNoRecipients
+	}
+
+	// Like sendmail, fall back to the sender of the message
+	if cfg.FromAddr == "" {
+		if err := email.parseSender(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := email.prepare(); err != nil {
+		return nil, err
+	}
 	return email, nil
 }
 
+// NewFromFile creates an Email from the message in the file at path, as New
+// does for a message read from stdin
+func NewFromFile(cfg *config.Config, path string) (*Email, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return New(cfg, body)
+}
+
+// prepare applies the recipient rules and adds headers and signature once
+// the recipients are known
+func (e *Email) prepare() error {
+	if err := e.checkAddresses(); err != nil {
+		return err
+	}
+
+	// Upstream headers go before any of ours is added
+	if len(e.Config.StripHeaders) > 0 {
+		e.stripHeaders()
+	}
+
+	e.normalizeRecipients()
+	if e.Config.RedirectAll != "" {
+		e.redirectAll()
+	}
+	e.mapDomains()
+
+	if err := e.filterRecipients(); err != nil {
+		return err
+	}
+	if max := e.Config.MaxRecipients; max > 0 && len(e.Config.Recipients) > max {
+		return fmt.Errorf("%w: %d recipients, the limit is %d", ErrTooManyRecipients, len(e.Config.Recipients), max)
+	}
+
+	// The archive copy escapes the rewriting and filtering of recipients
+	if e.Config.AlwaysBcc != "" {
+		e.addArchive()
+	}
+
+	// Before encoding, so that an 8-bit footer is encoded as well
+	if e.Config.Footer != "" {
+		e.addFooter()
+	}
+
+	if e.Config.ForceQuotedPrintable {
+		if err := e.encodeQuotedPrintable(); err != nil {
+			return err
+		}
+	}
+
+	e.setFromName()
+	e.addHeaders()
+	if e.Config.TraceHeader && e.Config.TraceID != "" {
+		e.addTraceHeader()
+	}
+	if e.Config.Submission {
+		if err := e.completeHeaders(); err != nil {
+			return err
+		}
+	}
+
+	// The command sees the final message, our signature covers its output
+	if e.Config.PreSendCommand != "" {
+		if err := e.runPreSendCommand(); err != nil {
+			return err
+		}
+	}
+
+	if e.Config.DKIMKeyPath != "" {
+		if err := e.signDKIM(); err != nil {
+			return fmt.Errorf("failed to sign email: %w", err)
+		}
+	}
+
+	if max := e.Config.MaxMessageSize; max > 0 && len(e.Body) > max {
+		return fmt.Errorf("%w: %d bytes, the limit is %d", ErrMessageTooLarge, len(e.Body), max)
+	}
+	return nil
+}
+
 // parseRecipients parses the email message and extracts recipients
 func (e *Email) parseRecipients() error {
 	msg, err := mail.ReadMessage(bytes.NewReader(e.Body))
@@ -74,121 +262,710 @@ func (e *Email) parseRecipients() error {
 	//
 	// []string{"foo@domain.tld", "bar@domain.tld", "baz@domain.tld", "waldo@domain.tld", "xyzzy@domain.tld"}
 
-	for _, h := range []string{"to", "cc", "bcc"} {
-		headerValue := msg.Header.Get(h)
-		if headerValue == "" {
-			continue
-		}
-		for _, part := range strings.Split(headerValue, ",") {
-			trimmed := strings.Trim(part, " ")
-			if trimmed == "" {
-				continue
-			}
-			regex := regexp.MustCompile(`.*<(.*)>`)
-			matches := regex.FindStringSubmatch(trimmed)
-			recipient := ""
-			if len(matches) > 1 {
-				recipient = matches[1]
-			} else {
-				recipient = trimmed
+	// Recipients may already be given on the command line
+	seen := map[string]bool{}
+	for _, rcpt := range e.Config.Recipients {
+		seen[rcpt] = true
+	}
+	for _, h := range []string{"To", "Cc", "Bcc"} {
+		for _, headerValue := range msg.Header[h] {
+			for _, rcpt := range parseAddressList(headerValue) {
+				if !seen[rcpt] {
+					seen[rcpt] = true
+					e.Config.Recipients = append(e.Config.Recipients, rcpt)
+				}
 			}
-			e.Config.Recipients = append(e.Config.Recipients, recipient)
 		}
 	}
 	return nil
 }
 
-// Send attempts to send the email through one of the configured SMTP servers
-func (e *Email) Send() error {
-	return e.sendWithDialer(DefaultSMTPDialer)
+// parseSender sets the envelope sender from the From header, or from the
+// Sender header when From lists several authors
+func (e *Email) parseSender() error {
+	msg, err := mail.ReadMessage(bytes.NewReader(e.Body))
+	if err != nil {
+		return err
+	}
+
+	from := msg.Header.Get("From")
+	if from == "" {
+		return ErrNoSender
+	}
+	authors, err := mail.ParseAddressList(from)
+	if err != nil {
+		return fmt.Errorf("invalid From header %q: %w", from, err)
+	}
+	if len(authors) > 1 {
+		sender, err := mail.ParseAddress(msg.Header.Get("Sender"))
+		if err != nil {
+			return fmt.Errorf("the From header lists several authors and there is no valid Sender header: %w", err)
+		}
+		authors = []*mail.Address{sender}
+	}
+	e.Config.FromAddr = authors[0].Address
+	return nil
+}
+
+// checkAddresses rejects sender and recipient addresses that would break
+// out of the MAIL and RCPT commands
+func (e *Email) checkAddresses() error {
+	cfg := e.Config
+	addrs := append([]string{cfg.FromAddr}, cfg.Recipients...)
+	for _, from := range cfg.SenderRules {
+		addrs = append(addrs, from)
+	}
+	for _, addr := range addrs {
+		if strings.ContainsAny(addr, "\r\n\x00") {
+			return fmt.Errorf("%w: %q", ErrUnsafeAddress, addr)
+		}
+	}
+	return nil
+}
+
+// angleAddr extracts the address from "Name <address>"
+var angleAddr = regexp.MustCompile(`.*<(.*)>`)
+
+// parseAddressList returns the addresses in a header value. Values net/mail
+// cannot parse are split on commas, taking the address between angle
+// brackets when present.
+func parseAddressList(value string) []string {
+	var recipients []string
+	if list, err := mail.ParseAddressList(value); err == nil {
+		for _, addr := range list {
+			recipients = append(recipients, addr.Address)
+		}
+		return recipients
+	}
+
+	for _, part := range strings.Split(value, ",") {
+		trimmed := strings.TrimSpace(part)
+		if trimmed == "" {
+			continue
+		}
+		if matches := angleAddr.FindStringSubmatch(trimmed); len(matches) > 1 {
+			trimmed = matches[1]
+		}
+		recipients = append(recipients, trimmed)
+	}
+	return recipients
+}
+
+// Send attempts to send the email through one of the configured SMTP servers,
+// giving up once the context or the configured overall timeout expires
+func (e *Email) Send(ctx context.Context) (*SendResult, error) {
+	if e.Config.OverallTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.Config.OverallTimeout)
+		defer cancel()
+	}
+	return e.send(ctx, smtpDialer(e.Config))
+}
+
+// send sends the email with the given dialer, updating the metrics file,
+// following the retry schedule when a state directory is set and bouncing
+// permanent failures when asked to. In the queue delivery mode the email is
+// spooled instead.
+func (e *Email) send(ctx context.Context, dialer SMTPDialer) (*SendResult, error) {
+	if e.Config.DeliveryMode == config.DeliveryQueue && !e.Config.DryRun {
+		return e.queue()
+	}
+
+	var state *retryState
+	if e.Config.StateDir != "" && !e.Config.DryRun {
+		var err error
+		if state, err = e.checkSchedule(); err != nil {
+			return nil, err
+		}
+	}
+
+	if e.limiter == nil {
+		e.limiter = newLimiter(e.Config)
+	}
+
+	start := time.Now()
+	result, err := e.sendWithDialer(ctx, dialer)
+	if result != nil {
+		result.Duration = time.Since(start)
+	}
+	if e.Config.MetricsFile != "" && !e.Config.DryRun {
+		if metricsErr := e.writeMetrics(time.Since(start), err == nil); metricsErr != nil {
+			log.Println("error writing metrics file:", metricsErr)
+		}
+	}
+	if state != nil {
+		err = e.updateSchedule(state, err)
+	}
+	if e.Config.BounceOnFailure && !e.Config.DryRun && failedPermanently(err) {
+		if bounceErr := e.bounce(ctx, dialer, result, err); bounceErr != nil {
+			log.Println("error sending bounce:", bounceErr)
+		}
+	}
+	return result, err
 }
 
+// DefaultSMTPDialer creates real SMTP connections, bounded by the deadline
+// of the context
+func DefaultSMTPDialer(ctx context.Context, addr string) (SMTPClient, error) {
+	var d net.Dialer
+	return dialSMTP(ctx, addr, config.SMTPModeAuto, config.DefaultGreetingTimeout, d.DialContext)
+}
 
+// dialSMTP opens an SMTP or LMTP session over a connection made by dial,
+// greeting SMTP servers as the SMTP mode says once they greeted the client
+// within the greeting timeout
+func dialSMTP(ctx context.Context, addr, mode string, greeting time.Duration, dial func(ctx context.Context, network, addr string) (net.Conn, error)) (SMTPClient, error) {
+	addr, lmtp := strings.CutPrefix(addr, config.LMTPScheme)
 
-// DefaultSMTPDialer creates real SMTP connections
-func DefaultSMTPDialer(addr string) (SMTPClient, error) {
-	client, err := smtp.Dial(addr)
+	conn, err := dial(ctx, "tcp", addr)
 	if err != nil {
 		return nil, err
 	}
-	return &RealSMTPClient{Client: client}, nil
+
+	// Bound the whole SMTP session, not just the dial
+	session := sessionDeadline{raw: conn}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		session.deadline = deadline
+	}
+
+	// The greeting has a timeout of its own, within the session deadline
+	greetingFirst := greeting > 0 && (session.deadline.IsZero() || time.Now().Add(greeting).Before(session.deadline))
+	if greeting > 0 {
+		session.RefreshDeadline(greeting)
+	}
+	greeted := func(err error) error {
+		if err == nil {
+			err = session.RefreshDeadline(0)
+		}
+		if err != nil {
+			conn.Close()
+			if greetingFirst && errors.Is(err, os.ErrDeadlineExceeded) {
+				return fmt.Errorf("no greeting within %v: %w", greeting, err)
+			}
+		}
+		return err
+	}
+
+	if lmtp {
+		client, err := NewLMTPClient(conn)
+		if err := greeted(err); err != nil {
+			return nil, err
+		}
+		client.sessionDeadline = session
+		return client, nil
+	}
+
+	if mode == config.SMTPModeHELO {
+		client, err := NewHeloClient(conn)
+		if err := greeted(err); err != nil {
+			return nil, err
+		}
+		client.sessionDeadline = session
+		return client, nil
+	}
+
+	host, _, _ := net.SplitHostPort(addr)
+	client, err := smtp.NewClient(conn, host)
+	if err := greeted(err); err != nil {
+		return nil, err
+	}
+	if mode == config.SMTPModeEHLO {
+		if err := requireEHLO(client); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+	return &RealSMTPClient{Client: client, sessionDeadline: session}, nil
 }
 
 // sendWithDialer allows injection of custom dialer for testing
-func (e *Email) sendWithDialer(dialer SMTPDialer) error {
+func (e *Email) sendWithDialer(ctx context.Context, dialer SMTPDialer) (*SendResult, error) {
+	groups := [][]string{e.Config.Recipients}
+	if len(e.Config.SenderRules) > 0 || e.Config.EnableVERP {
+		groups = e.groupBySender(e.Config.Recipients)
+	}
+	if e.Config.DirectDelivery {
+		groups = groupByDomain(groups)
+	}
+	if len(groups) > 1 {
+		return e.sendGroups(ctx, groups, dialer)
+	}
+	return e.sendTo(ctx, e.Config.Recipients, dialer)
+}
+
+// sendTo sends the email to the recipients, in parallel batches if
+// configured
+func (e *Email) sendTo(ctx context.Context, recipients []string, dialer SMTPDialer) (*SendResult, error) {
+	if e.Config.Parallelism > 1 && len(recipients) > 1 {
+		return e.sendParallel(ctx, recipients, dialer)
+	}
+
+	_, result, err := e.deliver(ctx, recipients, dialer)
+	if err != nil {
+		return result, &DeliveryError{
+			Kind: classify(err),
+			Err:  fmt.Errorf("failed to send email to any SMTP server: %w", err),
+		}
+	}
+	return result, nil
+}
+
+// deliver tries each SMTP server in turn until one accepts the email for
+// the given recipients, and returns the server used
+func (e *Email) deliver(ctx context.Context, recipients []string, dialer SMTPDialer) (string, *SendResult, error) {
 	var err error
-	// Try each SMTP server until one succeeds
-	for _, server := range e.Config.SmtpAddrs {
-		if err = e.attemptRelayWithDialer(server, dialer); err == nil {
+	var server string
+	var result *SendResult
+	var attempts []*attemptError
+
+	// Nothing is tried when the deadline passes before the rate limit
+	// allows the transaction
+	if err = e.waitRate(ctx, recipients); err != nil {
+		result = &SendResult{}
+		for _, rcpt := range recipients {
+			result.reject(rcpt, err)
+		}
+		return "", result, err
+	}
+
+	// Look up the hosts of mx: entries, a failed lookup counting as a
+	// failed attempt
+	var servers []string
+	for _, entry := range e.serverEntries(recipients) {
+		hosts, lookupErr := serversOf(ctx, entry)
+		if lookupErr != nil {
+			log.Println("error looking up the MX records of", entry)
+			err = lookupErr
+			attempts = append(attempts, attemptAt(entry, err))
+			continue
+		}
+		servers = append(servers, hosts...)
+	}
+
+	// Try each SMTP server until one succeeds, with the recipients of the
+	// batches no server has accepted yet
+	delivered := &SendResult{}
+	pending := recipients
+	for _, server = range servers {
+		result, err = e.relay(ctx, server, dialer, pending)
+		e.recordAttempt(server, err)
+		if err == nil {
+			delivered.merge(result)
+			result = delivered
 			// Email sent successfully
-			if e.Config.BeVerbose {
-				fmt.Println("successfully sent mail from", e.Config.FromAddr, "to", e.Config.Recipients, "via", server)
+			if e.Config.BeVerbose && !e.Config.DryRun {
+				log.Println("successfully sent mail from", e.sender(recipients), "to", result.Accepted, "via", server)
 			}
-			return nil
+			break
+		}
+		attempts = append(attempts, attemptAt(server, err))
+		if result != nil {
+			delivered.Accepted = append(delivered.Accepted, result.Accepted...)
+			delivered.Server = result.Server
+			delivered.Bytes += result.Bytes
+			pending = without(pending, result.Accepted)
+		}
+
+		// Stop failing over once the deadline has passed
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	if err == nil && result == nil {
+		err = errors.New("no SMTP servers configured")
+	} else if err != nil {
+		err = &SendError{attempts: attempts, cause: ctx.Err()}
+	}
+	if err != nil {
+		// Every recipient not yet delivered failed with the last error seen
+		result = &SendResult{
+			Accepted: delivered.Accepted,
+			Server:   delivered.Server,
+			From:     e.sender(recipients),
+			Bytes:    delivered.Bytes,
+		}
+		for _, rcpt := range pending {
+			result.reject(rcpt, err)
+		}
+	}
+
+	// Nothing was delivered in a dry run, so there is nothing to record
+	if e.Config.DryRun {
+		return server, result, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// Log the delivery the way an MTA would
+	if e.Config.UseSyslog {
+		if len(result.Accepted) > 0 {
+			log.Printf("from=<%s> to=<%s> relay=%s status=sent", e.sender(recipients), strings.Join(result.Accepted, ">,<"), server)
+		}
+		for _, rcpt := range result.Rejected {
+			log.Printf("from=<%s> to=<%s> relay=%s status=failed (%v)", e.sender(recipients), rcpt, server, result.Errors[rcpt])
 		}
 	}
 
-	return fmt.Errorf("failed to send email to any SMTP server: %w", err)
+	// Record the outcome for every recipient
+	if e.Config.AuditFile != "" {
+		if auditErr := e.writeAudit(recipients, server, result); auditErr != nil {
+			log.Println("error writing audit file:", auditErr)
+		}
+	}
+
+	return server, result, err
 }
 
 // attemptRelayWithDialer attempts to send email using provided dialer
-func (e *Email) attemptRelayWithDialer(server string, dialer SMTPDialer) error {
-	// Create a custom TLS config that skips certificate verification
-	tlsConfig := &tls.Config{
-		InsecureSkipVerify: true,
+func (e *Email) attemptRelayWithDialer(ctx context.Context, server string, dialer SMTPDialer) error {
+	_, err := e.relay(ctx, server, dialer, e.Config.Recipients)
+	return err
+}
+
+// relay attempts to send email to the given recipients through a single server
+func (e *Email) relay(ctx context.Context, server string, dialer SMTPDialer, recipients []string) (*SendResult, error) {
+	// Local targets are written to rather than connected to
+	if dir, ok := strings.CutPrefix(server, config.MaildirScheme); ok {
+		return e.writeMaildir(dir, server, recipients)
+	}
+	if path, ok := strings.CutPrefix(server, config.MboxScheme); ok {
+		return e.writeMbox(path, server, recipients)
+	}
+
+	c, err := connect(ctx, e.Config, server, dialer)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	// Stop short of the transaction in a dry run
+	if e.Config.DryRun {
+		result := e.dryRun(server, recipients)
+		if err = c.Quit(); err != nil {
+			log.Println("error closing connection")
+			return nil, atStage("quit", err)
+		}
+		return result, nil
+	}
+
+	// Servers limiting recipients get one transaction per batch
+	result := &SendResult{Server: server}
+	for _, batch := range batchRecipients(recipients, e.Config.MaxRecipientsPerMessage) {
+		batchResult, err := e.transaction(c, batch)
+		if err != nil {
+			// End the session cleanly rather than leave the server to time
+			// out, reporting the transaction error whatever the outcome
+			if quitErr := c.Quit(); quitErr != nil {
+				log.Println("error closing connection after failed transaction:", quitErr)
+			}
+			// Batches already sent are reported, they must not be sent again
+			if len(result.Accepted) > 0 {
+				return result, err
+			}
+			return nil, err
+		}
+		result.merge(batchResult)
+	}
+
+	// Close the connection
+	if err = c.Quit(); err != nil {
+		log.Println("error closing connection")
+		return nil, atStage("quit", err)
+	}
+
+	return result, nil
+}
+
+// dryRun reports what would be sent through the server, as if the
+// recipients were accepted
+func (e *Email) dryRun(server string, recipients []string) *SendResult {
+	// The JSON output reports the same, alone on stdout
+	if !e.Config.JSONOutput {
+		fmt.Println("dry run: would send", len(e.Body), "bytes from", e.sender(recipients), "to", recipients, "via", server)
+	}
+	result := &SendResult{Server: server, From: e.sender(recipients)}
+	for _, addr := range recipients {
+		result.accept(addr)
+	}
+	return result
+}
+
+// without returns the recipients not in drop
+func without(recipients, drop []string) []string {
+	dropped := map[string]bool{}
+	for _, rcpt := range drop {
+		dropped[rcpt] = true
+	}
+	var kept []string
+	for _, rcpt := range recipients {
+		if !dropped[rcpt] {
+			kept = append(kept, rcpt)
+		}
+	}
+	return kept
+}
+
+// batchRecipients splits the recipients into batches of at most size
+// recipients, a single batch when size is zero
+func batchRecipients(recipients []string, size int) [][]string {
+	if size <= 0 || len(recipients) <= size {
+		return [][]string{recipients}
+	}
+	var batches [][]string
+	for start := 0; start < len(recipients); start += size {
+		batches = append(batches, recipients[start:min(start+size, len(recipients))])
+	}
+	return batches
+}
+
+// connect dials the SMTP server, starts TLS and authenticates
+func connect(ctx context.Context, cfg *config.Config, server string, dialer SMTPDialer) (SMTPClient, error) {
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(server, config.LMTPScheme))
+	tlsConfig := newTLSConfig(cfg, host)
+
+	// Servers publishing TLSA records must present a matching certificate
+	helo := cfg.SMTPMode == config.SMTPModeHELO
+	policy := cfg.TLSPolicy(server)
+	if cfg.EnableDANE && !helo && policy != config.TLSPolicyNone {
+		verify, err := daneVerifier(ctx, cfg, host, port)
+		if err != nil {
+			log.Println("error checking the TLSA records of", server)
+			return nil, atStage("dane", err)
+		}
+		tlsConfig.VerifyPeerCertificate = bothVerifiers(tlsConfig.VerifyPeerCertificate, verify)
 	}
 
 	// Connect to the SMTP server using dialer
-	c, err := dialer(server)
+	c, err := dialer(ctx, server)
 	if err != nil {
 		log.Println("error connecting to", server)
-		return err
+		return nil, atStage("dial", err)
 	}
-	defer c.Close()
 
-	// Start TLS with our custom config
-	if err = c.StartTLS(tlsConfig); err != nil {
-		log.Println("error starting TLS with", server)
-		return err
+	// Servers greeted with HELO offer no extensions, the session stays in
+	// plaintext and unauthenticated
+	if helo {
+		log.Println("HELO forced for", server, "sending without TLS")
+		return c, nil
+	}
+	if cfg.BeVerbose {
+		log.Println(server, "advertises", capabilities(c))
 	}
 
-	// Set the sender
-	if err = c.Mail(e.Config.FromAddr); err != nil {
-		log.Println("error setting sender:", e.Config.FromAddr)
-		return err
+	switch policy {
+	case config.TLSPolicyNone:
+		log.Println("TLS disabled for", server, "sending without TLS")
+	case config.TLSPolicyRequired:
+		// In strict mode a server not offering STARTTLS may have had it
+		// stripped from its reply, never carry on in plaintext
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			log.Println("STARTTLS not offered by", server, "possible downgrade attempt, refusing plaintext")
+			c.Close()
+			return nil, atStage("tls", errNoSTARTTLS)
+		}
+		fallthrough
+	default:
+		// Start TLS with our custom config
+		if err = c.StartTLS(tlsConfig); err != nil {
+			log.Println("error starting TLS with", server)
+			c.Close()
+			return nil, atStage("tls", versionError(tlsConfig, err))
+		}
+		if cfg.BeVerbose {
+			log.Println(server, "advertises after STARTTLS", capabilities(c))
+		}
+	}
+
+	// Authenticate if credentials are configured
+	if cfg.AuthUser != "" {
+		auth, err := chooseAuth(c, cfg, host)
+		if err == nil {
+			err = c.Auth(auth)
+		}
+		if err != nil {
+			log.Println("error authenticating with", server)
+			c.Close()
+			return nil, atStage("auth", err)
+		}
+	}
+
+	return c, nil
+}
+
+// transaction sends the email to the given recipients over an established
+// connection, leaving the connection open for further use
+func (e *Email) transaction(c SMTPClient, recipients []string) (*SendResult, error) {
+	result := &SendResult{}
+
+	// Make sure the server still answers before committing to the
+	// transaction, as a proxy may have dropped the connection while idle
+	// during a slow authentication or between batches
+	if err := c.Noop(); err != nil {
+		log.Println("error pinging server")
+		return nil, atStage("noop", err)
+	}
+
+	// Set the sender, declaring the message size, 8-bit content and UTF-8
+	// addresses to servers supporting them
+	var params []string
+	if ok, _ := c.Extension("SIZE"); ok {
+		params = append(params, "SIZE="+strconv.Itoa(len(e.Body)))
+	}
+	if has8Bit(e.Body) {
+		if ok, _ := c.Extension("8BITMIME"); ok {
+			params = append(params, "BODY=8BITMIME")
+		} else if !e.declaresEncoding() {
+			return nil, atStage("mail", errUndeclared8Bit)
+		}
+	}
+	// SMTPUTF8 (RFC 6531) is declared to servers supporting it, as UTF-8
+	// headers need it too, and internationalized addresses go as they are.
+	// Other servers get the domain of such addresses as Punycode.
+	from := e.sender(recipients)
+	wire := asciiAddress
+	if ok, _ := c.Extension("SMTPUTF8"); ok {
+		params = append(params, "SMTPUTF8")
+		wire = func(addr string) string { return addr }
+	}
+	if err := c.Mail(wire(from), params...); err != nil {
+		log.Println("error setting sender:", from)
+		return nil, atStage("mail", err)
 	}
 
-	// Set recipients
-	for _, addr := range e.Config.Recipients {
-		if err = c.Rcpt(addr); err != nil {
+	// Set recipients, carrying on past rejections in partial delivery mode
+	var err error
+	for _, addr := range recipients {
+		if err = c.Rcpt(wire(addr)); err != nil {
 			log.Println("error setting recipient:", addr)
-			return err
+			err = &recipientError{recipient: addr, err: err}
+			// Drop the envelope so that no one gets the message
+			if e.Config.AllOrNothing {
+				log.Println("aborting transaction, all recipients are required")
+				if rsetErr := c.Reset(); rsetErr != nil {
+					log.Println("error resetting transaction:", rsetErr)
+				}
+				return nil, atStage("rcpt", err)
+			}
+			if !e.Config.PartialDelivery {
+				return nil, atStage("rcpt", err)
+			}
+			result.reject(addr, err)
+			continue
 		}
+		result.accept(addr)
+	}
+	if len(recipients) > 0 && len(result.Accepted) == 0 {
+		return nil, atStage("rcpt", fmt.Errorf("no recipients accepted: %w", err))
 	}
 
-	// Send the email body
+	result.From = from
+
+	// Send the email body, in chunks to servers supporting them, ending it
+	// with a single line ending before the terminator
+	data := terminateBody(e.Body, false)
+	if cs, ok := c.(ChunkSender); ok {
+		if chunking, _ := c.Extension("CHUNKING"); chunking {
+			if err := e.sendChunks(cs, data); err != nil {
+				log.Println("error sending email body")
+				return nil, atStage("data", err)
+			}
+			result.Bytes = len(data)
+			return result, nil
+		}
+	}
 	wc, err := c.Data()
 	if err != nil {
 		log.Println("error getting data writer")
-		return err
+		return nil, atStage("data", err)
 	}
 
-	if _, err = wc.Write(e.Body); err != nil {
+	if err = e.writeBody(c, wc, data); err != nil {
 		log.Println("error writing email body")
 		wc.Close()
-		return err
+		return nil, atStage("data", err)
 	}
 
 	if err = wc.Close(); err != nil {
 		log.Println("error closing data writer")
-		return err
+		return nil, atStage("data", err)
 	}
+	result.Bytes = len(data)
 
-	// Close the connection
-	if err = c.Quit(); err != nil {
-		log.Println("error closing connection")
-		return err
+	// LMTP servers report the delivery status of each recipient only now
+	if r, ok := c.(RecipientStatusReporter); ok && len(result.Accepted) > 0 {
+		status := r.RecipientStatus()
+		accepted := result.Accepted
+		result.Accepted = nil
+		for _, addr := range accepted {
+			if err := status[wire(addr)]; err != nil {
+				log.Println("error delivering to recipient:", addr)
+				result.reject(addr, &recipientError{recipient: addr, err: err})
+				continue
+			}
+			result.accept(addr)
+		}
+		if len(result.Accepted) == 0 {
+			return nil, atStage("data", fmt.Errorf("no recipients accepted: %w", result.Errors[accepted[len(accepted)-1]]))
+		}
+	}
+
+	return result, nil
+}
+
+// writeBody streams the message data in chunks of the configured size,
+// giving each chunk its own deadline so that a stalled transfer times out
+// while a large message over a slow link does not. The session deadline
+// is restored for the reply to the data.
+func (e *Email) writeBody(c SMTPClient, w io.Writer, data []byte) error {
+	size := e.Config.WriteChunkSize
+	if size <= 0 {
+		size = config.DefaultWriteChunkSize
+	}
+	refresher, _ := c.(DeadlineRefresher)
+	if refresher != nil {
+		defer refresher.RefreshDeadline(0)
 	}
 
+	for len(data) > 0 {
+		chunk := data[:min(size, len(data))]
+		if refresher != nil {
+			if err := refresher.RefreshDeadline(dataChunkTimeout); err != nil {
+				return err
+			}
+		}
+		if err := writeAll(w, chunk); err != nil {
+			return err
+		}
+		data = data[len(chunk):]
+	}
+	return nil
+}
+
+// writeAll writes all of the data, resuming after short writes, and fails
+// on writers that make no progress rather than dropping part of the message
+func writeAll(w io.Writer, data []byte) error {
+	for len(data) > 0 {
+		n, err := w.Write(data)
+		if err != nil {
+			return err
+		}
+		if n <= 0 || n > len(data) {
+			return io.ErrShortWrite
+		}
+		data = data[n:]
+	}
 	return nil
 }
+
+// has8Bit reports whether the body contains bytes outside of 7-bit ASCII
+func has8Bit(body []byte) bool {
+	for _, b := range body {
+		if b >= 0x80 {
+			return true
+		}
+	}
+	return false
+}
@@ -1,13 +1,24 @@
 package email
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/smtp"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/kiinoda/mailrelay/internal/config"
 )
@@ -42,8 +53,8 @@ func TestNew(t *testing.T) {
 		{
 			name:     "email with no recipients",
 			body:     "From: sender@example.com\nSubject: Test\n\nBody content",
-			wantErr:  false,
-			expected: []string{},
+			wantErr:  true,
+			expected: nil,
 		},
 		{
 			name:     "invalid email format",
@@ -76,6 +87,120 @@ func TestNew(t *testing.T) {
 	}
 }
 
+func TestNewNoRecipients(t *testing.T) {
+	cfg := &config.Config{
+		FromAddr:  testFromAddr,
+		SmtpAddrs: []string{testSMTPAddr},
+	}
+
+	// The message is refused before any server would be contacted
+	email, err := New(cfg, []byte("Subject: Report\r\n\r\nBody\r\n"))
+	if !errors.Is(err, ErrNoRecipients) || !strings.Contains(err.Error(), "-to") {
+		t.Fatalf("New() error = %v, want ErrNoRecipients explaining how to give recipients", err)
+	}
+	if email != nil {
+		t.Errorf("New() = %v, want no email", email)
+	}
+
+	// Recipients from the command line are enough
+	cfg.Recipients = []string{"a@domain.tld"}
+	if _, err := New(cfg, []byte("Subject: Report\r\n\r\nBody\r\n")); err != nil {
+		t.Errorf("New() error = %v with a recipient on the command line", err)
+	}
+}
+
+func TestNewEmptyMessage(t *testing.T) {
+	for _, body := range []string{"", "\r\n\n"} {
+		cfg := &config.Config{
+			FromAddr:  testFromAddr,
+			SmtpAddrs: []string{testSMTPAddr},
+		}
+
+		if _, err := New(cfg, []byte(body)); !errors.Is(err, ErrEmptyMessage) {
+			t.Errorf("New(%q) error = %v, want ErrEmptyMessage", body, err)
+		}
+	}
+}
+
+func TestNewUnsafeAddress(t *testing.T) {
+	tests := []struct {
+		name       string
+		from       string
+		recipients []string
+		rules      map[string]string
+		body       string
+	}{
+		{
+			name:       "Recipient with CRLF",
+			from:       testFromAddr,
+			recipients: []string{"a@domain.tld>\r\nRCPT TO:<evil@attacker.tld"},
+			body:       "Subject: test\r\n\r\nBody\r\n",
+		},
+		{
+			name: "Sender with LF",
+			from: "sender@domain.tld>\nDATA",
+			body: "To: a@domain.tld\r\n\r\nBody\r\n",
+		},
+		{
+			name:  "Sender rule with CR",
+			from:  testFromAddr,
+			rules: map[string]string{"domain.tld": "bounce@domain.tld\r"},
+			body:  "To: a@domain.tld\r\n\r\nBody\r\n",
+		},
+		{
+			name: "Header recipient with NUL",
+			from: testFromAddr,
+			body: "To: a\x00@domain.tld\r\n\r\nBody\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{
+				FromAddr:    tt.from,
+				SmtpAddrs:   []string{testSMTPAddr},
+				Recipients:  tt.recipients,
+				SenderRules: tt.rules,
+			}
+			if _, err := New(cfg, []byte(tt.body)); !errors.Is(err, ErrUnsafeAddress) {
+				t.Errorf("New() error = %v, want ErrUnsafeAddress", err)
+			}
+		})
+	}
+}
+
+func TestNewFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "message.eml")
+	if err := os.WriteFile(path, []byte("To: a@domain.tld\nCc: b@domain.tld\n\nBody\n"), 0600); err != nil {
+		t.Fatalf("Failed to write message: %v", err)
+	}
+
+	cfg := &config.Config{
+		FromAddr:  testFromAddr,
+		SmtpAddrs: []string{testSMTPAddr},
+	}
+	email, err := NewFromFile(cfg, path)
+	if err != nil {
+		t.Fatalf("NewFromFile() failed: %v", err)
+	}
+	if !reflect.DeepEqual(email.Config.Recipients, []string{"a@domain.tld", "b@domain.tld"}) {
+		t.Errorf("NewFromFile() recipients = %v", email.Config.Recipients)
+	}
+
+	// An empty file is an empty message
+	empty := filepath.Join(t.TempDir(), "empty.eml")
+	if err := os.WriteFile(empty, nil, 0600); err != nil {
+		t.Fatalf("Failed to write message: %v", err)
+	}
+	if _, err := NewFromFile(&config.Config{FromAddr: testFromAddr}, empty); !errors.Is(err, ErrEmptyMessage) {
+		t.Errorf("NewFromFile() error = %v, want ErrEmptyMessage", err)
+	}
+
+	if _, err := NewFromFile(&config.Config{FromAddr: testFromAddr}, filepath.Join(t.TempDir(), "missing.eml")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("NewFromFile() error = %v, want a missing file", err)
+	}
+}
+
 func TestNewWithTestData(t *testing.T) {
 	// Read test email from testdata
 	testDataPath := filepath.Join("..", "..", "testdata", "body")
@@ -102,6 +227,115 @@ func TestNewWithTestData(t *testing.T) {
 	}
 }
 
+func TestNewWithFoldedHeaders(t *testing.T) {
+	body, err := os.ReadFile(filepath.Join("..", "..", "testdata", "folded"))
+	if err != nil {
+		t.Fatalf("Failed to read test data: %v", err)
+	}
+
+	cfg := &config.Config{
+		FromAddr:  testFromAddr,
+		SmtpAddrs: []string{testSMTPAddr},
+	}
+
+	email, err := New(cfg, body)
+	if err != nil {
+		t.Fatalf("New() with folded headers failed: %v", err)
+	}
+
+	expected := []string{
+		"one@domain.tld", "two@domain.tld", "three@domain.tld", "four@domain.tld", "five@domain.tld",
+		"six@domain.tld", "seven@domain.tld", "eight@domain.tld", "nine@domain.tld", "ten@domain.tld",
+	}
+	if !reflect.DeepEqual(email.Config.Recipients, expected) {
+		t.Errorf("New() with folded headers recipients = %v, want %v", email.Config.Recipients, expected)
+	}
+}
+
+func TestNewWithFlagRecipients(t *testing.T) {
+	headers := "From: sender@example.com\r\nTo: a@domain.tld, b@domain.tld\r\nSubject: test\r\n\r\nBody\r\n"
+	noHeaders := "From: sender@example.com\r\nSubject: test\r\n\r\nBody\r\n"
+
+	tests := []struct {
+		name       string
+		recipients []string
+		body       string
+		expected   []string
+	}{
+		{"Headers only", nil, headers, []string{"a@domain.tld", "b@domain.tld"}},
+		{"Flags only", []string{"c@domain.tld", "hidden@domain.tld"}, noHeaders, []string{"c@domain.tld", "hidden@domain.tld"}},
+		{"Flags and headers", []string{"b@domain.tld", "hidden@domain.tld"}, headers, []string{"b@domain.tld", "hidden@domain.tld", "a@domain.tld"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{
+				FromAddr:   testFromAddr,
+				SmtpAddrs:  []string{testSMTPAddr},
+				Recipients: tt.recipients,
+			}
+			email, err := New(cfg, []byte(tt.body))
+			if err != nil {
+				t.Fatalf("New() failed: %v", err)
+			}
+			if !reflect.DeepEqual(email.Config.Recipients, tt.expected) {
+				t.Errorf("New() recipients = %v, want %v", email.Config.Recipients, tt.expected)
+			}
+
+			// Recipients from flags never show in the transmitted message
+			mockClient := NewMockSMTPClient()
+			if _, err := email.sendWithDialer(context.Background(), createMockDialer(mockClient, false)); err != nil {
+				t.Fatalf("sendWithDialer() failed: %v", err)
+			}
+			if strings.Contains(string(mockClient.DataWriter.Written), "hidden@domain.tld") {
+				t.Errorf("Transmitted message reveals a flag recipient:\n%s", mockClient.DataWriter.Written)
+			}
+		})
+	}
+}
+
+func TestNewSenderFromHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		from     string
+		body     string
+		expected string
+		wantErr  error
+	}{
+		{"Configured sender wins", testFromAddr, "From: Author <author@domain.tld>\r\nTo: rcpt@domain.tld\r\n\r\nBody\r\n", testFromAddr, nil},
+		{"From header", "", "From: Author <author@domain.tld>\r\nTo: rcpt@domain.tld\r\n\r\nBody\r\n", "author@domain.tld", nil},
+		{"Sender header for several authors", "", "From: a@domain.tld, b@domain.tld\r\nSender: secretary@domain.tld\r\nTo: rcpt@domain.tld\r\n\r\nBody\r\n", "secretary@domain.tld", nil},
+		{"No sender anywhere", "", "To: rcpt@domain.tld\r\n\r\nBody\r\n", "", ErrNoSender},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{
+				FromAddr:  tt.from,
+				SmtpAddrs: []string{testSMTPAddr},
+			}
+			email, err := New(cfg, []byte(tt.body))
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("New() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("New() failed: %v", err)
+			}
+			if email.Config.FromAddr != tt.expected {
+				t.Errorf("New() sender = %q, want %q", email.Config.FromAddr, tt.expected)
+			}
+		})
+	}
+
+	cfg := &config.Config{SmtpAddrs: []string{testSMTPAddr}}
+	if _, err := New(cfg, []byte("From: not an address\r\nTo: rcpt@domain.tld\r\n\r\nBody\r\n")); err == nil {
+		t.Error("New() should fail on an invalid From header")
+	}
+}
+
 func TestEmailStruct(t *testing.T) {
 	cfg := &config.Config{
 		FromAddr:  testFromAddr,
@@ -127,22 +361,36 @@ func TestEmailStruct(t *testing.T) {
 
 // MockSMTPClient implements SMTPClient for testing
 type MockSMTPClient struct {
-	ShouldFailOn     string // Which method should fail: "dial", "tls", "mail", "rcpt", "data", "write", "close", "quit"
+	ShouldFailOn     string // Which method should fail: "dial", "tls", "auth", "mail", "rcpt", "data", "write", "close", "bdat", "reset", "noop", "quit"
 	FailOnRecipient  string // Specific recipient to fail on
 	DataWriter       *MockWriteCloser
 	MethodCallCount  map[string]int
+	FailWith         error // Error returned on failure instead of a generic one
+	TLSConfig        *tls.Config
+	Extensions       map[string]string // Extensions advertised by the server
+	MailParams       []string          // Parameters given to the last Mail call
+	MailFrom         string            // Sender given to the last Mail call
+	RcptTo           []string          // Recipients given to Rcpt
+	Chunks           []string          // BDAT commands sent, with their data
+	Timeouts         []time.Duration   // Timeouts given to RefreshDeadline
 }
 
 type MockWriteCloser struct {
 	ShouldFailWrite bool
 	ShouldFailClose bool
 	Written         []byte
+	MaxWrite        int // Bytes accepted per Write call without error, 0 for no limit
+	Writes          int
 }
 
 func (m *MockWriteCloser) Write(p []byte) (n int, err error) {
 	if m.ShouldFailWrite {
 		return 0, errors.New("mock write error")
 	}
+	m.Writes++
+	if m.MaxWrite > 0 && len(p) > m.MaxWrite {
+		p = p[:m.MaxWrite]
+	}
 	m.Written = append(m.Written, p...)
 	return len(p), nil
 }
@@ -161,26 +409,50 @@ func NewMockSMTPClient() *MockSMTPClient {
 	}
 }
 
+func (m *MockSMTPClient) failure(msg string) error {
+	if m.FailWith != nil {
+		return m.FailWith
+	}
+	return errors.New(msg)
+}
+
 func (m *MockSMTPClient) StartTLS(config *tls.Config) error {
 	m.MethodCallCount["StartTLS"]++
+	m.TLSConfig = config
 	if m.ShouldFailOn == "tls" {
-		return errors.New("mock TLS error")
+		return m.failure("mock TLS error")
+	}
+	return nil
+}
+
+func (m *MockSMTPClient) Auth(a smtp.Auth) error {
+	m.MethodCallCount["Auth"]++
+	if m.ShouldFailOn == "auth" {
+		return m.failure("mock auth error")
 	}
 	return nil
 }
 
-func (m *MockSMTPClient) Mail(from string) error {
+func (m *MockSMTPClient) Extension(ext string) (bool, string) {
+	params, ok := m.Extensions[ext]
+	return ok, params
+}
+
+func (m *MockSMTPClient) Mail(from string, params ...string) error {
 	m.MethodCallCount["Mail"]++
+	m.MailParams = params
+	m.MailFrom = from
 	if m.ShouldFailOn == "mail" {
-		return errors.New("mock mail error")
+		return m.failure("mock mail error")
 	}
 	return nil
 }
 
 func (m *MockSMTPClient) Rcpt(to string) error {
 	m.MethodCallCount["Rcpt"]++
+	m.RcptTo = append(m.RcptTo, to)
 	if m.ShouldFailOn == "rcpt" || (m.FailOnRecipient != "" && to == m.FailOnRecipient) {
-		return errors.New("mock rcpt error")
+		return m.failure("mock rcpt error")
 	}
 	return nil
 }
@@ -188,7 +460,7 @@ func (m *MockSMTPClient) Rcpt(to string) error {
 func (m *MockSMTPClient) Data() (io.WriteCloser, error) {
 	m.MethodCallCount["Data"]++
 	if m.ShouldFailOn == "data" {
-		return nil, errors.New("mock data error")
+		return nil, m.failure("mock data error")
 	}
 	if m.ShouldFailOn == "write" {
 		m.DataWriter.ShouldFailWrite = true
@@ -199,10 +471,44 @@ func (m *MockSMTPClient) Data() (io.WriteCloser, error) {
 	return m.DataWriter, nil
 }
 
+func (m *MockSMTPClient) Bdat(chunk []byte, last bool) error {
+	m.MethodCallCount["Bdat"]++
+	if m.ShouldFailOn == "bdat" {
+		return m.failure("mock bdat error")
+	}
+	cmd := fmt.Sprintf("BDAT %d", len(chunk))
+	if last {
+		cmd += " LAST"
+	}
+	m.Chunks = append(m.Chunks, cmd+"\n"+string(chunk))
+	return nil
+}
+
+func (m *MockSMTPClient) Reset() error {
+	m.MethodCallCount["Reset"]++
+	if m.ShouldFailOn == "reset" {
+		return m.failure("mock reset error")
+	}
+	return nil
+}
+
+func (m *MockSMTPClient) Noop() error {
+	m.MethodCallCount["Noop"]++
+	if m.ShouldFailOn == "noop" {
+		return m.failure("mock noop error")
+	}
+	return nil
+}
+
+func (m *MockSMTPClient) RefreshDeadline(timeout time.Duration) error {
+	m.Timeouts = append(m.Timeouts, timeout)
+	return nil
+}
+
 func (m *MockSMTPClient) Quit() error {
 	m.MethodCallCount["Quit"]++
 	if m.ShouldFailOn == "quit" {
-		return errors.New("mock quit error")
+		return m.failure("mock quit error")
 	}
 	return nil
 }
@@ -213,7 +519,7 @@ func (m *MockSMTPClient) Close() error {
 }
 
 func createMockDialer(client *MockSMTPClient, shouldFailDial bool) SMTPDialer {
-	return func(addr string) (SMTPClient, error) {
+	return func(ctx context.Context, addr string) (SMTPClient, error) {
 		if shouldFailDial {
 			return nil, errors.New("mock dial error")
 		}
@@ -238,7 +544,7 @@ func TestSendSuccessful(t *testing.T) {
 	}
 	
 	// Test successful attempt
-	err := email.attemptRelayWithDialer(testSMTPAddr, dialer)
+	err := email.attemptRelayWithDialer(context.Background(), testSMTPAddr, dialer)
 	if err != nil {
 		t.Errorf("attemptRelay() failed unexpectedly: %v", err)
 	}
@@ -259,8 +565,8 @@ func TestSendSuccessful(t *testing.T) {
 		}
 	}
 	
-	// Verify email body was written
-	if string(mockClient.DataWriter.Written) != "test email body" {
+	// Verify email body was written, ending with a line ending
+	if string(mockClient.DataWriter.Written) != "test email body\n" {
 		t.Errorf("Expected email body to be written, got: %s", string(mockClient.DataWriter.Written))
 	}
 }
@@ -302,7 +608,7 @@ func TestSendFailureScenarios(t *testing.T) {
 				Body:   []byte("test email body"),
 			}
 			
-			err := email.attemptRelayWithDialer(testSMTPAddr, dialer)
+			err := email.attemptRelayWithDialer(context.Background(), testSMTPAddr, dialer)
 			if (err != nil) != tt.expectError {
 				t.Errorf("attemptRelay() error = %v, expectError %v", err, tt.expectError)
 			}
@@ -318,7 +624,7 @@ func TestSendWithMultipleServers(t *testing.T) {
 	successfulClient := NewMockSMTPClient()
 	
 	callCount := 0
-	dialer := func(addr string) (SMTPClient, error) {
+	dialer := func(ctx context.Context, addr string) (SMTPClient, error) {
 		callCount++
 		if callCount == 1 {
 			return failingClient, nil
@@ -338,7 +644,7 @@ func TestSendWithMultipleServers(t *testing.T) {
 		Body:   []byte("test email body"),
 	}
 	
-	err := email.sendWithDialer(dialer)
+	_, err := email.sendWithDialer(context.Background(), dialer)
 	if err != nil {
 		t.Errorf("Send() should succeed with fallback server, got error: %v", err)
 	}
@@ -348,3 +654,752 @@ func TestSendWithMultipleServers(t *testing.T) {
 		t.Error("Second server should have been used successfully")
 	}
 }
+
+func TestSendLogsDeliveryRecord(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	cfg := &config.Config{
+		FromAddr:   testFromAddr,
+		SmtpAddrs:  []string{testSMTPAddr},
+		Recipients: []string{"a@domain.tld", "b@domain.tld"},
+		UseSyslog:  true,
+	}
+
+	email := &Email{
+		Config: cfg,
+		Body:   []byte("test email body"),
+	}
+
+	if _, err := email.sendWithDialer(context.Background(), createMockDialer(NewMockSMTPClient(), false)); err != nil {
+		t.Fatalf("sendWithDialer() failed unexpectedly: %v", err)
+	}
+
+	for _, want := range []string{"from=<" + testFromAddr + ">", "to=<a@domain.tld>,<b@domain.tld>", "relay=" + testSMTPAddr, "status=sent"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Delivery log %q does not contain %q", buf.String(), want)
+		}
+	}
+}
+
+func TestSendPartialDelivery(t *testing.T) {
+	mockClient := NewMockSMTPClient()
+	mockClient.FailOnRecipient = "b@domain.tld"
+
+	cfg := &config.Config{
+		FromAddr:        testFromAddr,
+		SmtpAddrs:       []string{testSMTPAddr},
+		Recipients:      []string{"a@domain.tld", "b@domain.tld", "c@domain.tld"},
+		PartialDelivery: true,
+	}
+
+	email := &Email{
+		Config: cfg,
+		Body:   []byte("test email body"),
+	}
+
+	result, err := email.sendWithDialer(context.Background(), createMockDialer(mockClient, false))
+	if err != nil {
+		t.Fatalf("sendWithDialer() should succeed with partial delivery, got: %v", err)
+	}
+
+	// The remaining recipients still get Rcpt and the body is sent
+	if mockClient.MethodCallCount["Rcpt"] != 3 {
+		t.Errorf("Expected Rcpt to be called 3 times, got %d", mockClient.MethodCallCount["Rcpt"])
+	}
+	if mockClient.MethodCallCount["Data"] != 1 {
+		t.Errorf("Expected Data to be called once, got %d", mockClient.MethodCallCount["Data"])
+	}
+
+	if !reflect.DeepEqual(result.Accepted, []string{"a@domain.tld", "c@domain.tld"}) {
+		t.Errorf("Accepted = %v", result.Accepted)
+	}
+	if !reflect.DeepEqual(result.Rejected, []string{"b@domain.tld"}) {
+		t.Errorf("Rejected = %v", result.Rejected)
+	}
+	if result.Errors["b@domain.tld"] == nil {
+		t.Error("Expected an error for the rejected recipient")
+	}
+}
+
+func TestSendPartialDeliveryNoneAccepted(t *testing.T) {
+	mockClient := NewMockSMTPClient()
+	mockClient.ShouldFailOn = "rcpt"
+
+	cfg := &config.Config{
+		FromAddr:        testFromAddr,
+		SmtpAddrs:       []string{testSMTPAddr},
+		Recipients:      []string{"a@domain.tld", "b@domain.tld"},
+		PartialDelivery: true,
+	}
+
+	email := &Email{
+		Config: cfg,
+		Body:   []byte("test email body"),
+	}
+
+	result, err := email.sendWithDialer(context.Background(), createMockDialer(mockClient, false))
+	if err == nil {
+		t.Fatal("sendWithDialer() should fail when no recipient is accepted")
+	}
+	if mockClient.MethodCallCount["Data"] != 0 {
+		t.Error("Data should not be called when no recipient is accepted")
+	}
+	if len(result.Accepted) != 0 || len(result.Rejected) != 2 {
+		t.Errorf("Unexpected result %+v", result)
+	}
+}
+
+func TestSendAllOrNothing(t *testing.T) {
+	mockClient := NewMockSMTPClient()
+	mockClient.FailOnRecipient = "b@domain.tld"
+
+	cfg := &config.Config{
+		FromAddr:     testFromAddr,
+		SmtpAddrs:    []string{testSMTPAddr},
+		Recipients:   []string{"a@domain.tld", "b@domain.tld", "c@domain.tld"},
+		AllOrNothing: true,
+	}
+
+	email := &Email{
+		Config: cfg,
+		Body:   []byte("test email body"),
+	}
+
+	result, err := email.sendWithDialer(context.Background(), createMockDialer(mockClient, false))
+	if err == nil {
+		t.Fatal("sendWithDialer() should fail when a recipient is rejected")
+	}
+
+	// The transaction is reset at the first rejection, before any data
+	if mockClient.MethodCallCount["Rcpt"] != 2 {
+		t.Errorf("Expected Rcpt to be called 2 times, got %d", mockClient.MethodCallCount["Rcpt"])
+	}
+	if mockClient.MethodCallCount["Reset"] != 1 {
+		t.Errorf("Expected Reset to be called once, got %d", mockClient.MethodCallCount["Reset"])
+	}
+	if mockClient.MethodCallCount["Data"] != 0 {
+		t.Error("Data should not be called when a recipient is rejected")
+	}
+	if len(result.Accepted) != 0 || len(result.Rejected) != 3 {
+		t.Errorf("Unexpected result %+v", result)
+	}
+}
+
+func TestSendQuitAfterFailedTransaction(t *testing.T) {
+	tests := []struct {
+		name          string
+		shouldFailOn  string
+		failRecipient string
+		stage         string
+	}{
+		{"Recipient rejected", "", "b@domain.tld", "rcpt"},
+		{"Recipient rejected and quit failing", "quit", "b@domain.tld", "rcpt"},
+		{"Data failing", "data", "", "data"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockClient := NewMockSMTPClient()
+			mockClient.ShouldFailOn = tt.shouldFailOn
+			mockClient.FailOnRecipient = tt.failRecipient
+
+			email := &Email{
+				Config: &config.Config{
+					FromAddr:   testFromAddr,
+					SmtpAddrs:  []string{testSMTPAddr},
+					Recipients: []string{"a@domain.tld", "b@domain.tld"},
+				},
+				Body: []byte("test email body"),
+			}
+
+			_, err := email.sendWithDialer(context.Background(), createMockDialer(mockClient, false))
+			if err == nil {
+				t.Fatal("sendWithDialer() should fail")
+			}
+
+			// The session is ended with QUIT, the original error is kept
+			if mockClient.MethodCallCount["Quit"] != 1 {
+				t.Errorf("Expected Quit to be called once, got %d", mockClient.MethodCallCount["Quit"])
+			}
+			if want := testSMTPAddr + ": " + tt.stage + ":"; !strings.Contains(err.Error(), want) {
+				t.Errorf("sendWithDialer() error = %v, want it to contain %q", err, want)
+			}
+		})
+	}
+}
+
+func TestSendMaxRecipientsPerMessage(t *testing.T) {
+	var recipients []string
+	for i := 0; i < 250; i++ {
+		recipients = append(recipients, fmt.Sprintf("rcpt%d@domain.tld", i))
+	}
+
+	mockClient := NewMockSMTPClient()
+	dials := 0
+	dialer := func(ctx context.Context, addr string) (SMTPClient, error) {
+		dials++
+		return mockClient, nil
+	}
+
+	email := &Email{
+		Config: &config.Config{
+			FromAddr:                testFromAddr,
+			SmtpAddrs:               []string{testSMTPAddr},
+			Recipients:              recipients,
+			MaxRecipientsPerMessage: 100,
+		},
+		Body: []byte("test email body"),
+	}
+
+	result, err := email.sendWithDialer(context.Background(), dialer)
+	if err != nil {
+		t.Fatalf("sendWithDialer() failed: %v", err)
+	}
+
+	// Three transactions over a single connection, each with the body
+	if dials != 1 {
+		t.Errorf("Expected 1 connection, got %d", dials)
+	}
+	for method, want := range map[string]int{"Mail": 3, "Rcpt": 250, "Data": 3, "Quit": 1} {
+		if got := mockClient.MethodCallCount[method]; got != want {
+			t.Errorf("Expected %s to be called %d times, got %d", method, want, got)
+		}
+	}
+	if !reflect.DeepEqual(result.Accepted, recipients) {
+		t.Errorf("Accepted %d recipients, want all 250", len(result.Accepted))
+	}
+}
+
+func TestSendMaxRecipientsPerMessageFailover(t *testing.T) {
+	recipients := []string{"a@domain.tld", "b@domain.tld", "c@domain.tld", "d@domain.tld", "e@domain.tld"}
+
+	// The first server fails on the second batch
+	failingClient := NewMockSMTPClient()
+	failingClient.FailOnRecipient = "c@domain.tld"
+	successfulClient := NewMockSMTPClient()
+	dialer := func(ctx context.Context, addr string) (SMTPClient, error) {
+		if addr == "smtp1.example.com:587" {
+			return failingClient, nil
+		}
+		return successfulClient, nil
+	}
+
+	email := &Email{
+		Config: &config.Config{
+			FromAddr:                testFromAddr,
+			SmtpAddrs:               []string{"smtp1.example.com:587", "smtp2.example.com:587"},
+			Recipients:              recipients,
+			MaxRecipientsPerMessage: 2,
+		},
+		Body: []byte("test email body"),
+	}
+
+	result, err := email.sendWithDialer(context.Background(), dialer)
+	if err != nil {
+		t.Fatalf("sendWithDialer() failed: %v", err)
+	}
+
+	// The batch already delivered is not sent again
+	if failingClient.MethodCallCount["Data"] != 1 {
+		t.Errorf("Expected 1 transaction through the first server, got %d", failingClient.MethodCallCount["Data"])
+	}
+	if successfulClient.MethodCallCount["Rcpt"] != 3 || successfulClient.MethodCallCount["Data"] != 2 {
+		t.Errorf("Second server got %d recipients in %d transactions, want 3 in 2", successfulClient.MethodCallCount["Rcpt"], successfulClient.MethodCallCount["Data"])
+	}
+	if !reflect.DeepEqual(result.Accepted, recipients) {
+		t.Errorf("Accepted = %v, want %v", result.Accepted, recipients)
+	}
+}
+
+func TestBatchRecipients(t *testing.T) {
+	recipients := []string{"a", "b", "c", "d", "e"}
+	tests := []struct {
+		size     int
+		expected [][]string
+	}{
+		{0, [][]string{{"a", "b", "c", "d", "e"}}},
+		{5, [][]string{{"a", "b", "c", "d", "e"}}},
+		{2, [][]string{{"a", "b"}, {"c", "d"}, {"e"}}},
+	}
+
+	for _, tt := range tests {
+		if got := batchRecipients(recipients, tt.size); !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("batchRecipients(%d) = %v, want %v", tt.size, got, tt.expected)
+		}
+	}
+}
+
+func TestSendDryRun(t *testing.T) {
+	mockClient := NewMockSMTPClient()
+
+	cfg := &config.Config{
+		FromAddr:   testFromAddr,
+		SmtpAddrs:  []string{testSMTPAddr},
+		Recipients: []string{"a@domain.tld", "b@domain.tld"},
+		DryRun:     true,
+	}
+
+	email := &Email{
+		Config: cfg,
+		Body:   []byte("test email body"),
+	}
+
+	result, err := email.sendWithDialer(context.Background(), createMockDialer(mockClient, false))
+	if err != nil {
+		t.Fatalf("sendWithDialer() failed in dry run: %v", err)
+	}
+
+	// The connection and TLS are exercised, the transaction is not
+	if mockClient.MethodCallCount["StartTLS"] != 1 {
+		t.Error("Expected StartTLS to be called in dry run")
+	}
+	for _, method := range []string{"Mail", "Rcpt", "Data"} {
+		if mockClient.MethodCallCount[method] != 0 {
+			t.Errorf("Expected %s not to be called in dry run, got %d calls", method, mockClient.MethodCallCount[method])
+		}
+	}
+	if len(mockClient.DataWriter.Written) != 0 {
+		t.Error("No body should be written in dry run")
+	}
+	if !reflect.DeepEqual(result.Accepted, cfg.Recipients) {
+		t.Errorf("Dry run result = %v, want %v", result.Accepted, cfg.Recipients)
+	}
+}
+
+func TestSendLoneDotLine(t *testing.T) {
+	mockClient := NewMockSMTPClient()
+	body := "To: a@domain.tld\n\nfirst\n.\nlast\n"
+
+	cfg := &config.Config{
+		FromAddr:   testFromAddr,
+		SmtpAddrs:  []string{testSMTPAddr},
+		Recipients: []string{"a@domain.tld"},
+		IgnoreDots: true,
+	}
+
+	email := &Email{
+		Config: cfg,
+		Body:   []byte(body),
+	}
+
+	if _, err := email.sendWithDialer(context.Background(), createMockDialer(mockClient, false)); err != nil {
+		t.Fatalf("sendWithDialer() failed unexpectedly: %v", err)
+	}
+
+	// The whole body reaches the DATA writer, which takes care of dot-stuffing
+	if string(mockClient.DataWriter.Written) != body {
+		t.Errorf("Written body = %q, want %q", mockClient.DataWriter.Written, body)
+	}
+}
+
+func TestSendShortWrites(t *testing.T) {
+	mockClient := NewMockSMTPClient()
+	mockClient.DataWriter.MaxWrite = 4
+	body := "To: a@domain.tld\n\nthe whole body\n"
+
+	email := &Email{
+		Config: &config.Config{
+			FromAddr:   testFromAddr,
+			SmtpAddrs:  []string{testSMTPAddr},
+			Recipients: []string{"a@domain.tld"},
+		},
+		Body: []byte(body),
+	}
+
+	if _, err := email.sendWithDialer(context.Background(), createMockDialer(mockClient, false)); err != nil {
+		t.Fatalf("sendWithDialer() failed unexpectedly: %v", err)
+	}
+
+	// The rest of the body is written after each short write
+	if string(mockClient.DataWriter.Written) != body {
+		t.Errorf("Written body = %q, want %q", mockClient.DataWriter.Written, body)
+	}
+	if want := (len(body) + 3) / 4; mockClient.DataWriter.Writes != want {
+		t.Errorf("Write called %d times, want %d", mockClient.DataWriter.Writes, want)
+	}
+}
+
+// stalledWriter accepts nothing without reporting an error
+type stalledWriter struct{}
+
+func (stalledWriter) Write(p []byte) (int, error) { return 0, nil }
+
+func TestWriteAllNoProgress(t *testing.T) {
+	if err := writeAll(stalledWriter{}, []byte("body")); !errors.Is(err, io.ErrShortWrite) {
+		t.Errorf("writeAll() error = %v, want %v", err, io.ErrShortWrite)
+	}
+	if err := writeAll(stalledWriter{}, nil); err != nil {
+		t.Errorf("writeAll() of nothing error = %v", err)
+	}
+}
+
+func TestSendDeadlineMidFailover(t *testing.T) {
+	dialCount := 0
+	dialer := func(ctx context.Context, addr string) (SMTPClient, error) {
+		dialCount++
+		// The first server is slow and then fails, using up the deadline
+		<-ctx.Done()
+		client := NewMockSMTPClient()
+		client.ShouldFailOn = "tls"
+		return client, nil
+	}
+
+	cfg := &config.Config{
+		FromAddr:   testFromAddr,
+		SmtpAddrs:  []string{"smtp1.example.com:587", "smtp2.example.com:587", "smtp3.example.com:587"},
+		Recipients: []string{"test@domain.tld"},
+	}
+
+	email := &Email{
+		Config: cfg,
+		Body:   []byte("test email body"),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	_, err := email.sendWithDialer(ctx, dialer)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("sendWithDialer() error = %v, want deadline exceeded", err)
+	}
+	if dialCount != 1 {
+		t.Errorf("Expected failover to stop after the deadline, got %d dials", dialCount)
+	}
+}
+
+func TestSendWithAuth(t *testing.T) {
+	tests := []struct {
+		name          string
+		user          string
+		failOn        string
+		expectedAuths int
+		expectError   bool
+	}{
+		{"no credentials", "", "", 0, false},
+		{"with credentials", "user", "", 1, false},
+		{"auth failure", "user", "auth", 1, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockClient := NewMockSMTPClient()
+			mockClient.ShouldFailOn = tt.failOn
+
+			cfg := &config.Config{
+				FromAddr:     testFromAddr,
+				SmtpAddrs:    []string{testSMTPAddr},
+				Recipients:   []string{"test@domain.tld"},
+				AuthUser:     tt.user,
+				AuthPassword: "secret",
+			}
+
+			email := &Email{
+				Config: cfg,
+				Body:   []byte("test email body"),
+			}
+
+			err := email.attemptRelayWithDialer(context.Background(), testSMTPAddr, createMockDialer(mockClient, false))
+			if (err != nil) != tt.expectError {
+				t.Errorf("attemptRelay() error = %v, expectError %v", err, tt.expectError)
+			}
+			if mockClient.MethodCallCount["Auth"] != tt.expectedAuths {
+				t.Errorf("Expected Auth to be called %d times, got %d", tt.expectedAuths, mockClient.MethodCallCount["Auth"])
+			}
+			if tt.expectError && mockClient.MethodCallCount["Mail"] != 0 {
+				t.Error("No transaction should start after a failed authentication")
+			}
+		})
+	}
+}
+
+func TestSendTLSServerName(t *testing.T) {
+	tests := []struct {
+		server   string
+		expected string
+	}{
+		{"smtp.example.com:587", "smtp.example.com"},
+		{"192.0.2.1:25", ""},
+		{"[2001:db8::1]:587", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.server, func(t *testing.T) {
+			mockClient := NewMockSMTPClient()
+			var dialed string
+			dialer := func(ctx context.Context, addr string) (SMTPClient, error) {
+				dialed = addr
+				return mockClient, nil
+			}
+
+			cfg := &config.Config{
+				FromAddr:   testFromAddr,
+				SmtpAddrs:  []string{tt.server},
+				Recipients: []string{"test@domain.tld"},
+			}
+
+			email := &Email{
+				Config: cfg,
+				Body:   []byte("test email body"),
+			}
+
+			if _, err := email.sendWithDialer(context.Background(), dialer); err != nil {
+				t.Fatalf("sendWithDialer() failed: %v", err)
+			}
+			if dialed != tt.server {
+				t.Errorf("Dialed %q, want %q", dialed, tt.server)
+			}
+			if mockClient.TLSConfig.ServerName != tt.expected {
+				t.Errorf("TLS ServerName = %q, want %q", mockClient.TLSConfig.ServerName, tt.expected)
+			}
+		})
+	}
+}
+
+func TestSendTLSClientCertificate(t *testing.T) {
+	cert := &tls.Certificate{Certificate: [][]byte{[]byte("client certificate")}}
+
+	for _, tt := range []struct {
+		name string
+		cert *tls.Certificate
+	}{
+		{"With certificate", cert},
+		{"Without certificate", nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mockClient := NewMockSMTPClient()
+			email := &Email{
+				Config: &config.Config{
+					FromAddr:   testFromAddr,
+					SmtpAddrs:  []string{testSMTPAddr},
+					Recipients: []string{"test@domain.tld"},
+					ClientCert: tt.cert,
+				},
+				Body: []byte("test email body"),
+			}
+
+			if _, err := email.sendWithDialer(context.Background(), createMockDialer(mockClient, false)); err != nil {
+				t.Fatalf("sendWithDialer() failed: %v", err)
+			}
+
+			certs := mockClient.TLSConfig.Certificates
+			if tt.cert == nil {
+				if len(certs) != 0 {
+					t.Errorf("TLS config has %d certificates, want none", len(certs))
+				}
+				return
+			}
+			if len(certs) != 1 || !reflect.DeepEqual(certs[0], *tt.cert) {
+				t.Errorf("TLS config certificates = %v, want the client certificate", certs)
+			}
+		})
+	}
+}
+
+func TestSendMailParameters(t *testing.T) {
+	ascii := "Subject: plain\n\nHello"
+	utf8 := "Subject: accented\n\nHéllo"
+
+	tests := []struct {
+		name       string
+		extensions map[string]string
+		body       string
+		expected   []string
+	}{
+		{"No extensions", nil, ascii, nil},
+		{"SIZE", map[string]string{"SIZE": "10240000"}, ascii, []string{"SIZE=" + strconv.Itoa(len(ascii))}},
+		{"8BITMIME with 7-bit body", map[string]string{"8BITMIME": ""}, ascii, nil},
+		{"8BITMIME with 8-bit body", map[string]string{"8BITMIME": ""}, utf8, []string{"BODY=8BITMIME"}},
+		{"Both", map[string]string{"SIZE": "", "8BITMIME": ""}, utf8, []string{"SIZE=" + strconv.Itoa(len(utf8)), "BODY=8BITMIME"}},
+		{"SMTPUTF8", map[string]string{"SMTPUTF8": ""}, ascii, []string{"SMTPUTF8"}},
+		{"All", map[string]string{"SIZE": "", "8BITMIME": "", "SMTPUTF8": ""}, utf8, []string{"SIZE=" + strconv.Itoa(len(utf8)), "BODY=8BITMIME", "SMTPUTF8"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockClient := NewMockSMTPClient()
+			mockClient.Extensions = tt.extensions
+
+			email := &Email{
+				Config: &config.Config{
+					FromAddr:   testFromAddr,
+					SmtpAddrs:  []string{testSMTPAddr},
+					Recipients: []string{"rcpt@domain.tld"},
+				},
+				Body: []byte(tt.body),
+			}
+
+			if _, err := email.sendWithDialer(context.Background(), createMockDialer(mockClient, false)); err != nil {
+				t.Fatalf("sendWithDialer() failed: %v", err)
+			}
+			if !reflect.DeepEqual(mockClient.MailParams, tt.expected) {
+				t.Errorf("MAIL FROM parameters = %q, want %q", mockClient.MailParams, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRealSMTPClientMailParameters(t *testing.T) {
+	client, server := net.Pipe()
+	received := make(chan string, 1)
+	go func() {
+		defer server.Close()
+		r := bufio.NewReader(server)
+		fmt.Fprint(server, "220 smtp.example.com ready\r\n")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch {
+			case strings.HasPrefix(line, "EHLO"):
+				fmt.Fprint(server, "250-smtp.example.com\r\n250-SIZE 1000\r\n250 8BITMIME\r\n")
+			case strings.HasPrefix(line, "MAIL"):
+				received <- strings.TrimRight(line, "\r\n")
+				fmt.Fprint(server, "250 ok\r\n")
+			default:
+				fmt.Fprint(server, "221 bye\r\n")
+				return
+			}
+		}
+	}()
+
+	c, err := smtp.NewClient(client, "smtp.example.com")
+	if err != nil {
+		t.Fatalf("NewClient() failed: %v", err)
+	}
+	defer c.Close()
+
+	if err := (&RealSMTPClient{Client: c}).Mail(testFromAddr, "SIZE=42", "BODY=8BITMIME"); err != nil {
+		t.Fatalf("Mail() failed: %v", err)
+	}
+	if got, want := <-received, "MAIL FROM:<"+testFromAddr+"> SIZE=42 BODY=8BITMIME"; got != want {
+		t.Errorf("Mail() sent %q, want %q", got, want)
+	}
+}
+
+func TestSendQuiet(t *testing.T) {
+	tests := []struct {
+		name       string
+		quiet      bool
+		wantOutput bool
+	}{
+		{"Verbose", false, true},
+		{"Quiet overriding verbose", true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			log.SetOutput(&logs)
+			defer log.SetOutput(os.Stderr)
+
+			// Capture stdout, which used to get the success line
+			stdout := os.Stdout
+			r, w, err := os.Pipe()
+			if err != nil {
+				t.Fatalf("Failed to create pipe: %v", err)
+			}
+			os.Stdout = w
+			defer func() { os.Stdout = stdout }()
+
+			cfg := &config.Config{
+				FromAddr:   testFromAddr,
+				SmtpAddrs:  []string{testSMTPAddr},
+				Recipients: []string{"a@domain.tld"},
+				BeVerbose:  true,
+				Quiet:      tt.quiet,
+			}
+			if err := cfg.Prepare(); err != nil {
+				t.Fatalf("Prepare() error = %v", err)
+			}
+			email := &Email{Config: cfg, Body: []byte("test email body")}
+			_, sendErr := email.sendWithDialer(context.Background(), createMockDialer(NewMockSMTPClient(), false))
+
+			w.Close()
+			os.Stdout = stdout
+			printed, _ := io.ReadAll(r)
+			if sendErr != nil {
+				t.Fatalf("sendWithDialer() failed: %v", sendErr)
+			}
+			if len(printed) != 0 {
+				t.Errorf("Printed %q on stdout", printed)
+			}
+			if got := logs.Len() > 0; got != tt.wantOutput {
+				t.Errorf("Logged %q, want output %v", logs.String(), tt.wantOutput)
+			}
+		})
+	}
+}
+
+func TestSendNoopBeforeMail(t *testing.T) {
+	// The first server dropped the idle connection, the second answers
+	stale := NewMockSMTPClient()
+	stale.ShouldFailOn = "noop"
+	live := NewMockSMTPClient()
+	clients := map[string]*MockSMTPClient{"stale.example.com:25": stale, "live.example.com:25": live}
+	dialer := func(ctx context.Context, addr string) (SMTPClient, error) {
+		return clients[addr], nil
+	}
+
+	email := &Email{
+		Config: &config.Config{
+			FromAddr:                testFromAddr,
+			SmtpAddrs:               []string{"stale.example.com:25", "live.example.com:25"},
+			Recipients:              []string{"a@domain.tld", "b@domain.tld"},
+			MaxRecipientsPerMessage: 1,
+			NoRandomize:             true,
+		},
+		Body: []byte("test email body"),
+	}
+	result, err := email.sendWithDialer(context.Background(), dialer)
+	if err != nil {
+		t.Fatalf("sendWithDialer() error = %v", err)
+	}
+
+	// No transaction starts on a connection failing the ping
+	if stale.MethodCallCount["Noop"] != 1 || stale.MethodCallCount["Mail"] != 0 {
+		t.Errorf("stale server got %d pings and %d transactions, want 1 and 0", stale.MethodCallCount["Noop"], stale.MethodCallCount["Mail"])
+	}
+	if stale.MethodCallCount["Quit"] != 1 {
+		t.Error("Expected the stale session to be ended with QUIT")
+	}
+
+	// Each batch is preceded by its own ping
+	if live.MethodCallCount["Noop"] != 2 || live.MethodCallCount["Mail"] != 2 {
+		t.Errorf("live server got %d pings and %d transactions, want 2 each", live.MethodCallCount["Noop"], live.MethodCallCount["Mail"])
+	}
+	if result.Server != "live.example.com:25" {
+		t.Errorf("Server = %q, want the live server", result.Server)
+	}
+}
+
+func TestMessageLimits(t *testing.T) {
+	body := "To: a@domain.tld, b@domain.tld\nSubject: Limits\n\nBody\n"
+	tests := []struct {
+		name    string
+		cfg     config.Config
+		wantErr error
+	}{
+		{"No limits", config.Config{}, nil},
+		{"Recipients at the limit", config.Config{MaxRecipients: 2}, nil},
+		{"Too many recipients", config.Config{MaxRecipients: 1}, ErrTooManyRecipients},
+		{"Archive address not counted", config.Config{MaxRecipients: 2, AlwaysBcc: "archive@domain.tld"}, nil},
+		{"Size at the limit", config.Config{MaxMessageSize: len(body)}, nil},
+		{"Message too large", config.Config{MaxMessageSize: len(body) - 1}, ErrMessageTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			cfg.FromAddr = testFromAddr
+			cfg.SmtpAddrs = []string{testSMTPAddr}
+
+			_, err := New(&cfg, []byte(body))
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Errorf("New() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
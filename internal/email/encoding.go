@@ -0,0 +1,86 @@
+package email
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"strings"
+)
+
+// headerValue returns the unfolded value of the first header with the
+// given name
+func headerValue(lines []string, name string) string {
+	name = strings.ToLower(name)
+	var value strings.Builder
+	found := false
+	for _, line := range lines {
+		if n := headerName(line); n != "" {
+			if found {
+				break
+			}
+			if n == name {
+				found = true
+				_, v, _ := strings.Cut(line, ":")
+				value.WriteString(strings.TrimSpace(v))
+			}
+			continue
+		}
+		if found {
+			value.WriteString(" " + strings.TrimSpace(line))
+		}
+	}
+	return value.String()
+}
+
+// declaresEncoding reports whether the message declares its
+// Content-Transfer-Encoding, leaving 8-bit content to the recipient's MIME
+// handling
+func (e *Email) declaresEncoding() bool {
+	lines, _, _ := splitHeader(e.Body)
+	return hasHeader(lines, "Content-Transfer-Encoding")
+}
+
+// encodeQuotedPrintable encodes a single part 8-bit body without a declared
+// Content-Transfer-Encoding as quoted-printable, adding the MIME headers
+// describing it
+func (e *Email) encodeQuotedPrintable() error {
+	lines, rest, eol := splitHeader(e.Body)
+	if hasHeader(lines, "Content-Transfer-Encoding") || !has8Bit(rest) {
+		return nil
+	}
+
+	// The parts of a multipart message carry their own encodings
+	contentType := headerValue(lines, "Content-Type")
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil && strings.HasPrefix(mediaType, "multipart/") {
+		return fmt.Errorf("cannot quoted-printable encode a %s message, its parts must declare their encoding", mediaType)
+	}
+
+	// Drop the empty separator line, it is written back below
+	body := bytes.TrimPrefix(bytes.TrimPrefix(rest, []byte("\r\n")), []byte("\n"))
+
+	var encoded bytes.Buffer
+	w := quotedprintable.NewWriter(&encoded)
+	if _, err := w.Write(body); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	if n := len(lines); n > 0 && !strings.HasSuffix(lines[n-1], "\n") {
+		lines[n-1] += eol
+	}
+	if !hasHeader(lines, "MIME-Version") {
+		lines = append(lines, "MIME-Version: 1.0"+eol)
+	}
+	if contentType == "" {
+		lines = append(lines, "Content-Type: text/plain; charset=utf-8"+eol)
+	}
+	lines = append(lines, "Content-Transfer-Encoding: quoted-printable"+eol)
+
+	// The encoder always ends lines with CRLF
+	qp := bytes.ReplaceAll(encoded.Bytes(), []byte("\r\n"), []byte(eol))
+	e.Body = joinHeader(lines, append([]byte(eol), qp...))
+	return nil
+}
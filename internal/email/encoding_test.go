@@ -0,0 +1,78 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+)
+
+func TestSend8BitBodies(t *testing.T) {
+	ascii := "To: rcpt@domain.tld\r\nSubject: plain\r\n\r\nHello\r\n"
+	declared := "To: rcpt@domain.tld\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\nHéllo\r\n"
+	undeclared := "To: rcpt@domain.tld\r\nSubject: accented\r\n\r\nHéllo wörld\r\n"
+
+	tests := []struct {
+		name       string
+		body       string
+		extensions map[string]string
+		forceQP    bool
+		wantErr    bool
+		expected   string
+	}{
+		{"ASCII only", ascii, nil, false, false, ascii},
+		{"Declared 8-bit", declared, nil, false, false, declared},
+		{"Undeclared 8-bit with 8BITMIME", undeclared, map[string]string{"8BITMIME": ""}, false, false, undeclared},
+		{"Undeclared 8-bit without 8BITMIME", undeclared, nil, false, true, ""},
+		{
+			"Undeclared 8-bit encoded", undeclared, nil, true, false,
+			"To: rcpt@domain.tld\r\nSubject: accented\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n" +
+				"Content-Transfer-Encoding: quoted-printable\r\n\r\nH=C3=A9llo w=C3=B6rld\r\n",
+		},
+		{"Declared 8-bit is not encoded", declared, nil, true, false, declared},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{
+				FromAddr:             testFromAddr,
+				SmtpAddrs:            []string{testSMTPAddr},
+				ForceQuotedPrintable: tt.forceQP,
+			}
+			email, err := New(cfg, []byte(tt.body))
+			if err != nil {
+				t.Fatalf("New() failed: %v", err)
+			}
+
+			mockClient := NewMockSMTPClient()
+			mockClient.Extensions = tt.extensions
+			_, err = email.sendWithDialer(context.Background(), createMockDialer(mockClient, false))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("sendWithDialer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				var deliveryErr *DeliveryError
+				if !errors.As(err, &deliveryErr) || deliveryErr.Kind != PermanentFailure {
+					t.Errorf("sendWithDialer() error = %v, want a permanent failure", err)
+				}
+				if mockClient.MethodCallCount["Mail"] != 0 {
+					t.Error("Mail should not be sent for undeclared 8-bit content")
+				}
+				return
+			}
+			if got := string(mockClient.DataWriter.Written); got != tt.expected {
+				t.Errorf("Transmitted message = %q, want %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestEncodeQuotedPrintableMultipart(t *testing.T) {
+	body := "Content-Type: multipart/mixed; boundary=x\n\n--x\n\nHéllo\n--x--\n"
+	email := &Email{Config: &config.Config{}, Body: []byte(body)}
+	if err := email.encodeQuotedPrintable(); err == nil || !strings.Contains(err.Error(), "multipart/mixed") {
+		t.Errorf("encodeQuotedPrintable() error = %v, want a multipart refusal", err)
+	}
+}
@@ -0,0 +1,80 @@
+package email
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"os"
+	"path/filepath"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+)
+
+// Envelope describes a message stored apart from its envelope, as mail
+// spools do. Body is the path of the message, relative paths are resolved
+// against the directory of the envelope file.
+//
+//	{"from": "sender@example.com", "to": ["rcpt@example.com"], "body": "msg.eml"}
+type Envelope struct {
+	From string   `json:"from"`
+	To   []string `json:"to"`
+	Body string   `json:"body"`
+}
+
+// ReadEnvelope reads and validates an envelope file
+func ReadEnvelope(path string) (*Envelope, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	env := &Envelope{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(env); err != nil {
+		return nil, fmt.Errorf("invalid envelope %s: %w", path, err)
+	}
+
+	if len(env.To) == 0 {
+		return nil, fmt.Errorf("invalid envelope %s: no recipients", path)
+	}
+	if env.Body == "" {
+		return nil, fmt.Errorf("invalid envelope %s: no body", path)
+	}
+	if !filepath.IsAbs(env.Body) {
+		env.Body = filepath.Join(filepath.Dir(path), env.Body)
+	}
+	return env, nil
+}
+
+// NewFromEnvelope creates an email for the envelope sender and recipients,
+// reading the message from the envelope body without parsing its headers
+func NewFromEnvelope(cfg *config.Config, env *Envelope) (*Email, error) {
+	if env.From != "" {
+		sender, err := mail.ParseAddress(env.From)
+		if err != nil {
+			return nil, fmt.Errorf("invalid envelope sender %q: %w", env.From, err)
+		}
+		cfg.FromAddr = sender.Address
+	}
+	if cfg.FromAddr == "" {
+		return nil, errors.New("no sender in envelope or configuration")
+	}
+
+	body, err := os.ReadFile(env.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.Recipients = append([]string{}, env.To...)
+	email := &Email{
+		Config: cfg,
+		Body:   body,
+	}
+	if err := email.prepare(); err != nil {
+		return nil, err
+	}
+	return email, nil
+}
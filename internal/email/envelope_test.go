@@ -0,0 +1,85 @@
+package email
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+)
+
+func writeEnvelope(t *testing.T, envelope string) string {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "msg.eml"), []byte("To: other@domain.tld\n\nBody"), 0600); err != nil {
+		t.Fatalf("Failed to write message: %v", err)
+	}
+	path := filepath.Join(dir, "envelope.json")
+	if err := os.WriteFile(path, []byte(envelope), 0600); err != nil {
+		t.Fatalf("Failed to write envelope: %v", err)
+	}
+	return path
+}
+
+func TestReadEnvelope(t *testing.T) {
+	path := writeEnvelope(t, `{"from": "Spool <spool@example.com>", "to": ["a@domain.tld", "b@domain.tld"], "body": "msg.eml"}`)
+
+	env, err := ReadEnvelope(path)
+	if err != nil {
+		t.Fatalf("ReadEnvelope() failed: %v", err)
+	}
+	if env.Body != filepath.Join(filepath.Dir(path), "msg.eml") {
+		t.Errorf("Body = %q, want a path next to the envelope", env.Body)
+	}
+
+	cfg := &config.Config{SmtpAddrs: []string{testSMTPAddr}}
+	email, err := NewFromEnvelope(cfg, env)
+	if err != nil {
+		t.Fatalf("NewFromEnvelope() failed: %v", err)
+	}
+
+	// The envelope wins over the message headers
+	if !reflect.DeepEqual(cfg.Recipients, []string{"a@domain.tld", "b@domain.tld"}) {
+		t.Errorf("Recipients = %v", cfg.Recipients)
+	}
+	if cfg.FromAddr != "spool@example.com" {
+		t.Errorf("FromAddr = %q, want spool@example.com", cfg.FromAddr)
+	}
+	if string(email.Body) != "To: other@domain.tld\n\nBody" {
+		t.Errorf("Body = %q", email.Body)
+	}
+}
+
+func TestReadEnvelopeErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		envelope string
+	}{
+		{"malformed JSON", `{"to": ["a@domain.tld"], "body": "msg.eml"`},
+		{"unknown field", `{"to": ["a@domain.tld"], "body": "msg.eml", "cc": ["b@domain.tld"]}`},
+		{"no recipients", `{"from": "spool@example.com", "to": [], "body": "msg.eml"}`},
+		{"no body", `{"to": ["a@domain.tld"]}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ReadEnvelope(writeEnvelope(t, tt.envelope)); err == nil {
+				t.Error("ReadEnvelope() should fail on a malformed envelope")
+			}
+		})
+	}
+
+	// Envelopes without a sender need one configured
+	env, err := ReadEnvelope(writeEnvelope(t, `{"to": ["a@domain.tld"], "body": "msg.eml"}`))
+	if err != nil {
+		t.Fatalf("ReadEnvelope() failed: %v", err)
+	}
+	if _, err := NewFromEnvelope(&config.Config{SmtpAddrs: []string{testSMTPAddr}}, env); err == nil {
+		t.Error("NewFromEnvelope() should fail without a sender")
+	}
+
+	env.Body = filepath.Join(t.TempDir(), "missing.eml")
+	if _, err := NewFromEnvelope(&config.Config{FromAddr: testFromAddr, SmtpAddrs: []string{testSMTPAddr}}, env); err == nil {
+		t.Error("NewFromEnvelope() should fail when the body is missing")
+	}
+}
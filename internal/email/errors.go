@@ -0,0 +1,186 @@
+package email
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"strings"
+
+	"github.com/kiinoda/mailrelay/internal/exitcode"
+)
+
+// FailureKind categorizes why an email could not be delivered
+type FailureKind int
+
+const (
+	// TemporaryFailure covers 4xx replies and network errors, the
+	// email may be delivered if tried again later
+	TemporaryFailure FailureKind = iota
+
+	// PermanentFailure covers 5xx replies outside of recipient handling
+	PermanentFailure
+
+	// RecipientFailure covers 5xx replies rejecting a recipient
+	RecipientFailure
+)
+
+// DeliveryError is returned by Send when the email could not be delivered
+type DeliveryError struct {
+	Kind FailureKind
+	Err  error
+}
+
+func (e *DeliveryError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *DeliveryError) Unwrap() error {
+	return e.Err
+}
+
+// ExitCode maps the failure to a sysexits exit code, so that calling MTAs
+// can requeue temporary failures
+func (e *DeliveryError) ExitCode() int {
+	switch e.Kind {
+	case PermanentFailure:
+		return exitcode.NoPerm
+	case RecipientFailure:
+		return exitcode.NoUser
+	default:
+		return exitcode.TempFail
+	}
+}
+
+// combinedKind categorizes the failure of several transactions. Any
+// temporary failure makes retrying worthwhile, and the failure only counts
+// as rejecting recipients when every transaction failed that way.
+func combinedKind(errs []error) FailureKind {
+	kind := classify(errs[0])
+	for _, err := range errs[1:] {
+		if k := classify(err); k < kind {
+			kind = k
+		}
+	}
+	return kind
+}
+
+// recipientError marks an error returned by the server for a recipient
+type recipientError struct {
+	recipient string
+	err       error
+}
+
+func (e *recipientError) Error() string {
+	return e.recipient + ": " + e.err.Error()
+}
+
+func (e *recipientError) Unwrap() error {
+	return e.err
+}
+
+// attemptError records the stage of the SMTP session at which a delivery
+// attempt through a server failed
+type attemptError struct {
+	server string
+	stage  string
+	err    error
+}
+
+func (e *attemptError) Error() string {
+	if e.server == "" {
+		return e.stage + ": " + e.err.Error()
+	}
+	return e.server + ": " + e.stage + ": " + e.err.Error()
+}
+
+func (e *attemptError) Unwrap() error {
+	return e.err
+}
+
+// atStage tags an error with the stage of the SMTP session it occurred in,
+// one of dns, dial, tls, auth, reset, noop, mail, rcpt, data or quit, or
+// maildir or mbox for local targets
+func atStage(stage string, err error) error {
+	return &attemptError{stage: stage, err: err}
+}
+
+// attemptAt records a failed attempt through the server
+func attemptAt(server string, err error) *attemptError {
+	attempt, ok := err.(*attemptError)
+	if !ok {
+		attempt = &attemptError{stage: "session", err: err}
+	}
+	attempt.server = server
+	return attempt
+}
+
+// SendError is returned when no server accepted the email, with the failed
+// attempt of every server tried
+type SendError struct {
+	attempts []*attemptError
+	cause    error // set when the deadline cut the failover short
+}
+
+func (e *SendError) Error() string {
+	msg := strings.Join(e.Attempts(), "; ")
+	if e.cause != nil {
+		return fmt.Sprintf("%v after trying %s", e.cause, msg)
+	}
+	return msg
+}
+
+// Unwrap exposes the deadline and the last failure, which determines how
+// the failure is classified
+func (e *SendError) Unwrap() []error {
+	var errs []error
+	if e.cause != nil {
+		errs = append(errs, e.cause)
+	}
+	if n := len(e.attempts); n > 0 {
+		errs = append(errs, e.attempts[n-1])
+	}
+	return errs
+}
+
+// Attempts describes each failed attempt as "server: stage: error"
+func (e *SendError) Attempts() []string {
+	lines := make([]string, len(e.attempts))
+	for i, attempt := range e.attempts {
+		lines[i] = attempt.Error()
+	}
+	return lines
+}
+
+// errUndeclared8Bit is returned for 8-bit content the server cannot be
+// told about
+var errUndeclared8Bit = errors.New("message has 8-bit content without a Content-Transfer-Encoding and the server does not support 8BITMIME, enable quoted-printable encoding to send it")
+
+// classify determines the failure kind from the SMTP reply wrapped in err
+func classify(err error) FailureKind {
+	// Keep the kind of failures classified already
+	var deliveryErr *DeliveryError
+	if errors.As(err, &deliveryErr) {
+		return deliveryErr.Kind
+	}
+
+	// Content the server cannot take will not be accepted later either
+	if errors.Is(err, errUndeclared8Bit) {
+		return PermanentFailure
+	}
+
+	// Neither will domains refusing all mail
+	if errors.Is(err, errNullMX) {
+		return PermanentFailure
+	}
+
+	var protoErr *textproto.Error
+	if !errors.As(err, &protoErr) || protoErr.Code < 500 {
+		return TemporaryFailure
+	}
+
+	var rcptErr *recipientError
+	if errors.As(err, &rcptErr) {
+		return RecipientFailure
+	}
+	return PermanentFailure
+}
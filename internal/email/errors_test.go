@@ -0,0 +1,168 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"net/textproto"
+	"reflect"
+	"testing"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+	"github.com/kiinoda/mailrelay/internal/exitcode"
+)
+
+func TestDeliveryErrorExitCodes(t *testing.T) {
+	tests := []struct {
+		name         string
+		failOn       string
+		failWith     error
+		expectedKind FailureKind
+		expectedCode int
+	}{
+		{"network error", "tls", errors.New("connection reset"), TemporaryFailure, exitcode.TempFail},
+		{"4xx on sender", "mail", &textproto.Error{Code: 451, Msg: "try again later"}, TemporaryFailure, exitcode.TempFail},
+		{"4xx on recipient", "rcpt", &textproto.Error{Code: 452, Msg: "mailbox full"}, TemporaryFailure, exitcode.TempFail},
+		{"5xx on sender", "mail", &textproto.Error{Code: 550, Msg: "relay denied"}, PermanentFailure, exitcode.NoPerm},
+		{"5xx on data", "data", &textproto.Error{Code: 554, Msg: "transaction failed"}, PermanentFailure, exitcode.NoPerm},
+		{"5xx on recipient", "rcpt", &textproto.Error{Code: 550, Msg: "no such user"}, RecipientFailure, exitcode.NoUser},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockClient := NewMockSMTPClient()
+			mockClient.ShouldFailOn = tt.failOn
+			mockClient.FailWith = tt.failWith
+
+			cfg := &config.Config{
+				FromAddr:   testFromAddr,
+				SmtpAddrs:  []string{testSMTPAddr},
+				Recipients: []string{"test@domain.tld"},
+			}
+
+			email := &Email{
+				Config: cfg,
+				Body:   []byte("test email body"),
+			}
+
+			_, err := email.sendWithDialer(context.Background(), createMockDialer(mockClient, false))
+			var deliveryErr *DeliveryError
+			if !errors.As(err, &deliveryErr) {
+				t.Fatalf("sendWithDialer() error = %v, want a DeliveryError", err)
+			}
+			if deliveryErr.Kind != tt.expectedKind {
+				t.Errorf("DeliveryError.Kind = %v, want %v", deliveryErr.Kind, tt.expectedKind)
+			}
+			if code := deliveryErr.ExitCode(); code != tt.expectedCode {
+				t.Errorf("DeliveryError.ExitCode() = %d, want %d", code, tt.expectedCode)
+			}
+		})
+	}
+}
+
+func TestSendErrorListsAttempts(t *testing.T) {
+	clients := map[string]*MockSMTPClient{
+		"smtp2.example.com:587": NewMockSMTPClient(),
+		"smtp3.example.com:587": NewMockSMTPClient(),
+	}
+	clients["smtp2.example.com:587"].ShouldFailOn = "tls"
+	clients["smtp3.example.com:587"].FailWith = &textproto.Error{Code: 550, Msg: "no such user"}
+	clients["smtp3.example.com:587"].ShouldFailOn = "rcpt"
+
+	dialer := func(ctx context.Context, addr string) (SMTPClient, error) {
+		if client, ok := clients[addr]; ok {
+			return client, nil
+		}
+		return nil, errors.New("connection refused")
+	}
+
+	cfg := &config.Config{
+		FromAddr:   testFromAddr,
+		SmtpAddrs:  []string{"smtp1.example.com:587", "smtp2.example.com:587", "smtp3.example.com:587"},
+		Recipients: []string{"test@domain.tld"},
+	}
+	email := &Email{
+		Config: cfg,
+		Body:   []byte("test email body"),
+	}
+
+	_, err := email.sendWithDialer(context.Background(), dialer)
+	var sendErr *SendError
+	if !errors.As(err, &sendErr) {
+		t.Fatalf("sendWithDialer() error = %v, want a SendError", err)
+	}
+
+	expected := []string{
+		"smtp1.example.com:587: dial: connection refused",
+		"smtp2.example.com:587: tls: mock TLS error",
+		`smtp3.example.com:587: rcpt: test@domain.tld: 550 "no such user"`,
+	}
+	if got := sendErr.Attempts(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("SendError.Attempts() = %q, want %q", got, expected)
+	}
+
+	// The last failure decides the classification
+	if classify(err) != RecipientFailure {
+		t.Errorf("classify() = %v, want RecipientFailure", classify(err))
+	}
+}
+
+func TestCombinedKind(t *testing.T) {
+	temporary := &textproto.Error{Code: 451, Msg: "try again later"}
+	permanent := &textproto.Error{Code: 554, Msg: "transaction failed"}
+	rejected := &recipientError{recipient: "a@domain.tld", err: &textproto.Error{Code: 550, Msg: "no such user"}}
+
+	tests := []struct {
+		name     string
+		errs     []error
+		expected FailureKind
+	}{
+		{"Only recipients rejected", []error{rejected, rejected}, RecipientFailure},
+		{"Recipients rejected and permanent", []error{rejected, permanent}, PermanentFailure},
+		{"Any temporary", []error{permanent, temporary, rejected}, TemporaryFailure},
+		{"Already classified", []error{&DeliveryError{Kind: RecipientFailure, Err: rejected}}, RecipientFailure},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if kind := combinedKind(tt.errs); kind != tt.expected {
+				t.Errorf("combinedKind() = %v, want %v", kind, tt.expected)
+			}
+		})
+	}
+}
+
+func TestSplitSendRecipientFailure(t *testing.T) {
+	// Every transaction rejects its recipients
+	dialer := func(ctx context.Context, addr string) (SMTPClient, error) {
+		client := NewMockSMTPClient()
+		client.ShouldFailOn = "rcpt"
+		client.FailWith = &textproto.Error{Code: 550, Msg: "no such user"}
+		return client, nil
+	}
+
+	tests := []struct {
+		name string
+		cfg  *config.Config
+	}{
+		{"Parallel batches", &config.Config{Parallelism: 2}},
+		{"Sender groups", &config.Config{SenderRules: map[string]string{"gmail.com": "gmail-sender@example.com"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.FromAddr = testFromAddr
+			tt.cfg.SmtpAddrs = []string{testSMTPAddr}
+			tt.cfg.Recipients = []string{"a@gmail.com", "b@domain.tld"}
+			email := &Email{Config: tt.cfg, Body: []byte("test email body")}
+
+			_, err := email.sendWithDialer(context.Background(), dialer)
+			var deliveryErr *DeliveryError
+			if !errors.As(err, &deliveryErr) {
+				t.Fatalf("sendWithDialer() error = %v, want a DeliveryError", err)
+			}
+			if code := deliveryErr.ExitCode(); code != exitcode.NoUser {
+				t.Errorf("DeliveryError.ExitCode() = %d, want %d", code, exitcode.NoUser)
+			}
+		})
+	}
+}
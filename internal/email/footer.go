@@ -0,0 +1,131 @@
+package email
+
+import (
+	"bytes"
+	"log"
+	"mime"
+	"strings"
+)
+
+// addFooter appends the footer to plain text messages and, with
+// FooterMultipart, to the first plain text part of multipart messages.
+// Bodies the footer cannot be appended to as text are left alone.
+func (e *Email) addFooter() {
+	lines, rest, eol := splitHeader(e.Body)
+	footer := strings.ReplaceAll(strings.TrimRight(e.Config.Footer, "\r\n"), "\r\n", "\n")
+	footer = strings.ReplaceAll(footer, "\n", eol)
+
+	mediaType, params := mediaTypeOf(lines)
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/"):
+		if !e.Config.FooterMultipart {
+			log.Println("not adding the footer to a multipart message")
+			return
+		}
+		body, ok := footerInPart(rest, params["boundary"], footer, eol)
+		if !ok {
+			log.Println("not adding the footer, the message has no plain text part")
+			return
+		}
+		e.Body = joinHeader(lines, body)
+	case mediaType == "text/plain" && identityEncoding(lines):
+		// Keep the empty separator line, even before an empty body
+		sep, body := cutLine(rest)
+		body = bytes.TrimRight(body, "\r\n")
+		var b bytes.Buffer
+		b.WriteString(sep + eol)
+		if len(body) > 0 {
+			b.Write(body)
+			b.WriteString(eol)
+		}
+		b.WriteString(footer + eol)
+		e.Body = joinHeader(lines, b.Bytes())
+	default:
+		log.Println("not adding the footer to a", mediaType, "message")
+	}
+}
+
+// footerInPart appends the footer to the first plain text part of the
+// multipart body, looking into nested multipart parts, and reports whether
+// there was one
+func footerInPart(body []byte, boundary, footer, eol string) ([]byte, bool) {
+	if boundary == "" {
+		return nil, false
+	}
+
+	// Find the delimiter lines, each part runs from the end of one to the
+	// start of the next
+	delimiter := "--" + boundary
+	var starts, ends []int
+	for off := 0; off < len(body); {
+		next := len(body)
+		if end := bytes.IndexByte(body[off:], '\n'); end >= 0 {
+			next = off + end + 1
+		}
+		line := string(bytes.TrimRight(body[off:next], " \t\r\n"))
+		if line == delimiter+"--" {
+			starts = append(starts, off)
+			break
+		}
+		if line == delimiter {
+			starts = append(starts, off)
+			ends = append(ends, next)
+		}
+		off = next
+	}
+
+	for i := 0; i < len(ends) && i+1 < len(starts); i++ {
+		// The line ending before a delimiter belongs to the delimiter
+		part := bytes.TrimSuffix(body[ends[i]:starts[i+1]], []byte("\n"))
+		part = bytes.TrimSuffix(part, []byte("\r"))
+		partEnd := ends[i] + len(part)
+
+		lines, rest, _ := splitHeader(part)
+		mediaType, params := mediaTypeOf(lines)
+		switch {
+		case strings.HasPrefix(mediaType, "multipart/"):
+			contentStart := partEnd - len(rest)
+			if inner, ok := footerInPart(rest, params["boundary"], footer, eol); ok {
+				return concat(body[:contentStart], inner, body[partEnd:]), true
+			}
+		case mediaType == "text/plain" && identityEncoding(lines) && !isAttachment(lines):
+			return concat(body[:partEnd], []byte(eol+footer), body[partEnd:]), true
+		}
+	}
+	return nil, false
+}
+
+// mediaTypeOf returns the lowercased media type of the header lines and
+// its parameters, text/plain when there is no Content-Type header
+func mediaTypeOf(lines []string) (string, map[string]string) {
+	contentType := headerValue(lines, "Content-Type")
+	if contentType == "" {
+		return "text/plain", nil
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", nil
+	}
+	return mediaType, params
+}
+
+// identityEncoding reports whether the content is sent as is, so that text
+// can be appended to it
+func identityEncoding(lines []string) bool {
+	switch strings.ToLower(headerValue(lines, "Content-Transfer-Encoding")) {
+	case "", "7bit", "8bit", "binary":
+		return true
+	}
+	return false
+}
+
+// isAttachment reports whether the part is meant to be saved rather than
+// displayed
+func isAttachment(lines []string) bool {
+	return strings.HasPrefix(strings.ToLower(headerValue(lines, "Content-Disposition")), "attachment")
+}
+
+// concat joins the byte slices into a new one
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
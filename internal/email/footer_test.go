@@ -0,0 +1,86 @@
+package email
+
+import (
+	"testing"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+)
+
+func TestAddFooter(t *testing.T) {
+	const footer = "--\nACME Corp, confidential\n"
+
+	tests := []struct {
+		name      string
+		multipart bool
+		body      string
+		expected  string
+	}{
+		{
+			name:     "Plain text",
+			body:     "To: a@domain.tld\r\n\r\nHello\r\n",
+			expected: "To: a@domain.tld\r\n\r\nHello\r\n--\r\nACME Corp, confidential\r\n",
+		},
+		{
+			name:     "Plain text without trailing newline",
+			body:     "To: a@domain.tld\nContent-Type: text/plain; charset=utf-8\n\nHello",
+			expected: "To: a@domain.tld\nContent-Type: text/plain; charset=utf-8\n\nHello\n--\nACME Corp, confidential\n",
+		},
+		{
+			name:     "Empty body",
+			body:     "To: a@domain.tld\n\n",
+			expected: "To: a@domain.tld\n\n--\nACME Corp, confidential\n",
+		},
+		{
+			name:     "Base64 body skipped",
+			body:     "To: a@domain.tld\nContent-Transfer-Encoding: base64\n\nSGVsbG8=\n",
+			expected: "To: a@domain.tld\nContent-Transfer-Encoding: base64\n\nSGVsbG8=\n",
+		},
+		{
+			name:     "HTML body skipped",
+			body:     "To: a@domain.tld\nContent-Type: text/html\n\n<p>Hello</p>\n",
+			expected: "To: a@domain.tld\nContent-Type: text/html\n\n<p>Hello</p>\n",
+		},
+		{
+			name:     "Multipart skipped by default",
+			body:     "Content-Type: multipart/mixed; boundary=b1\n\n--b1\n\nHello\n--b1--\n",
+			expected: "Content-Type: multipart/mixed; boundary=b1\n\n--b1\n\nHello\n--b1--\n",
+		},
+		{
+			name:      "Multipart text part",
+			multipart: true,
+			body: "Content-Type: multipart/mixed; boundary=b1\n\n" +
+				"--b1\nContent-Type: text/plain\nContent-Disposition: attachment\n\nattached\n" +
+				"--b1\nContent-Type: multipart/alternative; boundary=\"b2\"\n\n" +
+				"--b2\nContent-Type: text/plain\n\nHello\n" +
+				"--b2\nContent-Type: text/html\n\n<p>Hello</p>\n" +
+				"--b2--\n" +
+				"--b1--\n",
+			expected: "Content-Type: multipart/mixed; boundary=b1\n\n" +
+				"--b1\nContent-Type: text/plain\nContent-Disposition: attachment\n\nattached\n" +
+				"--b1\nContent-Type: multipart/alternative; boundary=\"b2\"\n\n" +
+				"--b2\nContent-Type: text/plain\n\nHello\n--\nACME Corp, confidential\n" +
+				"--b2\nContent-Type: text/html\n\n<p>Hello</p>\n" +
+				"--b2--\n" +
+				"--b1--\n",
+		},
+		{
+			name:      "Multipart without text part",
+			multipart: true,
+			body:      "Content-Type: multipart/mixed; boundary=b1\n\n--b1\nContent-Type: image/png\nContent-Transfer-Encoding: base64\n\niVBORw0K\n--b1--\n",
+			expected:  "Content-Type: multipart/mixed; boundary=b1\n\n--b1\nContent-Type: image/png\nContent-Transfer-Encoding: base64\n\niVBORw0K\n--b1--\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			email := &Email{
+				Config: &config.Config{Footer: footer, FooterMultipart: tt.multipart},
+				Body:   []byte(tt.body),
+			}
+			email.addFooter()
+			if string(email.Body) != tt.expected {
+				t.Errorf("Body = %q, want %q", email.Body, tt.expected)
+			}
+		})
+	}
+}
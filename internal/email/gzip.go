@@ -0,0 +1,34 @@
+package email
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrNotCompressed is returned by New when decompression is requested and
+// the message is not gzip compressed
+var ErrNotCompressed = errors.New("message is not gzip compressed, drop -z to send it as is")
+
+// gzipMagic starts every gzip stream
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// gunzip decompresses a gzip compressed message
+func gunzip(body []byte) ([]byte, error) {
+	if !bytes.HasPrefix(body, gzipMagic) {
+		return nil, ErrNotCompressed
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress message: %w", err)
+	}
+	defer zr.Close()
+
+	plain, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress message: %w", err)
+	}
+	return plain, nil
+}
@@ -0,0 +1,74 @@
+package email
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"testing"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+)
+
+// compress gzips s
+func compress(t *testing.T, s string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(s)); err != nil {
+		t.Fatalf("Failed to compress: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Failed to compress: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestNewDecompress(t *testing.T) {
+	message := "To: a@domain.tld\r\n\r\nDaily report\r\n"
+
+	tests := []struct {
+		name       string
+		body       []byte
+		decompress bool
+		wantErr    error
+	}{
+		{"Compressed input", compress(t, message), true, nil},
+		{"Plain input", []byte(message), false, nil},
+		{"Plain input with decompression", []byte(message), true, ErrNotCompressed},
+		{"Compressed empty input", compress(t, ""), true, ErrEmptyMessage},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{
+				FromAddr:   testFromAddr,
+				SmtpAddrs:  []string{testSMTPAddr},
+				Decompress: tt.decompress,
+			}
+
+			email, err := New(cfg, tt.body)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("New() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("New() failed: %v", err)
+			}
+			if string(email.Body) != message {
+				t.Errorf("Body = %q, want %q", email.Body, message)
+			}
+			if len(cfg.Recipients) != 1 || cfg.Recipients[0] != "a@domain.tld" {
+				t.Errorf("Recipients = %v", cfg.Recipients)
+			}
+		})
+	}
+}
+
+func TestGunzipCorrupt(t *testing.T) {
+	body := compress(t, "To: a@domain.tld\r\n\r\nDaily report\r\n")
+	if _, err := gunzip(body[:len(body)-6]); err == nil {
+		t.Error("gunzip() should fail on a truncated stream")
+	}
+}
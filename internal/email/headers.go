@@ -0,0 +1,325 @@
+package email
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+)
+
+// splitHeader splits the message into its header lines, each including its
+// line ending, and the remainder starting at the empty separator line. The
+// line ending used by the message is returned as well.
+func splitHeader(body []byte) ([]string, []byte, string) {
+	eol := "\n"
+	if bytes.Contains(body, []byte("\r\n")) {
+		eol = "\r\n"
+	}
+
+	var lines []string
+	rest := body
+	for len(rest) > 0 {
+		end := bytes.IndexByte(rest, '\n')
+		if end < 0 {
+			end = len(rest) - 1
+		}
+		line := string(rest[:end+1])
+		if strings.TrimRight(line, "\r\n") == "" {
+			break
+		}
+		lines = append(lines, line)
+		rest = rest[end+1:]
+	}
+	return lines, rest, eol
+}
+
+// canonicalBoundary makes exactly one empty line separate the header block
+// from the body, inserting one where the headers run into the body or end
+// the message. Header lines are rewritten with the line ending of the
+// message, so that a stray LF cannot end the header block early.
+func canonicalBoundary(body []byte) ([]byte, error) {
+	eol := lineEnding(body)
+
+	var buf bytes.Buffer
+	rest := body
+	for first := true; len(rest) > 0; first = false {
+		line, next := cutLine(rest)
+		if line == "" {
+			break
+		}
+		if !isHeaderLine(line, first) {
+			if first {
+				return nil, ErrMalformedMessage
+			}
+			break
+		}
+		buf.WriteString(line + eol)
+		rest = next
+	}
+
+	// Further empty lines would start the body, fold them into the boundary
+	for len(rest) > 0 {
+		line, next := cutLine(rest)
+		if line != "" {
+			break
+		}
+		rest = next
+	}
+
+	buf.WriteString(eol)
+	buf.Write(rest)
+	return buf.Bytes(), nil
+}
+
+// terminateBody ends the body with a single line ending, folding the empty
+// lines trailing it, which leaves DKIM signatures valid. With trim, NUL
+// bytes and whitespace trailing the body are dropped as well, which may
+// not.
+func terminateBody(msg []byte, trim bool) []byte {
+	eol := lineEnding(msg)
+	start := 0
+	if i := bytes.Index(msg, []byte(eol+eol)); i >= 0 {
+		start = i + 2*len(eol)
+	}
+
+	cutset := "\r\n"
+	if trim {
+		cutset = "\x00 \t\r\n\v\f"
+	}
+	body := bytes.TrimRight(msg[start:], cutset)
+	if len(msg)-start-len(body) == len(eol) && bytes.HasSuffix(msg, []byte(eol)) {
+		return msg
+	}
+	if len(body) == 0 {
+		// A message of headers only ends with the boundary already
+		if start > 0 {
+			return msg[:start]
+		}
+		return msg
+	}
+
+	out := append([]byte(nil), msg[:start]...)
+	out = append(out, body...)
+	return append(out, eol...)
+}
+
+// lineEnding returns the line ending of the message, CRLF if any line ends
+// with it
+func lineEnding(msg []byte) string {
+	if bytes.Contains(msg, []byte("\r\n")) {
+		return "\r\n"
+	}
+	return "\n"
+}
+
+// cutLine returns the first line of b without its line ending, and the
+// remainder after it
+func cutLine(b []byte) (string, []byte) {
+	end := bytes.IndexByte(b, '\n')
+	if end < 0 {
+		return strings.TrimRight(string(b), "\r"), nil
+	}
+	return strings.TrimRight(string(b[:end]), "\r"), b[end+1:]
+}
+
+// isHeaderLine reports whether line is a header field or, past the first
+// line, the continuation of a folded one
+func isHeaderLine(line string, first bool) bool {
+	if line[0] == ' ' || line[0] == '\t' {
+		return !first
+	}
+	name, _, ok := strings.Cut(line, ":")
+	if !ok || name == "" {
+		return false
+	}
+	for _, c := range []byte(name) {
+		if c < 33 || c > 126 {
+			return false
+		}
+	}
+	return true
+}
+
+// joinHeader reassembles a message split by splitHeader
+func joinHeader(lines []string, rest []byte) []byte {
+	var buf bytes.Buffer
+	for _, line := range lines {
+		buf.WriteString(line)
+	}
+	buf.Write(rest)
+	return buf.Bytes()
+}
+
+// headerName returns the lowercased name of a header line, or an empty
+// string for continuation lines
+func headerName(line string) string {
+	if line == "" || line[0] == ' ' || line[0] == '\t' {
+		return ""
+	}
+	name, _, _ := strings.Cut(line, ":")
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// removeHeader drops every header with the given name, including its
+// folded continuation lines
+func removeHeader(lines []string, name string) []string {
+	name = strings.ToLower(name)
+	kept := lines[:0:0]
+	dropping := false
+	for _, line := range lines {
+		if n := headerName(line); n != "" {
+			dropping = n == name
+		}
+		if !dropping {
+			kept = append(kept, line)
+		}
+	}
+	return kept
+}
+
+// hasHeader reports whether a header with the given name is present
+func hasHeader(lines []string, name string) bool {
+	name = strings.ToLower(name)
+	for _, line := range lines {
+		if headerName(line) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// stripHeaders removes the configured headers, whatever their case and
+// along with their continuation lines
+func (e *Email) stripHeaders() {
+	lines, rest, _ := splitHeader(e.Body)
+	for _, name := range e.Config.StripHeaders {
+		lines = removeHeader(lines, name)
+	}
+	e.Body = joinHeader(lines, rest)
+}
+
+// addHeaders appends the configured extra headers to the header block and
+// prepends a Return-Path header when requested
+func (e *Email) addHeaders() {
+	if len(e.Config.ExtraHeaders) == 0 && !e.Config.ReturnPath {
+		return
+	}
+
+	lines, rest, eol := splitHeader(e.Body)
+	if n := len(lines); n > 0 && !strings.HasSuffix(lines[n-1], "\n") {
+		lines[n-1] += eol
+	}
+	for _, h := range e.Config.ExtraHeaders {
+		name, value, _ := strings.Cut(h, ":")
+		if e.Config.ReplaceHeaders {
+			lines = removeHeader(lines, name)
+		}
+		lines = append(lines, strings.TrimSpace(name)+": "+strings.TrimSpace(value)+eol)
+	}
+
+	// Return-Path goes on top, as if added by the final MTA
+	if e.Config.ReturnPath && !hasHeader(lines, "Return-Path") {
+		lines = append([]string{"Return-Path: <" + e.Config.FromAddr + ">" + eol}, lines...)
+	}
+	e.Body = joinHeader(lines, rest)
+}
+
+// addTraceHeader adds the trace ID of the run on top of the headers, as
+// trace fields go, so that the message can be matched with the logs
+func (e *Email) addTraceHeader() {
+	lines, rest, eol := splitHeader(e.Body)
+	lines = append([]string{"X-Mailrelay-Trace: " + e.Config.TraceID + eol}, lines...)
+	e.Body = joinHeader(lines, rest)
+}
+
+// completeHeaders adds the Date and Message-ID headers an initial
+// submission may lack, as a submission server would (RFC 6409 8.2, 8.3)
+func (e *Email) completeHeaders() error {
+	lines, rest, eol := splitHeader(e.Body)
+	var added []string
+	if !hasHeader(lines, "Date") {
+		added = append(added, "Date: "+time.Now().Format(time.RFC1123Z)+eol)
+	}
+	if !hasHeader(lines, "Message-ID") {
+		id, err := newMessageID(e.Config.FromAddr)
+		if err != nil {
+			return err
+		}
+		added = append(added, "Message-ID: "+id+eol)
+	}
+	if len(added) == 0 {
+		return nil
+	}
+
+	if n := len(lines); n > 0 && !strings.HasSuffix(lines[n-1], "\n") {
+		lines[n-1] += eol
+	}
+	e.Body = joinHeader(append(lines, added...), rest)
+	return nil
+}
+
+// newMessageID returns a unique message ID in the domain of the sender,
+// or of the host for the null sender
+func newMessageID(from string) (string, error) {
+	var random [16]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return "", err
+	}
+	domain := recipientDomain(from)
+	if domain == "" {
+		if domain, _ = os.Hostname(); domain == "" {
+			domain = "localhost"
+		}
+	}
+	return "<" + hex.EncodeToString(random[:]) + "@" + domain + ">", nil
+}
+
+// setFromName gives the From header the configured display name, keeping
+// the address of an existing header or using the envelope sender for a
+// new one. From headers listing several authors are left alone.
+func (e *Email) setFromName() {
+	if e.Config.FromName == "" {
+		return
+	}
+
+	lines, rest, eol := splitHeader(e.Body)
+	addr := e.Config.FromAddr
+	if value := headerValue(lines, "From"); value != "" {
+		author, err := mail.ParseAddress(value)
+		if err != nil {
+			return
+		}
+		addr = author.Address
+	}
+	// net/mail quotes names with special characters and encodes non-ASCII
+	// ones as RFC 2047 words
+	from := "From: " + (&mail.Address{Name: e.Config.FromName, Address: addr}).String() + eol
+
+	if !hasHeader(lines, "From") {
+		if n := len(lines); n > 0 && !strings.HasSuffix(lines[n-1], "\n") {
+			lines[n-1] += eol
+		}
+		e.Body = joinHeader(append(lines, from), rest)
+		return
+	}
+
+	// Replace the header in place, along with its continuation lines
+	replaced := lines[:0:0]
+	dropping := false
+	for _, line := range lines {
+		if n := headerName(line); n != "" {
+			dropping = n == "from"
+			if dropping && from != "" {
+				replaced = append(replaced, from)
+				from = ""
+			}
+		}
+		if !dropping {
+			replaced = append(replaced, line)
+		}
+	}
+	e.Body = joinHeader(replaced, rest)
+}
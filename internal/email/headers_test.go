@@ -0,0 +1,454 @@
+package email
+
+import (
+	"errors"
+	"net/mail"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+)
+
+func TestAddHeaders(t *testing.T) {
+	tests := []struct {
+		name     string
+		headers  []string
+		replace  bool
+		body     string
+		expected string
+	}{
+		{
+			name:     "No extra headers",
+			body:     "To: rcpt@domain.tld\n\nBody",
+			expected: "To: rcpt@domain.tld\n\nBody",
+		},
+		{
+			name:     "Appended to header block",
+			headers:  []string{"X-Mailer: mailrelay", "X-Priority:1"},
+			body:     "To: rcpt@domain.tld\nX-Mailer: other\n\nBody",
+			expected: "To: rcpt@domain.tld\nX-Mailer: other\nX-Mailer: mailrelay\nX-Priority: 1\n\nBody",
+		},
+		{
+			name:     "CRLF line endings kept",
+			headers:  []string{"X-Mailer: mailrelay"},
+			body:     "To: rcpt@domain.tld\r\n\r\nBody\r\n",
+			expected: "To: rcpt@domain.tld\r\nX-Mailer: mailrelay\r\n\r\nBody\r\n",
+		},
+		{
+			name:     "Replace existing folded header",
+			headers:  []string{"x-mailer: mailrelay"},
+			replace:  true,
+			body:     "X-Mailer: other\n\tcontinued\nTo: rcpt@domain.tld\n\nX-Mailer: in body",
+			expected: "To: rcpt@domain.tld\nx-mailer: mailrelay\n\nX-Mailer: in body",
+		},
+		{
+			name:     "Message without body",
+			headers:  []string{"X-Mailer: mailrelay"},
+			body:     "To: rcpt@domain.tld",
+			expected: "To: rcpt@domain.tld\nX-Mailer: mailrelay\n\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{
+				FromAddr:       testFromAddr,
+				SmtpAddrs:      []string{testSMTPAddr},
+				ExtraHeaders:   tt.headers,
+				ReplaceHeaders: tt.replace,
+			}
+
+			email, err := New(cfg, []byte(tt.body))
+			if err != nil {
+				t.Fatalf("New() failed: %v", err)
+			}
+			if got := string(email.Body); got != tt.expected {
+				t.Errorf("Body = %q, want %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestCanonicalBoundary(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		expected string
+		wantErr  bool
+	}{
+		{
+			name:     "Single boundary kept",
+			body:     "Subject: hi\r\n\r\nBody\r\n",
+			expected: "Subject: hi\r\n\r\nBody\r\n",
+		},
+		{
+			name:     "No boundary before the body",
+			body:     "Subject: hi\nTo: rcpt@domain.tld\nBody starts here\n",
+			expected: "Subject: hi\nTo: rcpt@domain.tld\n\nBody starts here\n",
+		},
+		{
+			name:     "Headers only",
+			body:     "Subject: hi\r\nTo: rcpt@domain.tld",
+			expected: "Subject: hi\r\nTo: rcpt@domain.tld\r\n\r\n",
+		},
+		{
+			name:     "Double boundary",
+			body:     "Subject: hi\n\n\nBody\n\nMore\n",
+			expected: "Subject: hi\n\nBody\n\nMore\n",
+		},
+		{
+			name:     "Inconsistent line endings",
+			body:     "Subject: hi\nTo: rcpt@domain.tld\r\n\nBody\r\n",
+			expected: "Subject: hi\r\nTo: rcpt@domain.tld\r\n\r\nBody\r\n",
+		},
+		{
+			name:     "Folded header kept",
+			body:     "Subject: a\n long subject\nBody\n",
+			expected: "Subject: a\n long subject\n\nBody\n",
+		},
+		{
+			name:     "No headers",
+			body:     "\nBody\n",
+			expected: "\nBody\n",
+		},
+		{
+			name:    "Not a message",
+			body:    "Hello there,\nhow are you?\n",
+			wantErr: true,
+		},
+		{
+			name:    "Starts with a continuation line",
+			body:    " Subject: hi\n\nBody\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := canonicalBoundary([]byte(tt.body))
+			if tt.wantErr {
+				if !errors.Is(err, ErrMalformedMessage) {
+					t.Fatalf("canonicalBoundary() error = %v, want ErrMalformedMessage", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("canonicalBoundary() failed: %v", err)
+			}
+			if string(got) != tt.expected {
+				t.Errorf("canonicalBoundary() = %q, want %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestNewMalformedMessage(t *testing.T) {
+	cfg := &config.Config{
+		FromAddr:  testFromAddr,
+		SmtpAddrs: []string{testSMTPAddr},
+	}
+	if _, err := New(cfg, []byte("just some text\n")); !errors.Is(err, ErrMalformedMessage) {
+		t.Errorf("New() error = %v, want ErrMalformedMessage", err)
+	}
+}
+
+func TestReturnPath(t *testing.T) {
+	tests := []struct {
+		name     string
+		enabled  bool
+		body     string
+		expected string
+	}{
+		{
+			name:     "Disabled",
+			body:     "To: rcpt@domain.tld\n\nBody",
+			expected: "To: rcpt@domain.tld\n\nBody",
+		},
+		{
+			name:     "Added from envelope sender",
+			enabled:  true,
+			body:     "To: rcpt@domain.tld\r\n\r\nBody",
+			expected: "Return-Path: <" + testFromAddr + ">\r\nTo: rcpt@domain.tld\r\n\r\nBody",
+		},
+		{
+			name:     "Existing header kept",
+			enabled:  true,
+			body:     "To: rcpt@domain.tld\nreturn-path: <bounces@example.com>\n\nBody",
+			expected: "To: rcpt@domain.tld\nreturn-path: <bounces@example.com>\n\nBody",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{
+				FromAddr:   testFromAddr,
+				SmtpAddrs:  []string{testSMTPAddr},
+				ReturnPath: tt.enabled,
+			}
+
+			email, err := New(cfg, []byte(tt.body))
+			if err != nil {
+				t.Fatalf("New() failed: %v", err)
+			}
+			if got := string(email.Body); got != tt.expected {
+				t.Errorf("Body = %q, want %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestFromName(t *testing.T) {
+	tests := []struct {
+		name     string
+		fromName string
+		body     string
+		expected string
+	}{
+		{
+			name:     "No name",
+			body:     "From: a@domain.tld\nTo: rcpt@domain.tld\n\nBody",
+			expected: "From: a@domain.tld\nTo: rcpt@domain.tld\n\nBody",
+		},
+		{
+			name:     "Plain name added to the envelope sender",
+			fromName: "Cron Daemon",
+			body:     "To: rcpt@domain.tld\n\nBody",
+			expected: "To: rcpt@domain.tld\nFrom: \"Cron Daemon\" <" + testFromAddr + ">\n\nBody",
+		},
+		{
+			name:     "Existing header rewritten in place",
+			fromName: "Backup",
+			body:     "From: Old Name\n <old@domain.tld>\nTo: rcpt@domain.tld\n\nFrom: in body",
+			expected: "From: \"Backup\" <old@domain.tld>\nTo: rcpt@domain.tld\n\nFrom: in body",
+		},
+		{
+			name:     "Special characters quoted",
+			fromName: `Smith, John "JS" (ops)`,
+			body:     "To: rcpt@domain.tld\r\n\r\nBody\r\n",
+			expected: "To: rcpt@domain.tld\r\nFrom: \"Smith, John \\\"JS\\\" (ops)\" <" + testFromAddr + ">\r\n\r\nBody\r\n",
+		},
+		{
+			name:     "Non-ASCII name encoded",
+			fromName: "Zoë",
+			body:     "To: rcpt@domain.tld\n\nBody",
+			expected: "To: rcpt@domain.tld\nFrom: =?utf-8?q?Zo=C3=AB?= <" + testFromAddr + ">\n\nBody",
+		},
+		{
+			name:     "Several authors left alone",
+			fromName: "Backup",
+			body:     "From: a@domain.tld, b@domain.tld\nTo: rcpt@domain.tld\n\nBody",
+			expected: "From: a@domain.tld, b@domain.tld\nTo: rcpt@domain.tld\n\nBody",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{
+				FromAddr:  testFromAddr,
+				FromName:  tt.fromName,
+				SmtpAddrs: []string{testSMTPAddr},
+			}
+
+			email, err := New(cfg, []byte(tt.body))
+			if err != nil {
+				t.Fatalf("New() failed: %v", err)
+			}
+			if string(email.Body) != tt.expected {
+				t.Errorf("Body = %q, want %q", email.Body, tt.expected)
+			}
+		})
+	}
+}
+
+func TestTerminateBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		trim     bool
+		expected string
+	}{
+		{"Terminated body", "To: a@domain.tld\r\n\r\nBody\r\n", false, "To: a@domain.tld\r\n\r\nBody\r\n"},
+		{"No trailing newline", "To: a@domain.tld\r\n\r\nBody", false, "To: a@domain.tld\r\n\r\nBody\r\n"},
+		{"No trailing newline with LF", "To: a@domain.tld\n\nBody", false, "To: a@domain.tld\n\nBody\n"},
+		{"Trailing empty lines", "To: a@domain.tld\r\n\r\nBody\r\n\r\n\r\n", false, "To: a@domain.tld\r\n\r\nBody\r\n"},
+		{"Trailing garbage kept", "To: a@domain.tld\r\n\r\nBody\r\n\x00\x00 \t", false, "To: a@domain.tld\r\n\r\nBody\r\n\x00\x00 \t\r\n"},
+		{"Trailing garbage trimmed", "To: a@domain.tld\r\n\r\nBody\r\n\x00\x00 \t\r\n \x00", true, "To: a@domain.tld\r\n\r\nBody\r\n"},
+		{"Headers only", "To: a@domain.tld\r\n\r\n", false, "To: a@domain.tld\r\n\r\n"},
+		{"Headers only with garbage trimmed", "To: a@domain.tld\r\n\r\n\x00\r\n", true, "To: a@domain.tld\r\n\r\n"},
+		{"Boundary kept when trimming", "To: a@domain.tld\n\n \n", true, "To: a@domain.tld\n\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := terminateBody([]byte(tt.body), tt.trim); string(got) != tt.expected {
+				t.Errorf("terminateBody() = %q, want %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestNewTrimBody(t *testing.T) {
+	cfg := &config.Config{
+		FromAddr:  testFromAddr,
+		SmtpAddrs: []string{testSMTPAddr},
+		TrimBody:  true,
+	}
+	email, err := New(cfg, []byte("To: a@domain.tld\n\nBody\x00\x00\x00"))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if string(email.Body) != "To: a@domain.tld\n\nBody\n" {
+		t.Errorf("Body = %q", email.Body)
+	}
+}
+
+func TestCompleteHeaders(t *testing.T) {
+	idPattern := regexp.MustCompile(`\nMessage-ID: <[0-9a-f]{32}@` + regexp.QuoteMeta(recipientDomain(testFromAddr)) + `>\r\n\r\nBody$`)
+
+	tests := []struct {
+		name       string
+		submission bool
+		body       string
+		check      func(t *testing.T, body string)
+	}{
+		{
+			name: "Not a submission",
+			body: "To: rcpt@domain.tld\n\nBody",
+			check: func(t *testing.T, body string) {
+				if body != "To: rcpt@domain.tld\n\nBody" {
+					t.Errorf("Body = %q, want it unchanged", body)
+				}
+			},
+		},
+		{
+			name:       "Missing headers added",
+			submission: true,
+			body:       "To: rcpt@domain.tld\r\n\r\nBody",
+			check: func(t *testing.T, body string) {
+				msg, err := mail.ReadMessage(strings.NewReader(body))
+				if err != nil {
+					t.Fatalf("ReadMessage() error = %v", err)
+				}
+				if _, err := msg.Header.Date(); err != nil {
+					t.Errorf("Date header invalid: %v", err)
+				}
+				if !idPattern.MatchString(body) {
+					t.Errorf("Body = %q, want a Message-ID in the sender domain", body)
+				}
+			},
+		},
+		{
+			name:       "Existing headers kept",
+			submission: true,
+			body:       "Date: Mon, 2 Jan 2006 15:04:05 -0700\nmessage-id: <id@example.com>\nTo: rcpt@domain.tld\n\nBody",
+			check: func(t *testing.T, body string) {
+				if body != "Date: Mon, 2 Jan 2006 15:04:05 -0700\nmessage-id: <id@example.com>\nTo: rcpt@domain.tld\n\nBody" {
+					t.Errorf("Body = %q, want it unchanged", body)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{
+				FromAddr:   testFromAddr,
+				SmtpAddrs:  []string{testSMTPAddr},
+				Submission: tt.submission,
+			}
+
+			email, err := New(cfg, []byte(tt.body))
+			if err != nil {
+				t.Fatalf("New() failed: %v", err)
+			}
+			tt.check(t, string(email.Body))
+		})
+	}
+}
+
+func TestTraceHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		enable bool
+		body   string
+		want   string
+	}{
+		{"Disabled", false, "To: rcpt@domain.tld\n\nBody", "To: rcpt@domain.tld\n\nBody"},
+		{"Enabled", true, "To: rcpt@domain.tld\r\n\r\nBody", "X-Mailrelay-Trace: 0123456789ab\r\nTo: rcpt@domain.tld\r\n\r\nBody"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{
+				FromAddr:    testFromAddr,
+				SmtpAddrs:   []string{testSMTPAddr},
+				TraceID:     "0123456789ab",
+				TraceHeader: tt.enable,
+			}
+
+			email, err := New(cfg, []byte(tt.body))
+			if err != nil {
+				t.Fatalf("New() failed: %v", err)
+			}
+			if string(email.Body) != tt.want {
+				t.Errorf("Body = %q, want %q", email.Body, tt.want)
+			}
+		})
+	}
+}
+
+func TestStripHeaders(t *testing.T) {
+	tests := []struct {
+		name       string
+		strip      []string
+		returnPath bool
+		body       string
+		want       string
+	}{
+		{
+			name:  "Folded and repeated headers",
+			strip: []string{"received", "X-Original-To", "Return-Path"},
+			body: "Return-Path: <upstream@domain.tld>\r\n" +
+				"Received: from mx.domain.tld\r\n\tby relay.domain.tld;\r\n Mon, 1 Jan 2024 00:00:00 +0000\r\n" +
+				"To: rcpt@domain.tld\r\n" +
+				"RECEIVED: from localhost\r\n" +
+				"X-Original-To: internal@domain.tld\r\n" +
+				"Subject: Hello\r\n\tworld\r\n" +
+				"\r\nReceived: in body\r\n",
+			want: "To: rcpt@domain.tld\r\nSubject: Hello\r\n\tworld\r\n\r\nReceived: in body\r\n",
+		},
+		{
+			name:  "Nothing to strip",
+			strip: []string{"Received"},
+			body:  "To: rcpt@domain.tld\n\nBody",
+			want:  "To: rcpt@domain.tld\n\nBody",
+		},
+		{
+			name:       "Own Return-Path added after stripping",
+			strip:      []string{"Return-Path"},
+			returnPath: true,
+			body:       "Return-Path: <upstream@domain.tld>\nTo: rcpt@domain.tld\n\nBody",
+			want:       "Return-Path: <" + testFromAddr + ">\nTo: rcpt@domain.tld\n\nBody",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{
+				FromAddr:     testFromAddr,
+				SmtpAddrs:    []string{testSMTPAddr},
+				StripHeaders: tt.strip,
+				ReturnPath:   tt.returnPath,
+			}
+
+			email, err := New(cfg, []byte(tt.body))
+			if err != nil {
+				t.Fatalf("New() failed: %v", err)
+			}
+			if string(email.Body) != tt.want {
+				t.Errorf("Body = %q, want %q", email.Body, tt.want)
+			}
+		})
+	}
+}
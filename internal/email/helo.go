@@ -0,0 +1,135 @@
+package email
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+)
+
+// errHeloOnly is returned for extensions asked of a server greeted with HELO
+var errHeloOnly = errors.New("not available with HELO, the SMTP mode is helo")
+
+// HeloClient implements SMTPClient for legacy servers greeted with HELO,
+// which offer no extensions: no STARTTLS, no AUTH and no MAIL parameters
+type HeloClient struct {
+	Text *textproto.Conn
+	sessionDeadline
+}
+
+// NewHeloClient reads the server greeting and introduces itself with HELO
+func NewHeloClient(conn net.Conn) (*HeloClient, error) {
+	c := &HeloClient{Text: textproto.NewConn(conn)}
+	if _, _, err := c.Text.ReadResponse(220); err != nil {
+		c.Text.Close()
+		return nil, err
+	}
+	if _, _, err := c.cmd(250, "HELO localhost"); err != nil {
+		c.Text.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// cmd sends a command and reads its response
+func (c *HeloClient) cmd(expectCode int, format string, args ...any) (int, string, error) {
+	id, err := c.Text.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+	return c.Text.ReadResponse(expectCode)
+}
+
+func (c *HeloClient) StartTLS(config *tls.Config) error {
+	return errHeloOnly
+}
+
+func (c *HeloClient) Auth(a smtp.Auth) error {
+	return errHeloOnly
+}
+
+// Extension reports every extension as missing
+func (c *HeloClient) Extension(ext string) (bool, string) {
+	return false, ""
+}
+
+// Mail drops the parameters, which need extensions
+func (c *HeloClient) Mail(from string, params ...string) error {
+	if strings.ContainsAny(from, "\r\n") {
+		return errors.New("smtp: A line must not contain CR or LF")
+	}
+	_, _, err := c.cmd(250, "MAIL FROM:<%s>", from)
+	return err
+}
+
+func (c *HeloClient) Rcpt(to string) error {
+	if strings.ContainsAny(to, "\r\n") {
+		return errors.New("smtp: A line must not contain CR or LF")
+	}
+	_, _, err := c.cmd(25, "RCPT TO:<%s>", to)
+	return err
+}
+
+func (c *HeloClient) Data() (io.WriteCloser, error) {
+	if _, _, err := c.cmd(354, "DATA"); err != nil {
+		return nil, err
+	}
+	return &heloDataWriter{WriteCloser: c.Text.DotWriter(), c: c}, nil
+}
+
+func (c *HeloClient) Reset() error {
+	_, _, err := c.cmd(250, "RSET")
+	return err
+}
+
+func (c *HeloClient) Noop() error {
+	_, _, err := c.cmd(250, "NOOP")
+	return err
+}
+
+func (c *HeloClient) Quit() error {
+	if _, _, err := c.cmd(221, "QUIT"); err != nil {
+		return err
+	}
+	return c.Text.Close()
+}
+
+func (c *HeloClient) Close() error {
+	return c.Text.Close()
+}
+
+// heloDataWriter reads the reply to the message data once it is complete
+type heloDataWriter struct {
+	io.WriteCloser
+	c *HeloClient
+}
+
+func (w *heloDataWriter) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		return err
+	}
+	_, _, err := w.c.Text.ReadResponse(250)
+	return err
+}
+
+// requireEHLO greets the server with EHLO, failing instead of falling back
+// to HELO as net/smtp would. The client greets the server again with EHLO
+// before its first command, which RFC 5321 allows.
+func requireEHLO(c *smtp.Client) error {
+	id, err := c.Text.Cmd("EHLO localhost")
+	if err != nil {
+		return err
+	}
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+	if _, _, err := c.Text.ReadResponse(250); err != nil {
+		return fmt.Errorf("server does not support EHLO, required by the SMTP mode: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package email
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+)
+
+// serveLegacySMTP plays an SMTP server on conn that answers EHLO with the
+// given reply, and returns the commands it received
+func serveLegacySMTP(conn net.Conn, ehloReply string) <-chan []string {
+	done := make(chan []string, 1)
+	go func() {
+		defer conn.Close()
+		var commands []string
+		r := bufio.NewReader(conn)
+		reply := func(line string) {
+			fmt.Fprint(conn, line+"\r\n")
+		}
+
+		reply("220 smtp.example.com ready")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				break
+			}
+			cmd := strings.TrimRight(line, "\r\n")
+			commands = append(commands, cmd)
+
+			switch {
+			case strings.HasPrefix(cmd, "EHLO"):
+				reply(ehloReply)
+			case cmd == "DATA":
+				reply("354 go ahead")
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil || line == ".\r\n" {
+						break
+					}
+				}
+				reply("250 queued")
+			case cmd == "QUIT":
+				reply("221 bye")
+				done <- commands
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+		done <- commands
+	}()
+	return done
+}
+
+func TestSendHELOMode(t *testing.T) {
+	client, server := net.Pipe()
+	commands := serveLegacySMTP(server, "502 command not implemented")
+
+	email := &Email{
+		Config: &config.Config{
+			FromAddr:   testFromAddr,
+			SmtpAddrs:  []string{testSMTPAddr},
+			Recipients: []string{"a@domain.tld"},
+			SMTPMode:   config.SMTPModeHELO,
+			EnableDANE: true,
+		},
+		Body: []byte("To: a@domain.tld\r\n\r\nBody\r\n"),
+	}
+
+	dialer := func(ctx context.Context, addr string) (SMTPClient, error) {
+		return dialSMTP(ctx, addr, config.SMTPModeHELO, 0, func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return client, nil
+		})
+	}
+	if _, err := email.sendWithDialer(context.Background(), dialer); err != nil {
+		t.Fatalf("sendWithDialer() failed: %v", err)
+	}
+
+	expected := []string{
+		"HELO localhost",
+		"NOOP",
+		"MAIL FROM:<" + testFromAddr + ">",
+		"RCPT TO:<a@domain.tld>",
+		"DATA",
+		"QUIT",
+	}
+	if got := <-commands; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Commands = %q, want %q", got, expected)
+	}
+}
+
+func TestSendHELOModeSkipsExtensions(t *testing.T) {
+	mockClient := NewMockSMTPClient()
+	mockClient.Extensions = map[string]string{"STARTTLS": "", "AUTH": "PLAIN", "SIZE": "1000"}
+	email := &Email{
+		Config: &config.Config{
+			FromAddr:   testFromAddr,
+			SmtpAddrs:  []string{testSMTPAddr},
+			Recipients: []string{"a@domain.tld"},
+			SMTPMode:   config.SMTPModeHELO,
+		},
+		Body: []byte("test email body"),
+	}
+
+	if _, err := email.send(context.Background(), createMockDialer(mockClient, false)); err != nil {
+		t.Fatalf("send() failed: %v", err)
+	}
+	for _, method := range []string{"StartTLS", "Auth"} {
+		if n := mockClient.MethodCallCount[method]; n != 0 {
+			t.Errorf("%s called %d times, want none with HELO", method, n)
+		}
+	}
+}
+
+func TestDialSMTPRequireEHLO(t *testing.T) {
+	tests := []struct {
+		name      string
+		ehloReply string
+		wantErr   bool
+	}{
+		{"EHLO supported", "250 smtp.example.com", false},
+		{"EHLO not implemented", "502 command not implemented", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			serveLegacySMTP(server, tt.ehloReply)
+
+			c, err := dialSMTP(context.Background(), testSMTPAddr, config.SMTPModeEHLO, 0, func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return client, nil
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("dialSMTP() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				c.Quit()
+			}
+		})
+	}
+}
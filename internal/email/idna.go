@@ -0,0 +1,33 @@
+package email
+
+import (
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// asciiAddress converts the domain of an address to its ASCII form, with
+// internationalized labels as Punycode A-labels, for servers without
+// SMTPUTF8. A non-ASCII local part cannot be converted and is kept, and so
+// is a domain that is not a valid IDN, for the server to reject.
+func asciiAddress(addr string) string {
+	at := strings.LastIndex(addr, "@")
+	if at < 0 || isASCII(addr[at+1:]) {
+		return addr
+	}
+	domain, err := idna.Lookup.ToASCII(addr[at+1:])
+	if err != nil {
+		return addr
+	}
+	return addr[:at+1] + domain
+}
+
+// isASCII reports whether s holds ASCII characters only
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
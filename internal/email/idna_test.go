@@ -0,0 +1,117 @@
+package email
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+)
+
+func TestASCIIAddress(t *testing.T) {
+	tests := []struct {
+		addr     string
+		expected string
+	}{
+		{"user@example.com", "user@example.com"},
+		{"user@müller.de", "user@xn--mller-kva.de"},
+		{"user@Bücher.Example", "user@xn--bcher-kva.example"},
+		{"jörg@müller.de", "jörg@xn--mller-kva.de"},
+		{"user@mü_ller.de", "user@mü_ller.de"},
+		{"no-domain", "no-domain"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			if got := asciiAddress(tt.addr); got != tt.expected {
+				t.Errorf("asciiAddress(%q) = %q, want %q", tt.addr, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestSendIDNRecipient(t *testing.T) {
+	mockClient := NewMockSMTPClient()
+	email := &Email{
+		Config: &config.Config{
+			FromAddr:   "sender@bücher.example",
+			SmtpAddrs:  []string{testSMTPAddr},
+			Recipients: []string{"user@müller.de", "other@example.com"},
+		},
+		Body: []byte("Subject: IDN\n\nBody\n"),
+	}
+
+	result, err := email.sendWithDialer(context.Background(), createMockDialer(mockClient, false))
+	if err != nil {
+		t.Fatalf("sendWithDialer() error = %v", err)
+	}
+
+	// The wire gets A-labels, the result keeps the display form
+	if mockClient.MailFrom != "sender@xn--bcher-kva.example" {
+		t.Errorf("MAIL FROM = %q, want the Punycode domain", mockClient.MailFrom)
+	}
+	if want := []string{"user@xn--mller-kva.de", "other@example.com"}; !reflect.DeepEqual(mockClient.RcptTo, want) {
+		t.Errorf("RCPT TO = %v, want %v", mockClient.RcptTo, want)
+	}
+	if !reflect.DeepEqual(result.Accepted, email.Config.Recipients) {
+		t.Errorf("Accepted = %v, want %v", result.Accepted, email.Config.Recipients)
+	}
+	if string(mockClient.DataWriter.Written) != string(email.Body) {
+		t.Errorf("Written message = %q, want it unchanged", mockClient.DataWriter.Written)
+	}
+}
+
+func TestSendSMTPUTF8(t *testing.T) {
+	tests := []struct {
+		name       string
+		extensions map[string]string
+		recipients []string
+		params     []string
+		rcptTo     []string
+	}{
+		{
+			name:       "Advertised, internationalized address",
+			extensions: map[string]string{"SMTPUTF8": ""},
+			recipients: []string{"jörg@müller.de", "user@example.com"},
+			params:     []string{"SMTPUTF8"},
+			rcptTo:     []string{"jörg@müller.de", "user@example.com"},
+		},
+		{
+			name:       "Advertised, ASCII addresses",
+			extensions: map[string]string{"SMTPUTF8": ""},
+			recipients: []string{"user@example.com"},
+			params:     []string{"SMTPUTF8"},
+			rcptTo:     []string{"user@example.com"},
+		},
+		{
+			name:       "Not advertised, Punycode fallback",
+			recipients: []string{"user@müller.de"},
+			rcptTo:     []string{"user@xn--mller-kva.de"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockClient := NewMockSMTPClient()
+			mockClient.Extensions = tt.extensions
+			email := &Email{
+				Config: &config.Config{
+					FromAddr:   testFromAddr,
+					SmtpAddrs:  []string{testSMTPAddr},
+					Recipients: tt.recipients,
+				},
+				Body: []byte("Subject: SMTPUTF8\n\nBody\n"),
+			}
+
+			if _, err := email.sendWithDialer(context.Background(), createMockDialer(mockClient, false)); err != nil {
+				t.Fatalf("sendWithDialer() error = %v", err)
+			}
+			if !reflect.DeepEqual(mockClient.MailParams, tt.params) {
+				t.Errorf("MAIL FROM parameters = %q, want %q", mockClient.MailParams, tt.params)
+			}
+			if !reflect.DeepEqual(mockClient.RcptTo, tt.rcptTo) {
+				t.Errorf("RCPT TO = %q, want %q", mockClient.RcptTo, tt.rcptTo)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package email
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+)
+
+// RecipientStatusReporter is implemented by clients learning the outcome
+// for each recipient only after the message data, as LMTP clients do
+type RecipientStatusReporter interface {
+	RecipientStatus() map[string]error
+}
+
+// LMTPClient implements SMTPClient for servers speaking LMTP (RFC 2033),
+// which greet with LHLO and answer the message data once per recipient
+type LMTPClient struct {
+	Text *textproto.Conn
+	sessionDeadline
+
+	conn   net.Conn
+	ext    map[string]string
+	rcpts  []string
+	status map[string]error
+}
+
+// NewLMTPClient reads the server greeting and introduces itself with LHLO
+func NewLMTPClient(conn net.Conn) (*LMTPClient, error) {
+	c := &LMTPClient{Text: textproto.NewConn(conn), conn: conn}
+	if _, _, err := c.Text.ReadResponse(220); err != nil {
+		c.Text.Close()
+		return nil, err
+	}
+	if err := c.lhlo(); err != nil {
+		c.Text.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// cmd sends a command and reads its response
+func (c *LMTPClient) cmd(expectCode int, format string, args ...any) (int, string, error) {
+	id, err := c.Text.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+	return c.Text.ReadResponse(expectCode)
+}
+
+// lhlo sends LHLO and records the extensions offered by the server
+func (c *LMTPClient) lhlo() error {
+	_, msg, err := c.cmd(250, "LHLO localhost")
+	if err != nil {
+		return err
+	}
+
+	c.ext = map[string]string{}
+	for _, line := range strings.Split(msg, "\n")[1:] {
+		name, args, _ := strings.Cut(line, " ")
+		c.ext[strings.ToUpper(name)] = args
+	}
+	return nil
+}
+
+// StartTLS upgrades the connection when the server offers it. LMTP is
+// mostly used for local delivery without TLS, so its absence is not an
+// error unless the config pins the server certificate or presents a
+// client certificate.
+func (c *LMTPClient) StartTLS(config *tls.Config) error {
+	if _, ok := c.ext["STARTTLS"]; !ok {
+		if config.VerifyPeerCertificate != nil || len(config.Certificates) > 0 {
+			return errors.New("server does not offer STARTTLS, required by the TLS settings")
+		}
+		return nil
+	}
+	if _, _, err := c.cmd(220, "STARTTLS"); err != nil {
+		return err
+	}
+	c.conn = tls.Client(c.conn, config)
+	c.Text = textproto.NewConn(c.conn)
+	return c.lhlo()
+}
+
+// Auth is not supported over LMTP
+func (c *LMTPClient) Auth(a smtp.Auth) error {
+	return errors.New("authentication is not supported over LMTP")
+}
+
+// Extension reports whether the server offers an extension, and its
+// parameters
+func (c *LMTPClient) Extension(ext string) (bool, string) {
+	args, ok := c.ext[strings.ToUpper(ext)]
+	return ok, args
+}
+
+func (c *LMTPClient) Mail(from string, params ...string) error {
+	c.rcpts = nil
+	c.status = nil
+	cmd := "MAIL FROM:<" + from + ">"
+	if len(params) > 0 {
+		cmd += " " + strings.Join(params, " ")
+	}
+	_, _, err := c.cmd(250, "%s", cmd)
+	return err
+}
+
+func (c *LMTPClient) Rcpt(to string) error {
+	if _, _, err := c.cmd(25, "RCPT TO:<%s>", to); err != nil {
+		return err
+	}
+	c.rcpts = append(c.rcpts, to)
+	return nil
+}
+
+func (c *LMTPClient) Data() (io.WriteCloser, error) {
+	if _, _, err := c.cmd(354, "DATA"); err != nil {
+		return nil, err
+	}
+	return &lmtpDataWriter{WriteCloser: c.Text.DotWriter(), c: c}, nil
+}
+
+func (c *LMTPClient) Reset() error {
+	c.rcpts = nil
+	c.status = nil
+	_, _, err := c.cmd(250, "RSET")
+	return err
+}
+
+func (c *LMTPClient) Noop() error {
+	_, _, err := c.cmd(250, "NOOP")
+	return err
+}
+
+func (c *LMTPClient) Quit() error {
+	if _, _, err := c.cmd(221, "QUIT"); err != nil {
+		return err
+	}
+	return c.Text.Close()
+}
+
+func (c *LMTPClient) Close() error {
+	return c.Text.Close()
+}
+
+// RecipientStatus returns the errors reported after the message data for
+// the recipients the server failed to deliver to
+func (c *LMTPClient) RecipientStatus() map[string]error {
+	return c.status
+}
+
+// lmtpDataWriter collects one response per accepted recipient once the
+// message data is complete
+type lmtpDataWriter struct {
+	io.WriteCloser
+	c *LMTPClient
+}
+
+func (w *lmtpDataWriter) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		return err
+	}
+
+	w.c.status = map[string]error{}
+	for _, rcpt := range w.c.rcpts {
+		if _, _, err := w.c.Text.ReadResponse(250); err != nil {
+			var protoErr *textproto.Error
+			if !errors.As(err, &protoErr) {
+				return err
+			}
+			w.c.status[rcpt] = err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package email
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+)
+
+// serveLMTP plays an LMTP server on conn, answering the message data with
+// the given per-recipient replies, and returns the commands it received
+func serveLMTP(conn net.Conn, dataReplies []string) <-chan []string {
+	done := make(chan []string, 1)
+	go func() {
+		defer conn.Close()
+		var commands []string
+		r := bufio.NewReader(conn)
+		reply := func(lines ...string) {
+			fmt.Fprint(conn, strings.Join(lines, "\r\n")+"\r\n")
+		}
+
+		reply("220 lmtp.example.com ready")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				break
+			}
+			cmd := strings.TrimRight(line, "\r\n")
+			commands = append(commands, cmd)
+
+			switch {
+			case strings.HasPrefix(cmd, "LHLO"):
+				reply("250-lmtp.example.com", "250 PIPELINING")
+			case cmd == "DATA":
+				reply("354 go ahead")
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil || line == ".\r\n" {
+						break
+					}
+				}
+				reply(dataReplies...)
+			case cmd == "QUIT":
+				reply("221 bye")
+				done <- commands
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+		done <- commands
+	}()
+	return done
+}
+
+func TestSendLMTP(t *testing.T) {
+	client, server := net.Pipe()
+	commands := serveLMTP(server, []string{"250 2.0.0 a@domain.tld delivered", "550 5.1.1 b@domain.tld unknown user"})
+
+	cfg := &config.Config{
+		FromAddr:   testFromAddr,
+		SmtpAddrs:  []string{config.LMTPScheme + "localhost:24"},
+		Recipients: []string{"a@domain.tld", "b@domain.tld"},
+	}
+	email := &Email{
+		Config: cfg,
+		Body:   []byte("To: a@domain.tld, b@domain.tld\r\n\r\nBody\r\n"),
+	}
+
+	dialer := func(ctx context.Context, addr string) (SMTPClient, error) {
+		if addr != config.LMTPScheme+"localhost:24" {
+			t.Errorf("dialer called with %q", addr)
+		}
+		return NewLMTPClient(client)
+	}
+
+	result, err := email.sendWithDialer(context.Background(), dialer)
+	if err != nil {
+		t.Fatalf("sendWithDialer() failed: %v", err)
+	}
+
+	if !reflect.DeepEqual(result.Accepted, []string{"a@domain.tld"}) {
+		t.Errorf("Accepted = %v", result.Accepted)
+	}
+	if !reflect.DeepEqual(result.Rejected, []string{"b@domain.tld"}) {
+		t.Errorf("Rejected = %v", result.Rejected)
+	}
+	if err := result.Errors["b@domain.tld"]; err == nil || !strings.Contains(err.Error(), "unknown user") {
+		t.Errorf("Error for rejected recipient = %v", err)
+	}
+
+	expected := []string{
+		"LHLO localhost",
+		"NOOP",
+		"MAIL FROM:<" + testFromAddr + ">",
+		"RCPT TO:<a@domain.tld>",
+		"RCPT TO:<b@domain.tld>",
+		"DATA",
+		"QUIT",
+	}
+	if got := <-commands; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Commands = %q, want %q", got, expected)
+	}
+}
+
+func TestSendLMTPNoneDelivered(t *testing.T) {
+	client, server := net.Pipe()
+	serveLMTP(server, []string{"452 4.2.2 mailbox full"})
+
+	cfg := &config.Config{
+		FromAddr:   testFromAddr,
+		SmtpAddrs:  []string{config.LMTPScheme + "localhost:24"},
+		Recipients: []string{"a@domain.tld"},
+	}
+	email := &Email{
+		Config: cfg,
+		Body:   []byte("To: a@domain.tld\r\n\r\nBody\r\n"),
+	}
+
+	dialer := func(ctx context.Context, addr string) (SMTPClient, error) {
+		return NewLMTPClient(client)
+	}
+
+	result, err := email.sendWithDialer(context.Background(), dialer)
+	if err == nil {
+		t.Fatal("sendWithDialer() should fail when no recipient was delivered")
+	}
+	if classify(err) != TemporaryFailure {
+		t.Errorf("classify() = %v, want TemporaryFailure", classify(err))
+	}
+	if !reflect.DeepEqual(result.Rejected, []string{"a@domain.tld"}) {
+		t.Errorf("Rejected = %v", result.Rejected)
+	}
+}
+
+func TestSendLMTPPinnedWithoutTLS(t *testing.T) {
+	client, server := net.Pipe()
+	commands := serveLMTP(server, nil)
+
+	cfg := &config.Config{
+		FromAddr:          testFromAddr,
+		SmtpAddrs:         []string{config.LMTPScheme + "localhost:24"},
+		Recipients:        []string{"a@domain.tld"},
+		PinnedFingerprint: strings.Repeat("ab", 32),
+	}
+	email := &Email{
+		Config: cfg,
+		Body:   []byte("To: a@domain.tld\r\n\r\nBody\r\n"),
+	}
+
+	dialer := func(ctx context.Context, addr string) (SMTPClient, error) {
+		return NewLMTPClient(client)
+	}
+
+	_, err := email.sendWithDialer(context.Background(), dialer)
+	if err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+		t.Fatalf("sendWithDialer() error = %v, want a missing STARTTLS failure", err)
+	}
+	for _, cmd := range <-commands {
+		if strings.HasPrefix(cmd, "MAIL") {
+			t.Errorf("Mail sent in plaintext despite the pinned certificate: %q", cmd)
+		}
+	}
+}
@@ -0,0 +1,10 @@
+package email
+
+import "errors"
+
+// errLocked is returned by tryLockFile when another process holds the lock
+var errLocked = errors.New("file is locked by another process")
+
+// lockSuffix names the lock file kept next to a file shared between
+// concurrent mailrelay processes
+const lockSuffix = ".lock"
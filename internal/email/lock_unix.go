@@ -0,0 +1,41 @@
+//go:build !windows
+
+package email
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive lock on the file, creating it if needed and
+// waiting for other holders. Closing the returned file releases the lock.
+func lockFile(path string) (*os.File, error) {
+	return flock(path, syscall.LOCK_EX)
+}
+
+// tryLockFile is like lockFile but returns errLocked instead of waiting
+func tryLockFile(path string) (*os.File, error) {
+	return flock(path, syscall.LOCK_EX|syscall.LOCK_NB)
+}
+
+func flock(path string, how int) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		err = syscall.Flock(int(f.Fd()), how)
+		if !errors.Is(err, syscall.EINTR) {
+			break
+		}
+	}
+	if err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, errLocked
+		}
+		return nil, err
+	}
+	return f, nil
+}
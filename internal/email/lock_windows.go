@@ -0,0 +1,48 @@
+//go:build windows
+
+package email
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+)
+
+// errorSharingViolation is ERROR_SHARING_VIOLATION, missing from syscall
+const errorSharingViolation syscall.Errno = 32
+
+// lockFile takes an exclusive lock on the file, creating it if needed and
+// waiting for other holders. Closing the returned file releases the lock.
+func lockFile(path string) (*os.File, error) {
+	for {
+		f, err := openExclusive(path)
+		if !errors.Is(err, errLocked) {
+			return f, err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// tryLockFile is like lockFile but returns errLocked instead of waiting
+func tryLockFile(path string) (*os.File, error) {
+	return openExclusive(path)
+}
+
+// openExclusive opens the file without sharing it, which Windows refuses
+// while another process has it open
+func openExclusive(path string) (*os.File, error) {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	h, err := syscall.CreateFile(name, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil,
+		syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		if errors.Is(err, errorSharingViolation) {
+			return nil, errLocked
+		}
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return os.NewFile(uintptr(h), path), nil
+}
@@ -0,0 +1,112 @@
+package email
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// maildirDeliveries counts the files written by the process, keeping the
+// names of files written within the same microsecond apart
+var maildirDeliveries atomic.Int64
+
+// makeMaildir creates the tmp, new and cur subdirectories of a Maildir
+func makeMaildir(dir string) error {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeMaildir delivers the email to the Maildir instead of a server. The
+// file is written to tmp and then moved to new under a unique name, so
+// that readers never see partial messages. The envelope is kept in the
+// Return-Path and X-Envelope-To headers.
+func (e *Email) writeMaildir(dir, server string, recipients []string) (*SendResult, error) {
+	if e.Config.DryRun {
+		return e.dryRun(server, recipients), nil
+	}
+	if err := makeMaildir(dir); err != nil {
+		return nil, atStage("maildir", err)
+	}
+
+	from := e.sender(recipients)
+	data := e.withEnvelope(from, recipients)
+	name, err := maildirName(time.Now())
+	if err != nil {
+		return nil, atStage("maildir", err)
+	}
+	tmp := filepath.Join(dir, "tmp", name)
+	if err := writeSynced(tmp, data); err != nil {
+		os.Remove(tmp)
+		return nil, atStage("maildir", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, "new", name)); err != nil {
+		os.Remove(tmp)
+		return nil, atStage("maildir", err)
+	}
+
+	result := &SendResult{Server: server, From: from, Bytes: len(data)}
+	for _, rcpt := range recipients {
+		result.accept(rcpt)
+	}
+	return result, nil
+}
+
+// withEnvelope returns the message with LF line endings, as local mail
+// files have, and the envelope on top of its headers as a delivery agent
+// records it
+func (e *Email) withEnvelope(from string, recipients []string) []byte {
+	lines, rest, _ := splitHeader(bytes.ReplaceAll(e.Body, []byte("\r\n"), []byte("\n")))
+	if n := len(lines); n > 0 && !strings.HasSuffix(lines[n-1], "\n") {
+		lines[n-1] += "\n"
+	}
+	lines = removeHeader(lines, "Return-Path")
+	envelope := []string{
+		"Return-Path: <" + from + ">\n",
+		"X-Envelope-To: " + strings.Join(recipients, ", ") + "\n",
+	}
+	return joinHeader(append(envelope, lines...), rest)
+}
+
+// maildirName returns a unique file name for a Maildir, made of the time,
+// the process, a counter and randomness, and the host name
+func maildirName(now time.Time) (string, error) {
+	var random [4]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return "", err
+	}
+	host, _ := os.Hostname()
+	if host == "" {
+		host = "localhost"
+	}
+	// Slashes and colons are not allowed in the host part
+	host = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(host)
+	return fmt.Sprintf("%d.M%dP%dQ%dR%s.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(),
+		maildirDeliveries.Add(1), hex.EncodeToString(random[:]), host), nil
+}
+
+// writeSynced writes a new file and flushes it to disk before closing it
+func writeSynced(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,95 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+)
+
+// noDialer fails the test when a server is connected to
+func noDialer(t *testing.T) SMTPDialer {
+	return func(ctx context.Context, addr string) (SMTPClient, error) {
+		t.Errorf("dialed %s, want no connection", addr)
+		return nil, errors.New("unexpected dial")
+	}
+}
+
+func TestWriteMaildir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "Maildir")
+	send := func(body string) *SendResult {
+		t.Helper()
+		email := &Email{
+			Config: &config.Config{
+				FromAddr:   testFromAddr,
+				SmtpAddrs:  []string{config.MaildirScheme + dir},
+				Recipients: []string{"a@domain.tld", "b@domain.tld"},
+			},
+			Body: []byte(body),
+		}
+		result, err := email.sendWithDialer(context.Background(), noDialer(t))
+		if err != nil {
+			t.Fatalf("sendWithDialer() error = %v", err)
+		}
+		return result
+	}
+
+	result := send("Return-Path: <old@domain.tld>\r\nSubject: One\r\n\r\nBody\r\n")
+	send("Subject: Two\n\nBody\n")
+	if len(result.Accepted) != 2 || result.Server != config.MaildirScheme+dir {
+		t.Errorf("result = %+v, want both recipients accepted by the Maildir", result)
+	}
+
+	if tmp, _ := os.ReadDir(filepath.Join(dir, "tmp")); len(tmp) != 0 {
+		t.Errorf("tmp holds %d files, want none", len(tmp))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "cur")); err != nil {
+		t.Errorf("cur directory missing: %v", err)
+	}
+	files, err := os.ReadDir(filepath.Join(dir, "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("new holds %d files, want 2", len(files))
+	}
+
+	namePattern := regexp.MustCompile(`^\d+\.M\d+P\d+Q\d+R[0-9a-f]{8}\.[^/:]+$`)
+	contents := map[string]bool{}
+	for _, f := range files {
+		if !namePattern.MatchString(f.Name()) {
+			t.Errorf("file name %q is not a unique Maildir name", f.Name())
+		}
+		data, err := os.ReadFile(filepath.Join(dir, "new", f.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[string(data)] = true
+	}
+
+	for _, want := range []string{
+		"Return-Path: <" + testFromAddr + ">\nX-Envelope-To: a@domain.tld, b@domain.tld\nSubject: One\n\nBody\n",
+		"Return-Path: <" + testFromAddr + ">\nX-Envelope-To: a@domain.tld, b@domain.tld\nSubject: Two\n\nBody\n",
+	} {
+		if !contents[want] {
+			t.Errorf("no Maildir file holds %q", want)
+		}
+	}
+}
+
+func TestCheckMaildir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "Maildir")
+	cfg := &config.Config{SmtpAddrs: []string{config.MaildirScheme + dir}}
+
+	results := check(context.Background(), cfg, noDialer(t))
+	if len(results) != 1 || results[0].Err != nil {
+		t.Fatalf("check() = %+v, want the Maildir to pass", results)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "new")); err != nil {
+		t.Errorf("check() did not create the Maildir: %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+package email
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// makeMbox creates the mbox file and its directory, leaving an existing
+// file untouched
+func makeMbox(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// writeMbox delivers the email to the mbox file instead of a server, with
+// the envelope kept in the From line and the Return-Path and X-Envelope-To
+// headers
+func (e *Email) writeMbox(path, server string, recipients []string) (*SendResult, error) {
+	if e.Config.DryRun {
+		return e.dryRun(server, recipients), nil
+	}
+	if err := makeMbox(path); err != nil {
+		return nil, atStage("mbox", err)
+	}
+
+	from := e.sender(recipients)
+	data := e.withEnvelope(from, recipients)
+	if err := appendMbox(path, from, data, time.Now()); err != nil {
+		return nil, atStage("mbox", err)
+	}
+
+	result := &SendResult{Server: server, From: from, Bytes: len(data)}
+	for _, rcpt := range recipients {
+		result.accept(rcpt)
+	}
+	return result, nil
+}
+
+// appendMbox appends the message to the mbox file at path, preceded by a
+// From line naming the envelope sender. Lines of the message starting with
+// From, quoted or not, get one more > so that readers do not take them for
+// the start of the next message (mboxrd).
+func appendMbox(path, from string, msg []byte, now time.Time) error {
+	if from == "" {
+		from = "MAILER-DAEMON"
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("From " + from + " " + now.UTC().Format(time.ANSIC) + "\n")
+	msg = bytes.ReplaceAll(msg, []byte("\r\n"), []byte("\n"))
+	for _, line := range bytes.SplitAfter(msg, []byte("\n")) {
+		if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+			buf.WriteByte('>')
+		}
+		buf.Write(line)
+	}
+	if !bytes.HasSuffix(msg, []byte("\n")) {
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+
+	// Concurrent processes must not interleave their messages
+	lock, err := lockFile(path + lockSuffix)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
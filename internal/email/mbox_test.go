@@ -0,0 +1,98 @@
+package email
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+)
+
+func TestAppendMbox(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mbox")
+	now := time.Date(2024, 3, 5, 14, 7, 9, 0, time.UTC)
+
+	if err := appendMbox(path, "a@domain.tld", []byte("Subject: One\r\n\r\nFrom here\r\n>From there\r\nFromage"), now); err != nil {
+		t.Fatalf("appendMbox() error = %v", err)
+	}
+	if err := appendMbox(path, "", []byte("Subject: Two\n\nBody\n"), now); err != nil {
+		t.Fatalf("appendMbox() error = %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "From a@domain.tld Tue Mar  5 14:07:09 2024\n" +
+		"Subject: One\n\n>From here\n>>From there\nFromage\n\n" +
+		"From MAILER-DAEMON Tue Mar  5 14:07:09 2024\n" +
+		"Subject: Two\n\nBody\n\n"
+	if string(data) != want {
+		t.Errorf("mbox = %q, want %q", data, want)
+	}
+}
+
+func TestWriteMbox(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mail", "capture.mbox")
+	body := "Subject: Hello\r\n\r\nFrom the start\r\n>From a quote\r\nEnd\r\n"
+
+	// Concurrent senders must not interleave their messages
+	const senders = 8
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			email := &Email{
+				Config: &config.Config{
+					FromAddr:   testFromAddr,
+					SmtpAddrs:  []string{config.MboxScheme + path},
+					Recipients: []string{"a@domain.tld"},
+				},
+				Body: []byte(body),
+			}
+			if _, err := email.sendWithDialer(context.Background(), noDialer(t)); err != nil {
+				t.Errorf("sendWithDialer() error = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delimiter := regexp.MustCompile(`(?m)^From ` + regexp.QuoteMeta(testFromAddr) + ` \w{3} \w{3} [ \d]\d \d\d:\d\d:\d\d \d{4}\n`)
+	messages := delimiter.Split(string(data), -1)
+	if len(messages) != senders+1 || messages[0] != "" {
+		t.Fatalf("mbox holds %d From lines, want %d:\n%s", len(messages)-1, senders, data)
+	}
+	want := "Return-Path: <" + testFromAddr + ">\nX-Envelope-To: a@domain.tld\n" +
+		"Subject: Hello\n\n>From the start\n>>From a quote\nEnd\n\n"
+	for _, msg := range messages[1:] {
+		if msg != want {
+			t.Errorf("message = %q, want %q", msg, want)
+		}
+	}
+	if strings.Contains(string(data), "\r") {
+		t.Errorf("mbox holds CRLF line endings")
+	}
+}
+
+func TestCheckMbox(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mail", "capture.mbox")
+	cfg := &config.Config{SmtpAddrs: []string{config.MboxScheme + path}}
+
+	results := check(context.Background(), cfg, noDialer(t))
+	if len(results) != 1 || results[0].Err != nil {
+		t.Fatalf("check() = %+v, want the mbox to pass", results)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("check() did not create the mbox: %v", err)
+	}
+}
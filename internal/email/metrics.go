@@ -0,0 +1,179 @@
+package email
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// durationBuckets are the upper bounds in seconds of the send duration
+// histogram buckets
+var durationBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// metricFamilies lists the metrics written to the metrics file, in order
+var metricFamilies = []struct {
+	name, kind, help string
+	perServer        bool
+}{
+	{"mailrelay_send_total", "counter", "Number of emails handled.", false},
+	{"mailrelay_send_success_total", "counter", "Number of emails delivered.", false},
+	{"mailrelay_send_attempts_total", "counter", "Number of delivery attempts per server.", true},
+	{"mailrelay_send_failures_total", "counter", "Number of failed delivery attempts per server.", true},
+	{"mailrelay_send_duration_seconds", "histogram", "Time taken to send an email.", false},
+}
+
+// serverAttempt records the outcome of a delivery attempt for the metrics
+type serverAttempt struct {
+	server string
+	failed bool
+}
+
+// recordAttempt remembers a delivery attempt through the server when
+// metrics are enabled
+func (e *Email) recordAttempt(server string, err error) {
+	if e.Config.MetricsFile == "" {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.attempts = append(e.attempts, serverAttempt{server: server, failed: err != nil})
+}
+
+// writeMetrics adds the outcome of the send to the counters in the metrics
+// file, in the Prometheus text format read by the node_exporter textfile
+// collector. The file is replaced atomically so the collector never reads
+// a partial file, and locked so that concurrent sends do not lose updates.
+func (e *Email) writeMetrics(duration time.Duration, sent bool) error {
+	path := e.Config.MetricsFile
+	lock, err := lockFile(path + lockSuffix)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	samples, err := readMetrics(path)
+	if err != nil {
+		return err
+	}
+
+	samples["mailrelay_send_total"]++
+	if sent {
+		samples["mailrelay_send_success_total"]++
+	}
+	for _, attempt := range e.attempts {
+		label := fmt.Sprintf("{server=%q}", attempt.server)
+		samples["mailrelay_send_attempts_total"+label]++
+		if attempt.failed {
+			samples["mailrelay_send_failures_total"+label]++
+		}
+	}
+
+	seconds := duration.Seconds()
+	for _, le := range durationBuckets {
+		if seconds <= le {
+			samples[bucketName(le)]++
+		}
+	}
+	samples[`mailrelay_send_duration_seconds_bucket{le="+Inf"}`]++
+	samples["mailrelay_send_duration_seconds_sum"] += seconds
+	samples["mailrelay_send_duration_seconds_count"]++
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(formatMetrics(samples)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// readMetrics reads the samples of an existing metrics file, keyed by
+// metric name and labels
+func readMetrics(path string) (map[string]float64, error) {
+	samples := map[string]float64{}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return samples, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		sep := strings.LastIndex(line, " ")
+		if sep < 0 {
+			continue
+		}
+		if value, err := strconv.ParseFloat(line[sep+1:], 64); err == nil {
+			samples[line[:sep]] = value
+		}
+	}
+	return samples, scanner.Err()
+}
+
+// formatMetrics renders the samples grouped by metric family
+func formatMetrics(samples map[string]float64) string {
+	var b strings.Builder
+	for _, family := range metricFamilies {
+		fmt.Fprintf(&b, "# HELP %s %s\n", family.name, family.help)
+		fmt.Fprintf(&b, "# TYPE %s %s\n", family.name, family.kind)
+
+		if family.kind == "histogram" {
+			// Buckets must be listed in increasing order
+			for _, le := range durationBuckets {
+				fmt.Fprintf(&b, "%s %s\n", bucketName(le), formatValue(samples[bucketName(le)]))
+			}
+			for _, suffix := range []string{`_bucket{le="+Inf"}`, "_sum", "_count"} {
+				fmt.Fprintf(&b, "%s%s %s\n", family.name, suffix, formatValue(samples[family.name+suffix]))
+			}
+			continue
+		}
+
+		var keys []string
+		for key := range samples {
+			if key == family.name || strings.HasPrefix(key, family.name+"{") {
+				keys = append(keys, key)
+			}
+		}
+		if len(keys) == 0 && !family.perServer {
+			keys = append(keys, family.name)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(&b, "%s %s\n", key, formatValue(samples[key]))
+		}
+	}
+	return b.String()
+}
+
+// bucketName returns the sample name of a duration histogram bucket
+func bucketName(le float64) string {
+	return fmt.Sprintf(`mailrelay_send_duration_seconds_bucket{le="%s"}`, formatValue(le))
+}
+
+// formatValue formats a sample value without needless digits
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,136 @@
+package email
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "mailrelay.prom")
+
+	clients := map[string]*MockSMTPClient{
+		"smtp1.example.com:587": NewMockSMTPClient(),
+		"smtp2.example.com:587": NewMockSMTPClient(),
+	}
+	clients["smtp1.example.com:587"].ShouldFailOn = "tls"
+	dialer := func(ctx context.Context, addr string) (SMTPClient, error) {
+		return clients[addr], nil
+	}
+
+	// Two sends failing over from the first server to the second
+	for i := 0; i < 2; i++ {
+		email := &Email{
+			Config: &config.Config{
+				FromAddr:    testFromAddr,
+				SmtpAddrs:   []string{"smtp1.example.com:587", "smtp2.example.com:587"},
+				Recipients:  []string{"test@domain.tld"},
+				MetricsFile: path,
+			},
+			Body: []byte("test email body"),
+		}
+		_, err := email.sendWithDialer(context.Background(), dialer)
+		if err != nil {
+			t.Fatalf("sendWithDialer() failed: %v", err)
+		}
+		if err := email.writeMetrics(300*time.Millisecond, err == nil); err != nil {
+			t.Fatalf("writeMetrics() failed: %v", err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read metrics file: %v", err)
+	}
+	metrics := string(data)
+
+	expected := []string{
+		"# TYPE mailrelay_send_total counter\nmailrelay_send_total 2\n",
+		"mailrelay_send_success_total 2\n",
+		`mailrelay_send_attempts_total{server="smtp1.example.com:587"} 2` + "\n" +
+			`mailrelay_send_attempts_total{server="smtp2.example.com:587"} 2` + "\n",
+		"# TYPE mailrelay_send_failures_total counter\n" +
+			`mailrelay_send_failures_total{server="smtp1.example.com:587"} 2` + "\n# HELP",
+		"# TYPE mailrelay_send_duration_seconds histogram\n",
+		`mailrelay_send_duration_seconds_bucket{le="0.25"} 0` + "\n" +
+			`mailrelay_send_duration_seconds_bucket{le="0.5"} 2` + "\n",
+		`mailrelay_send_duration_seconds_bucket{le="+Inf"} 2` + "\n" +
+			"mailrelay_send_duration_seconds_sum 0.6\n" +
+			"mailrelay_send_duration_seconds_count 2\n",
+	}
+	for _, want := range expected {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("Metrics file does not contain %q:\n%s", want, metrics)
+		}
+	}
+}
+
+func TestWriteMetricsAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "mailrelay.prom")
+	if err := os.WriteFile(path, []byte("mailrelay_send_total 41\n"), 0644); err != nil {
+		t.Fatalf("Failed to write metrics file: %v", err)
+	}
+
+	// A reader holding the old file keeps seeing it whole
+	old, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open metrics file: %v", err)
+	}
+	defer old.Close()
+
+	email := &Email{Config: &config.Config{MetricsFile: path}}
+	if err := email.writeMetrics(time.Second, true); err != nil {
+		t.Fatalf("writeMetrics() failed: %v", err)
+	}
+
+	oldData := make([]byte, 100)
+	n, _ := old.Read(oldData)
+	if string(oldData[:n]) != "mailrelay_send_total 41\n" {
+		t.Errorf("Old file was modified in place: %q", oldData[:n])
+	}
+
+	data, _ := os.ReadFile(path)
+	if !strings.Contains(string(data), "mailrelay_send_total 42\n") {
+		t.Errorf("Metrics file was not updated:\n%s", data)
+	}
+
+	// No temporary file is left behind, only the lock file
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if name := entry.Name(); name != "mailrelay.prom" && name != "mailrelay.prom"+lockSuffix {
+			t.Errorf("Unexpected file %s left in %s", name, dir)
+		}
+	}
+}
+
+func TestWriteMetricsConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mailrelay.prom")
+
+	const sends = 20
+	var wg sync.WaitGroup
+	for i := 0; i < sends; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			email := &Email{Config: &config.Config{MetricsFile: path}}
+			if err := email.writeMetrics(time.Second, true); err != nil {
+				t.Errorf("writeMetrics() failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	data, _ := os.ReadFile(path)
+	if want := fmt.Sprintf("mailrelay_send_total %d\n", sends); !strings.Contains(string(data), want) {
+		t.Errorf("Metrics file lost updates, want %q:\n%s", want, data)
+	}
+}
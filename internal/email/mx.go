@@ -0,0 +1,88 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+)
+
+// errNullMX is returned for domains publishing a null MX record, which
+// accept no mail at all
+var errNullMX = errors.New("domain accepts no mail, it publishes a null MX record")
+
+// lookupMX returns the MX records of the domain, allowing tests to stub DNS
+var lookupMX = func(ctx context.Context, domain string) ([]*net.MX, error) {
+	return net.DefaultResolver.LookupMX(ctx, domain)
+}
+
+// serversOf returns the servers an entry of the server list stands for,
+// the hosts of the MX records of the domain in order of preference for
+// mx: entries, the entry itself otherwise
+func serversOf(ctx context.Context, entry string) ([]string, error) {
+	domain, ok := strings.CutPrefix(entry, config.MXScheme)
+	if !ok {
+		return []string{entry}, nil
+	}
+	port := strconv.Itoa(config.DefaultSMTPPort)
+
+	records, err := lookupMX(ctx, domain)
+	if err != nil {
+		// Domains without MX records receive mail on their address records
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return []string{net.JoinHostPort(domain, port)}, nil
+		}
+		return nil, atStage("dns", fmt.Errorf("MX lookup failed: %w", err))
+	}
+	if len(records) == 0 {
+		return []string{net.JoinHostPort(domain, port)}, nil
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Pref < records[j].Pref
+	})
+	var servers []string
+	for _, mx := range records {
+		host := strings.TrimSuffix(mx.Host, ".")
+		if host == "" {
+			return nil, atStage("dns", errNullMX)
+		}
+		servers = append(servers, net.JoinHostPort(host, port))
+	}
+	return servers, nil
+}
+
+// serverEntries returns the entries of the server list to try for the
+// recipients, the MX hosts of their domain in direct delivery
+func (e *Email) serverEntries(recipients []string) []string {
+	if e.Config.DirectDelivery && len(recipients) > 0 {
+		return []string{config.MXScheme + recipientDomain(asciiAddress(recipients[0]))}
+	}
+	return e.Config.SmtpAddrs
+}
+
+// groupByDomain splits each group of recipients by domain, keeping the
+// order in which domains first appear
+func groupByDomain(groups [][]string) [][]string {
+	var split [][]string
+	for _, group := range groups {
+		index := map[string]int{}
+		for _, rcpt := range group {
+			domain := recipientDomain(rcpt)
+			i, ok := index[domain]
+			if !ok {
+				i = len(split)
+				index[domain] = i
+				split = append(split, nil)
+			}
+			split[i] = append(split[i], rcpt)
+		}
+	}
+	return split
+}
@@ -0,0 +1,182 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+)
+
+// stubMX makes MX lookups return the records and error, restoring the
+// resolver when the test ends
+func stubMX(t *testing.T, records []*net.MX, err error) {
+	t.Helper()
+	orig := lookupMX
+	lookupMX = func(ctx context.Context, domain string) ([]*net.MX, error) {
+		return records, err
+	}
+	t.Cleanup(func() { lookupMX = orig })
+}
+
+func TestServersOf(t *testing.T) {
+	tests := []struct {
+		name     string
+		entry    string
+		records  []*net.MX
+		err      error
+		expected []string
+		wantErr  bool
+	}{
+		{
+			name:     "Smarthost",
+			entry:    "smtp.example.com:587",
+			expected: []string{"smtp.example.com:587"},
+		},
+		{
+			name:  "MX hosts by preference",
+			entry: "mx:example.com",
+			records: []*net.MX{
+				{Host: "mx3.example.com.", Pref: 30},
+				{Host: "mx1.example.com.", Pref: 10},
+				{Host: "mx2.example.com.", Pref: 20},
+			},
+			expected: []string{"mx1.example.com:25", "mx2.example.com:25", "mx3.example.com:25"},
+		},
+		{
+			name:     "No MX records",
+			entry:    "mx:example.com",
+			err:      &net.DNSError{Err: "no such host", Name: "example.com", IsNotFound: true},
+			expected: []string{"example.com:25"},
+		},
+		{
+			name:    "Null MX",
+			entry:   "mx:example.com",
+			records: []*net.MX{{Host: ".", Pref: 0}},
+			wantErr: true,
+		},
+		{
+			name:    "Lookup failure",
+			entry:   "mx:example.com",
+			err:     &net.DNSError{Err: "server misbehaving", Name: "example.com", IsTemporary: true},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stubMX(t, tt.records, tt.err)
+
+			servers, err := serversOf(context.Background(), tt.entry)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("serversOf() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			// Only a null MX means the domain will never take the message
+			if err != nil && (classify(err) == PermanentFailure) != errors.Is(err, errNullMX) {
+				t.Errorf("classify() = %v for %v", classify(err), err)
+			}
+			if !reflect.DeepEqual(servers, tt.expected) {
+				t.Errorf("serversOf() = %v, want %v", servers, tt.expected)
+			}
+		})
+	}
+}
+
+func TestSendDirectToMX(t *testing.T) {
+	stubMX(t, []*net.MX{
+		{Host: "backup.example.com.", Pref: 20},
+		{Host: "primary.example.com.", Pref: 10},
+	}, nil)
+
+	backup := NewMockSMTPClient()
+	var dialed []string
+	dialer := func(ctx context.Context, addr string) (SMTPClient, error) {
+		dialed = append(dialed, addr)
+		if addr == "primary.example.com:25" {
+			return nil, errors.New("connection refused")
+		}
+		return backup, nil
+	}
+
+	email := &Email{
+		Config: &config.Config{
+			FromAddr:   testFromAddr,
+			SmtpAddrs:  []string{"mx:example.com"},
+			Recipients: []string{"user@example.com"},
+		},
+		Body: []byte("test email body"),
+	}
+	if _, err := email.sendWithDialer(context.Background(), dialer); err != nil {
+		t.Fatalf("sendWithDialer() failed: %v", err)
+	}
+
+	// The primary MX is tried first, then the backup
+	expected := []string{"primary.example.com:25", "backup.example.com:25"}
+	if !reflect.DeepEqual(dialed, expected) {
+		t.Errorf("Dialed %v, want %v", dialed, expected)
+	}
+	if backup.MethodCallCount["Data"] != 1 {
+		t.Error("Expected the message to be sent through the backup MX")
+	}
+}
+
+func TestSendDirectDelivery(t *testing.T) {
+	orig := lookupMX
+	lookupMX = func(ctx context.Context, domain string) ([]*net.MX, error) {
+		return []*net.MX{{Host: "mx." + domain + ".", Pref: 10}}, nil
+	}
+	t.Cleanup(func() { lookupMX = orig })
+
+	clients := map[string]*MockSMTPClient{
+		"mx.one.example:25": NewMockSMTPClient(),
+		"mx.two.example:25": NewMockSMTPClient(),
+	}
+	clients["mx.two.example:25"].ShouldFailOn = "mail"
+	dialer := func(ctx context.Context, addr string) (SMTPClient, error) {
+		c, ok := clients[addr]
+		if !ok {
+			return nil, errors.New("unexpected server " + addr)
+		}
+		return c, nil
+	}
+
+	email := &Email{
+		Config: &config.Config{
+			FromAddr:       testFromAddr,
+			Recipients:     []string{"a@one.example", "b@two.example", "c@One.example"},
+			DirectDelivery: true,
+		},
+		Body: []byte("test email body"),
+	}
+	result, err := email.sendWithDialer(context.Background(), dialer)
+	if err == nil {
+		t.Fatal("sendWithDialer() should report the failing domain")
+	}
+
+	// Each domain gets its own connection, a failure of one leaves the
+	// other delivered
+	for addr, c := range clients {
+		if c.MethodCallCount["Mail"] != 1 {
+			t.Errorf("%s got %d transactions, want 1", addr, c.MethodCallCount["Mail"])
+		}
+	}
+	if !reflect.DeepEqual(result.Accepted, []string{"a@one.example", "c@One.example"}) {
+		t.Errorf("Accepted = %v", result.Accepted)
+	}
+	if !reflect.DeepEqual(result.Rejected, []string{"b@two.example"}) {
+		t.Errorf("Rejected = %v", result.Rejected)
+	}
+}
+
+func TestGroupByDomain(t *testing.T) {
+	groups := groupByDomain([][]string{
+		{"a@one.example", "b@two.example", "c@one.example"},
+		{"d@two.example"},
+	})
+	expected := [][]string{{"a@one.example", "c@one.example"}, {"b@two.example"}, {"d@two.example"}}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Errorf("groupByDomain() = %v, want %v", groups, expected)
+	}
+}
@@ -0,0 +1,100 @@
+package email
+
+import "strings"
+
+// normalizeRecipients rewrites the recipients as configured, dropping
+// duplicates that normalization may create
+func (e *Email) normalizeRecipients() {
+	cfg := e.Config
+	if !cfg.NormalizeAddresses && !cfg.StripPlusTags && !cfg.LowercaseLocal {
+		return
+	}
+
+	seen := map[string]bool{}
+	normalized := []string{}
+	for _, rcpt := range cfg.Recipients {
+		rcpt = normalizeAddress(rcpt, cfg.StripPlusTags, cfg.LowercaseLocal)
+		if !seen[rcpt] {
+			seen[rcpt] = true
+			normalized = append(normalized, rcpt)
+		}
+	}
+	cfg.Recipients = normalized
+}
+
+// redirectAll replaces the recipients with the redirect address, listing
+// them in an X-Original-To header in place of any existing one
+func (e *Email) redirectAll() {
+	lines, rest, eol := splitHeader(e.Body)
+	lines = removeHeader(lines, "X-Original-To")
+	if n := len(lines); n > 0 && !strings.HasSuffix(lines[n-1], "\n") {
+		lines[n-1] += eol
+	}
+	// One recipient per line keeps long lists within the line length limit
+	header := "X-Original-To: " + strings.Join(e.Config.Recipients, ","+eol+" ") + eol
+	e.Body = joinHeader(append(lines, header), rest)
+	e.Config.Recipients = []string{e.Config.RedirectAll}
+}
+
+// addArchive adds the archive address to the envelope recipients, unless
+// it is one of them already
+func (e *Email) addArchive() {
+	for _, rcpt := range e.Config.Recipients {
+		if strings.EqualFold(rcpt, e.Config.AlwaysBcc) {
+			return
+		}
+	}
+	e.Config.Recipients = append(e.Config.Recipients, e.Config.AlwaysBcc)
+}
+
+// mapDomains rewrites the recipients following the domain map, dropping
+// duplicates as a catch-all address turns them all into one
+func (e *Email) mapDomains() {
+	cfg := e.Config
+	if len(cfg.DomainMap) == 0 {
+		return
+	}
+
+	seen := map[string]bool{}
+	mapped := []string{}
+	for _, rcpt := range cfg.Recipients {
+		target, ok := cfg.DomainMap[recipientDomain(rcpt)]
+		if !ok {
+			target, ok = cfg.DomainMap["*"]
+		}
+		at := strings.LastIndex(rcpt, "@")
+		switch {
+		case !ok:
+		case strings.Contains(target, "@"):
+			rcpt = target
+		case at >= 0:
+			rcpt = rcpt[:at+1] + target
+		}
+		if !seen[rcpt] {
+			seen[rcpt] = true
+			mapped = append(mapped, rcpt)
+		}
+	}
+	cfg.Recipients = mapped
+}
+
+// normalizeAddress lowercases the domain of an address and optionally
+// strips the +tag from its local part and lowercases it
+func normalizeAddress(addr string, stripTag, lowerLocal bool) string {
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
+		return addr
+	}
+
+	local, domain := addr[:at], strings.ToLower(addr[at+1:])
+	if stripTag {
+		// Quoted local parts may legitimately contain a plus
+		if plus := strings.Index(local, "+"); plus > 0 && !strings.HasPrefix(local, "\"") {
+			local = local[:plus]
+		}
+	}
+	if lowerLocal {
+		local = strings.ToLower(local)
+	}
+	return local + "@" + domain
+}
@@ -0,0 +1,249 @@
+package email
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+)
+
+func TestNormalizeAddress(t *testing.T) {
+	tests := []struct {
+		addr       string
+		stripTag   bool
+		lowerLocal bool
+		expected   string
+	}{
+		{"User+tag@EXAMPLE.com", false, false, "User+tag@example.com"},
+		{"User+tag@EXAMPLE.com", true, false, "User@example.com"},
+		{"User+tag@EXAMPLE.com", true, true, "user@example.com"},
+		{"User+tag@EXAMPLE.com", false, true, "user+tag@example.com"},
+		{"+tag@example.com", true, false, "+tag@example.com"},
+		{"\"a+b\"@example.com", true, false, "\"a+b\"@example.com"},
+		{"no-domain", true, true, "no-domain"},
+	}
+
+	for _, tt := range tests {
+		if got := normalizeAddress(tt.addr, tt.stripTag, tt.lowerLocal); got != tt.expected {
+			t.Errorf("normalizeAddress(%q, %v, %v) = %q, want %q", tt.addr, tt.stripTag, tt.lowerLocal, got, tt.expected)
+		}
+	}
+}
+
+func TestNormalizeRecipients(t *testing.T) {
+	body := "To: User+tag@EXAMPLE.com, user+other@example.com\nCc: Other@Example.COM\n\nBody"
+
+	tests := []struct {
+		name     string
+		cfg      config.Config
+		expected []string
+	}{
+		{
+			name:     "Disabled by default",
+			expected: []string{"User+tag@EXAMPLE.com", "user+other@example.com", "Other@Example.COM"},
+		},
+		{
+			name:     "Domain only",
+			cfg:      config.Config{NormalizeAddresses: true},
+			expected: []string{"User+tag@example.com", "user+other@example.com", "Other@example.com"},
+		},
+		{
+			name:     "Plus tags stripped",
+			cfg:      config.Config{NormalizeAddresses: true, StripPlusTags: true},
+			expected: []string{"User@example.com", "user@example.com", "Other@example.com"},
+		},
+		{
+			name:     "Duplicates dropped",
+			cfg:      config.Config{StripPlusTags: true, LowercaseLocal: true},
+			expected: []string{"user@example.com", "other@example.com"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			cfg.FromAddr = testFromAddr
+			cfg.SmtpAddrs = []string{testSMTPAddr}
+
+			email, err := New(&cfg, []byte(body))
+			if err != nil {
+				t.Fatalf("New() failed: %v", err)
+			}
+			if !reflect.DeepEqual(email.Config.Recipients, tt.expected) {
+				t.Errorf("Recipients = %v, want %v", email.Config.Recipients, tt.expected)
+			}
+		})
+	}
+}
+
+func TestMapDomains(t *testing.T) {
+	body := "To: a@old.example, b@Old.example\nCc: c@other.example, d@keep.example\n\nBody"
+
+	tests := []struct {
+		name      string
+		domainMap map[string]string
+		expected  []string
+	}{
+		{
+			name:     "No rules",
+			expected: []string{"a@old.example", "b@Old.example", "c@other.example", "d@keep.example"},
+		},
+		{
+			name:      "Specific domain",
+			domainMap: map[string]string{"old.example": "new.example"},
+			expected:  []string{"a@new.example", "b@new.example", "c@other.example", "d@keep.example"},
+		},
+		{
+			name:      "Address target",
+			domainMap: map[string]string{"other.example": "sink@example.com"},
+			expected:  []string{"a@old.example", "b@Old.example", "sink@example.com", "d@keep.example"},
+		},
+		{
+			name:      "Catch-all",
+			domainMap: map[string]string{"*": "test@example.com"},
+			expected:  []string{"test@example.com"},
+		},
+		{
+			name:      "Specific rule wins over catch-all",
+			domainMap: map[string]string{"*": "test@example.com", "keep.example": "keep.example"},
+			expected:  []string{"test@example.com", "d@keep.example"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Config{
+				FromAddr:  testFromAddr,
+				SmtpAddrs: []string{testSMTPAddr},
+				DomainMap: tt.domainMap,
+			}
+
+			email, err := New(&cfg, []byte(body))
+			if err != nil {
+				t.Fatalf("New() failed: %v", err)
+			}
+			if !reflect.DeepEqual(email.Config.Recipients, tt.expected) {
+				t.Errorf("Recipients = %v, want %v", email.Config.Recipients, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRedirectAll(t *testing.T) {
+	body := "To: a@example.com\r\nCc: b@example.org\r\nX-Original-To: forged@example.net\r\n\r\nBody"
+	cfg := &config.Config{
+		FromAddr:    testFromAddr,
+		SmtpAddrs:   []string{testSMTPAddr},
+		Recipients:  []string{"c@example.net"},
+		RedirectAll: "sink@staging.example",
+	}
+	email, err := New(cfg, []byte(body))
+	if err != nil {
+		t.Fatalf("New() failed: %v", err)
+	}
+
+	if !reflect.DeepEqual(email.Config.Recipients, []string{"sink@staging.example"}) {
+		t.Errorf("Recipients = %v, want only the sink", email.Config.Recipients)
+	}
+	expected := "To: a@example.com\r\nCc: b@example.org\r\n" +
+		"X-Original-To: c@example.net,\r\n a@example.com,\r\n b@example.org\r\n\r\nBody"
+	if string(email.Body) != expected {
+		t.Errorf("Body = %q, want %q", email.Body, expected)
+	}
+
+	mock := NewMockSMTPClient()
+	dialer := func(ctx context.Context, addr string) (SMTPClient, error) {
+		return mock, nil
+	}
+	result, err := email.sendWithDialer(context.Background(), dialer)
+	if err != nil {
+		t.Fatalf("sendWithDialer() error = %v", err)
+	}
+	if mock.MethodCallCount["Rcpt"] != 1 {
+		t.Errorf("Rcpt called %d times, want 1", mock.MethodCallCount["Rcpt"])
+	}
+	if !reflect.DeepEqual(result.Accepted, []string{"sink@staging.example"}) {
+		t.Errorf("Accepted = %v, want only the sink", result.Accepted)
+	}
+}
+
+func TestAlwaysBcc(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      config.Config
+		body     string
+		expected []string
+	}{
+		{
+			name:     "Added to header recipients",
+			body:     "To: a@example.com\n\nBody",
+			expected: []string{"a@example.com", "archive@example.org"},
+		},
+		{
+			name:     "Added to flag recipients",
+			cfg:      config.Config{Recipients: []string{"b@example.com"}},
+			body:     "To: a@example.com\n\nBody",
+			expected: []string{"b@example.com", "a@example.com", "archive@example.org"},
+		},
+		{
+			name:     "Already a recipient",
+			body:     "To: a@example.com\nCc: Archive@Example.org\n\nBody",
+			expected: []string{"a@example.com", "Archive@Example.org"},
+		},
+		{
+			name:     "Kept when redirecting",
+			cfg:      config.Config{RedirectAll: "sink@staging.example"},
+			body:     "To: a@example.com\n\nBody",
+			expected: []string{"sink@staging.example", "archive@example.org"},
+		},
+		{
+			name:     "Not filtered by domain",
+			cfg:      config.Config{AllowedDomains: []string{"example.com"}},
+			body:     "To: a@example.com\n\nBody",
+			expected: []string{"a@example.com", "archive@example.org"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			cfg.FromAddr = testFromAddr
+			cfg.SmtpAddrs = []string{testSMTPAddr}
+			cfg.AlwaysBcc = "archive@example.org"
+
+			email, err := New(&cfg, []byte(tt.body))
+			if err != nil {
+				t.Fatalf("New() failed: %v", err)
+			}
+			if !reflect.DeepEqual(email.Config.Recipients, tt.expected) {
+				t.Errorf("Recipients = %v, want %v", email.Config.Recipients, tt.expected)
+			}
+		})
+	}
+}
+
+func TestAlwaysBccNotInHeaders(t *testing.T) {
+	body := "To: a@example.com\n\nBody\n"
+	cfg := &config.Config{
+		FromAddr:  testFromAddr,
+		SmtpAddrs: []string{testSMTPAddr},
+		AlwaysBcc: "archive@example.org",
+	}
+	email, err := New(cfg, []byte(body))
+	if err != nil {
+		t.Fatalf("New() failed: %v", err)
+	}
+
+	mock := NewMockSMTPClient()
+	result, err := email.sendWithDialer(context.Background(), createMockDialer(mock, false))
+	if err != nil {
+		t.Fatalf("sendWithDialer() error = %v", err)
+	}
+	if !reflect.DeepEqual(result.Accepted, []string{"a@example.com", "archive@example.org"}) {
+		t.Errorf("Accepted = %v, want the archive too", result.Accepted)
+	}
+	if written := string(mock.DataWriter.Written); written != body {
+		t.Errorf("Written message = %q, want it unchanged %q", written, body)
+	}
+}
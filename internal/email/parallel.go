@@ -0,0 +1,75 @@
+package email
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// sendParallel splits the recipients into batches and relays each batch in
+// its own transaction, using at most Config.Parallelism concurrent workers
+func (e *Email) sendParallel(ctx context.Context, recipients []string, dialer SMTPDialer) (*SendResult, error) {
+	batches := splitRecipients(recipients, e.Config.Parallelism)
+
+	jobs := make(chan []string)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failures := map[string][]string{}
+	var errs []error
+	result := &SendResult{}
+
+	for i := 0; i < e.Config.Parallelism && i < len(batches); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range jobs {
+				_, batchResult, err := e.deliver(ctx, batch, dialer)
+				mu.Lock()
+				result.merge(batchResult)
+				if err != nil {
+					errs = append(errs, err)
+					failures[err.Error()] = append(failures[err.Error()], batch...)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, batch := range batches {
+		jobs <- batch
+	}
+	close(jobs)
+	wg.Wait()
+
+	if e.tolerated(result, errs) {
+		return result, nil
+	}
+
+	// Produce a stable message listing the failed recipients per server
+	reasons := make([]string, 0, len(failures))
+	for reason, recipients := range failures {
+		sort.Strings(recipients)
+		reasons = append(reasons, fmt.Sprintf("%s (%s)", strings.Join(recipients, ", "), reason))
+	}
+	sort.Strings(reasons)
+	return result, &DeliveryError{
+		Kind: combinedKind(errs),
+		Err:  fmt.Errorf("failed to send email to some recipients: %s", strings.Join(reasons, "; ")),
+	}
+}
+
+// splitRecipients divides recipients into at most n batches of similar size
+func splitRecipients(recipients []string, n int) [][]string {
+	size := (len(recipients) + n - 1) / n
+	var batches [][]string
+	for start := 0; start < len(recipients); start += size {
+		end := start + size
+		if end > len(recipients) {
+			end = len(recipients)
+		}
+		batches = append(batches, recipients[start:end])
+	}
+	return batches
+}
@@ -0,0 +1,121 @@
+package email
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+)
+
+// recordingDialer hands out a fresh mock client per connection and keeps
+// track of every recipient accepted, so it can be shared between goroutines
+type recordingDialer struct {
+	mu       sync.Mutex
+	accepted []string
+	failOn   string
+}
+
+func (d *recordingDialer) dial(ctx context.Context, addr string) (SMTPClient, error) {
+	client := NewMockSMTPClient()
+	client.FailOnRecipient = d.failOn
+	return &recordingClient{MockSMTPClient: client, dialer: d}, nil
+}
+
+type recordingClient struct {
+	*MockSMTPClient
+	dialer  *recordingDialer
+	pending []string
+}
+
+func (c *recordingClient) Rcpt(to string) error {
+	if err := c.MockSMTPClient.Rcpt(to); err != nil {
+		return err
+	}
+	c.pending = append(c.pending, to)
+	return nil
+}
+
+func (c *recordingClient) Quit() error {
+	c.dialer.mu.Lock()
+	c.dialer.accepted = append(c.dialer.accepted, c.pending...)
+	c.dialer.mu.Unlock()
+	return c.MockSMTPClient.Quit()
+}
+
+func TestSplitRecipients(t *testing.T) {
+	recipients := []string{"a", "b", "c", "d", "e"}
+	got := splitRecipients(recipients, 2)
+	want := [][]string{{"a", "b", "c"}, {"d", "e"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("splitRecipients() = %v, want %v", got, want)
+	}
+
+	if got := splitRecipients(recipients, 10); len(got) != 5 {
+		t.Errorf("splitRecipients() with more workers than recipients = %v", got)
+	}
+}
+
+func TestSendParallel(t *testing.T) {
+	recipients := []string{}
+	for _, r := range "abcdefghij" {
+		recipients = append(recipients, string(r)+"@domain.tld")
+	}
+
+	dialer := &recordingDialer{}
+	cfg := &config.Config{
+		FromAddr:    testFromAddr,
+		SmtpAddrs:   []string{"smtp1.example.com:587", "smtp2.example.com:587"},
+		Recipients:  recipients,
+		Parallelism: 3,
+	}
+
+	email := &Email{
+		Config: cfg,
+		Body:   []byte("test email body"),
+	}
+
+	if _, err := email.sendWithDialer(context.Background(), dialer.dial); err != nil {
+		t.Fatalf("sendWithDialer() failed unexpectedly: %v", err)
+	}
+
+	sort.Strings(dialer.accepted)
+	if !reflect.DeepEqual(dialer.accepted, recipients) {
+		t.Errorf("Accepted recipients = %v, want %v", dialer.accepted, recipients)
+	}
+}
+
+func TestSendParallelReportsFailedRecipients(t *testing.T) {
+	dialer := &recordingDialer{failOn: "c@domain.tld"}
+	cfg := &config.Config{
+		FromAddr:    testFromAddr,
+		SmtpAddrs:   []string{"smtp1.example.com:587", "smtp2.example.com:587"},
+		Recipients:  []string{"a@domain.tld", "b@domain.tld", "c@domain.tld", "d@domain.tld"},
+		Parallelism: 2,
+	}
+
+	email := &Email{
+		Config: cfg,
+		Body:   []byte("test email body"),
+	}
+
+	_, err := email.sendWithDialer(context.Background(), dialer.dial)
+	if err == nil {
+		t.Fatal("sendWithDialer() should report the failed batch")
+	}
+
+	// The batch containing the rejected recipient fails on every server
+	for _, want := range []string{"c@domain.tld", "d@domain.tld", "smtp2.example.com:587", "mock rcpt error"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Error %q does not mention %q", err, want)
+		}
+	}
+
+	sort.Strings(dialer.accepted)
+	if !reflect.DeepEqual(dialer.accepted, []string{"a@domain.tld", "b@domain.tld"}) {
+		t.Errorf("Accepted recipients = %v", dialer.accepted)
+	}
+}
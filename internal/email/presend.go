@@ -0,0 +1,52 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+)
+
+// ErrPreSendCommand is returned when the pre-send command fails, the
+// message is then not sent
+var ErrPreSendCommand = errors.New("pre-send command failed")
+
+// runPreSendCommand pipes the message through the pre-send command, taking
+// its output as the new message
+func (e *Email) runPreSendCommand() error {
+	timeout := e.Config.PreSendTimeout
+	if timeout == 0 {
+		timeout = config.DefaultPreSendTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sh", "-c", e.Config.PreSendCommand)
+	cmd.Stdin = bytes.NewReader(e.Body)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// Children keeping the output open must not outlive the timeout
+	cmd.WaitDelay = time.Second
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			err = fmt.Errorf("killed after %v", timeout)
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%v: %s", err, msg)
+		}
+		return fmt.Errorf("%w: %v", ErrPreSendCommand, err)
+	}
+	if len(bytes.TrimSpace(stdout.Bytes())) == 0 {
+		return fmt.Errorf("%w: no message on its output", ErrPreSendCommand)
+	}
+
+	e.Body = stdout.Bytes()
+	return nil
+}
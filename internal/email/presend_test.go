@@ -0,0 +1,57 @@
+package email
+
+import (
+	"errors"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+)
+
+func TestPreSendCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the pre-send command runs in sh")
+	}
+
+	tests := []struct {
+		name     string
+		command  string
+		timeout  time.Duration
+		expected string
+		wantErr  string
+	}{
+		{"Unchanged by cat", "cat", 0, "To: a@domain.tld\n\nBody\n", ""},
+		{"Rewritten by sed", "sed 's/Body/Filtered/'", 0, "To: a@domain.tld\n\nFiltered\n", ""},
+		{"Header added", "printf 'X-Scanned: yes\\n'; cat", 0, "X-Scanned: yes\nTo: a@domain.tld\n\nBody\n", ""},
+		{"Failing command", "echo 'virus found' >&2; exit 1", 0, "", "virus found"},
+		{"Empty output", "cat >/dev/null", 0, "", "no message"},
+		{"Timeout", "sleep 5", 100 * time.Millisecond, "", "killed after"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{
+				FromAddr:       testFromAddr,
+				SmtpAddrs:      []string{testSMTPAddr},
+				PreSendCommand: tt.command,
+				PreSendTimeout: tt.timeout,
+			}
+
+			email, err := New(cfg, []byte("To: a@domain.tld\n\nBody\n"))
+			if tt.wantErr != "" {
+				if !errors.Is(err, ErrPreSendCommand) || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("New() error = %v, want the command failure with %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			if string(email.Body) != tt.expected {
+				t.Errorf("Body = %q, want %q", email.Body, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+	"golang.org/x/net/proxy"
+)
+
+// smtpDialer returns the dialer for the configured servers, reaching them
+// through the SOCKS5 proxy when one is set. TLS is started over the
+// proxied connection as usual.
+func smtpDialer(cfg *config.Config) SMTPDialer {
+	return func(ctx context.Context, addr string) (SMTPClient, error) {
+		var d proxy.ContextDialer = netDialer(cfg)
+		if cfg.SocksProxy != "" {
+			var err error
+			if d, err = proxyDialer(cfg); err != nil {
+				return nil, err
+			}
+		}
+		return dialSMTP(ctx, addr, cfg.SMTPMode, cfg.GreetingTimeout, func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := d.DialContext(ctx, network, addr)
+			if err != nil && cfg.LocalAddr != "" {
+				return nil, fmt.Errorf("connecting from local address %s: %w", cfg.LocalAddr, err)
+			}
+			if err == nil && cfg.SendProxyHeader {
+				if err = writeProxyHeader(conn, cfg.ProxyHeaderVersion); err != nil {
+					conn.Close()
+					return nil, err
+				}
+			}
+			return conn, err
+		})
+	}
+}
+
+// netDialer returns the dialer making direct connections, from the
+// configured source address if any
+func netDialer(cfg *config.Config) *net.Dialer {
+	d := &net.Dialer{}
+	if ip := net.ParseIP(cfg.LocalAddr); ip != nil {
+		d.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	return d
+}
+
+// proxyDialer dials through the SOCKS5 proxy, except for the hosts listed
+// in NoProxy
+func proxyDialer(cfg *config.Config) (proxy.ContextDialer, error) {
+	u, err := url.Parse(cfg.SocksProxy)
+	if err != nil {
+		return nil, err
+	}
+	direct := netDialer(cfg)
+	socks, err := proxy.FromURL(u, direct)
+	if err != nil {
+		return nil, err
+	}
+
+	d := socks
+	if cfg.NoProxy != "" {
+		perHost := proxy.NewPerHost(socks, direct)
+		perHost.AddFromString(cfg.NoProxy)
+		d = perHost
+	}
+
+	ctxDialer, ok := d.(proxy.ContextDialer)
+	if !ok {
+		return nil, errors.New("proxy dialer does not support contexts")
+	}
+	return ctxDialer, nil
+}
@@ -0,0 +1,191 @@
+package email
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+)
+
+// serveSOCKS5 accepts a single SOCKS5 CONNECT on ln, reports the requested
+// destination and then plays an SMTP server over the tunnel
+func serveSOCKS5(t *testing.T, ln net.Listener) <-chan string {
+	t.Helper()
+	target := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+
+		// Greeting, accepting no authentication
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(r, make([]byte, header[1])); err != nil {
+			return
+		}
+		conn.Write([]byte{5, 0})
+
+		// CONNECT request
+		req := make([]byte, 4)
+		if _, err := io.ReadFull(r, req); err != nil {
+			return
+		}
+		var host string
+		switch req[3] {
+		case 1:
+			ip := make([]byte, 4)
+			io.ReadFull(r, ip)
+			host = net.IP(ip).String()
+		case 3:
+			n, _ := r.ReadByte()
+			name := make([]byte, n)
+			io.ReadFull(r, name)
+			host = string(name)
+		}
+		port := make([]byte, 2)
+		io.ReadFull(r, port)
+		target <- net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+		conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+
+		// SMTP over the tunnel
+		fmt.Fprint(conn, "220 smtp.example.com ready\r\n")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if strings.HasPrefix(line, "QUIT") {
+				fmt.Fprint(conn, "221 bye\r\n")
+				return
+			}
+			fmt.Fprint(conn, "250 ok\r\n")
+		}
+	}()
+	return target
+}
+
+func TestSMTPDialerThroughProxy(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+	target := serveSOCKS5(t, ln)
+
+	cfg := &config.Config{SocksProxy: "socks5://" + ln.Addr().String()}
+	client, err := smtpDialer(cfg)(context.Background(), "smtp.example.com:25")
+	if err != nil {
+		t.Fatalf("Dial through proxy failed: %v", err)
+	}
+	defer client.Close()
+
+	if got := <-target; got != "smtp.example.com:25" {
+		t.Errorf("Proxy asked to connect to %s, want smtp.example.com:25", got)
+	}
+	if err := client.Noop(); err != nil {
+		t.Errorf("Noop() through proxy failed: %v", err)
+	}
+	if err := client.Quit(); err != nil {
+		t.Errorf("Quit() through proxy failed: %v", err)
+	}
+}
+
+func TestSMTPDialerNoProxy(t *testing.T) {
+	// An SMTP server reached directly
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprint(conn, "220 smtp.example.com ready\r\n")
+		bufio.NewReader(conn).ReadString('\n')
+	}()
+
+	// The proxy itself is unreachable
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	closed.Close()
+
+	cfg := &config.Config{
+		SocksProxy: "socks5://" + closed.Addr().String(),
+		NoProxy:    "localhost,127.0.0.1",
+	}
+	client, err := smtpDialer(cfg)(context.Background(), ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Direct dial for a NO_PROXY host failed: %v", err)
+	}
+	client.Close()
+}
+
+func TestNetDialerLocalAddr(t *testing.T) {
+	tests := []struct {
+		localAddr string
+		expected  net.Addr
+	}{
+		{"", nil},
+		{"192.0.2.10", &net.TCPAddr{IP: net.ParseIP("192.0.2.10")}},
+		{"2001:db8::10", &net.TCPAddr{IP: net.ParseIP("2001:db8::10")}},
+	}
+
+	for _, tt := range tests {
+		d := netDialer(&config.Config{LocalAddr: tt.localAddr})
+		if !reflect.DeepEqual(d.LocalAddr, tt.expected) {
+			t.Errorf("netDialer(%q) LocalAddr = %v, want %v", tt.localAddr, d.LocalAddr, tt.expected)
+		}
+	}
+}
+
+func TestSMTPDialerLocalAddr(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+	remote := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		remote <- conn.RemoteAddr().(*net.TCPAddr).IP.String()
+		fmt.Fprint(conn, "220 smtp.example.com ready\r\n")
+		bufio.NewReader(conn).ReadString('\n')
+	}()
+
+	client, err := smtpDialer(&config.Config{LocalAddr: "127.0.0.1"})(context.Background(), ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial from local address failed: %v", err)
+	}
+	client.Close()
+	if got := <-remote; got != "127.0.0.1" {
+		t.Errorf("Connection came from %s, want 127.0.0.1", got)
+	}
+
+	// An address not assigned to the host cannot be bound
+	_, err = smtpDialer(&config.Config{LocalAddr: "192.0.2.10"})(context.Background(), ln.Addr().String())
+	if err == nil || !strings.Contains(err.Error(), "connecting from local address 192.0.2.10") {
+		t.Errorf("Dial from an unassigned address error = %v", err)
+	}
+}
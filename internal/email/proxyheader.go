@@ -0,0 +1,75 @@
+package email
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// proxySignature starts every PROXY protocol version 2 header
+var proxySignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyHeader returns the PROXY protocol header telling the server the
+// addresses of the connection as seen by the client, in the text format of
+// version 1 or the binary one of version 2. Connections whose addresses are
+// not TCP, as through some proxies, are declared with an unknown family.
+func proxyHeader(conn net.Conn, version int) []byte {
+	src, srcOK := conn.LocalAddr().(*net.TCPAddr)
+	dst, dstOK := conn.RemoteAddr().(*net.TCPAddr)
+	known := srcOK && dstOK
+
+	// Both addresses must be of the same family, IPv4 ones are mapped to
+	// IPv6 when mixed
+	ipv4 := known && src.IP.To4() != nil && dst.IP.To4() != nil
+
+	if version == 1 {
+		switch {
+		case !known:
+			return []byte("PROXY UNKNOWN\r\n")
+		case ipv4:
+			return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", src.IP.To4(), dst.IP.To4(), src.Port, dst.Port))
+		default:
+			return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", ipv6String(src.IP), ipv6String(dst.IP), src.Port, dst.Port))
+		}
+	}
+
+	var b bytes.Buffer
+	b.Write(proxySignature)
+	b.WriteByte(0x21) // version 2, PROXY command
+	var addrs []byte
+	switch {
+	case !known:
+		b.WriteByte(0x00)
+	case ipv4:
+		b.WriteByte(0x11) // TCP over IPv4
+		addrs = append(append(addrs, src.IP.To4()...), dst.IP.To4()...)
+	default:
+		b.WriteByte(0x21) // TCP over IPv6
+		addrs = append(append(addrs, src.IP.To16()...), dst.IP.To16()...)
+	}
+	if known {
+		addrs = binary.BigEndian.AppendUint16(addrs, uint16(src.Port))
+		addrs = binary.BigEndian.AppendUint16(addrs, uint16(dst.Port))
+	}
+	binary.Write(&b, binary.BigEndian, uint16(len(addrs)))
+	b.Write(addrs)
+	return b.Bytes()
+}
+
+// ipv6String formats the address in IPv6 notation, even an IPv4 one
+func ipv6String(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
+
+// writeProxyHeader sends the PROXY protocol header, before the server
+// greets the client
+func writeProxyHeader(conn net.Conn, version int) error {
+	if _, err := conn.Write(proxyHeader(conn, version)); err != nil {
+		return fmt.Errorf("sending PROXY protocol header: %w", err)
+	}
+	return nil
+}
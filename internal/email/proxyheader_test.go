@@ -0,0 +1,134 @@
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+)
+
+// addrConn is a connection with fixed addresses, for building headers
+type addrConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c *addrConn) LocalAddr() net.Addr  { return c.local }
+func (c *addrConn) RemoteAddr() net.Addr { return c.remote }
+
+func TestProxyHeader(t *testing.T) {
+	v4 := &addrConn{
+		local:  &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 50000},
+		remote: &net.TCPAddr{IP: net.ParseIP("198.51.100.25"), Port: 25},
+	}
+	v6 := &addrConn{
+		local:  &net.TCPAddr{IP: net.ParseIP("2001:db8::10"), Port: 50000},
+		remote: &net.TCPAddr{IP: net.ParseIP("2001:db8::25"), Port: 587},
+	}
+	mixed := &addrConn{
+		local:  &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 50000},
+		remote: &net.TCPAddr{IP: net.ParseIP("2001:db8::25"), Port: 25},
+	}
+	unknown := &addrConn{
+		local:  &net.UnixAddr{Name: "/tmp/a", Net: "unix"},
+		remote: &net.UnixAddr{Name: "/tmp/b", Net: "unix"},
+	}
+	v2 := func(famLen []byte, addrs ...byte) []byte {
+		return append(append(append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x21), famLen...), addrs...)
+	}
+
+	tests := []struct {
+		name    string
+		conn    net.Conn
+		version int
+		want    []byte
+	}{
+		{"v1 IPv4", v4, 1, []byte("PROXY TCP4 192.0.2.10 198.51.100.25 50000 25\r\n")},
+		{"v1 IPv6", v6, 1, []byte("PROXY TCP6 2001:db8::10 2001:db8::25 50000 587\r\n")},
+		{"v1 mixed", mixed, 1, []byte("PROXY TCP6 ::ffff:192.0.2.10 2001:db8::25 50000 25\r\n")},
+		{"v1 unknown", unknown, 1, []byte("PROXY UNKNOWN\r\n")},
+		{"v2 IPv4", v4, 2, v2([]byte{0x11, 0, 12},
+			192, 0, 2, 10, 198, 51, 100, 25, 0xc3, 0x50, 0, 25)},
+		{"v2 IPv6", v6, 2, v2([]byte{0x21, 0, 36},
+			0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x10,
+			0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x25,
+			0xc3, 0x50, 0x02, 0x4b)},
+		{"v2 unknown", unknown, 2, v2([]byte{0x00, 0, 0})},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := proxyHeader(tt.conn, tt.version); !bytes.Equal(got, tt.want) {
+				t.Errorf("proxyHeader() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSMTPDialerProxyHeader(t *testing.T) {
+	for _, version := range []int{1, 2} {
+		t.Run(fmt.Sprintf("v%d", version), func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("Failed to listen: %v", err)
+			}
+			defer ln.Close()
+
+			// The server records what the client sent before its EHLO
+			received := make(chan []byte, 1)
+			want := make(chan []byte, 1)
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				want <- proxyHeader(&addrConn{local: conn.RemoteAddr(), remote: conn.LocalAddr()}, version)
+
+				fmt.Fprint(conn, "220 smtp.example.com ready\r\n")
+				r := bufio.NewReader(conn)
+				var data []byte
+				for {
+					line, err := r.ReadBytes('\n')
+					data = append(data, line...)
+					if err != nil || bytes.Contains(line, []byte("EHLO")) {
+						break
+					}
+				}
+				received <- data
+				fmt.Fprint(conn, "250 smtp.example.com\r\n")
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil || strings.HasPrefix(line, "QUIT") {
+						return
+					}
+					fmt.Fprint(conn, "250 ok\r\n")
+				}
+			}()
+
+			cfg := &config.Config{SendProxyHeader: true, ProxyHeaderVersion: version}
+			client, err := smtpDialer(cfg)(context.Background(), ln.Addr().String())
+			if err != nil {
+				t.Fatalf("Dial failed: %v", err)
+			}
+			defer client.Close()
+			if err := client.Noop(); err != nil {
+				t.Fatalf("Noop() failed: %v", err)
+			}
+
+			header := <-want
+			data := <-received
+			if !bytes.HasPrefix(data, header) {
+				t.Fatalf("server received %q, want the PROXY header %q first", data, header)
+			}
+			if rest := string(data[len(header):]); !strings.HasPrefix(rest, "EHLO ") {
+				t.Errorf("server received %q after the PROXY header, want EHLO", rest)
+			}
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package email
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+	"github.com/kiinoda/mailrelay/internal/ratelimit"
+)
+
+// newLimiter returns the limiter pacing transactions as configured, or nil
+// without a rate limit
+func newLimiter(cfg *config.Config) *ratelimit.Limiter {
+	if cfg.RateLimit <= 0 {
+		return nil
+	}
+	return ratelimit.New(cfg.RateLimit)
+}
+
+// waitRate blocks until the rate limit allows a transaction to the
+// recipients
+func (e *Email) waitRate(ctx context.Context, recipients []string) error {
+	if e.limiter == nil {
+		return nil
+	}
+	n := 1
+	if e.Config.RateLimitRecipients {
+		n = len(recipients)
+	}
+	if err := e.limiter.Wait(ctx, n); err != nil {
+		return fmt.Errorf("waiting for the rate limit: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+)
+
+func TestSendRateLimit(t *testing.T) {
+	var recipients []string
+	for i := 0; i < 12; i++ {
+		recipients = append(recipients, fmt.Sprintf("rcpt%d@domain.tld", i))
+	}
+
+	tests := []struct {
+		name         string
+		recipients   bool
+		verp         bool
+		transactions int
+		minElapsed   time.Duration
+	}{
+		// A burst of 10 lets the first ten transactions through at once,
+		// the last two wait 100ms each
+		{"Transactions", false, true, 12, 150 * time.Millisecond},
+		{"Recipients", true, true, 12, 150 * time.Millisecond},
+		// A full bucket lets a larger batch through, delaying the next one
+		{"Recipients in one transaction", true, false, 1, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockClient := NewMockSMTPClient()
+			email := &Email{
+				Config: &config.Config{
+					FromAddr:            testFromAddr,
+					SmtpAddrs:           []string{testSMTPAddr},
+					Recipients:          recipients,
+					EnableVERP:          tt.verp,
+					RateLimit:           10,
+					RateLimitRecipients: tt.recipients,
+				},
+				Body: []byte("test email body"),
+			}
+
+			start := time.Now()
+			if _, err := email.send(context.Background(), createMockDialer(mockClient, false)); err != nil {
+				t.Fatalf("send() failed: %v", err)
+			}
+			if elapsed := time.Since(start); elapsed < tt.minElapsed {
+				t.Errorf("send() took %v, want at least %v", elapsed, tt.minElapsed)
+			}
+			if mockClient.MethodCallCount["Mail"] != tt.transactions {
+				t.Errorf("Expected %d transactions, got %d", tt.transactions, mockClient.MethodCallCount["Mail"])
+			}
+		})
+	}
+}
+
+func TestSendRateLimitDeadline(t *testing.T) {
+	mockClient := NewMockSMTPClient()
+	email := &Email{
+		Config: &config.Config{
+			FromAddr:   testFromAddr,
+			SmtpAddrs:  []string{testSMTPAddr},
+			Recipients: []string{"a@domain.tld", "b@domain.tld"},
+			EnableVERP: true,
+			RateLimit:  1.0 / 3600,
+		},
+		Body: []byte("test email body"),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	result, err := email.send(ctx, createMockDialer(mockClient, false))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("send() error = %v, want the deadline while waiting", err)
+	}
+
+	// The second transaction is not attempted
+	if mockClient.MethodCallCount["Mail"] != 1 {
+		t.Errorf("Expected 1 transaction, got %d", mockClient.MethodCallCount["Mail"])
+	}
+	if len(result.Accepted) != 1 || len(result.Rejected) != 1 {
+		t.Errorf("send() result = %+v, want one recipient each accepted and rejected", result)
+	}
+}
+
+func TestFlushRateLimit(t *testing.T) {
+	dir := t.TempDir()
+	for _, rcpt := range []string{"a@domain.tld", "b@domain.tld"} {
+		email := &Email{
+			Config: &config.Config{FromAddr: testFromAddr, Recipients: []string{rcpt}},
+			Body:   []byte("test email body"),
+		}
+		if _, err := email.Spool(dir, nil, nil); err != nil {
+			t.Fatalf("Spool() failed: %v", err)
+		}
+	}
+
+	cfg := &config.Config{
+		SmtpAddrs: []string{testSMTPAddr},
+		SpoolDir:  dir,
+		RateLimit: 1.0 / 3600,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	results, err := flush(ctx, cfg, createMockDialer(NewMockSMTPClient(), false))
+	if err != nil {
+		t.Fatalf("flush() failed: %v", err)
+	}
+
+	// The limit holds across messages, so the second one waits
+	if len(results) != 2 || results[0].Err != nil || !errors.Is(results[1].Err, context.DeadlineExceeded) {
+		t.Fatalf("flush() results = %v", results)
+	}
+	if files := spoolFiles(t, dir); len(files) != 1 {
+		t.Errorf("Spool files = %v, want the message not sent kept", files)
+	}
+}
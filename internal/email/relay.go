@@ -0,0 +1,50 @@
+package email
+
+import (
+	"context"
+	"log"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+)
+
+// Relay holds an open connection to a single SMTP server and sends any
+// number of emails over it, resetting the transaction state in between
+type Relay struct {
+	Server string
+
+	client SMTPClient
+	used   bool
+}
+
+// DialRelay connects to the SMTP server and starts TLS, ready to send
+func DialRelay(ctx context.Context, cfg *config.Config, server string, dialer SMTPDialer) (*Relay, error) {
+	c, err := connect(ctx, cfg, server, dialer)
+	if err != nil {
+		return nil, err
+	}
+	return &Relay{Server: server, client: c}, nil
+}
+
+// Send relays the email to its recipients over the open connection
+func (r *Relay) Send(e *Email) (*SendResult, error) {
+	// Clear any state left by the previous transaction
+	if r.used {
+		if err := r.client.Reset(); err != nil {
+			log.Println("error resetting transaction with", r.Server)
+			return nil, attemptAt(r.Server, atStage("reset", err))
+		}
+	}
+	r.used = true
+
+	result, err := e.transaction(r.client, e.Config.Recipients)
+	if err != nil {
+		return nil, attemptAt(r.Server, err)
+	}
+	return result, nil
+}
+
+// Close ends the SMTP session and closes the connection
+func (r *Relay) Close() error {
+	defer r.client.Close()
+	return r.client.Quit()
+}
@@ -0,0 +1,107 @@
+package email
+
+import (
+	"context"
+	"testing"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+)
+
+// callRecorder wraps the mock client to record the order of SMTP commands
+type callRecorder struct {
+	*MockSMTPClient
+	calls []string
+}
+
+func (c *callRecorder) Mail(from string, params ...string) error {
+	c.calls = append(c.calls, "MAIL")
+	return c.MockSMTPClient.Mail(from, params...)
+}
+
+func (c *callRecorder) Reset() error {
+	c.calls = append(c.calls, "RSET")
+	return c.MockSMTPClient.Reset()
+}
+
+func (c *callRecorder) Quit() error {
+	c.calls = append(c.calls, "QUIT")
+	return c.MockSMTPClient.Quit()
+}
+
+func TestRelaySendsMultipleMessages(t *testing.T) {
+	client := &callRecorder{MockSMTPClient: NewMockSMTPClient()}
+	dials := 0
+	dialer := func(ctx context.Context, addr string) (SMTPClient, error) {
+		dials++
+		return client, nil
+	}
+
+	cfg := &config.Config{
+		FromAddr:   testFromAddr,
+		SmtpAddrs:  []string{testSMTPAddr},
+		Recipients: []string{"test@domain.tld"},
+	}
+
+	relay, err := DialRelay(context.Background(), cfg, testSMTPAddr, dialer)
+	if err != nil {
+		t.Fatalf("DialRelay() failed: %v", err)
+	}
+
+	for _, body := range []string{"first", "second", "third"} {
+		email := &Email{Config: cfg, Body: []byte(body)}
+		if _, err := relay.Send(email); err != nil {
+			t.Fatalf("Relay.Send() failed: %v", err)
+		}
+	}
+
+	if err := relay.Close(); err != nil {
+		t.Fatalf("Relay.Close() failed: %v", err)
+	}
+
+	if dials != 1 {
+		t.Errorf("Expected a single connection, got %d", dials)
+	}
+
+	expected := []string{"MAIL", "RSET", "MAIL", "RSET", "MAIL", "QUIT"}
+	if len(client.calls) != len(expected) {
+		t.Fatalf("SMTP commands = %v, want %v", client.calls, expected)
+	}
+	for i := range expected {
+		if client.calls[i] != expected[i] {
+			t.Errorf("SMTP commands = %v, want %v", client.calls, expected)
+			break
+		}
+	}
+
+	if string(client.DataWriter.Written) != "first\nsecond\nthird\n" {
+		t.Errorf("Written bodies = %q", client.DataWriter.Written)
+	}
+}
+
+func TestRelayResetFailure(t *testing.T) {
+	client := NewMockSMTPClient()
+	client.ShouldFailOn = "reset"
+
+	cfg := &config.Config{
+		FromAddr:   testFromAddr,
+		SmtpAddrs:  []string{testSMTPAddr},
+		Recipients: []string{"test@domain.tld"},
+	}
+
+	relay, err := DialRelay(context.Background(), cfg, testSMTPAddr, createMockDialer(client, false))
+	if err != nil {
+		t.Fatalf("DialRelay() failed: %v", err)
+	}
+	defer relay.Close()
+
+	email := &Email{Config: cfg, Body: []byte("body")}
+	if _, err := relay.Send(email); err != nil {
+		t.Fatalf("First Relay.Send() failed: %v", err)
+	}
+	if _, err := relay.Send(email); err == nil {
+		t.Error("Relay.Send() should fail when RSET fails")
+	}
+	if client.MethodCallCount["Mail"] != 1 {
+		t.Errorf("No transaction should start after a failed RSET, got %d MAIL", client.MethodCallCount["Mail"])
+	}
+}
@@ -0,0 +1,108 @@
+package email
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// SendResult describes which recipients were accepted for delivery and
+// which were rejected, along with the reason for each rejection
+type SendResult struct {
+	Accepted []string
+	Rejected []string
+	Errors   map[string]error
+
+	// Server and From are the server and envelope sender of the last
+	// transaction, when the recipients were split over several
+	Server string
+	From   string
+
+	// Bytes counts the message data sent, once per transaction. Duration
+	// is the time the whole send took.
+	Bytes    int
+	Duration time.Duration
+
+	// Queued is the spool file of an email queued without attempting
+	// delivery
+	Queued string
+}
+
+// accept records a recipient accepted by the server
+func (r *SendResult) accept(rcpt string) {
+	r.Accepted = append(r.Accepted, rcpt)
+}
+
+// reject records a recipient that could not be delivered
+func (r *SendResult) reject(rcpt string, err error) {
+	if r.Errors == nil {
+		r.Errors = map[string]error{}
+	}
+	r.Rejected = append(r.Rejected, rcpt)
+	r.Errors[rcpt] = err
+}
+
+// merge adds the outcome of another transaction to the result
+func (r *SendResult) merge(other *SendResult) {
+	r.Accepted = append(r.Accepted, other.Accepted...)
+	for _, rcpt := range other.Rejected {
+		r.reject(rcpt, other.Errors[rcpt])
+	}
+	if other.Server != "" {
+		r.Server = other.Server
+	}
+	if other.From != "" {
+		r.From = other.From
+	}
+	r.Bytes += other.Bytes
+}
+
+// tolerated reports whether a send split over several transactions
+// succeeded: either none failed, or partial delivery is enabled and some
+// recipients were accepted
+func (e *Email) tolerated(result *SendResult, errs []error) bool {
+	return len(errs) == 0 || (e.Config.PartialDelivery && len(result.Accepted) > 0)
+}
+
+// resultJSON is the outcome of a send as printed by WriteJSON
+type resultJSON struct {
+	Server     string          `json:"server"`
+	From       string          `json:"from"`
+	Accepted   []string        `json:"accepted"`
+	Rejected   []rejectionJSON `json:"rejected"`
+	Bytes      int             `json:"bytes"`
+	DurationMS int64           `json:"duration_ms"`
+	Queued     string          `json:"queued,omitempty"`
+	Error      string          `json:"error,omitempty"`
+}
+
+type rejectionJSON struct {
+	Recipient string `json:"recipient"`
+	Error     string `json:"error"`
+}
+
+// WriteJSON writes the outcome of a send as a single line JSON object,
+// the result being nil when the send failed before reaching any server.
+// The recipient lists are always present, empty rather than null.
+func WriteJSON(w io.Writer, result *SendResult, err error) error {
+	out := resultJSON{Accepted: []string{}, Rejected: []rejectionJSON{}}
+	if result != nil {
+		out.Server = result.Server
+		out.From = result.From
+		out.Accepted = append(out.Accepted, result.Accepted...)
+		for _, rcpt := range result.Rejected {
+			reason := ""
+			if rcptErr := result.Errors[rcpt]; rcptErr != nil {
+				reason = rcptErr.Error()
+			}
+			out.Rejected = append(out.Rejected, rejectionJSON{Recipient: rcpt, Error: reason})
+		}
+		out.Bytes = result.Bytes
+		out.DurationMS = result.Duration.Milliseconds()
+		out.Queued = result.Queued
+	}
+	if err != nil {
+		out.Error = err.Error()
+	}
+	return json.NewEncoder(w).Encode(out)
+}
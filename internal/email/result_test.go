@@ -0,0 +1,210 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+)
+
+func TestSendResultFields(t *testing.T) {
+	body := "To: a@domain.tld\n\ntest email body"
+
+	tests := []struct {
+		name     string
+		cfg      config.Config
+		fail     string // Recipient rejected by the second server
+		down     bool   // Whether the second server is down too
+		expected SendResult
+	}{
+		{
+			name: "Delivered after failover",
+			cfg:  config.Config{Recipients: []string{"a@domain.tld", "b@domain.tld"}},
+			expected: SendResult{
+				Accepted: []string{"a@domain.tld", "b@domain.tld"},
+				Server:   "second.example.com:25",
+				From:     testFromAddr,
+				Bytes:    len(body) + 1,
+			},
+		},
+		{
+			name: "Partial delivery",
+			cfg:  config.Config{Recipients: []string{"a@domain.tld", "b@domain.tld"}, PartialDelivery: true},
+			fail: "b@domain.tld",
+			expected: SendResult{
+				Accepted: []string{"a@domain.tld"},
+				Rejected: []string{"b@domain.tld"},
+				Server:   "second.example.com:25",
+				From:     testFromAddr,
+				Bytes:    len(body) + 1,
+			},
+		},
+		{
+			name: "Batches counted once each",
+			cfg:  config.Config{Recipients: []string{"a@domain.tld", "b@domain.tld"}, MaxRecipientsPerMessage: 1},
+			expected: SendResult{
+				Accepted: []string{"a@domain.tld", "b@domain.tld"},
+				Server:   "second.example.com:25",
+				From:     testFromAddr,
+				Bytes:    2 * (len(body) + 1),
+			},
+		},
+		{
+			name: "Not delivered",
+			cfg:  config.Config{Recipients: []string{"a@domain.tld"}},
+			down: true,
+			expected: SendResult{
+				Rejected: []string{"a@domain.tld"},
+				From:     testFromAddr,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := NewMockSMTPClient()
+			client.FailOnRecipient = tt.fail
+			dialer := func(ctx context.Context, addr string) (SMTPClient, error) {
+				if addr == "first.example.com:25" || tt.down {
+					return nil, errors.New("connection refused")
+				}
+				return client, nil
+			}
+
+			cfg := tt.cfg
+			cfg.FromAddr = testFromAddr
+			cfg.SmtpAddrs = []string{"first.example.com:25", "second.example.com:25"}
+			email := &Email{Config: &cfg, Body: []byte(body)}
+
+			result, err := email.send(context.Background(), dialer)
+			if (err != nil) != tt.down {
+				t.Fatalf("send() error = %v", err)
+			}
+
+			if result.Duration <= 0 {
+				t.Errorf("Duration = %v, want the time taken", result.Duration)
+			}
+			for _, rcpt := range result.Rejected {
+				if result.Errors[rcpt] == nil {
+					t.Errorf("no reason given for rejected recipient %s", rcpt)
+				}
+			}
+			got := *result
+			got.Errors, got.Duration = nil, 0
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("send() result = %+v, want %+v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	tests := []struct {
+		name     string
+		result   *SendResult
+		err      error
+		expected map[string]any
+	}{
+		{
+			name: "Partial delivery",
+			result: &SendResult{
+				Accepted: []string{"a@domain.tld"},
+				Rejected: []string{"b@domain.tld"},
+				Errors:   map[string]error{"b@domain.tld": errors.New("550 no such user")},
+				Server:   testSMTPAddr,
+				From:     testFromAddr,
+				Bytes:    42,
+				Duration: 1500 * time.Millisecond,
+			},
+			expected: map[string]any{
+				"server":      testSMTPAddr,
+				"from":        testFromAddr,
+				"accepted":    []any{"a@domain.tld"},
+				"rejected":    []any{map[string]any{"recipient": "b@domain.tld", "error": "550 no such user"}},
+				"bytes":       42.0,
+				"duration_ms": 1500.0,
+			},
+		},
+		{
+			name: "Failed before any server",
+			err:  errors.New("no SMTP servers configured"),
+			expected: map[string]any{
+				"server":      "",
+				"from":        "",
+				"accepted":    []any{},
+				"rejected":    []any{},
+				"bytes":       0.0,
+				"duration_ms": 0.0,
+				"error":       "no SMTP servers configured",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := WriteJSON(&out, tt.result, tt.err); err != nil {
+				t.Fatalf("WriteJSON() error = %v", err)
+			}
+			if lines := strings.Count(out.String(), "\n"); lines != 1 {
+				t.Errorf("WriteJSON() wrote %d lines, want a single one: %q", lines, out.String())
+			}
+
+			var got map[string]any
+			if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+				t.Fatalf("WriteJSON() wrote invalid JSON %q: %v", out.String(), err)
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("WriteJSON() = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestSendJSONDryRun(t *testing.T) {
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to create pipe: %v", err)
+	}
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	cfg := &config.Config{
+		FromAddr:   testFromAddr,
+		SmtpAddrs:  []string{testSMTPAddr},
+		Recipients: []string{"a@domain.tld"},
+		DryRun:     true,
+		JSONOutput: true,
+	}
+	email := &Email{Config: cfg, Body: []byte("test email body")}
+	result, sendErr := email.sendWithDialer(context.Background(), createMockDialer(NewMockSMTPClient(), false))
+	jsonErr := WriteJSON(os.Stdout, result, sendErr)
+
+	w.Close()
+	os.Stdout = stdout
+	printed, _ := io.ReadAll(r)
+	if sendErr != nil || jsonErr != nil {
+		t.Fatalf("sendWithDialer() error = %v, WriteJSON() error = %v", sendErr, jsonErr)
+	}
+
+	// Only the JSON object reaches stdout
+	var got struct {
+		Server   string   `json:"server"`
+		Accepted []string `json:"accepted"`
+	}
+	if err := json.Unmarshal(printed, &got); err != nil {
+		t.Fatalf("stdout is not a JSON object: %q: %v", printed, err)
+	}
+	if got.Server != testSMTPAddr || !reflect.DeepEqual(got.Accepted, cfg.Recipients) {
+		t.Errorf("JSON output = %+v", got)
+	}
+}
@@ -0,0 +1,123 @@
+package email
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// stateExt marks the attempt tracking files in the state directory
+const stateExt = ".json"
+
+// retryState tracks the attempts made to deliver a message across
+// invocations
+type retryState struct {
+	Attempts  int       `json:"attempts"`
+	First     time.Time `json:"first_attempt"`
+	NextRetry time.Time `json:"next_retry"`
+	LastError string    `json:"last_error"`
+}
+
+// timeNow allows tests to advance the clock between invocations
+var timeNow = time.Now
+
+// ErrGaveUp is wrapped by the permanent failure returned once a message
+// failed on every attempt of the retry schedule
+var ErrGaveUp = errors.New("retry schedule exhausted")
+
+// NotDueError is returned instead of sending a message whose next attempt
+// is scheduled later
+type NotDueError struct {
+	Next time.Time
+}
+
+func (e *NotDueError) Error() string {
+	return "next attempt scheduled at " + e.Next.Format(time.RFC3339)
+}
+
+// statePath names the attempt tracking file of the message after a hash of
+// its envelope and body, so that a message sent again maps to the same file
+func (e *Email) statePath() string {
+	recipients := append([]string(nil), e.Config.Recipients...)
+	sort.Strings(recipients)
+
+	h := sha256.New()
+	h.Write([]byte(e.Config.FromAddr + "\x00" + strings.Join(recipients, "\n") + "\x00"))
+	h.Write(e.Body)
+	return filepath.Join(e.Config.StateDir, hex.EncodeToString(h.Sum(nil))+stateExt)
+}
+
+// checkSchedule returns the attempt tracking state of the message, or a
+// NotDueError when its next attempt is not due yet
+func (e *Email) checkSchedule() (*retryState, error) {
+	state := &retryState{}
+	data, err := os.ReadFile(e.statePath())
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("invalid state file %s: %w", e.statePath(), err)
+	}
+
+	if now := timeNow(); now.Before(state.NextRetry) {
+		return nil, &DeliveryError{Kind: TemporaryFailure, Err: &NotDueError{Next: state.NextRetry}}
+	}
+	return state, nil
+}
+
+// updateSchedule records the outcome of an attempt and returns the error
+// to report. Temporary failures schedule the next attempt, until the
+// schedule is exhausted and the failure becomes permanent. Any other
+// outcome ends the tracking.
+func (e *Email) updateSchedule(state *retryState, sendErr error) error {
+	path := e.statePath()
+	var deliveryErr *DeliveryError
+	if !errors.As(sendErr, &deliveryErr) || deliveryErr.Kind != TemporaryFailure {
+		removeState(path)
+		return sendErr
+	}
+
+	now := timeNow().UTC()
+	if state.Attempts == 0 {
+		state.First = now
+	}
+	state.Attempts++
+	state.LastError = sendErr.Error()
+
+	schedule := e.Config.RetrySchedule
+	if state.Attempts > len(schedule) {
+		removeState(path)
+		return &DeliveryError{
+			Kind: PermanentFailure,
+			Err:  fmt.Errorf("%w after %d attempts since %s: %w", ErrGaveUp, state.Attempts, state.First.Format(time.RFC3339), sendErr),
+		}
+	}
+	state.NextRetry = now.Add(schedule[state.Attempts-1])
+
+	data, err := json.Marshal(state)
+	if err == nil {
+		err = writeFileAtomic(path, data)
+	}
+	if err != nil {
+		log.Println("error writing state file:", err)
+	}
+	return sendErr
+}
+
+// removeState ends the tracking of a message
+func removeState(path string) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Println("error removing state file:", err)
+	}
+}
@@ -0,0 +1,159 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+	"github.com/kiinoda/mailrelay/internal/exitcode"
+)
+
+// setClock makes timeNow return the time given to the returned function
+func setClock(t *testing.T) func(time.Time) {
+	t.Helper()
+	var now time.Time
+	timeNow = func() time.Time { return now }
+	t.Cleanup(func() { timeNow = time.Now })
+	return func(at time.Time) { now = at }
+}
+
+func TestRetrySchedule(t *testing.T) {
+	dir := t.TempDir()
+	setNow := setClock(t)
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	// Every invocation reads the same message again
+	invoke := func(client *MockSMTPClient) error {
+		email := &Email{
+			Config: &config.Config{
+				FromAddr:      testFromAddr,
+				SmtpAddrs:     []string{testSMTPAddr},
+				Recipients:    []string{"a@domain.tld", "b@domain.tld"},
+				StateDir:      dir,
+				RetrySchedule: []time.Duration{10 * time.Minute, time.Hour},
+			},
+			Body: []byte("test email body"),
+		}
+		_, err := email.send(context.Background(), createMockDialer(client, false))
+		return err
+	}
+	failing := func() *MockSMTPClient {
+		client := NewMockSMTPClient()
+		client.ShouldFailOn = "mail"
+		client.FailWith = &textproto.Error{Code: 451, Msg: "try again later"}
+		return client
+	}
+	stateFiles := func() []string {
+		files, _ := filepath.Glob(filepath.Join(dir, "*"+stateExt))
+		return files
+	}
+
+	steps := []struct {
+		name     string
+		at       time.Duration
+		sent     bool
+		expected int
+	}{
+		{"First attempt", 0, true, exitcode.TempFail},
+		{"Before the first wait", 5 * time.Minute, false, exitcode.TempFail},
+		{"Second attempt", 10 * time.Minute, true, exitcode.TempFail},
+		{"Before the second wait", 69 * time.Minute, false, exitcode.TempFail},
+		{"Last attempt", 70 * time.Minute, true, exitcode.NoPerm},
+	}
+
+	for _, step := range steps {
+		setNow(start.Add(step.at))
+		client := failing()
+		err := invoke(client)
+
+		var deliveryErr *DeliveryError
+		if !errors.As(err, &deliveryErr) {
+			t.Fatalf("%s: send() error = %v, want a DeliveryError", step.name, err)
+		}
+		if code := deliveryErr.ExitCode(); code != step.expected {
+			t.Errorf("%s: ExitCode() = %d, want %d", step.name, code, step.expected)
+		}
+		if sent := client.MethodCallCount["Mail"] > 0; sent != step.sent {
+			t.Errorf("%s: sent = %v, want %v", step.name, sent, step.sent)
+		}
+		var notDue *NotDueError
+		if errors.As(err, &notDue) == step.sent {
+			t.Errorf("%s: send() error = %v", step.name, err)
+		}
+	}
+
+	// A message given up is no longer tracked, sending it again starts over
+	if files := stateFiles(); len(files) != 0 {
+		t.Errorf("State files = %v, want none after giving up", files)
+	}
+	setNow(start.Add(2 * time.Hour))
+	client := failing()
+	if err := invoke(client); classify(err) != TemporaryFailure || client.MethodCallCount["Mail"] != 1 {
+		t.Errorf("send() error = %v, want a new first attempt", err)
+	}
+
+	// Delivery ends the tracking
+	setNow(start.Add(2*time.Hour + 10*time.Minute))
+	if err := invoke(NewMockSMTPClient()); err != nil {
+		t.Fatalf("send() error = %v", err)
+	}
+	if files := stateFiles(); len(files) != 0 {
+		t.Errorf("State files = %v, want none after delivery", files)
+	}
+}
+
+func TestFlushRetrySchedule(t *testing.T) {
+	spoolDir := t.TempDir()
+	email := &Email{
+		Config: &config.Config{FromAddr: testFromAddr, Recipients: []string{"a@domain.tld"}},
+		Body:   []byte("test email body"),
+	}
+	path, err := email.Spool(spoolDir, nil, nil)
+	if err != nil {
+		t.Fatalf("Spool() failed: %v", err)
+	}
+
+	setNow := setClock(t)
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	cfg := &config.Config{
+		SmtpAddrs:     []string{testSMTPAddr},
+		SpoolDir:      spoolDir,
+		StateDir:      t.TempDir(),
+		RetrySchedule: []time.Duration{time.Hour},
+	}
+
+	steps := []struct {
+		name  string
+		at    time.Duration
+		check func(error) bool
+	}{
+		{"First attempt", 0, func(err error) bool { return classify(err) == TemporaryFailure }},
+		{"Not due", 30 * time.Minute, func(err error) bool { var notDue *NotDueError; return errors.As(err, &notDue) }},
+		{"Last attempt", time.Hour, func(err error) bool { return errors.Is(err, ErrGaveUp) }},
+	}
+	for _, step := range steps {
+		setNow(start.Add(step.at))
+		results, err := flush(context.Background(), cfg, createMockDialer(nil, true))
+		if err != nil {
+			t.Fatalf("%s: flush() failed: %v", step.name, err)
+		}
+		if len(results) != 1 || !step.check(results[0].Err) {
+			t.Fatalf("%s: flush() results = %v", step.name, results)
+		}
+	}
+
+	// The message given up is set aside
+	if files := spoolFiles(t, spoolDir); len(files) != 0 {
+		t.Errorf("Spool files = %v, want none", files)
+	}
+	failed := strings.TrimSuffix(path, spoolExt) + failedExt
+	if _, err := os.Stat(failed); err != nil {
+		t.Errorf("Message given up not kept as %s: %v", failed, err)
+	}
+}
@@ -0,0 +1,93 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// sender returns the envelope sender for the recipients, chosen by the
+// sender rules when they all map to the same address
+func (e *Email) sender(recipients []string) string {
+	if len(recipients) == 0 {
+		return e.Config.FromAddr
+	}
+	from := e.ruleSender(recipients[0])
+	for _, rcpt := range recipients[1:] {
+		if e.ruleSender(rcpt) != from {
+			return e.Config.FromAddr
+		}
+	}
+	return from
+}
+
+// ruleSender returns the sender configured for the domain of the
+// recipient, falling back to the default sender, encoding the recipient in
+// it when VERP is enabled
+func (e *Email) ruleSender(rcpt string) string {
+	from, ok := e.Config.SenderRules[recipientDomain(rcpt)]
+	if !ok {
+		from = e.Config.FromAddr
+	}
+	if e.Config.EnableVERP {
+		return verpAddress(from, rcpt)
+	}
+	return from
+}
+
+// verpAddress encodes the recipient in the sender address, turning
+// bounce@sender.tld and user@domain.tld into bounce+user=domain.tld@sender.tld.
+// The null sender is kept, as nothing bounces to it.
+func verpAddress(from, rcpt string) string {
+	at := strings.LastIndex(from, "@")
+	if at < 0 {
+		return from
+	}
+	return from[:at] + "+" + strings.Replace(rcpt, "@", "=", 1) + from[at:]
+}
+
+// groupBySender splits the recipients by envelope sender, keeping the
+// order in which senders first appear
+func (e *Email) groupBySender(recipients []string) [][]string {
+	var groups [][]string
+	index := map[string]int{}
+	for _, rcpt := range recipients {
+		from := e.ruleSender(rcpt)
+		i, ok := index[from]
+		if !ok {
+			i = len(groups)
+			index[from] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], rcpt)
+	}
+	return groups
+}
+
+// sendGroups sends one transaction per group of recipients, grouped by
+// envelope sender or domain
+func (e *Email) sendGroups(ctx context.Context, groups [][]string, dialer SMTPDialer) (*SendResult, error) {
+	result := &SendResult{}
+	var errs []error
+	for _, group := range groups {
+		groupResult, err := e.sendTo(ctx, group, dialer)
+		if groupResult != nil {
+			result.merge(groupResult)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if e.tolerated(result, errs) {
+		return result, nil
+	}
+	if len(errs) == 1 {
+		return result, errs[0]
+	}
+	return result, &DeliveryError{
+		Kind: combinedKind(errs),
+		Err:  fmt.Errorf("failed to send email to some recipients: %w", errors.Join(errs...)),
+	}
+}
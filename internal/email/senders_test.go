@@ -0,0 +1,165 @@
+package email
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+)
+
+// senderRecorder records the sender and recipients of every transaction
+type senderRecorder struct {
+	*MockSMTPClient
+	transactions [][]string
+}
+
+func (c *senderRecorder) Mail(from string, params ...string) error {
+	c.transactions = append(c.transactions, []string{from})
+	return c.MockSMTPClient.Mail(from, params...)
+}
+
+func (c *senderRecorder) Rcpt(to string) error {
+	last := len(c.transactions) - 1
+	c.transactions[last] = append(c.transactions[last], to)
+	return c.MockSMTPClient.Rcpt(to)
+}
+
+func TestSenderRules(t *testing.T) {
+	rules := map[string]string{
+		"gmail.com":   "gmail-sender@example.com",
+		"outlook.com": "outlook-sender@example.com",
+	}
+
+	tests := []struct {
+		name       string
+		recipients []string
+		expected   [][]string
+	}{
+		{
+			name:       "Single domain with a rule",
+			recipients: []string{"a@gmail.com", "b@GMAIL.com"},
+			expected:   [][]string{{"gmail-sender@example.com", "a@gmail.com", "b@GMAIL.com"}},
+		},
+		{
+			name:       "No rule",
+			recipients: []string{"a@domain.tld"},
+			expected:   [][]string{{testFromAddr, "a@domain.tld"}},
+		},
+		{
+			name:       "Split by domain",
+			recipients: []string{"a@gmail.com", "b@domain.tld", "c@outlook.com", "d@gmail.com", "e@other.tld"},
+			expected: [][]string{
+				{"gmail-sender@example.com", "a@gmail.com", "d@gmail.com"},
+				{testFromAddr, "b@domain.tld", "e@other.tld"},
+				{"outlook-sender@example.com", "c@outlook.com"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &senderRecorder{MockSMTPClient: NewMockSMTPClient()}
+			dialer := func(ctx context.Context, addr string) (SMTPClient, error) {
+				return client, nil
+			}
+
+			email := &Email{
+				Config: &config.Config{
+					FromAddr:    testFromAddr,
+					SmtpAddrs:   []string{testSMTPAddr},
+					Recipients:  tt.recipients,
+					SenderRules: rules,
+				},
+				Body: []byte("test email body"),
+			}
+
+			result, err := email.sendWithDialer(context.Background(), dialer)
+			if err != nil {
+				t.Fatalf("sendWithDialer() failed: %v", err)
+			}
+			if !reflect.DeepEqual(client.transactions, tt.expected) {
+				t.Errorf("Transactions = %v, want %v", client.transactions, tt.expected)
+			}
+			if len(result.Accepted) != len(tt.recipients) {
+				t.Errorf("Accepted = %v, want all recipients", result.Accepted)
+			}
+		})
+	}
+}
+
+func TestSenderRulesFailedGroup(t *testing.T) {
+	client := NewMockSMTPClient()
+	client.FailOnRecipient = "b@domain.tld"
+
+	email := &Email{
+		Config: &config.Config{
+			FromAddr:    testFromAddr,
+			SmtpAddrs:   []string{testSMTPAddr},
+			Recipients:  []string{"a@gmail.com", "b@domain.tld"},
+			SenderRules: map[string]string{"gmail.com": "gmail-sender@example.com"},
+		},
+		Body: []byte("test email body"),
+	}
+
+	result, err := email.sendWithDialer(context.Background(), createMockDialer(client, false))
+	if err == nil {
+		t.Fatal("sendWithDialer() should report the failed transaction")
+	}
+	if !reflect.DeepEqual(result.Accepted, []string{"a@gmail.com"}) {
+		t.Errorf("Accepted = %v", result.Accepted)
+	}
+	if !reflect.DeepEqual(result.Rejected, []string{"b@domain.tld"}) {
+		t.Errorf("Rejected = %v", result.Rejected)
+	}
+}
+
+func TestVERPAddress(t *testing.T) {
+	tests := []struct {
+		from     string
+		rcpt     string
+		expected string
+	}{
+		{"bounce@sender.tld", "user@domain.tld", "bounce+user=domain.tld@sender.tld"},
+		{"bounce@sender.tld", "first.last+tag@sub.domain.tld", "bounce+first.last+tag=sub.domain.tld@sender.tld"},
+		{"bounce@sender.tld", "postmaster", "bounce+postmaster@sender.tld"},
+		{"", "user@domain.tld", ""},
+	}
+
+	for _, tt := range tests {
+		if got := verpAddress(tt.from, tt.rcpt); got != tt.expected {
+			t.Errorf("verpAddress(%q, %q) = %q, want %q", tt.from, tt.rcpt, got, tt.expected)
+		}
+	}
+}
+
+func TestSendVERP(t *testing.T) {
+	client := &senderRecorder{MockSMTPClient: NewMockSMTPClient()}
+	dialer := func(ctx context.Context, addr string) (SMTPClient, error) {
+		return client, nil
+	}
+
+	email := &Email{
+		Config: &config.Config{
+			FromAddr:    "bounce@sender.tld",
+			SmtpAddrs:   []string{testSMTPAddr},
+			Recipients:  []string{"a@domain.tld", "b@gmail.com"},
+			SenderRules: map[string]string{"gmail.com": "gmail-bounce@sender.tld"},
+			EnableVERP:  true,
+		},
+		Body: []byte("test email body"),
+	}
+
+	if _, err := email.sendWithDialer(context.Background(), dialer); err != nil {
+		t.Fatalf("sendWithDialer() failed: %v", err)
+	}
+
+	// Every recipient gets its own transaction
+	expected := [][]string{
+		{"bounce+a=domain.tld@sender.tld", "a@domain.tld"},
+		{"gmail-bounce+b=gmail.com@sender.tld", "b@gmail.com"},
+	}
+	if !reflect.DeepEqual(client.transactions, expected) {
+		t.Errorf("Transactions = %v, want %v", client.transactions, expected)
+	}
+}
@@ -0,0 +1,185 @@
+package email
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strings"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+)
+
+// Serve speaks SMTP on r and w as sendmail -bs does, relaying every message
+// received through the servers before replying to its data. It returns
+// once the client quits or closes its input.
+func Serve(ctx context.Context, cfg *config.Config, r io.Reader, w io.Writer) error {
+	limiter := newLimiter(cfg)
+	return serve(cfg, r, w, func(e *Email) (*SendResult, error) {
+		e.limiter = limiter
+		return e.Send(ctx)
+	})
+}
+
+// smtpSession is the state of an SMTP session served on stdin
+type smtpSession struct {
+	cfg   *config.Config
+	w     io.Writer
+	send  func(e *Email) (*SendResult, error)
+	from  string
+	mail  bool // a MAIL command started a transaction
+	rcpts []string
+}
+
+// serve runs the SMTP session, handing each message received to send
+func serve(cfg *config.Config, r io.Reader, w io.Writer, send func(e *Email) (*SendResult, error)) error {
+	host, _ := os.Hostname()
+	if host == "" {
+		host = "localhost"
+	}
+	s := &smtpSession{cfg: cfg, w: w, send: send}
+	text := textproto.NewReader(bufio.NewReader(r))
+
+	if err := s.reply(220, host+" ESMTP mailrelay"); err != nil {
+		return err
+	}
+	for {
+		line, err := text.ReadLine()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "HELO", "EHLO":
+			s.reset()
+			err = s.reply(250, host)
+		case "MAIL":
+			err = s.mailFrom(arg)
+		case "RCPT":
+			err = s.rcptTo(arg)
+		case "DATA":
+			err = s.data(text)
+		case "RSET":
+			s.reset()
+			err = s.reply(250, "2.0.0 Ok")
+		case "NOOP":
+			err = s.reply(250, "2.0.0 Ok")
+		case "VRFY":
+			err = s.reply(252, "2.5.2 Cannot verify the user, but will try delivery")
+		case "QUIT":
+			return s.reply(221, "2.0.0 Bye")
+		default:
+			err = s.reply(500, "5.5.2 Command not recognized")
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// reply writes a single line reply
+func (s *smtpSession) reply(code int, msg string) error {
+	_, err := fmt.Fprintf(s.w, "%d %s\r\n", code, msg)
+	return err
+}
+
+// reset forgets the transaction in progress
+func (s *smtpSession) reset() {
+	s.from = ""
+	s.mail = false
+	s.rcpts = nil
+}
+
+// mailFrom starts a transaction, ignoring the ESMTP parameters
+func (s *smtpSession) mailFrom(arg string) error {
+	if s.mail {
+		return s.reply(503, "5.5.1 Sender already given")
+	}
+	from, ok := commandPath(arg, "FROM:")
+	if !ok {
+		return s.reply(501, "5.5.4 Syntax: MAIL FROM:<address>")
+	}
+	s.from = from
+	s.mail = true
+	return s.reply(250, "2.1.0 Ok")
+}
+
+// rcptTo adds a recipient to the transaction
+func (s *smtpSession) rcptTo(arg string) error {
+	if !s.mail {
+		return s.reply(503, "5.5.1 Need MAIL before RCPT")
+	}
+	rcpt, ok := commandPath(arg, "TO:")
+	if !ok || rcpt == "" {
+		return s.reply(501, "5.5.4 Syntax: RCPT TO:<address>")
+	}
+	if max := s.cfg.MaxRecipients; max > 0 && len(s.rcpts) >= max {
+		return s.reply(452, "4.5.3 Too many recipients")
+	}
+	s.rcpts = append(s.rcpts, rcpt)
+	return s.reply(250, "2.1.5 Ok")
+}
+
+// data reads the message and relays it, replying with the outcome
+func (s *smtpSession) data(text *textproto.Reader) error {
+	if len(s.rcpts) == 0 {
+		return s.reply(503, "5.5.1 Need RCPT before DATA")
+	}
+	if err := s.reply(354, "End data with <CR><LF>.<CR><LF>"); err != nil {
+		return err
+	}
+	body, err := text.ReadDotBytes()
+	if err != nil {
+		return err
+	}
+	defer s.reset()
+
+	// Each message has its own envelope
+	msgCfg := *s.cfg
+	msgCfg.FromAddr = s.from
+	msgCfg.Recipients = s.rcpts
+	e := &Email{Config: &msgCfg, Body: body}
+	if err := e.prepare(); err != nil {
+		if errors.Is(err, ErrMessageTooLarge) {
+			return s.reply(552, "5.3.4 "+oneLine(err.Error()))
+		}
+		return s.reply(554, "5.6.0 "+oneLine(err.Error()))
+	}
+
+	result, err := s.send(e)
+	if err != nil {
+		if failedPermanently(err) {
+			return s.reply(554, "5.0.0 "+oneLine(err.Error()))
+		}
+		return s.reply(451, "4.0.0 "+oneLine(err.Error()))
+	}
+	if result != nil && result.Queued != "" {
+		return s.reply(250, "2.0.0 Ok: queued")
+	}
+	return s.reply(250, "2.0.0 Ok: relayed")
+}
+
+// commandPath extracts the address of a MAIL FROM or RCPT TO argument,
+// the empty address standing for the null sender
+func commandPath(arg, prefix string) (string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+	path, _, _ := strings.Cut(strings.TrimSpace(arg[len(prefix):]), " ")
+	if path == "<>" {
+		return "", true
+	}
+	addr, err := mail.ParseAddress(path)
+	if err != nil {
+		return "", false
+	}
+	return addr.Address, true
+}
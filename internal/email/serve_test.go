@@ -0,0 +1,123 @@
+package email
+
+import (
+	"net/textproto"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+)
+
+func TestServe(t *testing.T) {
+	tests := []struct {
+		name    string
+		session string
+		sendErr error
+		cfg     config.Config
+		replies []int
+		sent    []*Email
+	}{
+		{
+			name: "Relayed message",
+			session: "EHLO client.example\r\nMAIL FROM:<a@domain.tld> SIZE=42\r\nRCPT TO:<b@domain.tld>\r\nRCPT TO:c@domain.tld\r\nDATA\r\n" +
+				"Subject: Hi\r\nTo: other@domain.tld\r\n\r\n..leading dot\r\n.\r\nQUIT\r\n",
+			replies: []int{220, 250, 250, 250, 250, 354, 250, 221},
+			sent: []*Email{{
+				Config: &config.Config{FromAddr: "a@domain.tld", Recipients: []string{"b@domain.tld", "c@domain.tld"}},
+				Body:   []byte("Subject: Hi\nTo: other@domain.tld\n\n.leading dot\n"),
+			}},
+		},
+		{
+			name:    "Two transactions and the null sender",
+			session: "HELO client\r\nMAIL FROM:<>\r\nRCPT TO:<a@domain.tld>\r\nDATA\r\nSubject: 1\r\n\r\n.\r\nMAIL FROM:<b@domain.tld>\r\nRCPT TO:<c@domain.tld>\r\nDATA\r\nSubject: 2\r\n\r\n.\r\nQUIT\r\n",
+			replies: []int{220, 250, 250, 250, 354, 250, 250, 250, 354, 250, 221},
+			sent: []*Email{
+				{Config: &config.Config{FromAddr: "", Recipients: []string{"a@domain.tld"}}, Body: []byte("Subject: 1\n\n")},
+				{Config: &config.Config{FromAddr: "b@domain.tld", Recipients: []string{"c@domain.tld"}}, Body: []byte("Subject: 2\n\n")},
+			},
+		},
+		{
+			name:    "Commands out of order",
+			session: "RCPT TO:<a@domain.tld>\r\nDATA\r\nMAIL FROM:<a@domain.tld>\r\nMAIL FROM:<b@domain.tld>\r\nDATA\r\nRSET\r\nRCPT TO:<a@domain.tld>\r\nQUIT\r\n",
+			replies: []int{220, 503, 503, 250, 503, 503, 250, 503, 221},
+		},
+		{
+			name:    "Syntax errors and unknown commands",
+			session: "MAIL <a@domain.tld>\r\nMAIL FROM:not an address\r\nMAIL FROM:<a@domain.tld>\r\nRCPT TO:<>\r\nETRN domain.tld\r\nNOOP\r\nVRFY a\r\n",
+			replies: []int{220, 501, 501, 250, 501, 500, 250, 252},
+		},
+		{
+			name:    "Over the limits",
+			session: "MAIL FROM:<a@domain.tld>\r\nRCPT TO:<b@domain.tld>\r\nRCPT TO:<c@domain.tld>\r\nDATA\r\nSubject: Large message\r\n\r\nBody\r\n.\r\nQUIT\r\n",
+			cfg:     config.Config{MaxRecipients: 1, MaxMessageSize: 16},
+			replies: []int{220, 250, 250, 452, 354, 552, 221},
+		},
+		{
+			name:    "Temporary failure",
+			session: "MAIL FROM:<a@domain.tld>\r\nRCPT TO:<b@domain.tld>\r\nDATA\r\nSubject: Hi\r\n\r\n.\r\nQUIT\r\n",
+			sendErr: &DeliveryError{Kind: TemporaryFailure, Err: &textproto.Error{Code: 421, Msg: "busy"}},
+			replies: []int{220, 250, 250, 354, 451, 221},
+		},
+		{
+			name:    "Permanent failure",
+			session: "MAIL FROM:<a@domain.tld>\r\nRCPT TO:<b@domain.tld>\r\nDATA\r\nSubject: Hi\r\n\r\n.\r\nQUIT\r\n",
+			sendErr: &DeliveryError{Kind: RecipientFailure, Err: &textproto.Error{Code: 550, Msg: "no such user"}},
+			replies: []int{220, 250, 250, 354, 554, 221},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			var sent []*Email
+			cfg := tt.cfg
+			cfg.SmtpAddrs = []string{testSMTPAddr}
+			cfg.Recipients = []string{"ignored@domain.tld"}
+			err := serve(&cfg, strings.NewReader(tt.session), &out, func(e *Email) (*SendResult, error) {
+				sent = append(sent, e)
+				return &SendResult{}, tt.sendErr
+			})
+			if err != nil {
+				t.Fatalf("serve() error = %v", err)
+			}
+
+			var replies []int
+			for _, code := range regexp.MustCompile(`(?m)^(\d{3}) `).FindAllStringSubmatch(out.String(), -1) {
+				n, _ := strconv.Atoi(code[1])
+				replies = append(replies, n)
+			}
+			if !reflect.DeepEqual(replies, tt.replies) {
+				t.Errorf("replies = %v, want %v in:\n%s", replies, tt.replies, out.String())
+			}
+
+			if tt.sendErr != nil {
+				return
+			}
+			if len(sent) != len(tt.sent) {
+				t.Fatalf("sent %d messages, want %d", len(sent), len(tt.sent))
+			}
+			for i, want := range tt.sent {
+				if sent[i].Config.FromAddr != want.Config.FromAddr || !reflect.DeepEqual(sent[i].Config.Recipients, want.Config.Recipients) {
+					t.Errorf("message %d envelope = <%s> %v, want <%s> %v", i, sent[i].Config.FromAddr, sent[i].Config.Recipients, want.Config.FromAddr, want.Config.Recipients)
+				}
+				if string(sent[i].Body) != string(want.Body) {
+					t.Errorf("message %d body = %q, want %q", i, sent[i].Body, want.Body)
+				}
+			}
+		})
+	}
+}
+
+func TestServeUnexpectedEOF(t *testing.T) {
+	var out strings.Builder
+	err := serve(&config.Config{}, strings.NewReader("MAIL FROM:<a@domain.tld>\r\nRCPT TO:<b@domain.tld>\r\nDATA\r\nSubject: cut"), &out, func(e *Email) (*SendResult, error) {
+		t.Error("send called for an incomplete message")
+		return nil, nil
+	})
+	if err == nil {
+		t.Error("serve() succeeded, want an error for input ending within DATA")
+	}
+}
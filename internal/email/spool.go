@@ -0,0 +1,287 @@
+package email
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+	"github.com/kiinoda/mailrelay/internal/ratelimit"
+)
+
+// spoolExt marks complete spool files, files being written have no such
+// extension until they are renamed into place
+const spoolExt = ".json"
+
+// failedExt replaces the extension of spool files whose retry schedule is
+// exhausted, leaving them out of later flushes
+const failedExt = ".failed"
+
+// spooledMessage is a message waiting in the spool directory. The body is
+// stored as prepared for sending, with headers added and signed.
+type spooledMessage struct {
+	From      string    `json:"from"`
+	To        []string  `json:"to"`
+	Body      []byte    `json:"body"`
+	Queued    time.Time `json:"queued"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// Spool stores the email in the directory for a later flush, keeping only
+// the recipients the result does not show as accepted along with the error
+// of the send, and returns the path of the spool file
+func (e *Email) Spool(dir string, result *SendResult, sendErr error) (string, error) {
+	msg := &spooledMessage{
+		From:   e.Config.FromAddr,
+		To:     e.pending(result),
+		Body:   e.Body,
+		Queued: time.Now().UTC(),
+	}
+	if sendErr != nil {
+		msg.LastError = sendErr.Error()
+	}
+
+	// Names sort by queue time so that flushing keeps the order
+	var random [4]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return "", err
+	}
+	name := strconv.FormatInt(msg.Queued.UnixNano(), 10) + "-" + hex.EncodeToString(random[:]) + spoolExt
+	path := filepath.Join(dir, name)
+	if err := writeSpoolFile(path, msg); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// queue spools the email for a later flush without attempting delivery
+func (e *Email) queue() (*SendResult, error) {
+	path, err := e.Spool(e.Config.SpoolDir, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error spooling message: %w", err)
+	}
+	return &SendResult{From: e.Config.FromAddr, Bytes: len(e.Body), Queued: path}, nil
+}
+
+// pending returns the recipients the result does not show as accepted
+func (e *Email) pending(result *SendResult) []string {
+	accepted := map[string]bool{}
+	if result != nil {
+		for _, rcpt := range result.Accepted {
+			accepted[rcpt] = true
+		}
+	}
+	var pending []string
+	for _, rcpt := range e.Config.Recipients {
+		if !accepted[rcpt] {
+			pending = append(pending, rcpt)
+		}
+	}
+	return pending
+}
+
+// writeSpoolFile writes the message atomically, so that a flush never sees
+// a partial message
+func writeSpoolFile(path string, msg *spooledMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// writeFileAtomic writes the data to a temporary file and renames it into
+// place
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// readSpoolFile reads a message from the spool
+func readSpoolFile(path string) (*spooledMessage, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	msg := &spooledMessage{}
+	if err := json.Unmarshal(data, msg); err != nil {
+		return nil, fmt.Errorf("invalid spool file %s: %w", path, err)
+	}
+	if len(msg.To) == 0 {
+		return nil, fmt.Errorf("invalid spool file %s: no recipients", path)
+	}
+	return msg, nil
+}
+
+// ErrSpoolBusy is returned by Flush while another process flushes the spool
+var ErrSpoolBusy = errors.New("spool is being flushed by another process")
+
+// FlushResult is the outcome of retrying a single spooled message
+type FlushResult struct {
+	File string
+	Err  error
+}
+
+// Flush retries every message in the spool directory, oldest first,
+// deleting the ones delivered. Messages still failing are kept, holding
+// only the recipients not delivered yet, unless their retry schedule is
+// exhausted and they are set aside with the .failed extension. The whole
+// flush is bounded by the configured overall timeout.
+func Flush(ctx context.Context, cfg *config.Config) ([]FlushResult, error) {
+	if cfg.OverallTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.OverallTimeout)
+		defer cancel()
+	}
+	return flush(ctx, cfg, smtpDialer(cfg))
+}
+
+// flush allows injection of a custom dialer for testing
+func flush(ctx context.Context, cfg *config.Config, dialer SMTPDialer) ([]FlushResult, error) {
+	// Only one process flushes at a time, so that no message is sent twice
+	lock, err := tryLockFile(filepath.Join(cfg.SpoolDir, lockSuffix))
+	if errors.Is(err, errLocked) {
+		return nil, ErrSpoolBusy
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+
+	files, err := filepath.Glob(filepath.Join(cfg.SpoolDir, "*"+spoolExt))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	// The rate limit holds across the messages
+	limiter := newLimiter(cfg)
+	var results []FlushResult
+	for _, path := range files {
+		results = append(results, FlushResult{File: path, Err: flushFile(ctx, cfg, path, dialer, limiter)})
+	}
+	return results, nil
+}
+
+// flushFile retries a single spooled message
+func flushFile(ctx context.Context, cfg *config.Config, path string, dialer SMTPDialer, limiter *ratelimit.Limiter) error {
+	msg, err := readSpoolFile(path)
+	if err != nil {
+		return err
+	}
+
+	// Each message has its own envelope
+	msgCfg := *cfg
+	msgCfg.FromAddr = msg.From
+	msgCfg.Recipients = msg.To
+	msgCfg.DeliveryMode = config.DeliveryInteractive
+	email := &Email{
+		Config:  &msgCfg,
+		Body:    msg.Body,
+		limiter: limiter,
+	}
+
+	result, err := email.send(ctx, dialer)
+	if cfg.DryRun {
+		return err
+	}
+	if errors.Is(err, ErrGaveUp) {
+		if renameErr := os.Rename(path, strings.TrimSuffix(path, spoolExt)+failedExt); renameErr != nil {
+			return renameErr
+		}
+		return err
+	}
+	if err != nil {
+		// Keep the message, without the recipients delivered meanwhile
+		msg.To = email.pending(result)
+		msg.LastError = err.Error()
+		if writeErr := writeSpoolFile(path, msg); writeErr != nil {
+			return writeErr
+		}
+		return err
+	}
+	return os.Remove(path)
+}
+
+// SpoolEntry describes a message waiting in the spool
+type SpoolEntry struct {
+	ID        string
+	From      string
+	To        []string
+	Queued    time.Time
+	LastError string
+}
+
+// ReadSpool lists the messages in the spool directory, oldest first
+func ReadSpool(dir string) ([]SpoolEntry, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+spoolExt))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	entries := []SpoolEntry{}
+	for _, path := range files {
+		msg, err := readSpoolFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			// Delivered by a flush meanwhile
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, SpoolEntry{
+			ID:        strings.TrimSuffix(filepath.Base(path), spoolExt),
+			From:      msg.From,
+			To:        msg.To,
+			Queued:    msg.Queued,
+			LastError: msg.LastError,
+		})
+	}
+	return entries, nil
+}
+
+// PrintSpool writes the entries as a table in the manner of mailq, one
+// message per line with the ages relative to now
+func PrintSpool(w io.Writer, entries []SpoolEntry, now time.Time) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tAGE\tFROM\tRECIPIENTS\tLAST ERROR")
+	for _, entry := range entries {
+		lastError := entry.LastError
+		if lastError == "" {
+			lastError = "-"
+		}
+		// Errors may span lines, the table must not
+		lastError = strings.Join(strings.Fields(lastError), " ")
+		from := entry.From
+		if from == "" {
+			from = "<>"
+		}
+		age := now.Sub(entry.Queued).Truncate(time.Second)
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", entry.ID, age, from, strings.Join(entry.To, ","), lastError)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,294 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+)
+
+func spoolFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*"+spoolExt))
+	if err != nil {
+		t.Fatalf("Failed to list spool: %v", err)
+	}
+	return files
+}
+
+func TestSpool(t *testing.T) {
+	dir := t.TempDir()
+	failing := NewMockSMTPClient()
+	failing.ShouldFailOn = "mail"
+	failing.FailWith = &textproto.Error{Code: 451, Msg: "try again later"}
+
+	email := &Email{
+		Config: &config.Config{
+			FromAddr:   testFromAddr,
+			SmtpAddrs:  []string{testSMTPAddr},
+			Recipients: []string{"a@domain.tld", "b@domain.tld"},
+			SpoolDir:   dir,
+		},
+		Body: []byte("test email body"),
+	}
+
+	result, err := email.sendWithDialer(context.Background(), createMockDialer(failing, false))
+	var deliveryErr *DeliveryError
+	if !errors.As(err, &deliveryErr) || deliveryErr.Kind != TemporaryFailure {
+		t.Fatalf("sendWithDialer() error = %v, want a temporary failure", err)
+	}
+
+	path, err := email.Spool(dir, result, err)
+	if err != nil {
+		t.Fatalf("Spool() failed: %v", err)
+	}
+	if files := spoolFiles(t, dir); !reflect.DeepEqual(files, []string{path}) {
+		t.Fatalf("Spool files = %v, want %s", files, path)
+	}
+
+	msg, err := readSpoolFile(path)
+	if err != nil {
+		t.Fatalf("readSpoolFile() failed: %v", err)
+	}
+	if msg.From != testFromAddr || string(msg.Body) != "test email body" {
+		t.Errorf("Spooled message = %+v", msg)
+	}
+	if !reflect.DeepEqual(msg.To, email.Config.Recipients) {
+		t.Errorf("Spooled recipients = %v, want %v", msg.To, email.Config.Recipients)
+	}
+
+	// Accepted recipients are not spooled again
+	path, err = email.Spool(dir, &SendResult{Accepted: []string{"a@domain.tld"}}, nil)
+	if err != nil {
+		t.Fatalf("Spool() failed: %v", err)
+	}
+	if msg, err = readSpoolFile(path); err != nil || !reflect.DeepEqual(msg.To, []string{"b@domain.tld"}) {
+		t.Errorf("Spooled recipients = %v (%v), want [b@domain.tld]", msg.To, err)
+	}
+}
+
+func TestQueueDeliveryMode(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &config.Config{
+		FromAddr:     testFromAddr,
+		SmtpAddrs:    []string{testSMTPAddr},
+		Recipients:   []string{"a@domain.tld", "b@domain.tld"},
+		SpoolDir:     dir,
+		DeliveryMode: config.DeliveryQueue,
+	}
+	email := &Email{Config: cfg, Body: []byte("test email body")}
+
+	// Queued messages are spooled without dialing
+	result, err := email.send(context.Background(), noDialer(t))
+	if err != nil {
+		t.Fatalf("send() failed: %v", err)
+	}
+	files := spoolFiles(t, dir)
+	if len(files) != 1 || result.Queued != files[0] {
+		t.Fatalf("Spool files = %v, want the queued %s", files, result.Queued)
+	}
+	msg, err := readSpoolFile(files[0])
+	if err != nil || !reflect.DeepEqual(msg.To, cfg.Recipients) || msg.LastError != "" {
+		t.Errorf("Spooled message = %+v (%v), want both recipients and no error", msg, err)
+	}
+
+	// Flushing delivers them even in the queue delivery mode
+	client := NewMockSMTPClient()
+	results, err := flush(context.Background(), cfg, createMockDialer(client, false))
+	if err != nil || len(results) != 1 || results[0].Err != nil {
+		t.Fatalf("flush() = %v, %v, want one delivery", results, err)
+	}
+	if client.MethodCallCount["Data"] != 1 {
+		t.Errorf("Expected 1 message sent, got %d", client.MethodCallCount["Data"])
+	}
+	if files := spoolFiles(t, dir); len(files) != 0 {
+		t.Errorf("Delivered message left in spool: %v", files)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	spool := func(t *testing.T, dir string, recipients ...string) string {
+		email := &Email{
+			Config: &config.Config{FromAddr: testFromAddr, Recipients: recipients},
+			Body:   []byte("test email body"),
+		}
+		path, err := email.Spool(dir, nil, nil)
+		if err != nil {
+			t.Fatalf("Spool() failed: %v", err)
+		}
+		return path
+	}
+
+	t.Run("Delivered", func(t *testing.T) {
+		dir := t.TempDir()
+		spool(t, dir, "a@domain.tld")
+		spool(t, dir, "b@domain.tld")
+
+		client := NewMockSMTPClient()
+		cfg := &config.Config{SmtpAddrs: []string{testSMTPAddr}, SpoolDir: dir}
+		results, err := flush(context.Background(), cfg, createMockDialer(client, false))
+		if err != nil {
+			t.Fatalf("flush() failed: %v", err)
+		}
+		if len(results) != 2 {
+			t.Fatalf("flush() returned %d results, want 2", len(results))
+		}
+		for _, r := range results {
+			if r.Err != nil {
+				t.Errorf("%s: unexpected error %v", r.File, r.Err)
+			}
+		}
+		if files := spoolFiles(t, dir); len(files) != 0 {
+			t.Errorf("Delivered messages left in spool: %v", files)
+		}
+		if client.MethodCallCount["Data"] != 2 {
+			t.Errorf("Expected 2 messages sent, got %d", client.MethodCallCount["Data"])
+		}
+	})
+
+	t.Run("Still failing", func(t *testing.T) {
+		dir := t.TempDir()
+		path := spool(t, dir, "a@domain.tld")
+		before, _ := readSpoolFile(path)
+
+		cfg := &config.Config{SmtpAddrs: []string{testSMTPAddr}, SpoolDir: dir}
+		results, err := flush(context.Background(), cfg, createMockDialer(nil, true))
+		if err != nil {
+			t.Fatalf("flush() failed: %v", err)
+		}
+		if len(results) != 1 || results[0].Err == nil {
+			t.Fatalf("flush() results = %v, want one failure", results)
+		}
+		after, err := readSpoolFile(path)
+		if err != nil {
+			t.Fatalf("Failed message should be kept: %v", err)
+		}
+		if !reflect.DeepEqual(after.To, before.To) || string(after.Body) != string(before.Body) || !after.Queued.Equal(before.Queued) {
+			t.Errorf("Failed message should be kept unchanged, got %+v", after)
+		}
+		if after.LastError != results[0].Err.Error() {
+			t.Errorf("LastError = %q, want %q", after.LastError, results[0].Err)
+		}
+	})
+
+	t.Run("Partly delivered", func(t *testing.T) {
+		dir := t.TempDir()
+		path := spool(t, dir, "a@gmail.com", "b@domain.tld")
+
+		client := NewMockSMTPClient()
+		client.FailOnRecipient = "b@domain.tld"
+		cfg := &config.Config{
+			SmtpAddrs:   []string{testSMTPAddr},
+			SpoolDir:    dir,
+			SenderRules: map[string]string{"gmail.com": "gmail-sender@example.com"},
+		}
+		results, err := flush(context.Background(), cfg, createMockDialer(client, false))
+		if err != nil || len(results) != 1 || results[0].Err == nil {
+			t.Fatalf("flush() = %v, %v, want one failure", results, err)
+		}
+		msg, err := readSpoolFile(path)
+		if err != nil {
+			t.Fatalf("readSpoolFile() failed: %v", err)
+		}
+		if !reflect.DeepEqual(msg.To, []string{"b@domain.tld"}) {
+			t.Errorf("Spooled recipients = %v, want [b@domain.tld]", msg.To)
+		}
+	})
+
+	t.Run("Already flushing", func(t *testing.T) {
+		dir := t.TempDir()
+		path := spool(t, dir, "a@domain.tld")
+
+		lock, err := lockFile(filepath.Join(dir, lockSuffix))
+		if err != nil {
+			t.Fatalf("lockFile() failed: %v", err)
+		}
+		defer lock.Close()
+
+		client := NewMockSMTPClient()
+		cfg := &config.Config{SmtpAddrs: []string{testSMTPAddr}, SpoolDir: dir}
+		if _, err := flush(context.Background(), cfg, createMockDialer(client, false)); !errors.Is(err, ErrSpoolBusy) {
+			t.Fatalf("flush() error = %v, want ErrSpoolBusy", err)
+		}
+		if client.MethodCallCount["Mail"] != 0 {
+			t.Error("A busy spool should not be flushed")
+		}
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("Spooled message should be kept: %v", err)
+		}
+	})
+
+	t.Run("Ignores partial files", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, ".spool-123"), []byte("{"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		cfg := &config.Config{SmtpAddrs: []string{testSMTPAddr}, SpoolDir: dir}
+		results, err := flush(context.Background(), cfg, createMockDialer(NewMockSMTPClient(), false))
+		if err != nil || len(results) != 0 {
+			t.Errorf("flush() = %v, %v, want no results", results, err)
+		}
+	})
+}
+
+func TestPrintSpool(t *testing.T) {
+	dir := t.TempDir()
+	for _, rcpts := range [][]string{{"a@domain.tld", "b@domain.tld"}, {"c@domain.tld"}} {
+		email := &Email{
+			Config: &config.Config{FromAddr: testFromAddr, Recipients: rcpts},
+			Body:   []byte("test email body"),
+		}
+		if _, err := email.Spool(dir, nil, errors.New("smtp.example.com:587: mail: 451 try\nagain later")); err != nil {
+			t.Fatalf("Spool() failed: %v", err)
+		}
+	}
+	// A message queued without an error and a null sender
+	bounce := &Email{Config: &config.Config{Recipients: []string{"d@domain.tld"}}, Body: []byte("bounce")}
+	if _, err := bounce.Spool(dir, nil, nil); err != nil {
+		t.Fatalf("Spool() failed: %v", err)
+	}
+	// Files being written are not listed
+	os.WriteFile(filepath.Join(dir, ".tmp-123"), []byte("{"), 0600)
+
+	entries, err := ReadSpool(dir)
+	if err != nil {
+		t.Fatalf("ReadSpool() failed: %v", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("ReadSpool() returned %d entries, want 3", len(entries))
+	}
+
+	// Pin the queue times and IDs for a stable listing
+	queued := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i := range entries {
+		entries[i].ID = fmt.Sprintf("msg%d", i+1)
+		entries[i].Queued = queued.Add(time.Duration(i) * time.Minute)
+	}
+
+	var out bytes.Buffer
+	if err := PrintSpool(&out, entries, queued.Add(90*time.Minute+500*time.Millisecond)); err != nil {
+		t.Fatalf("PrintSpool() failed: %v", err)
+	}
+	expected := `ID    AGE      FROM              RECIPIENTS                 LAST ERROR
+msg1  1h30m0s  test@example.com  a@domain.tld,b@domain.tld  smtp.example.com:587: mail: 451 try again later
+msg2  1h29m0s  test@example.com  c@domain.tld               smtp.example.com:587: mail: 451 try again later
+msg3  1h28m0s  <>                d@domain.tld               -
+`
+	if out.String() != expected {
+		t.Errorf("PrintSpool() =\n%s\nwant\n%s", out.String(), expected)
+	}
+
+	// An empty spool only lists the header
+	entries, err = ReadSpool(t.TempDir())
+	if err != nil || len(entries) != 0 {
+		t.Errorf("ReadSpool() = %v, %v, want no entries", entries, err)
+	}
+}
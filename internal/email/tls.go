@@ -0,0 +1,73 @@
+package email
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+)
+
+// errNoSTARTTLS is returned for servers not offering STARTTLS when TLS is
+// required
+var errNoSTARTTLS = errors.New("server does not offer STARTTLS, refusing to continue in plaintext")
+
+// newTLSConfig creates the TLS config used with the host, within the
+// configured TLS versions. The certificate chain is not verified, a pinned
+// fingerprint is checked instead when set.
+func newTLSConfig(cfg *config.Config, host string) *tls.Config {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: true,
+		MinVersion:         cfg.MinTLSVersion,
+		MaxVersion:         cfg.MaxTLSVersion,
+	}
+
+	// IP literals cannot be used for SNI
+	if net.ParseIP(host) == nil {
+		tlsConfig.ServerName = host
+	}
+	if cfg.ClientCert != nil {
+		tlsConfig.Certificates = []tls.Certificate{*cfg.ClientCert}
+	}
+	if cfg.PinnedFingerprint != "" {
+		tlsConfig.VerifyPeerCertificate = verifyFingerprint(cfg.PinnedFingerprint)
+	}
+	return tlsConfig
+}
+
+// verifyFingerprint returns a callback accepting only a server certificate
+// with the given SHA-256 fingerprint, in lowercase hex
+func verifyFingerprint(pin string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("server presented no certificate")
+		}
+		sum := sha256.Sum256(rawCerts[0])
+		if got := hex.EncodeToString(sum[:]); got != pin {
+			return fmt.Errorf("server certificate fingerprint %s does not match the pinned %s", got, pin)
+		}
+		return nil
+	}
+}
+
+// versionError explains a handshake failing for want of a TLS version
+// both sides support, leaving other errors alone
+func versionError(tlsConfig *tls.Config, err error) error {
+	if err == nil || !strings.Contains(err.Error(), "protocol version") {
+		return err
+	}
+	minVersion := tlsConfig.MinVersion
+	if minVersion == 0 {
+		minVersion = config.DefaultMinTLSVersion
+	}
+	allowed := tls.VersionName(minVersion) + " or newer"
+	if tlsConfig.MaxVersion != 0 {
+		allowed = tls.VersionName(minVersion) + " to " + tls.VersionName(tlsConfig.MaxVersion)
+	}
+	return fmt.Errorf("server does not support %s: %w", allowed, err)
+}
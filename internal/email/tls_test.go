@@ -0,0 +1,276 @@
+package email
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+)
+
+// selfSignedCert creates a certificate for the host signed by its own key
+func selfSignedCert(t *testing.T, host string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// handshake runs a TLS handshake between a server presenting the
+// certificate and a client using the config
+func handshake(t *testing.T, cert tls.Certificate, clientConfig *tls.Config) error {
+	t.Helper()
+	return handshakeWith(t, &tls.Config{Certificates: []tls.Certificate{cert}}, clientConfig)
+}
+
+// handshakeWith runs a TLS handshake between a server and a client using
+// their configs
+func handshakeWith(t *testing.T, serverConfig, clientConfig *tls.Config) error {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.(*tls.Conn).Handshake()
+	}()
+
+	conn, err := net.DialTimeout("tcp", ln.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return tls.Client(conn, clientConfig).Handshake()
+}
+
+func TestPinnedFingerprint(t *testing.T) {
+	cert := selfSignedCert(t, "smtp.example.com")
+	sum := sha256.Sum256(cert.Certificate[0])
+	other := sha256.Sum256([]byte("another certificate"))
+
+	tests := []struct {
+		name    string
+		pin     string
+		wantErr bool
+	}{
+		{"No pin", "", false},
+		{"Matching pin", hex.EncodeToString(sum[:]), false},
+		{"Mismatching pin", hex.EncodeToString(other[:]), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{PinnedFingerprint: tt.pin}
+			err := handshake(t, cert, newTLSConfig(cfg, "smtp.example.com"))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("handshake error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr && !strings.Contains(err.Error(), "does not match the pinned") {
+				t.Errorf("handshake error = %v, want a fingerprint mismatch", err)
+			}
+		})
+	}
+}
+
+func TestTLSVersions(t *testing.T) {
+	tests := []struct {
+		name     string
+		min, max uint16
+	}{
+		{"Minimum only", tls.VersionTLS12, 0},
+		{"Single version", tls.VersionTLS13, tls.VersionTLS13},
+		{"Range", tls.VersionTLS11, tls.VersionTLS12},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{MinTLSVersion: tt.min, MaxTLSVersion: tt.max}
+			tlsConfig := newTLSConfig(cfg, "smtp.example.com")
+			if tlsConfig.MinVersion != tt.min || tlsConfig.MaxVersion != tt.max {
+				t.Errorf("TLS versions = %x to %x, want %x to %x", tlsConfig.MinVersion, tlsConfig.MaxVersion, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestTLSVersionMismatch(t *testing.T) {
+	// A legacy server speaking TLS 1.1 at most
+	server := &tls.Config{
+		Certificates: []tls.Certificate{selfSignedCert(t, "smtp.example.com")},
+		MinVersion:   tls.VersionTLS10,
+		MaxVersion:   tls.VersionTLS11,
+	}
+	cfg := &config.Config{MinTLSVersion: tls.VersionTLS12}
+	tlsConfig := newTLSConfig(cfg, "smtp.example.com")
+
+	err := versionError(tlsConfig, handshakeWith(t, server, tlsConfig))
+	if err == nil || !strings.Contains(err.Error(), "server does not support TLS 1.2 or newer") {
+		t.Fatalf("handshake error = %v, want the TLS versions explained", err)
+	}
+
+	// The server fails and the next one is tried
+	legacy := NewMockSMTPClient()
+	legacy.ShouldFailOn = "tls"
+	legacy.FailWith = errors.New("remote error: tls: protocol version not supported")
+	modern := NewMockSMTPClient()
+	cfg = &config.Config{
+		FromAddr:      testFromAddr,
+		SmtpAddrs:     []string{"legacy.example.com:25", "modern.example.com:25"},
+		Recipients:    []string{"rcpt@domain.tld"},
+		MinTLSVersion: tls.VersionTLS13,
+	}
+	email := &Email{Config: cfg, Body: []byte("test email body")}
+	dialer := func(ctx context.Context, addr string) (SMTPClient, error) {
+		if strings.HasPrefix(addr, "legacy.") {
+			return legacy, nil
+		}
+		return modern, nil
+	}
+	if _, err := email.sendWithDialer(context.Background(), dialer); err != nil {
+		t.Fatalf("sendWithDialer() error = %v, want the second server used", err)
+	}
+	if legacy.TLSConfig == nil || legacy.TLSConfig.MinVersion != tls.VersionTLS13 {
+		t.Errorf("legacy server TLS config = %+v, want TLS 1.3 at least", legacy.TLSConfig)
+	}
+	if modern.MethodCallCount["Data"] != 1 {
+		t.Errorf("Expected the message sent through the second server, got %d", modern.MethodCallCount["Data"])
+	}
+}
+
+func TestRequireTLS(t *testing.T) {
+	tests := []struct {
+		name       string
+		requireTLS bool
+		stripped   bool
+		failTLS    bool
+		wantUsed   bool
+	}{
+		{"STARTTLS offered", true, false, false, true},
+		{"STARTTLS stripped", true, true, false, false},
+		{"STARTTLS offered but failing", true, false, true, false},
+		{"STARTTLS stripped without strict mode", false, true, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first := NewMockSMTPClient()
+			if !tt.stripped {
+				first.Extensions = map[string]string{"STARTTLS": ""}
+			}
+			if tt.failTLS {
+				first.ShouldFailOn = "tls"
+			}
+			second := NewMockSMTPClient()
+			second.Extensions = map[string]string{"STARTTLS": ""}
+
+			clients := map[string]*MockSMTPClient{"smtp1.example.com:587": first, "smtp2.example.com:587": second}
+			dialer := func(ctx context.Context, addr string) (SMTPClient, error) {
+				return clients[addr], nil
+			}
+
+			email := &Email{
+				Config: &config.Config{
+					FromAddr:   testFromAddr,
+					SmtpAddrs:  []string{"smtp1.example.com:587", "smtp2.example.com:587"},
+					Recipients: []string{"test@domain.tld"},
+					RequireTLS: tt.requireTLS,
+				},
+				Body: []byte("test email body"),
+			}
+			if _, err := email.sendWithDialer(context.Background(), dialer); err != nil {
+				t.Fatalf("sendWithDialer() failed: %v", err)
+			}
+
+			// The message never goes through a server in plaintext
+			if used := first.MethodCallCount["Mail"] > 0; used != tt.wantUsed {
+				t.Errorf("First server used = %v, want %v", used, tt.wantUsed)
+			}
+			if tt.stripped && tt.requireTLS && first.MethodCallCount["StartTLS"] != 0 {
+				t.Error("STARTTLS should not be tried with a server not offering it")
+			}
+			if !tt.wantUsed && second.MethodCallCount["Mail"] != 1 {
+				t.Error("Expected to fail over to the second server")
+			}
+		})
+	}
+}
+
+func TestPerServerTLSPolicy(t *testing.T) {
+	tests := []struct {
+		name         string
+		requireTLS   bool
+		policy       string
+		offered      bool
+		wantStartTLS int
+		wantErr      bool
+	}{
+		{"Default policy", false, "", true, 1, false},
+		{"Plaintext internal relay", false, config.TLSPolicyNone, true, 0, false},
+		{"Plaintext relay despite RequireTLS", true, config.TLSPolicyNone, false, 0, false},
+		{"Required without STARTTLS", false, config.TLSPolicyRequired, false, 0, true},
+		{"Required with STARTTLS", false, config.TLSPolicyRequired, true, 1, false},
+		{"STARTTLS despite RequireTLS", true, config.TLSPolicyStartTLS, false, 1, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockClient := NewMockSMTPClient()
+			if tt.offered {
+				mockClient.Extensions = map[string]string{"STARTTLS": ""}
+			}
+			cfg := &config.Config{
+				FromAddr:   testFromAddr,
+				SmtpAddrs:  []string{testSMTPAddr},
+				Recipients: []string{"test@domain.tld"},
+				RequireTLS: tt.requireTLS,
+			}
+			if tt.policy != "" {
+				cfg.ServerTLS = map[string]string{testSMTPAddr: tt.policy}
+			}
+			email := &Email{Config: cfg, Body: []byte("test email body")}
+
+			err := email.attemptRelayWithDialer(context.Background(), testSMTPAddr, createMockDialer(mockClient, false))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("attemptRelayWithDialer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if n := mockClient.MethodCallCount["StartTLS"]; n != tt.wantStartTLS {
+				t.Errorf("StartTLS called %d times, want %d", n, tt.wantStartTLS)
+			}
+		})
+	}
+}
@@ -22,4 +22,30 @@ const (
 
 	// ParseError indicates a failure to parse data
 	ParseError = 4
+
+	// NotConfirmed indicates that sending to a large recipient list was
+	// declined, or could not be confirmed without a terminal
+	NotConfirmed = 5
+
+	// Usage indicates that the command was used incorrectly, as when no
+	// recipient is given (EX_USAGE)
+	Usage = 64
+
+	// DataError indicates a message over the configured recipient or size
+	// limits (EX_DATAERR)
+	DataError = 65
+
+	// NoInput indicates that no message was provided (EX_NOINPUT)
+	NoInput = 66
+
+	// NoUser indicates that the recipients were rejected (EX_NOUSER)
+	NoUser = 67
+
+	// TempFail indicates a temporary failure, the message can be
+	// retried later (EX_TEMPFAIL)
+	TempFail = 75
+
+	// NoPerm indicates that the server permanently refused the
+	// message (EX_NOPERM)
+	NoPerm = 77
 )
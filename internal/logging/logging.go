@@ -0,0 +1,48 @@
+package logging
+
+import (
+	"io"
+	"log"
+	"os"
+)
+
+// Syslog routes the standard logger output to the system logger using
+// the mail facility. The standard logger is left untouched on failure,
+// so callers can keep logging to stderr.
+func Syslog() error {
+	w, err := newSyslogWriter()
+	if err != nil {
+		return err
+	}
+
+	// syslog records carry their own timestamp
+	log.SetFlags(0)
+	log.SetOutput(w)
+	return nil
+}
+
+// Trace starts the message of every log record with the trace ID of the
+// run, so that the records of interleaved invocations can be correlated
+func Trace(id string) {
+	log.SetFlags(log.Flags() | log.Lmsgprefix)
+	log.SetPrefix("trace=" + id + " ")
+}
+
+// Discard drops the standard logger output, for quiet runs
+func Discard() {
+	log.SetOutput(io.Discard)
+}
+
+// File appends the standard logger output to the file, creating it if
+// needed. Each record is a single write to a file opened with O_APPEND, so
+// concurrent invocations do not interleave, and the file is only held
+// until the process exits, which suits log rotation. The standard logger
+// is left untouched on failure.
+func File(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	log.SetOutput(f)
+	return nil
+}
@@ -0,0 +1,87 @@
+package logging
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mailrelay.log")
+	if err := os.WriteFile(path, []byte("earlier record\n"), 0640); err != nil {
+		t.Fatalf("Failed to write log file: %v", err)
+	}
+	defer log.SetOutput(os.Stderr)
+
+	// Every invocation appends to the same file
+	for _, msg := range []string{"first run", "second run"} {
+		if err := File(path); err != nil {
+			t.Fatalf("File() error = %v", err)
+		}
+		log.Println(msg)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read log file: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	if len(lines) != 3 || lines[0] != "earlier record" || !strings.HasSuffix(lines[1], " first run") || !strings.HasSuffix(lines[2], " second run") {
+		t.Errorf("Log file content = %q", content)
+	}
+}
+
+func TestFileUnavailable(t *testing.T) {
+	var before strings.Builder
+	log.SetOutput(&before)
+	defer log.SetOutput(os.Stderr)
+
+	if err := File(filepath.Join(t.TempDir(), "missing", "mailrelay.log")); err == nil {
+		t.Fatal("File() should fail when the directory does not exist")
+	}
+
+	// The logger keeps its output
+	log.Println("still here")
+	if !strings.Contains(before.String(), "still here") {
+		t.Errorf("Logger output changed after a failure")
+	}
+}
+
+func TestDiscard(t *testing.T) {
+	var out strings.Builder
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	Discard()
+	log.Println("informational")
+	if out.Len() != 0 {
+		t.Errorf("Logger output = %q after Discard()", out.String())
+	}
+}
+
+func TestTrace(t *testing.T) {
+	var out strings.Builder
+	log.SetOutput(&out)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetPrefix("")
+		log.SetFlags(log.LstdFlags)
+	}()
+
+	Trace("0123456789ab")
+	log.Println("connecting")
+	log.Printf("sent to %d recipients", 2)
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Log output = %q, want 2 lines", out.String())
+	}
+	for _, line := range lines {
+		// The ID follows the timestamp, so that records still sort by time
+		if strings.HasPrefix(line, "trace=") || !strings.Contains(line, " trace=0123456789ab ") {
+			t.Errorf("Log line %q lacks the trace ID after its timestamp", line)
+		}
+	}
+}
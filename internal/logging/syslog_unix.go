@@ -0,0 +1,13 @@
+//go:build !windows && !plan9
+
+package logging
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// newSyslogWriter connects to the local syslog daemon with facility LOG_MAIL
+func newSyslogWriter() (io.Writer, error) {
+	return syslog.New(syslog.LOG_MAIL|syslog.LOG_INFO, "mailrelay")
+}
@@ -0,0 +1,95 @@
+// Package ratelimit paces outbound sends with a token bucket, shared by
+// every send of a process
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket refilled at Rate tokens per second and holding
+// at most Burst tokens. It is safe for concurrent use.
+type Limiter struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+
+	// now and sleep are replaced in tests
+	now   func() time.Time
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+// New returns a full limiter allowing rate events per second on average,
+// and bursts of up to one second worth of events, or of one event at
+// rates below one per second
+func New(rate float64) *Limiter {
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		now:    time.Now,
+		sleep:  sleep,
+	}
+}
+
+// Wait blocks until n events are allowed or the context is done. Events
+// beyond the burst size are allowed once the bucket is full and delay the
+// following ones, so that a large batch is not held back forever.
+func (l *Limiter) Wait(ctx context.Context, n int) error {
+	delay := l.reserve(float64(n))
+	if delay <= 0 {
+		return nil
+	}
+	if err := l.sleep(ctx, delay); err != nil {
+		// The events did not happen, give their tokens back
+		l.mu.Lock()
+		l.tokens += float64(n)
+		l.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// reserve takes n tokens, possibly going into debt, and returns how long
+// to wait for the bucket to have held them
+func (l *Limiter) reserve(n float64) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+
+	need := min(n, l.burst)
+	deficit := need - l.tokens
+	l.tokens -= n
+	if deficit <= 0 {
+		return 0
+	}
+	return time.Duration(deficit / l.rate * float64(time.Second))
+}
+
+// sleep waits for the duration unless the context is done first
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
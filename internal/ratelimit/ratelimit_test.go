@@ -0,0 +1,99 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// fakeClock advances on sleeps, recording them
+type fakeClock struct {
+	now    time.Time
+	sleeps []time.Duration
+}
+
+func newTestLimiter(rate float64) (*Limiter, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	l := New(rate)
+	l.now = func() time.Time { return clock.now }
+	l.sleep = func(ctx context.Context, d time.Duration) error {
+		clock.sleeps = append(clock.sleeps, d)
+		clock.now = clock.now.Add(d)
+		return nil
+	}
+	return l, clock
+}
+
+func TestWait(t *testing.T) {
+	tests := []struct {
+		name     string
+		rate     float64
+		events   []int
+		expected []time.Duration
+	}{
+		{"Within the burst", 2, []int{1, 1}, nil},
+		{"Beyond the burst", 2, []int{1, 1, 1, 1}, []time.Duration{500 * time.Millisecond, 500 * time.Millisecond}},
+		{"Slow rate", 1.0 / 60, []int{1, 1, 1}, []time.Duration{time.Minute, time.Minute}},
+		{"Large batch delays the next", 10, []int{30, 1}, []time.Duration{2100 * time.Millisecond}},
+		{"Batches of recipients", 10, []int{5, 5, 5}, []time.Duration{500 * time.Millisecond}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, clock := newTestLimiter(tt.rate)
+			for _, n := range tt.events {
+				if err := l.Wait(context.Background(), n); err != nil {
+					t.Fatalf("Wait() error = %v", err)
+				}
+			}
+			if len(clock.sleeps) != len(tt.expected) {
+				t.Fatalf("Wait() slept %v, want %v", clock.sleeps, tt.expected)
+			}
+			for i, d := range clock.sleeps {
+				if diff := d - tt.expected[i]; diff < -time.Millisecond || diff > time.Millisecond {
+					t.Errorf("Wait() slept %v, want %v", clock.sleeps, tt.expected)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestWaitRefills(t *testing.T) {
+	l, clock := newTestLimiter(1)
+	l.Wait(context.Background(), 1)
+
+	// A second later the token is back
+	clock.now = clock.now.Add(time.Second)
+	l.Wait(context.Background(), 1)
+	if len(clock.sleeps) != 0 {
+		t.Errorf("Wait() slept %v after the bucket refilled", clock.sleeps)
+	}
+
+	// The bucket holds no more than the burst however long it waits
+	clock.now = clock.now.Add(time.Hour)
+	l.Wait(context.Background(), 1)
+	l.Wait(context.Background(), 1)
+	if len(clock.sleeps) != 1 || clock.sleeps[0] != time.Second {
+		t.Errorf("Wait() slept %v, want [1s]", clock.sleeps)
+	}
+}
+
+func TestWaitCanceled(t *testing.T) {
+	l := New(1)
+	l.Wait(context.Background(), 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := l.Wait(ctx, 1); err != context.DeadlineExceeded {
+		t.Fatalf("Wait() error = %v, want the context error", err)
+	}
+
+	// The canceled wait does not hold back the next one further
+	l.mu.Lock()
+	tokens := l.tokens
+	l.mu.Unlock()
+	if tokens < -0.1 {
+		t.Errorf("tokens = %v after a canceled wait, want them given back", tokens)
+	}
+}
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"time"
 
 	"github.com/kiinoda/mailrelay/internal/config"
 	"github.com/kiinoda/mailrelay/internal/email"
 	"github.com/kiinoda/mailrelay/internal/exitcode"
+	"github.com/kiinoda/mailrelay/internal/logging"
 )
 
 func main() {
@@ -18,7 +23,203 @@ func main() {
 		os.Exit(exitcode.ConfigError)
 	}
 
-	// Read email from stdin
+	// Route logs to syslog or a file if requested, stderr otherwise, which
+	// quiet mode keeps for errors only
+	logToStderr := true
+	if cfg.UseSyslog {
+		if err := logging.Syslog(); err != nil {
+			fmt.Fprintf(os.Stderr, "syslog unavailable, logging to stderr: %v\n", err)
+		} else {
+			logToStderr = false
+		}
+	}
+	if cfg.LogFile != "" {
+		if err := logging.File(cfg.LogFile); err != nil {
+			fmt.Fprintf(os.Stderr, "log file unavailable, logging to stderr: %v\n", err)
+		} else {
+			logToStderr = false
+		}
+	}
+	if cfg.Quiet && logToStderr {
+		logging.Discard()
+	}
+	logging.Trace(cfg.TraceID)
+
+	// Check the servers instead of sending
+	if cfg.Check {
+		os.Exit(check(cfg))
+	}
+
+	// Retry spooled messages instead of sending
+	if cfg.Flush {
+		os.Exit(flush(cfg))
+	}
+
+	// List spooled messages instead of sending
+	if cfg.ListSpool {
+		os.Exit(listSpool(cfg))
+	}
+
+	// Receive messages over SMTP on stdin instead of reading one
+	if cfg.SMTPSession {
+		os.Exit(serveStdin(cfg))
+	}
+
+	// Read email from the envelope or input file if given, stdin otherwise
+	var mail *email.Email
+	switch {
+	case cfg.EnvelopeFile != "":
+		mail = readEnvelope(cfg)
+	case cfg.InputFile != "":
+		mail = readInput(cfg)
+	default:
+		mail = readStdin(cfg)
+	}
+
+	// Make sure a large recipient list is intended
+	if err := mail.Confirm(email.TerminalPrompt); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(exitcode.NotConfirmed)
+	}
+
+	// Send email
+	result, err := mail.Send(context.Background())
+
+	// Report the outcome to calling scripts, the exit code still telling
+	// success from failure
+	if cfg.JSONOutput {
+		if jsonErr := email.WriteJSON(os.Stdout, result, err); jsonErr != nil {
+			fmt.Fprintf(os.Stderr, "error writing result: %v\n", jsonErr)
+		}
+	}
+	if err != nil {
+		// An earlier invocation scheduled the next attempt later
+		var notDue *email.NotDueError
+		if errors.As(err, &notDue) {
+			fmt.Fprintf(os.Stderr, "delivery deferred: %v\n", err)
+			os.Exit(exitcode.TempFail)
+		}
+
+		// Keep temporarily failed messages for a later flush
+		var deliveryErr *email.DeliveryError
+		if cfg.SpoolDir != "" && !cfg.DryRun && errors.As(err, &deliveryErr) && deliveryErr.Kind == email.TemporaryFailure {
+			path, spoolErr := mail.Spool(cfg.SpoolDir, result, err)
+			if spoolErr == nil {
+				fmt.Fprintf(os.Stderr, "delivery deferred, message spooled to %s: %v\n", path, err)
+				os.Exit(exitcode.Success)
+			}
+			fmt.Fprintf(os.Stderr, "error spooling message: %v\n", spoolErr)
+		}
+
+		var sendErr *email.SendError
+		if errors.As(err, &sendErr) {
+			// List each server tried on its own line
+			fmt.Fprintln(os.Stderr, "failed to send email to any SMTP server:")
+			for _, attempt := range sendErr.Attempts() {
+				fmt.Fprintf(os.Stderr, "  %s\n", attempt)
+			}
+			if errors.Is(err, context.DeadlineExceeded) {
+				fmt.Fprintln(os.Stderr, "  gave up after the overall timeout")
+			}
+			if errors.Is(err, email.ErrGaveUp) {
+				fmt.Fprintln(os.Stderr, "  gave up, the retry schedule is exhausted")
+			}
+		} else {
+			fmt.Fprintf(os.Stderr, "failed to send email: %v\n", err)
+		}
+		if errors.As(err, &deliveryErr) {
+			os.Exit(deliveryErr.ExitCode())
+		}
+		os.Exit(exitcode.SendError)
+	}
+
+	// Report recipients rejected in partial delivery mode
+	for _, rcpt := range result.Rejected {
+		fmt.Fprintf(os.Stderr, "recipient rejected: %s: %v\n", rcpt, result.Errors[rcpt])
+	}
+	if cfg.BeVerbose && result.Queued != "" && !cfg.JSONOutput {
+		fmt.Printf("queued %d bytes from <%s> to %s\n", result.Bytes, result.From, result.Queued)
+	} else if cfg.BeVerbose && !cfg.DryRun && !cfg.JSONOutput {
+		fmt.Printf("sent %d bytes from <%s> to %d recipients via %s in %v\n",
+			result.Bytes, result.From, len(result.Accepted), result.Server, result.Duration.Round(time.Millisecond))
+	}
+
+	// Successfully sent email
+	os.Exit(exitcode.Success)
+}
+
+// check reports the health of every server and returns the exit code
+func check(cfg *config.Config) int {
+	code := exitcode.Success
+	for _, r := range email.Check(context.Background(), cfg) {
+		if r.Err != nil {
+			fmt.Printf("%s failed after %v: %v\n", r.Server, r.Latency.Round(time.Millisecond), r.Err)
+			code = exitcode.SendError
+			continue
+		}
+		fmt.Printf("%s ok in %v\n", r.Server, r.Latency.Round(time.Millisecond))
+	}
+	return code
+}
+
+// flush retries the spooled messages and returns the exit code, a
+// temporary failure if any message is left in the spool
+func flush(cfg *config.Config) int {
+	results, err := email.Flush(context.Background(), cfg)
+	if errors.Is(err, email.ErrSpoolBusy) {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return exitcode.TempFail
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading spool: %v\n", err)
+		return exitcode.IOError
+	}
+
+	code := exitcode.Success
+	for _, r := range results {
+		if r.Err != nil {
+			fmt.Fprintf(os.Stderr, "%s kept: %v\n", r.File, r.Err)
+			code = exitcode.TempFail
+			continue
+		}
+		if cfg.BeVerbose {
+			fmt.Printf("%s delivered\n", r.File)
+		}
+	}
+	return code
+}
+
+// listSpool prints the spooled messages and returns the exit code
+func listSpool(cfg *config.Config) int {
+	entries, err := email.ReadSpool(cfg.SpoolDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading spool: %v\n", err)
+		return exitcode.IOError
+	}
+	if err := email.PrintSpool(os.Stdout, entries, time.Now()); err != nil {
+		fmt.Fprintf(os.Stderr, "error listing spool: %v\n", err)
+		return exitcode.IOError
+	}
+	return exitcode.Success
+}
+
+// serveStdin speaks SMTP on stdin and stdout and returns the exit code,
+// the outcome of each message being replied to the client
+func serveStdin(cfg *config.Config) int {
+	if err := email.Serve(context.Background(), cfg, os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "error in SMTP session: %v\n", err)
+		return exitcode.IOError
+	}
+	return exitcode.Success
+}
+
+// readStdin reads the email from stdin, taking the recipients from its headers
+func readStdin(cfg *config.Config) *email.Email {
+	// Someone typing the message may not know how to end it
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 && !cfg.Quiet {
+		fmt.Fprintln(os.Stderr, "reading message from the terminal, end it with Ctrl-D")
+	}
+
 	body, err := io.ReadAll(os.Stdin)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error reading stdin: %v\n", err)
@@ -27,17 +228,65 @@ func main() {
 
 	// Create email instance with body
 	mail, err := email.New(cfg, body)
+	if errors.Is(err, email.ErrEmptyMessage) {
+		fmt.Fprintln(os.Stderr, "no message body provided on stdin, pipe the message to mailrelay")
+		os.Exit(exitcode.NoInput)
+	}
+	return checkMessage(mail, err)
+}
+
+// readInput reads the email from the input file, taking the recipients from
+// its headers
+func readInput(cfg *config.Config) *email.Email {
+	mail, err := email.NewFromFile(cfg, cfg.InputFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		fmt.Fprintf(os.Stderr, "error reading message: %v\n", err)
+		os.Exit(exitcode.NoInput)
+	}
+	if errors.Is(err, email.ErrEmptyMessage) {
+		fmt.Fprintf(os.Stderr, "no message body provided in %s\n", cfg.InputFile)
+		os.Exit(exitcode.NoInput)
+	}
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		fmt.Fprintf(os.Stderr, "error reading message: %v\n", err)
+		os.Exit(exitcode.IOError)
+	}
+	return checkMessage(mail, err)
+}
+
+// checkMessage exits on the errors of creating the email from a message
+func checkMessage(mail *email.Email, err error) *email.Email {
+	if errors.Is(err, email.ErrNoSender) {
+		fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+		os.Exit(exitcode.ConfigError)
+	}
+	if errors.Is(err, email.ErrNoRecipients) {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(exitcode.Usage)
+	}
+	if errors.Is(err, email.ErrTooManyRecipients) || errors.Is(err, email.ErrMessageTooLarge) {
+		fmt.Fprintf(os.Stderr, "message refused: %v\n", err)
+		os.Exit(exitcode.DataError)
+	}
+	if errors.Is(err, email.ErrPreSendCommand) {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(exitcode.SendError)
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error parsing message body: %v\n", err)
 		os.Exit(exitcode.ParseError)
 	}
+	return mail
+}
 
-	// Send email
-	if err := mail.Send(); err != nil {
-		fmt.Fprintf(os.Stderr, "failed to send email: %v\n", err)
-		os.Exit(exitcode.SendError)
+// readEnvelope reads the email described by the envelope file
+func readEnvelope(cfg *config.Config) *email.Email {
+	env, err := email.ReadEnvelope(cfg.EnvelopeFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading envelope: %v\n", err)
+		os.Exit(exitcode.ParseError)
 	}
 
-	// Successfully sent email
-	os.Exit(exitcode.Success)
+	return checkMessage(email.NewFromEnvelope(cfg, env))
 }
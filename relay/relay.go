@@ -0,0 +1,74 @@
+// Package relay sends email through SMTP relays the way the mailrelay
+// command does, for programs embedding it. The configuration is built in
+// code, neither the command line nor the environment are read:
+//
+//	cfg := &relay.Config{
+//		SmtpAddrs: []string{"relay1.domain.tld:25", "relay2.domain.tld:25"},
+//		FromAddr:  "noreply@domain.tld",
+//	}
+//	result, err := relay.Send(ctx, cfg, message)
+//
+// Recipients are taken from the To, Cc and Bcc headers of the message
+// unless Config.Recipients is set.
+package relay
+
+import (
+	"context"
+	"maps"
+
+	"github.com/kiinoda/mailrelay/internal/config"
+	"github.com/kiinoda/mailrelay/internal/email"
+)
+
+// Config holds the settings of a send, as documented on its fields
+type Config = config.Config
+
+// SendResult lists the recipients accepted and rejected by the server, along
+// with the server and sender used, the data sent and the time it took
+type SendResult = email.SendResult
+
+// DeliveryError is returned by Send when the email could not be delivered,
+// its Kind tells whether trying again later may help
+type DeliveryError = email.DeliveryError
+
+// FailureKind categorizes why an email could not be delivered
+type FailureKind = email.FailureKind
+
+// Failure kinds of a DeliveryError
+const (
+	TemporaryFailure = email.TemporaryFailure
+	PermanentFailure = email.PermanentFailure
+	RecipientFailure = email.RecipientFailure
+)
+
+// Errors returned by Send for messages that cannot be sent at all
+var (
+	ErrEmptyMessage = email.ErrEmptyMessage
+	ErrNoRecipients = email.ErrNoRecipients
+	ErrNoSender     = email.ErrNoSender
+
+	ErrTooManyRecipients = email.ErrTooManyRecipients
+	ErrMessageTooLarge   = email.ErrMessageTooLarge
+)
+
+// Send relays the message through the first server accepting it. The
+// configuration is not modified, so it can be reused for further sends.
+func Send(ctx context.Context, cfg *Config, body []byte) (*SendResult, error) {
+	// Validation fills in defaults and recipients, keep them to this send
+	c := *cfg
+	c.SmtpAddrs = append([]string(nil), cfg.SmtpAddrs...)
+	c.Recipients = append([]string(nil), cfg.Recipients...)
+	c.ServerWeights = maps.Clone(cfg.ServerWeights)
+	c.ServerTLS = maps.Clone(cfg.ServerTLS)
+	c.SenderRules = maps.Clone(cfg.SenderRules)
+	c.DomainMap = maps.Clone(cfg.DomainMap)
+	if err := c.Prepare(); err != nil {
+		return nil, err
+	}
+
+	msg, err := email.New(&c, body)
+	if err != nil {
+		return nil, err
+	}
+	return msg.Send(ctx)
+}
@@ -0,0 +1,152 @@
+package relay
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// serveLMTP accepts a single LMTP session on a local port, replying to DATA
+// with one line per recipient, and returns the server address along with
+// the commands received
+func serveLMTP(t *testing.T, dataReplies ...string) (string, <-chan []string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	done := make(chan []string, 1)
+	go func() {
+		var commands []string
+		defer func() { done <- commands }()
+
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(lines ...string) {
+			fmt.Fprint(conn, strings.Join(lines, "\r\n")+"\r\n")
+		}
+
+		reply("220 lmtp.example.com ready")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			cmd := strings.TrimRight(line, "\r\n")
+			commands = append(commands, cmd)
+
+			switch {
+			case strings.HasPrefix(cmd, "LHLO"):
+				reply("250-lmtp.example.com", "250 PIPELINING")
+			case cmd == "DATA":
+				reply("354 go ahead")
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil || line == ".\r\n" {
+						break
+					}
+				}
+				reply(dataReplies...)
+			case cmd == "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+	return "lmtp://" + ln.Addr().String(), done
+}
+
+func TestSend(t *testing.T) {
+	server, commands := serveLMTP(t, "250 2.0.0 delivered", "250 2.0.0 delivered")
+	cfg := &Config{
+		SmtpAddrs: []string{server},
+		FromAddr:  "Sender <sender@domain.tld>",
+	}
+	body := []byte("To: a@domain.tld\r\nCc: b@domain.tld\r\nSubject: test\r\n\r\nBody\r\n")
+
+	result, err := Send(context.Background(), cfg, body)
+	if err != nil {
+		t.Fatalf("Send() failed: %v", err)
+	}
+	if expected := []string{"a@domain.tld", "b@domain.tld"}; !reflect.DeepEqual(result.Accepted, expected) {
+		t.Errorf("Accepted = %v, want %v", result.Accepted, expected)
+	}
+
+	got := <-commands
+	expected := []string{"NOOP", "MAIL FROM:<sender@domain.tld>", "RCPT TO:<a@domain.tld>", "RCPT TO:<b@domain.tld>", "DATA", "QUIT"}
+	if !reflect.DeepEqual(got[1:], expected) {
+		t.Errorf("Commands = %q, want %q", got[1:], expected)
+	}
+
+	// The configuration can be reused as given
+	if cfg.FromAddr != "Sender <sender@domain.tld>" || len(cfg.Recipients) != 0 {
+		t.Errorf("Send() modified the configuration: %+v", cfg)
+	}
+}
+
+func TestSendErrors(t *testing.T) {
+	server, _ := serveLMTP(t, "550 5.1.1 unknown user")
+
+	tests := []struct {
+		name  string
+		cfg   *Config
+		body  string
+		check func(error) bool
+	}{
+		{
+			name:  "No server",
+			cfg:   &Config{FromAddr: "sender@domain.tld"},
+			body:  "To: a@domain.tld\r\n\r\nBody\r\n",
+			check: func(err error) bool { return err != nil },
+		},
+		{
+			name:  "Empty message",
+			cfg:   &Config{SmtpAddrs: []string{server}, FromAddr: "sender@domain.tld"},
+			body:  "\r\n",
+			check: func(err error) bool { return errors.Is(err, ErrEmptyMessage) },
+		},
+		{
+			name:  "No recipients",
+			cfg:   &Config{SmtpAddrs: []string{server}, FromAddr: "sender@domain.tld"},
+			body:  "Subject: Report\r\n\r\nBody\r\n",
+			check: func(err error) bool { return errors.Is(err, ErrNoRecipients) },
+		},
+		{
+			name:  "No sender",
+			cfg:   &Config{SmtpAddrs: []string{server}},
+			body:  "To: a@domain.tld\r\n\r\nBody\r\n",
+			check: func(err error) bool { return errors.Is(err, ErrNoSender) },
+		},
+		{
+			name: "Recipient rejected",
+			cfg:  &Config{SmtpAddrs: []string{server}, FromAddr: "sender@domain.tld"},
+			body: "To: a@domain.tld\r\n\r\nBody\r\n",
+			check: func(err error) bool {
+				var deliveryErr *DeliveryError
+				return errors.As(err, &deliveryErr) && deliveryErr.Kind == RecipientFailure
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Send(context.Background(), tt.cfg, []byte(tt.body))
+			if !tt.check(err) {
+				t.Errorf("Send() error = %v", err)
+			}
+		})
+	}
+}